@@ -0,0 +1,431 @@
+// Package archive writes tar, tar.gz and zip archives of trees as git archive
+// does
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+var (
+	// ErrUnknownFormat is returned for formats other than tar, tar.gz and zip
+	ErrUnknownFormat = errors.New("unknown archive format")
+	// ErrNoSuchRef is returned when the ref to archive does not exist
+	ErrNoSuchRef = errors.New("no such ref")
+	// ErrPathNotFound is returned when a path to archive is not in the tree
+	ErrPathNotFound = errors.New("pathspec did not match any files")
+)
+
+// Format of an archive
+type Format string
+
+const (
+	// Tar is an uncompressed tar
+	Tar Format = "tar"
+	// TarGz is a gzip compressed tar
+	TarGz Format = "tar.gz"
+	// Zip is a zip with deflate compressed files
+	Zip Format = "zip"
+)
+
+// ParseFormat parses a format name as taken by git archive --format
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "tar":
+		return Tar, nil
+	case "tar.gz", "tgz":
+		return TarGz, nil
+	case "zip":
+		return Zip, nil
+	}
+	return "", fmt.Errorf("%v: %s", ErrUnknownFormat, s)
+}
+
+// Ext returns the file extension of the format
+func (f Format) Ext() string {
+	return "." + string(f)
+}
+
+// ContentType returns the mime type of the format
+func (f Format) ContentType() string {
+	switch f {
+	case TarGz:
+		return "application/gzip"
+	case Zip:
+		return "application/zip"
+	}
+	return "application/x-tar"
+}
+
+// Options of the archive to write
+type Options struct {
+	Format Format
+	// Prepended to all paths e.g. project-1.0/
+	Prefix string
+	// Paths of the tree to archive.  All if empty.
+	Paths []string
+	// Compression level from 1 to 9 or NoCompression.  0 is the default.
+	Level int
+}
+
+// NoCompression stores files uncompressed as git archive -0 does
+const NoCompression = -1
+
+// ResolveRef returns the object a full or short ref name points to.  Only refs
+// are resolved so unreachable objects can't be archived.
+func ResolveRef(st storer.ReferenceStorer, name string) (plumbing.Hash, error) {
+	for _, n := range []string{name, "refs/" + name, "refs/heads/" + name, "refs/tags/" + name} {
+		if ref, err := storer.ResolveReference(st, plumbing.ReferenceName(n)); err == nil {
+			return ref.Hash(), nil
+		}
+	}
+	return plumbing.ZeroHash, fmt.Errorf("%v: %s", ErrNoSuchRef, name)
+}
+
+// Write writes the archive of the tree of h, a commit, tag or tree.  Files
+// have the commit time and its id is recorded in the archive comment.
+func Write(w io.Writer, st storer.EncodedObjectStorer, h plumbing.Hash, opts Options) error {
+	a := &archiver{st: st, opts: opts, mtime: time.Now()}
+
+	tree, err := a.peel(h)
+	if err != nil {
+		return err
+	}
+
+	var comment string
+	if a.commit != nil {
+		a.mtime = a.commit.Committer.When
+		comment = a.commit.Hash.String()
+	}
+
+	switch opts.Format {
+	case Tar, "":
+		a.w, err = newTarWriter(w, comment)
+	case TarGz:
+		level := opts.Level
+		switch level {
+		case 0:
+			level = gzip.DefaultCompression
+		case NoCompression:
+			level = gzip.NoCompression
+		}
+		var gz *gzip.Writer
+		if gz, err = gzip.NewWriterLevel(w, level); err == nil {
+			gz.ModTime = a.mtime
+			a.w, err = newTarWriter(gz, comment)
+			a.w.(*tarWriter).gz = gz
+		}
+	case Zip:
+		a.w, err = newZipWriter(w, comment, opts.Level)
+	default:
+		err = fmt.Errorf("%v: %s", ErrUnknownFormat, opts.Format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.Prefix != "" && strings.HasSuffix(opts.Prefix, "/") {
+		if err = a.w.writeDir(opts.Prefix, a.mtime); err != nil {
+			return err
+		}
+	}
+	a.matched = make([]bool, len(opts.Paths))
+	if err = a.walk(tree, ""); err != nil {
+		return err
+	}
+	for i, m := range a.matched {
+		if !m {
+			return fmt.Errorf("%v: %s", ErrPathNotFound, opts.Paths[i])
+		}
+	}
+	return a.w.close()
+}
+
+// entryWriter writes the entries of an archive format
+type entryWriter interface {
+	writeDir(name string, mtime time.Time) error
+	// The content of symlinks is their target
+	writeFile(name string, mode filemode.FileMode, mtime time.Time, size int64, r io.Reader) error
+	close() error
+}
+
+type archiver struct {
+	st     storer.EncodedObjectStorer
+	opts   Options
+	commit *object.Commit
+	mtime  time.Time
+	w      entryWriter
+	// .gitattributes rules of the dirs being walked, outermost first
+	rules []*attrRule
+	// whether each of the paths matched
+	matched []bool
+}
+
+// peel returns the tree of h setting the commit if there is one
+func (a *archiver) peel(h plumbing.Hash) (*object.Tree, error) {
+	for {
+		obj, err := a.st.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+
+		switch obj.Type() {
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(a.st, obj)
+			if err != nil {
+				return nil, err
+			}
+			h = t.Target
+		case plumbing.CommitObject:
+			if a.commit, err = object.DecodeCommit(a.st, obj); err != nil {
+				return nil, err
+			}
+			h = a.commit.TreeHash
+		case plumbing.TreeObject:
+			return object.DecodeTree(a.st, obj)
+		default:
+			return nil, fmt.Errorf("not a tree: %s", h)
+		}
+	}
+}
+
+// included returns whether the path is to be archived and if it is only the
+// parent dir of a path to archive
+func (a *archiver) included(p string, isDir bool) (ok bool, parent bool) {
+	if len(a.opts.Paths) == 0 {
+		return true, false
+	}
+	for i, want := range a.opts.Paths {
+		want = strings.Trim(want, "/")
+		switch {
+		case want == "" || p == want || strings.HasPrefix(p, want+"/"):
+			a.matched[i] = true
+			ok = true
+		case isDir && strings.HasPrefix(want, p+"/"):
+			parent = true
+		}
+	}
+	if ok {
+		return true, false
+	}
+	return parent, parent
+}
+
+func (a *archiver) walk(tree *object.Tree, dir string) error {
+	nrules := len(a.rules)
+	defer func() { a.rules = a.rules[:nrules] }()
+	if err := a.loadAttributes(tree, dir); err != nil {
+		return err
+	}
+
+	for _, e := range tree.Entries {
+		p := path.Join(dir, e.Name)
+		isDir := e.Mode == filemode.Dir || e.Mode == filemode.Submodule
+		attrs := a.attributes(p, isDir)
+		if attrs["export-ignore"] == attrSet {
+			continue
+		}
+		ok, parent := a.included(p, isDir)
+		if !ok {
+			continue
+		}
+
+		name := a.opts.Prefix + p
+		switch e.Mode {
+		case filemode.Dir:
+			sub, err := object.GetTree(a.st, e.Hash)
+			if err != nil {
+				return err
+			}
+			if err = a.w.writeDir(name+"/", a.mtime); err != nil {
+				return err
+			}
+			if err = a.walk(sub, p); err != nil {
+				return err
+			}
+
+		case filemode.Submodule:
+			// The commits of submodules are not in the repo
+			if err := a.w.writeDir(name+"/", a.mtime); err != nil {
+				return err
+			}
+
+		default:
+			if parent {
+				continue
+			}
+			if err := a.writeBlob(name, e, attrs["export-subst"] == attrSet); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (a *archiver) writeBlob(name string, e object.TreeEntry, subst bool) error {
+	blob, err := object.GetBlob(a.st, e.Hash)
+	if err != nil {
+		return err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if !subst || a.commit == nil || e.Mode == filemode.Symlink {
+		return a.w.writeFile(name, e.Mode, a.mtime, blob.Size, r)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b = substitute(b, a.commit)
+	return a.w.writeFile(name, e.Mode, a.mtime, int64(len(b)), bytes.NewReader(b))
+}
+
+// File modes as written by git archive with the default umask of 002
+const (
+	modeDir        = 0775
+	modeFile       = 0664
+	modeExecutable = 0775
+	modeSymlink    = 0777
+)
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+// newTarWriter starts the tar with a pax global header holding the comment as
+// git does
+func newTarWriter(w io.Writer, comment string) (*tarWriter, error) {
+	t := &tarWriter{tw: tar.NewWriter(w)}
+	if comment == "" {
+		return t, nil
+	}
+	err := t.tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		Name:       "pax_global_header",
+		PAXRecords: map[string]string{"comment": comment},
+		Format:     tar.FormatPAX,
+	})
+	return t, err
+}
+
+func (t *tarWriter) header(name string, mode int64, mtime time.Time) *tar.Header {
+	return &tar.Header{Name: name, Mode: mode, ModTime: mtime, Uname: "root", Gname: "root"}
+}
+
+func (t *tarWriter) writeDir(name string, mtime time.Time) error {
+	hdr := t.header(name, modeDir, mtime)
+	hdr.Typeflag = tar.TypeDir
+	return t.tw.WriteHeader(hdr)
+}
+
+func (t *tarWriter) writeFile(name string, mode filemode.FileMode, mtime time.Time, size int64, r io.Reader) error {
+	var hdr *tar.Header
+	switch mode {
+	case filemode.Symlink:
+		target, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		hdr = t.header(name, modeSymlink, mtime)
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = string(target)
+		return t.tw.WriteHeader(hdr)
+
+	case filemode.Executable:
+		hdr = t.header(name, modeExecutable, mtime)
+	default:
+		hdr = t.header(name, modeFile, mtime)
+	}
+
+	hdr.Typeflag = tar.TypeReg
+	hdr.Size = size
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.Copy(t.tw, r)
+	return err
+}
+
+func (t *tarWriter) close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+	// Store uncompressed at level 0
+	store bool
+}
+
+// newZipWriter writes a zip with the comment at the given deflate level
+func newZipWriter(w io.Writer, comment string, level int) (*zipWriter, error) {
+	z := &zipWriter{zw: zip.NewWriter(w), store: level == NoCompression}
+	if level > 0 {
+		z.zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return z, z.zw.SetComment(comment)
+}
+
+func (z *zipWriter) writeDir(name string, mtime time.Time) error {
+	hdr := &zip.FileHeader{Name: name, Modified: mtime, Method: zip.Store}
+	hdr.SetMode(os.ModeDir | modeDir)
+	_, err := z.zw.CreateHeader(hdr)
+	return err
+}
+
+func (z *zipWriter) writeFile(name string, mode filemode.FileMode, mtime time.Time, size int64, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Modified: mtime, Method: zip.Deflate}
+	switch mode {
+	case filemode.Symlink:
+		hdr.SetMode(os.ModeSymlink | modeSymlink)
+		hdr.Method = zip.Store
+	case filemode.Executable:
+		hdr.SetMode(modeExecutable)
+	default:
+		hdr.SetMode(modeFile)
+	}
+	if z.store {
+		hdr.Method = zip.Store
+	}
+	hdr.UncompressedSize64 = uint64(size)
+
+	fw, err := z.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, r)
+	return err
+}
+
+func (z *zipWriter) close() error {
+	return z.zw.Close()
+}
@@ -0,0 +1,116 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testBlob(t *testing.T, st *memory.Storage, content string) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, _ := obj.Writer()
+	w.Write([]byte(content))
+	w.Close()
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testTree(t *testing.T, st *memory.Storage, entries ...object.TreeEntry) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestWriteTar(t *testing.T) {
+	st := memory.NewStorage()
+	sub := testTree(t, st,
+		object.TreeEntry{Name: ".gitattributes", Mode: filemode.Regular, Hash: testBlob(t, st, "keep.log -export-ignore\n")},
+		object.TreeEntry{Name: "a.log", Mode: filemode.Regular, Hash: testBlob(t, st, "a")},
+		object.TreeEntry{Name: "keep.log", Mode: filemode.Regular, Hash: testBlob(t, st, "k")},
+	)
+	tree := testTree(t, st,
+		object.TreeEntry{Name: ".gitattributes", Mode: filemode.Regular, Hash: testBlob(t, st, "*.log export-ignore\nVERSION export-subst\n")},
+		object.TreeEntry{Name: "VERSION", Mode: filemode.Regular, Hash: testBlob(t, st, "$Format:%h %s$\n")},
+		object.TreeEntry{Name: "link", Mode: filemode.Symlink, Hash: testBlob(t, st, "run.sh")},
+		object.TreeEntry{Name: "logs", Mode: filemode.Dir, Hash: sub},
+		object.TreeEntry{Name: "run.sh", Mode: filemode.Executable, Hash: testBlob(t, st, "#!/bin/sh\n")},
+	)
+
+	when := time.Unix(1500000000, 0)
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: when}
+	obj := st.NewEncodedObject()
+	c := &object.Commit{Author: sig, Committer: sig, Message: "release\none\n\nbody", TreeHash: tree}
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ := st.SetEncodedObject(obj)
+
+	var buf bytes.Buffer
+	if err := Write(&buf, st, ch, Options{Format: Tar, Prefix: "p/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]*tar.Header{}
+	content := map[string]string{}
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			if hdr.PAXRecords["comment"] != ch.String() {
+				t.Fatal("comment", hdr.PAXRecords)
+			}
+			continue
+		}
+		b, _ := ioutil.ReadAll(tr)
+		got[hdr.Name], content[hdr.Name] = hdr, string(b)
+	}
+
+	for _, name := range []string{"p/", "p/.gitattributes", "p/VERSION", "p/link", "p/logs/", "p/logs/.gitattributes", "p/logs/keep.log", "p/run.sh"} {
+		if got[name] == nil {
+			t.Fatal("missing", name)
+		}
+		if !got[name].ModTime.Equal(when) {
+			t.Fatal(name, got[name].ModTime)
+		}
+	}
+	if len(got) != 8 {
+		t.Fatal("archived ignored files", len(got))
+	}
+
+	if content["p/VERSION"] != ch.String()[:7]+" release one\n" {
+		t.Fatalf("%q", content["p/VERSION"])
+	}
+	if got["p/run.sh"].Mode != modeExecutable || got["p/VERSION"].Mode != modeFile {
+		t.Fatal("modes", got["p/run.sh"].Mode, got["p/VERSION"].Mode)
+	}
+	if got["p/link"].Typeflag != tar.TypeSymlink || got["p/link"].Linkname != "run.sh" {
+		t.Fatal("symlink", got["p/link"])
+	}
+
+	if err := Write(ioutil.Discard, st, ch, Options{Paths: []string{"missing"}}); err == nil {
+		t.Fatal("should fail")
+	}
+}
@@ -0,0 +1,175 @@
+package archive
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+const attributesFile = ".gitattributes"
+
+// attrState is the state of an attribute of a path
+type attrState int
+
+const (
+	attrUnspecified attrState = iota
+	attrSet
+	attrUnset
+)
+
+// attrRule is a line of a .gitattributes file
+type attrRule struct {
+	// dir of the .gitattributes file
+	dir string
+	re  *regexp.Regexp
+	// Patterns without a slash match the base name at any depth
+	base bool
+	// Patterns ending in a slash only match dirs
+	dirOnly bool
+	attrs   map[string]attrState
+}
+
+func (rule *attrRule) match(p string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.dir != "" {
+		if !strings.HasPrefix(p, rule.dir+"/") {
+			return false
+		}
+		p = p[len(rule.dir)+1:]
+	}
+	if rule.base {
+		p = path.Base(p)
+	}
+	return rule.re.MatchString(p)
+}
+
+// loadAttributes adds the rules of the .gitattributes of the tree
+func (a *archiver) loadAttributes(tree *object.Tree, dir string) error {
+	var entry *object.TreeEntry
+	for i, e := range tree.Entries {
+		if e.Name == attributesFile && e.Mode != filemode.Dir && e.Mode != filemode.Symlink {
+			entry = &tree.Entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		return nil
+	}
+
+	blob, err := object.GetBlob(a.st, entry.Hash)
+	if err != nil {
+		return err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	a.rules = append(a.rules, parseAttributes(r, dir)...)
+	return nil
+}
+
+// attributes returns the state of the attributes of the path.  Later rules and
+// those of deeper dirs take precedence.
+func (a *archiver) attributes(p string, isDir bool) map[string]attrState {
+	attrs := map[string]attrState{}
+	for _, rule := range a.rules {
+		if !rule.match(p, isDir) {
+			continue
+		}
+		for k, v := range rule.attrs {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
+
+// parseAttributes parses the lines of a .gitattributes file in dir.  Lines
+// with invalid patterns are skipped.
+func parseAttributes(r io.Reader, dir string) []*attrRule {
+	var rules []*attrRule
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "[attr]") {
+			continue
+		}
+
+		rule := &attrRule{dir: dir, attrs: map[string]attrState{}}
+		pattern := fields[0]
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		rule.base = !strings.Contains(pattern, "/")
+		re, err := regexp.Compile(globRegexp(strings.TrimPrefix(pattern, "/")))
+		if err != nil {
+			continue
+		}
+		rule.re = re
+
+		for _, attr := range fields[1:] {
+			switch {
+			case strings.HasPrefix(attr, "-"):
+				rule.attrs[attr[1:]] = attrUnset
+			case strings.HasPrefix(attr, "!"):
+				rule.attrs[attr[1:]] = attrUnspecified
+			default:
+				// Values are irrelevant to archives
+				rule.attrs[strings.SplitN(attr, "=", 2)[0]] = attrSet
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+// globRegexp converts a gitattributes pattern to a regexp.  * and ? do not
+// match slashes while ** matches any number of dirs.
+func globRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case pattern[i:] == "/**":
+			b.WriteString("/.*")
+			i += 2
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			j := strings.IndexByte(pattern[i+1:], ']')
+			if j < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+j]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += j + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
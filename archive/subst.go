@@ -0,0 +1,148 @@
+package archive
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// Date layouts of the pretty format placeholders
+const (
+	dateDefault = "Mon Jan 2 15:04:05 2006 -0700"
+	dateRFC2822 = "Mon, 2 Jan 2006 15:04:05 -0700"
+	dateISO     = "2006-01-02 15:04:05 -0700"
+	dateShort   = "2006-01-02"
+)
+
+// substitute expands the $Format:<format>$ placeholders of export-subst files
+func substitute(b []byte, c *object.Commit) []byte {
+	const start, end = "$Format:", "$"
+
+	var out bytes.Buffer
+	for {
+		i := bytes.Index(b, []byte(start))
+		if i < 0 {
+			break
+		}
+		j := bytes.Index(b[i+len(start):], []byte(end))
+		if j < 0 {
+			break
+		}
+		format := string(b[i+len(start) : i+len(start)+j])
+		if strings.Contains(format, "\n") {
+			// Not a placeholder so keep looking after it
+			out.Write(b[:i+len(start)])
+			b = b[i+len(start):]
+			continue
+		}
+
+		out.Write(b[:i])
+		out.WriteString(formatCommit(format, c))
+		b = b[i+len(start)+j+len(end):]
+	}
+	out.Write(b)
+	return out.Bytes()
+}
+
+// formatCommit expands the git pretty format placeholders of the format.
+// Unknown placeholders are kept as is.
+func formatCommit(format string, c *object.Commit) string {
+	subject, body := splitMessage(c.Message)
+
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+
+		// Two letter placeholders of the author and committer
+		if i+2 < len(format) && (format[i+1] == 'a' || format[i+1] == 'c') {
+			sig := c.Author
+			if format[i+1] == 'c' {
+				sig = c.Committer
+			}
+			if s, ok := formatSignature(format[i+2], sig); ok {
+				b.WriteString(s)
+				i += 2
+				continue
+			}
+		}
+
+		switch format[i+1] {
+		case 'H':
+			b.WriteString(c.Hash.String())
+		case 'h':
+			b.WriteString(c.Hash.String()[:7])
+		case 'T':
+			b.WriteString(c.TreeHash.String())
+		case 't':
+			b.WriteString(c.TreeHash.String()[:7])
+		case 'P', 'p':
+			for k, p := range c.ParentHashes {
+				if k > 0 {
+					b.WriteByte(' ')
+				}
+				if format[i+1] == 'p' {
+					b.WriteString(p.String()[:7])
+				} else {
+					b.WriteString(p.String())
+				}
+			}
+		case 's':
+			b.WriteString(subject)
+		case 'b':
+			b.WriteString(body)
+		case 'B':
+			b.WriteString(c.Message)
+		case 'n':
+			b.WriteByte('\n')
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteString(format[i : i+2])
+		}
+		i++
+	}
+	return b.String()
+}
+
+func formatSignature(c byte, sig object.Signature) (string, bool) {
+	switch c {
+	case 'n', 'N':
+		return sig.Name, true
+	case 'e', 'E':
+		return sig.Email, true
+	case 'd':
+		return sig.When.Format(dateDefault), true
+	case 'D':
+		return sig.When.Format(dateRFC2822), true
+	case 'i':
+		return sig.When.Format(dateISO), true
+	case 'I':
+		return sig.When.Format(time.RFC3339), true
+	case 's':
+		return sig.When.Format(dateShort), true
+	case 't':
+		return strconv.FormatInt(sig.When.Unix(), 10), true
+	}
+	return "", false
+}
+
+// splitMessage returns the subject, the first paragraph on one line, and the
+// body of a commit message
+func splitMessage(msg string) (subject, body string) {
+	parts := strings.SplitN(strings.TrimLeft(msg, "\n"), "\n\n", 2)
+	lines := strings.Split(strings.TrimSpace(parts[0]), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	subject = strings.Join(lines, " ")
+	if len(parts) == 2 {
+		body = strings.TrimLeft(parts[1], "\n")
+	}
+	return subject, body
+}
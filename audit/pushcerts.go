@@ -0,0 +1,88 @@
+// Package audit keeps records of pushes for later review
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/euforia/go-git-server/packproto"
+)
+
+// PushCertEntry is a verified push certificate as recorded
+type PushCertEntry struct {
+	Time time.Time `json:"time"`
+	packproto.PushCert
+	// Certificate as sent by the pusher including the signature
+	Certificate string `json:"certificate"`
+}
+
+// PushCertLog appends verified push certificates to a log file per repo
+type PushCertLog struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewPushCertLog instantiates a log keeping its files under dir
+func NewPushCertLog(dir string) *PushCertLog {
+	return &PushCertLog{dir: dir}
+}
+
+func (l *PushCertLog) path(repo string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(repo)+".jsonl")
+}
+
+// StorePushCert appends the certificate to the log of the repo
+func (l *PushCertLog) StorePushCert(repo string, cert *packproto.PushCert) error {
+	b, err := json.Marshal(&PushCertEntry{Time: time.Now(), PushCert: *cert, Certificate: string(cert.Raw())})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	p := l.path(repo)
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// PushCerts returns the certificates of pushes to the repo, oldest first
+func (l *PushCertLog) PushCerts(repo string) ([]*PushCertEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := []*PushCertEntry{}
+
+	f, err := os.Open(l.path(repo))
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16<<20)
+	for sc.Scan() {
+		var e PushCertEntry
+		if err = json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, sc.Err()
+}
@@ -0,0 +1,207 @@
+// Package auth authenticates users and limits what their credentials allow
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DefaultRealm is the realm of challenges unless one is given
+const DefaultRealm = "go-git-server"
+
+var (
+	// ErrInvalidCredentials is returned when credentials are given but wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnauthenticated is returned when no credentials are given
+	ErrUnauthenticated = errors.New("authentication required")
+	// ErrInvalidScope is returned for unknown or missing token scopes
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// Authentication methods of principals
+const (
+	MethodBasic         = "basic"
+	MethodToken         = "token"
+	MethodPersonalToken = "personal-token"
+	MethodDeployToken   = "deploy-token"
+	MethodSSHKey        = "ssh-key"
+	MethodDeployKey     = "deploy-key"
+	MethodJWT           = "jwt"
+	MethodClientCert    = "client-cert"
+)
+
+// Scope limits what a credential allows.  Each scope includes the ones below.
+type Scope string
+
+const (
+	// ScopeRepoRead allows reading repos
+	ScopeRepoRead Scope = "repo:read"
+	// ScopeRepoWrite allows pushing to and creating repos
+	ScopeRepoWrite Scope = "repo:write"
+	// ScopeAdmin allows everything the user may do
+	ScopeAdmin Scope = "admin"
+)
+
+func (s Scope) level() int {
+	switch s {
+	case ScopeRepoRead:
+		return 1
+	case ScopeRepoWrite:
+		return 2
+	case ScopeAdmin:
+		return 3
+	}
+	return 0
+}
+
+// ValidateScopes checks there are scopes and they are known
+func ValidateScopes(scopes []Scope) error {
+	if len(scopes) == 0 {
+		return ErrInvalidScope
+	}
+	for _, s := range scopes {
+		if s.level() == 0 {
+			return fmt.Errorf("%v: %q", ErrInvalidScope, s)
+		}
+	}
+	return nil
+}
+
+// Principal is an authenticated user
+type Principal struct {
+	Name string `json:"name"`
+	// How the user authenticated
+	Method string `json:"method"`
+	// Scopes of the credential.  Nil if it is not limited.
+	Scopes []Scope `json:"scopes,omitempty"`
+	// Set if the credential is limited to the repo
+	Repo string `json:"repo,omitempty"`
+	// Groups the user is a member of per the credential
+	Groups []string `json:"groups,omitempty"`
+}
+
+// HasScope returns true if the credential is not limited or has a scope
+// including s
+func (p *Principal) HasScope(s Scope) bool {
+	if p.Scopes == nil {
+		return true
+	}
+	for _, sc := range p.Scopes {
+		if sc.level() >= s.level() {
+			return true
+		}
+	}
+	return false
+}
+
+// Admins are the users administering the server
+type Admins map[string]bool
+
+// NewAdmins instantiates the set of admins
+func NewAdmins(names ...string) Admins {
+	a := Admins{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			a[name] = true
+		}
+	}
+	return a
+}
+
+// IsAdmin returns true if the principal is an admin whose credential is
+// neither limited to a repo nor missing the admin scope
+func (a Admins) IsAdmin(p *Principal) bool {
+	return p != nil && a[p.Name] && p.Repo == "" && p.HasScope(ScopeAdmin)
+}
+
+func (p *Principal) String() string {
+	return fmt.Sprintf("%s (%s)", p.Name, p.Method)
+}
+
+// Authenticator authenticates requests
+type Authenticator interface {
+	// Authenticate returns the principal of the request.  It is nil if the
+	// request has no credentials the authenticator handles and
+	// ErrInvalidCredentials if they are wrong.
+	Authenticate(r *http.Request) (*Principal, error)
+	// Challenge is the WWW-Authenticate header asking for credentials
+	Challenge() string
+}
+
+// Chain tries each authenticator in turn
+type Chain []Authenticator
+
+// Authenticate returns the principal of the first authenticator accepting the
+// request.  The first error is returned if none did.
+func (c Chain) Authenticate(r *http.Request) (*Principal, error) {
+	var firstErr error
+	for _, a := range c {
+		p, err := a.Authenticate(r)
+		if p != nil {
+			return p, nil
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return nil, firstErr
+}
+
+// Challenge returns the distinct challenges of the authenticators
+func (c Chain) Challenge() string {
+	var challenges []string
+	seen := map[string]bool{}
+	for _, a := range c {
+		ch := a.Challenge()
+		if ch != "" && !seen[ch] {
+			seen[ch] = true
+			challenges = append(challenges, ch)
+		}
+	}
+	return strings.Join(challenges, ", ")
+}
+
+type ctxKey struct{}
+
+// NewContext returns a context holding the principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+// FromContext returns the principal of the context if there is one
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(ctxKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// BearerToken returns the token of a bearer authorization header
+func BearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:]), true
+	}
+	return "", false
+}
+
+// basicChallenge is the challenge git answers with a username and password
+func basicChallenge(realm string) string {
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return fmt.Sprintf("Basic realm=%q", realm)
+}
+
+func bearerChallenge(realm string) string {
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return fmt.Sprintf("Bearer realm=%q", realm)
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
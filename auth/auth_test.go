@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestChain(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "auth")
+	defer os.RemoveAll(dir)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+	path := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(path, []byte("# users\nalice:"+string(hash)+"\n"), 0600)
+	htpasswd, err := NewHtpasswd(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pats := NewTokens("")
+	_, pat, _ := pats.Create("alice", "laptop", []Scope{ScopeRepoWrite}, nil)
+	past := time.Now().Add(-time.Second)
+	if _, _, err = pats.Create("alice", "old", []Scope{ScopeAdmin}, &past); err != ErrExpired {
+		t.Fatal(err)
+	}
+	if _, _, err = pats.Create("alice", "none", nil, nil); err != ErrInvalidScope {
+		t.Fatal(err)
+	}
+	_, deploy, _ := pats.CreateDeploy("ns/repo", "ci", false, nil)
+
+	chain := Chain{htpasswd, NewStaticTokens(map[string]string{"static": "ci"}, ""), pats}
+
+	tests := []struct {
+		user, pass, bearer string
+		name, method       string
+		err                error
+	}{
+		{user: "alice", pass: "pass", name: "alice", method: MethodBasic},
+		{user: "alice", pass: "wrong", err: ErrInvalidCredentials},
+		// Tokens are accepted as the password git sends
+		{user: "alice", pass: pat, name: "alice", method: MethodPersonalToken},
+		{bearer: pat, name: "alice", method: MethodPersonalToken},
+		{bearer: "static", name: "ci", method: MethodToken},
+		{bearer: deploy, name: "deploy:", method: MethodDeployToken},
+		{bearer: PersonalTokenPrefix + "unknown", err: ErrInvalidCredentials},
+		{bearer: "unknown"},
+		{},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/ns/repo", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		} else if tt.bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.bearer)
+		}
+
+		p, err := chain.Authenticate(r)
+		if err != tt.err {
+			t.Fatal(i, err)
+		}
+		if tt.name == "" {
+			if p != nil {
+				t.Fatal(i, p)
+			}
+			continue
+		}
+		if p == nil || !strings.HasPrefix(p.Name, tt.name) || p.Method != tt.method {
+			t.Fatal(i, p)
+		}
+		switch p.Method {
+		case MethodPersonalToken:
+			if !p.HasScope(ScopeRepoRead) || p.HasScope(ScopeAdmin) {
+				t.Fatal(i, p.Scopes)
+			}
+		case MethodDeployToken:
+			if p.Repo != "ns/repo" || p.HasScope(ScopeRepoWrite) {
+				t.Fatal(i, p)
+			}
+		default:
+			if !p.HasScope(ScopeAdmin) {
+				t.Fatal(i, "unscoped credential limited")
+			}
+		}
+	}
+
+	if c := chain.Challenge(); c != `Basic realm="go-git-server", Bearer realm="go-git-server"` {
+		t.Fatal(c)
+	}
+
+	list := pats.List("alice")
+	if len(list) != 1 || list[0].LastUsed == nil {
+		t.Fatalf("%+v", list)
+	}
+	if err = pats.Revoke("alice", list[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+pat)
+	if _, err = pats.Authenticate(r); err != ErrInvalidCredentials {
+		t.Fatal("revoked token accepted", err)
+	}
+}
+
+func TestAdmins(t *testing.T) {
+	admins := NewAdmins("alice", " bob", "")
+	tests := []struct {
+		p     *Principal
+		admin bool
+	}{
+		{&Principal{Name: "alice"}, true},
+		{&Principal{Name: "bob", Scopes: []Scope{ScopeAdmin}}, true},
+		{&Principal{Name: "eve"}, false},
+		{&Principal{Name: "alice", Scopes: []Scope{ScopeRepoWrite}}, false},
+		{&Principal{Name: "alice", Scopes: []Scope{ScopeAdmin}, Repo: "alice/r"}, false},
+		{nil, false},
+	}
+	for i, tt := range tests {
+		if admins.IsAdmin(tt.p) != tt.admin {
+			t.Fatal(i, tt.p)
+		}
+	}
+}
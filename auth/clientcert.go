@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ClientCerts authenticates the subjects of verified tls client certificates.
+// Subjects are mapped to users or the common name is the user.
+type ClientCerts struct {
+	// subject to user
+	users map[string]string
+}
+
+// NewClientCerts instantiates the authenticator mapping subjects in the form
+// "CN=alice,O=Acme" to users.  Common names are users if users is nil.
+func NewClientCerts(users map[string]string) *ClientCerts {
+	return &ClientCerts{users: users}
+}
+
+// LoadClientCerts reads a file of "<user> <subject>" lines
+func LoadClientCerts(path string) (*ClientCerts, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: expected <user> <subject>", path, n)
+		}
+		users[strings.TrimSpace(fields[1])] = fields[0]
+	}
+	return NewClientCerts(users), scanner.Err()
+}
+
+// Authenticate returns the user of the verified client certificate.  Requests
+// without one or with an unmapped subject are left to other authenticators.
+func (cc *ClientCerts) Authenticate(r *http.Request) (*Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject
+
+	user := subject.CommonName
+	if cc.users != nil {
+		user = cc.users[subject.String()]
+	}
+	if user == "" {
+		return nil, nil
+	}
+	return &Principal{Name: user, Method: MethodClientCert}, nil
+}
+
+// Challenge is empty as certificates are asked for during the handshake
+func (cc *ClientCerts) Challenge() string {
+	return ""
+}
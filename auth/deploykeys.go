@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrKeyInUse is returned when adding a deploy key already added to a repo
+	ErrKeyInUse = errors.New("key already in use")
+	// ErrKeyNotFound is returned for unknown deploy key ids
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+// DeployKey is an ssh key limited to reading or also writing a repo
+type DeployKey struct {
+	ID    string `json:"id"`
+	Repo  string `json:"repo"`
+	Title string `json:"title"`
+	// authorized_keys format
+	Key         string    `json:"key"`
+	Fingerprint string    `json:"fingerprint"`
+	Write       bool      `json:"write"`
+	Created     time.Time `json:"created"`
+}
+
+// principal returns the principal the key authenticates
+func (k *DeployKey) principal() *Principal {
+	scope := ScopeRepoRead
+	if k.Write {
+		scope = ScopeRepoWrite
+	}
+	return &Principal{Name: "deploy:" + k.ID, Method: MethodDeployKey, Scopes: []Scope{scope}, Repo: k.Repo}
+}
+
+// DeployKeys stores the deploy keys of repos in memory.  A key can only be
+// added to one repo so it identifies the repo.
+type DeployKeys struct {
+	mu sync.RWMutex
+	// sha256 fingerprint to key
+	keys map[string]*DeployKey
+}
+
+// NewDeployKeys instantiates an empty deploy key store
+func NewDeployKeys() *DeployKeys {
+	return &DeployKeys{keys: map[string]*DeployKey{}}
+}
+
+// Add adds the ssh public key in authorized_keys format to the repo
+func (dk *DeployKeys) Add(repo, title, text string, write bool) (*DeployKey, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(text))
+	if err != nil {
+		return nil, err
+	}
+	if title == "" {
+		title = comment
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &DeployKey{
+		ID:          id,
+		Repo:        repo,
+		Title:       title,
+		Key:         strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Write:       write,
+		Created:     time.Now(),
+	}
+
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+
+	if _, ok := dk.keys[k.Fingerprint]; ok {
+		return nil, ErrKeyInUse
+	}
+	dk.keys[k.Fingerprint] = k
+
+	c := *k
+	return &c, nil
+}
+
+// List returns the deploy keys of the repo oldest first
+func (dk *DeployKeys) List(repo string) []*DeployKey {
+	dk.mu.RLock()
+	defer dk.mu.RUnlock()
+
+	list := make([]*DeployKey, 0)
+	for _, k := range dk.keys {
+		if k.Repo == repo {
+			c := *k
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Remove removes the deploy key with the id from the repo
+func (dk *DeployKeys) Remove(repo, id string) error {
+	dk.mu.Lock()
+	defer dk.mu.Unlock()
+
+	for fp, k := range dk.keys {
+		if k.Repo == repo && k.ID == id {
+			delete(dk.keys, fp)
+			return nil
+		}
+	}
+	return ErrKeyNotFound
+}
+
+// Principal returns the principal of a deploy key
+func (dk *DeployKeys) Principal(pub ssh.PublicKey) (*Principal, bool) {
+	dk.mu.RLock()
+	defer dk.mu.RUnlock()
+
+	k, ok := dk.keys[ssh.FingerprintSHA256(pub)]
+	if !ok {
+		return nil, false
+	}
+	return k.principal(), true
+}
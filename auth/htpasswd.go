@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd authenticates http basic credentials against an htpasswd file of
+// bcrypt hashes as written by htpasswd -B.  The file is reloaded when it
+// changes.
+type Htpasswd struct {
+	path  string
+	realm string
+
+	mu     sync.RWMutex
+	hashes map[string][]byte
+	mtime  time.Time
+}
+
+// NewHtpasswd loads the htpasswd file at path
+func NewHtpasswd(path, realm string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path, realm: realm}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = h.load(fi.ModTime()); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *Htpasswd) load(mtime time.Time) error {
+	f, err := os.Open(h.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hashes := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[1], "$2") {
+			return fmt.Errorf("%s:%d: not a bcrypt entry", h.path, n)
+		}
+		hashes[parts[0]] = []byte(parts[1])
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	h.hashes, h.mtime = hashes, mtime
+	h.mu.Unlock()
+	return nil
+}
+
+// reload loads the file again if it was modified.  The loaded entries are
+// kept if it can't be.
+func (h *Htpasswd) reload() {
+	fi, err := os.Stat(h.path)
+	if err != nil {
+		return
+	}
+
+	h.mu.RLock()
+	changed := !fi.ModTime().Equal(h.mtime)
+	h.mu.RUnlock()
+	if !changed {
+		return
+	}
+	if err = h.load(fi.ModTime()); err != nil {
+		log.Printf("ERR [auth] htpasswd reload: %v", err)
+	}
+}
+
+// Authenticate checks basic credentials of users in the file.  Other users
+// are left to other authenticators.
+func (h *Htpasswd) Authenticate(r *http.Request) (*Principal, error) {
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	h.reload()
+
+	h.mu.RLock()
+	hash, ok := h.hashes[user]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, nil
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(pass)) != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &Principal{Name: user, Method: MethodBasic}, nil
+}
+
+// Challenge asks for basic credentials
+func (h *Htpasswd) Challenge() string {
+	return basicChallenge(h.realm)
+}
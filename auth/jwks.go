@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// jwksTTL is how long keys fetched from a url are used before refetching
+	jwksTTL = 15 * time.Minute
+	// jwksMinRefresh limits refetching for unknown key ids
+	jwksMinRefresh = time.Minute
+	// jwksMaxSize limits the size of a fetched key set
+	jwksMaxSize = 1 << 20
+)
+
+var errNoKey = errors.New("no key to verify the token")
+
+// jwk is a JSON web key of the types tokens can be verified with
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	// Symmetric
+	K string `json:"k"`
+}
+
+// publicKey returns the *rsa.PublicKey, *ecdsa.PublicKey or []byte secret of
+// the key
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 {
+			return nil, fmt.Errorf("invalid rsa exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, fmt.Errorf("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+
+	case "oct":
+		return base64.RawURLEncoding.DecodeString(k.K)
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// verifyKey is a parsed key of a key set
+type verifyKey struct {
+	kid string
+	alg string
+	key interface{}
+}
+
+// parseJWKS parses a key set skipping keys not used for signatures or of
+// unsupported types
+func parseJWKS(r io.Reader) ([]verifyKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make([]verifyKey, 0, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("DBG [jwks] kid=%s %v", k.Kid, err)
+			continue
+		}
+		keys = append(keys, verifyKey{kid: k.Kid, alg: k.Alg, key: key})
+	}
+	return keys, nil
+}
+
+// keySet is a JSON web key set read from a file or url.  Files are reloaded
+// when modified and urls refetched after a while or for unknown key ids.
+type keySet struct {
+	file string
+	url  string
+
+	client *http.Client
+
+	mu       sync.Mutex
+	keys     []verifyKey
+	loaded   time.Time
+	modTime  time.Time
+	fetching bool
+}
+
+func newKeySet(file, url string) *keySet {
+	return &keySet{file: file, url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// lookup returns the keys with the id, all if it is empty.  The set is
+// refreshed first if needed.
+func (ks *keySet) lookup(kid string) []verifyKey {
+	if ks.file == "" && ks.shouldFetch(kid) {
+		ks.fetch()
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.file != "" {
+		ks.reloadFile()
+	}
+
+	var keys []verifyKey
+	for _, k := range ks.keys {
+		if kid == "" || k.kid == kid {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (ks *keySet) reloadFile() {
+	fi, err := os.Stat(ks.file)
+	if err != nil {
+		log.Printf("ERR [jwks] %v", err)
+		return
+	}
+	if fi.ModTime().Equal(ks.modTime) {
+		return
+	}
+	b, err := ioutil.ReadFile(ks.file)
+	if err != nil {
+		log.Printf("ERR [jwks] %v", err)
+		return
+	}
+	keys, err := parseJWKS(bytes.NewReader(b))
+	if err != nil {
+		log.Printf("ERR [jwks] %s: %v", ks.file, err)
+		return
+	}
+	ks.keys, ks.modTime = keys, fi.ModTime()
+}
+
+// shouldFetch returns true if the keys are stale or the key id is unknown and
+// no fetch is in progress, marking one as in progress if so
+func (ks *keySet) shouldFetch(kid string) bool {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	since := time.Since(ks.loaded)
+	stale := since > jwksTTL
+	if ks.fetching || !stale && (kid == "" || ks.hasKid(kid) || since < jwksMinRefresh) {
+		return false
+	}
+	// Failed fetches are also rate limited
+	ks.loaded, ks.fetching = time.Now(), true
+	return true
+}
+
+// fetch fetches the keys without holding the lock.  The loaded keys are kept
+// if fetching fails.
+func (ks *keySet) fetch() {
+	var keys []verifyKey
+	defer func() {
+		ks.mu.Lock()
+		if keys != nil {
+			ks.keys = keys
+		}
+		ks.fetching = false
+		ks.mu.Unlock()
+	}()
+
+	resp, err := ks.client.Get(ks.url)
+	if err != nil {
+		log.Printf("ERR [jwks] %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		log.Printf("ERR [jwks] %s: %s", ks.url, resp.Status)
+		return
+	}
+	if keys, err = parseJWKS(io.LimitReader(resp.Body, jwksMaxSize)); err != nil {
+		log.Printf("ERR [jwks] %s: %v", ks.url, err)
+	}
+}
+
+func (ks *keySet) hasKid(kid string) bool {
+	for _, k := range ks.keys {
+		if k.kid == kid {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew allowed checking token times
+const jwtLeeway = time.Minute
+
+var (
+	errJWTMalformed     = errors.New("malformed token")
+	errJWTUnknownIssuer = errors.New("unknown issuer")
+	errJWTAlgorithm     = errors.New("unsupported algorithm")
+	errJWTSignature     = errors.New("invalid signature")
+	errJWTExpired       = errors.New("token expired")
+	errJWTNotYetValid   = errors.New("token not yet valid")
+	errJWTAudience      = errors.New("invalid audience")
+	errJWTNoUser        = errors.New("no user claim")
+)
+
+// JWTIssuer is an issuer whose tokens are accepted
+type JWTIssuer struct {
+	// iss claim of the tokens
+	Issuer string `json:"issuer"`
+	// Tokens must be for the audience e.g. the url of the server so those
+	// issued for other services aren't accepted
+	Audience string `json:"audience"`
+	// Key set the tokens are verified with, a local file or a url
+	JWKSFile string `json:"jwks_file,omitempty"`
+	JWKSURL  string `json:"jwks_url,omitempty"`
+	// Claims holding the user name, sub by default, and groups, groups by
+	// default
+	UserClaim   string `json:"user_claim,omitempty"`
+	GroupsClaim string `json:"groups_claim,omitempty"`
+	// Prefixed to user and group names so they don't clash with local users
+	// e.g. "ci:"
+	Prefix string `json:"prefix"`
+	// Scopes limiting what the tokens allow, repo:write if not set
+	Scopes []Scope `json:"scopes,omitempty"`
+
+	keys *keySet
+}
+
+// JWT authenticates JSON web tokens signed with HS256, RS256 or ES256 by the
+// configured issuers e.g. OIDC tokens of CI jobs
+type JWT struct {
+	realm   string
+	issuers map[string]*JWTIssuer
+}
+
+// NewJWT instantiates the authenticator accepting tokens of the issuers
+func NewJWT(issuers []*JWTIssuer, realm string) (*JWT, error) {
+	j := &JWT{realm: realm, issuers: map[string]*JWTIssuer{}}
+	for _, iss := range issuers {
+		if iss.Issuer == "" {
+			return nil, fmt.Errorf("issuer required")
+		}
+		if (iss.JWKSFile == "") == (iss.JWKSURL == "") {
+			return nil, fmt.Errorf("%s: one of jwks_file or jwks_url required", iss.Issuer)
+		}
+		if iss.Audience == "" {
+			return nil, fmt.Errorf("%s: audience required", iss.Issuer)
+		}
+		if iss.Prefix == "" {
+			return nil, fmt.Errorf("%s: prefix required", iss.Issuer)
+		}
+		if len(iss.Scopes) == 0 {
+			iss.Scopes = []Scope{ScopeRepoWrite}
+		}
+		if err := ValidateScopes(iss.Scopes); err != nil {
+			return nil, fmt.Errorf("%s: %v", iss.Issuer, err)
+		}
+		if iss.UserClaim == "" {
+			iss.UserClaim = "sub"
+		}
+		if iss.GroupsClaim == "" {
+			iss.GroupsClaim = "groups"
+		}
+		iss.keys = newKeySet(iss.JWKSFile, iss.JWKSURL)
+		j.issuers[iss.Issuer] = iss
+	}
+	return j, nil
+}
+
+// LoadJWT reads the issuers from a JSON file of the form {"issuers": [...]}
+func LoadJWT(path, realm string) (*JWT, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var conf struct {
+		Issuers []*JWTIssuer `json:"issuers"`
+	}
+	if err = json.NewDecoder(f).Decode(&conf); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return NewJWT(conf.Issuers, realm)
+}
+
+// looksLikeJWT returns true for three dot separated parts starting with an
+// encoded JSON object
+func looksLikeJWT(token string) bool {
+	return strings.HasPrefix(token, "eyJ") && strings.Count(token, ".") == 2
+}
+
+// Authenticate checks bearer tokens and basic passwords that are JWTs.  The
+// user and groups are taken from the claims of the issuer.
+func (j *JWT) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := tokenCredential(r)
+	if !ok || !looksLikeJWT(token) {
+		return nil, nil
+	}
+
+	iss, claims, err := j.verify(token, time.Now())
+	if err != nil {
+		log.Printf("DBG [jwt] %v", err)
+		return nil, ErrInvalidCredentials
+	}
+
+	user, _ := claims[iss.UserClaim].(string)
+	if user == "" {
+		log.Printf("DBG [jwt] iss=%s %v: %s", iss.Issuer, errJWTNoUser, iss.UserClaim)
+		return nil, ErrInvalidCredentials
+	}
+	p := &Principal{Name: iss.Prefix + user, Method: MethodJWT, Scopes: iss.Scopes}
+	for _, g := range stringsClaim(claims[iss.GroupsClaim]) {
+		p.Groups = append(p.Groups, iss.Prefix+g)
+	}
+	return p, nil
+}
+
+// Challenge asks for a bearer token
+func (j *JWT) Challenge() string {
+	return bearerChallenge(j.realm)
+}
+
+// verify checks the signature and times of the token returning its issuer and
+// claims
+func (j *JWT) verify(token string, now time.Time) (*JWTIssuer, map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errJWTMalformed
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, nil, err
+	}
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errJWTMalformed
+	}
+
+	issuer, _ := claims["iss"].(string)
+	iss, ok := j.issuers[issuer]
+	if !ok {
+		return nil, nil, fmt.Errorf("%v: %q", errJWTUnknownIssuer, issuer)
+	}
+
+	keys := iss.keys.lookup(header.Kid)
+	if len(keys) == 0 {
+		return nil, nil, fmt.Errorf("iss=%s kid=%s %v", issuer, header.Kid, errNoKey)
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	err = errJWTSignature
+	for _, k := range keys {
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if err = verifySignature(header.Alg, k.key, signed, sig); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("iss=%s kid=%s %v", issuer, header.Kid, err)
+	}
+
+	// Expiry is required so tokens are short lived
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(unixTime(exp).Add(jwtLeeway)) {
+		return nil, nil, fmt.Errorf("iss=%s %v", issuer, errJWTExpired)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(unixTime(nbf)) {
+		return nil, nil, fmt.Errorf("iss=%s %v", issuer, errJWTNotYetValid)
+	}
+	if !containsString(stringsClaim(claims["aud"]), iss.Audience) {
+		return nil, nil, fmt.Errorf("iss=%s %v", issuer, errJWTAudience)
+	}
+	return iss, claims, nil
+}
+
+// verifySignature checks the signature of the algorithm with a key of the
+// matching type
+func verifySignature(alg string, key interface{}, signed, sig []byte) error {
+	sum := sha256.Sum256(signed)
+
+	switch alg {
+	case "HS256":
+		secret, ok := key.([]byte)
+		if !ok || len(secret) == 0 {
+			return errNoKey
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return errJWTSignature
+		}
+		return nil
+
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errNoKey
+		}
+		if rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) != nil {
+			return errJWTSignature
+		}
+		return nil
+
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errNoKey
+		}
+		if len(sig) != 64 {
+			return errJWTSignature
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return errJWTSignature
+		}
+		return nil
+	}
+	return fmt.Errorf("%v: %q", errJWTAlgorithm, alg)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errJWTMalformed
+	}
+	if err = json.Unmarshal(b, v); err != nil {
+		return errJWTMalformed
+	}
+	return nil
+}
+
+func unixTime(f float64) time.Time {
+	return time.Unix(int64(f), 0)
+}
+
+// stringsClaim returns a claim that is a string or a list of strings
+func stringsClaim(v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		list := make([]string, 0, len(c))
+		for _, s := range c {
+			if str, ok := s.(string); ok {
+				list = append(list, str)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
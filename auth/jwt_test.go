@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+	sum := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, sum[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestJWT(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+	}})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwks)
+	}))
+	defer srv.Close()
+
+	dir, _ := ioutil.TempDir("", "jwt")
+	defer os.RemoveAll(dir)
+	octFile := filepath.Join(dir, "jwks.json")
+	oct, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{"kty": "oct", "k": b64(secret)}}})
+	ioutil.WriteFile(octFile, oct, 0600)
+
+	j, err := NewJWT([]*JWTIssuer{
+		{Issuer: "https://ci", Audience: "git", JWKSURL: srv.URL, UserClaim: "job", Prefix: "ci:"},
+		{Issuer: "local", Audience: "git", JWKSFile: octFile, Prefix: "local:", Scopes: []Scope{ScopeRepoRead}},
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	ci := map[string]interface{}{"iss": "https://ci", "aud": []string{"git"}, "job": "build", "groups": []string{"team"}, "exp": exp}
+	local := map[string]interface{}{"iss": "local", "aud": "git", "sub": "alice", "exp": exp}
+
+	tests := []struct {
+		token string
+		name  string
+	}{
+		{signJWT(t, "RS256", "rsa", rsaKey, ci), "ci:build"},
+		{signJWT(t, "ES256", "ec", ecKey, ci), "ci:build"},
+		{signJWT(t, "HS256", "", secret, local), "local:alice"},
+		// Signed with the wrong key
+		{signJWT(t, "ES256", "rsa", ecKey, ci), ""},
+		// Public key used as an hmac secret
+		{signJWT(t, "HS256", "rsa", rsaKey.N.Bytes(), ci), ""},
+		{signJWT(t, "RS256", "rsa", rsaKey, map[string]interface{}{"iss": "https://ci", "aud": "other", "job": "x", "exp": exp}), ""},
+		{signJWT(t, "RS256", "rsa", rsaKey, map[string]interface{}{"iss": "https://ci", "aud": "git", "job": "x", "exp": time.Now().Add(-time.Hour).Unix()}), ""},
+		{signJWT(t, "HS256", "", secret, map[string]interface{}{"iss": "other", "aud": "git", "sub": "alice", "exp": exp}), ""},
+		// No audience
+		{signJWT(t, "HS256", "", secret, map[string]interface{}{"iss": "local", "sub": "alice", "exp": exp}), ""},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		p, err := j.Authenticate(r)
+		if tt.name == "" {
+			if err != ErrInvalidCredentials {
+				t.Fatal(i, p, err)
+			}
+			continue
+		}
+		if err != nil || p.Name != tt.name || p.Method != MethodJWT {
+			t.Fatal(i, p, err)
+		}
+		if i == 0 && (len(p.Groups) != 1 || p.Groups[0] != "ci:team" || p.HasScope(ScopeAdmin) || !p.HasScope(ScopeRepoWrite)) {
+			t.Fatal(p)
+		}
+		if i == 2 && p.HasScope(ScopeRepoWrite) {
+			t.Fatal(p.Scopes)
+		}
+	}
+
+	// Issuers must limit tokens to an audience and prefix their names
+	if _, err = NewJWT([]*JWTIssuer{{Issuer: "x", JWKSFile: octFile, Prefix: "x:"}}, ""); err == nil {
+		t.Fatal("no audience")
+	}
+	if _, err = NewJWT([]*JWTIssuer{{Issuer: "x", Audience: "git", JWKSFile: octFile}}, ""); err == nil {
+		t.Fatal("no prefix")
+	}
+
+	// Tokens are accepted as the password git sends
+	r := httptest.NewRequest("GET", "/", nil)
+	r.SetBasicAuth("x", tests[0].token)
+	if p, err := j.Authenticate(r); err != nil || p == nil {
+		t.Fatal(p, err)
+	}
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes of generated tokens so they can be recognised e.g. by secret
+// scanning
+const (
+	PersonalTokenPrefix = "ggp_"
+	DeployTokenPrefix   = "ggd_"
+)
+
+var (
+	// ErrTokenNotFound is returned for unknown token ids
+	ErrTokenNotFound = errors.New("token not found")
+	// ErrExpired is returned when creating a token that has already expired
+	ErrExpired = errors.New("expiry is in the past")
+)
+
+// tokenCredential returns a bearer token or the password of basic
+// credentials.  git only sends the latter so tokens are used as passwords.
+func tokenCredential(r *http.Request) (string, bool) {
+	if token, ok := BearerToken(r); ok {
+		return token, true
+	}
+	if _, pass, ok := r.BasicAuth(); ok {
+		return pass, true
+	}
+	return "", false
+}
+
+// StaticTokens authenticates fixed tokens each belonging to a user
+type StaticTokens struct {
+	realm string
+	// token to user
+	tokens map[string]string
+}
+
+// NewStaticTokens instantiates the authenticator with a map of tokens to users
+func NewStaticTokens(tokens map[string]string, realm string) *StaticTokens {
+	return &StaticTokens{realm: realm, tokens: tokens}
+}
+
+// LoadStaticTokens reads a file of "<token> <user>" lines
+func LoadStaticTokens(path, realm string) (*StaticTokens, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tokens := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <token> <user>", path, n)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	return NewStaticTokens(tokens, realm), scanner.Err()
+}
+
+// Authenticate checks bearer tokens and basic passwords against the tokens
+func (st *StaticTokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := tokenCredential(r)
+	if !ok {
+		return nil, nil
+	}
+	// Compare all so the time taken doesn't tell which matched
+	var user string
+	for t, u := range st.tokens {
+		if constantTimeEqual(t, token) {
+			user = u
+		}
+	}
+	if user == "" {
+		return nil, nil
+	}
+	return &Principal{Name: user, Method: MethodToken}, nil
+}
+
+// Challenge asks for a bearer token
+func (st *StaticTokens) Challenge() string {
+	return bearerChallenge(st.realm)
+}
+
+// Token is a personal access token a user created to authenticate as
+// themselves or a deploy token limited to a repo.  Only its hash is kept.
+type Token struct {
+	ID string `json:"id"`
+	// Owner of a personal token
+	User string `json:"user,omitempty"`
+	// Repo of a deploy token
+	Repo     string     `json:"repo,omitempty"`
+	Name     string     `json:"name"`
+	Scopes   []Scope    `json:"scopes"`
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	LastUsed *time.Time `json:"last_used,omitempty"`
+
+	hash string
+}
+
+// Expired returns true if the token expired by now
+func (t *Token) Expired(now time.Time) bool {
+	return t.Expires != nil && !now.Before(*t.Expires)
+}
+
+// principal returns the principal the token authenticates
+func (t *Token) principal() *Principal {
+	if t.Repo != "" {
+		return &Principal{Name: "deploy:" + t.ID, Method: MethodDeployToken, Scopes: t.Scopes, Repo: t.Repo}
+	}
+	return &Principal{Name: t.User, Method: MethodPersonalToken, Scopes: t.Scopes}
+}
+
+// Tokens stores and authenticates personal access and deploy tokens in memory
+type Tokens struct {
+	realm string
+
+	mu sync.RWMutex
+	// token hash to token
+	tokens map[string]*Token
+}
+
+// NewTokens instantiates an empty token store
+func NewTokens(realm string) *Tokens {
+	return &Tokens{realm: realm, tokens: map[string]*Token{}}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Create creates a personal token of the user with the scopes returning it and
+// the secret token.  The secret can't be retrieved later.  Tokens without an
+// expiry don't expire.
+func (ts *Tokens) Create(user, name string, scopes []Scope, expires *time.Time) (*Token, string, error) {
+	if err := ValidateScopes(scopes); err != nil {
+		return nil, "", err
+	}
+	return ts.create(&Token{User: user, Name: name, Scopes: scopes, Expires: expires}, PersonalTokenPrefix)
+}
+
+// CreateDeploy creates a token limited to reading or also writing the repo
+func (ts *Tokens) CreateDeploy(repo, name string, write bool, expires *time.Time) (*Token, string, error) {
+	scope := ScopeRepoRead
+	if write {
+		scope = ScopeRepoWrite
+	}
+	return ts.create(&Token{Repo: repo, Name: name, Scopes: []Scope{scope}, Expires: expires}, DeployTokenPrefix)
+}
+
+func (ts *Tokens) create(t *Token, prefix string) (*Token, string, error) {
+	now := time.Now()
+	if t.Expired(now) {
+		return nil, "", ErrExpired
+	}
+
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, "", err
+	}
+	secret, err := randomHex(20)
+	if err != nil {
+		return nil, "", err
+	}
+	secret = prefix + secret
+
+	t.ID, t.Created, t.hash = id, now, hashToken(secret)
+	ts.mu.Lock()
+	ts.tokens[t.hash] = t
+	ts.mu.Unlock()
+
+	c := *t
+	return &c, secret, nil
+}
+
+// List returns the personal tokens of the user oldest first
+func (ts *Tokens) List(user string) []*Token {
+	return ts.list(func(t *Token) bool { return t.Repo == "" && t.User == user })
+}
+
+// ListDeploy returns the deploy tokens of the repo oldest first
+func (ts *Tokens) ListDeploy(repo string) []*Token {
+	return ts.list(func(t *Token) bool { return t.Repo == repo })
+}
+
+func (ts *Tokens) list(match func(*Token) bool) []*Token {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+
+	list := make([]*Token, 0)
+	for _, t := range ts.tokens {
+		if match(t) {
+			c := *t
+			list = append(list, &c)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+// Revoke removes the personal token with the id of the user
+func (ts *Tokens) Revoke(user, id string) error {
+	return ts.revoke(func(t *Token) bool { return t.Repo == "" && t.User == user && t.ID == id })
+}
+
+// RevokeDeploy removes the deploy token with the id of the repo
+func (ts *Tokens) RevokeDeploy(repo, id string) error {
+	return ts.revoke(func(t *Token) bool { return t.Repo == repo && t.ID == id })
+}
+
+func (ts *Tokens) revoke(match func(*Token) bool) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	for h, t := range ts.tokens {
+		if match(t) {
+			delete(ts.tokens, h)
+			return nil
+		}
+	}
+	return ErrTokenNotFound
+}
+
+// Authenticate checks bearer tokens and basic passwords with a token prefix.
+// Expired tokens are rejected.
+func (ts *Tokens) Authenticate(r *http.Request) (*Principal, error) {
+	token, ok := tokenCredential(r)
+	if !ok || !(strings.HasPrefix(token, PersonalTokenPrefix) || strings.HasPrefix(token, DeployTokenPrefix)) {
+		return nil, nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	t, ok := ts.tokens[hashToken(token)]
+	now := time.Now()
+	if !ok || t.Expired(now) {
+		return nil, ErrInvalidCredentials
+	}
+	t.LastUsed = &now
+	return t.principal(), nil
+}
+
+// Challenge asks for basic credentials as git prompts for those
+func (ts *Tokens) Challenge() string {
+	return basicChallenge(ts.realm)
+}
@@ -0,0 +1,347 @@
+// Package authz decides what users may do with repos based on their roles in
+// the repo and its namespace and the repo visibility
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/euforia/go-git-server/auth"
+)
+
+var (
+	// ErrForbidden is returned when a user lacks the role required
+	ErrForbidden = errors.New("forbidden")
+	// ErrNotFound is returned for repos and namespaces the user can't read
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when creating a namespace that exists
+	ErrExists = errors.New("exists")
+)
+
+// Role of a user in a namespace or repo.  Each role includes the ones below.
+type Role string
+
+const (
+	// RoleNone grants nothing
+	RoleNone Role = ""
+	// RoleRead allows fetching
+	RoleRead Role = "read"
+	// RoleWrite allows pushing and creating repos in a namespace
+	RoleWrite Role = "write"
+	// RoleAdmin allows changing settings, members and visibility
+	RoleAdmin Role = "admin"
+)
+
+func (r Role) level() int {
+	switch r {
+	case RoleRead:
+		return 1
+	case RoleWrite:
+		return 2
+	case RoleAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Includes returns true if the role grants want
+func (r Role) Includes(want Role) bool {
+	return r.level() >= want.level()
+}
+
+func maxRole(a, b Role) Role {
+	if b.level() > a.level() {
+		return b
+	}
+	return a
+}
+
+func minRole(a, b Role) Role {
+	if b.level() < a.level() {
+		return b
+	}
+	return a
+}
+
+// scopeRole returns the highest role the scopes of the principal allow
+func scopeRole(p *auth.Principal) Role {
+	switch {
+	case p.HasScope(auth.ScopeAdmin):
+		return RoleAdmin
+	case p.HasScope(auth.ScopeRepoWrite):
+		return RoleWrite
+	case p.HasScope(auth.ScopeRepoRead):
+		return RoleRead
+	}
+	return RoleNone
+}
+
+// Visibility of a repo to users without a role
+type Visibility string
+
+const (
+	// Private repos are only visible to members.  It is the default.
+	Private Visibility = "private"
+	// Internal repos can be read by any authenticated user
+	Internal Visibility = "internal"
+	// Public repos can be read by anyone including anonymous users
+	Public Visibility = "public"
+)
+
+// Members maps user names to their roles
+type Members map[string]Role
+
+// Validate checks the roles are known
+func (m Members) Validate() error {
+	for user, role := range m {
+		if role.level() == 0 {
+			return fmt.Errorf("invalid role for %s: %q", user, role)
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of the members
+func (m Members) Clone() Members {
+	if m == nil {
+		return nil
+	}
+	c := make(Members, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// ACL is the access control of a repo
+type ACL struct {
+	Visibility Visibility `json:"visibility,omitempty"`
+	Members    Members    `json:"members,omitempty"`
+}
+
+// Validate checks the visibility and members are valid
+func (acl *ACL) Validate() error {
+	switch acl.Visibility {
+	case "", Private, Internal, Public:
+	default:
+		return fmt.Errorf("invalid visibility: %q", acl.Visibility)
+	}
+	return acl.Members.Validate()
+}
+
+// Namespace is the owner of the repos with its name as the id prefix
+type Namespace struct {
+	Name    string  `json:"name"`
+	Members Members `json:"members"`
+	// Roles of the members of groups e.g. from the claims of tokens
+	Groups Members `json:"groups,omitempty"`
+}
+
+func (ns *Namespace) clone() *Namespace {
+	return &Namespace{Name: ns.Name, Members: ns.Members.Clone(), Groups: ns.Groups.Clone()}
+}
+
+// Namespaces is an in memory namespace store
+type Namespaces struct {
+	mu sync.RWMutex
+	m  map[string]*Namespace
+}
+
+// NewNamespaces instantiates an empty namespace store
+func NewNamespaces() *Namespaces {
+	return &Namespaces{m: map[string]*Namespace{}}
+}
+
+// Get returns a copy of the namespace
+func (nss *Namespaces) Get(name string) (*Namespace, error) {
+	nss.mu.RLock()
+	defer nss.mu.RUnlock()
+
+	ns, ok := nss.m[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ns.clone(), nil
+}
+
+// Create creates the namespace
+func (nss *Namespaces) Create(ns *Namespace) error {
+	if err := ns.Members.Validate(); err != nil {
+		return err
+	}
+	if err := ns.Groups.Validate(); err != nil {
+		return err
+	}
+
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+
+	if _, ok := nss.m[ns.Name]; ok {
+		return ErrExists
+	}
+	nss.m[ns.Name] = ns.clone()
+	return nil
+}
+
+// SetMembers replaces the members of the namespace
+func (nss *Namespaces) SetMembers(name string, members Members) error {
+	if err := members.Validate(); err != nil {
+		return err
+	}
+
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+
+	ns, ok := nss.m[name]
+	if !ok {
+		return ErrNotFound
+	}
+	ns.Members = members.Clone()
+	return nil
+}
+
+// SetGroups replaces the group roles of the namespace
+func (nss *Namespaces) SetGroups(name string, groups Members) error {
+	if err := groups.Validate(); err != nil {
+		return err
+	}
+
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+
+	ns, ok := nss.m[name]
+	if !ok {
+		return ErrNotFound
+	}
+	ns.Groups = groups.Clone()
+	return nil
+}
+
+// Remove removes the namespace
+func (nss *Namespaces) Remove(name string) error {
+	nss.mu.Lock()
+	defer nss.mu.Unlock()
+
+	if _, ok := nss.m[name]; !ok {
+		return ErrNotFound
+	}
+	delete(nss.m, name)
+	return nil
+}
+
+// ACLFunc returns the access control of a repo.  Repos without one are
+// private without members.
+type ACLFunc func(repoID string) *ACL
+
+// Authorizer decides the roles of users in namespaces and repos
+type Authorizer struct {
+	namespaces *Namespaces
+	acl        ACLFunc
+}
+
+// NewAuthorizer instantiates an authorizer with the namespaces and the acls of
+// repos
+func NewAuthorizer(namespaces *Namespaces, acl ACLFunc) *Authorizer {
+	return &Authorizer{namespaces: namespaces, acl: acl}
+}
+
+// NamespaceOf returns the namespace of the repo id
+func NamespaceOf(repoID string) string {
+	return strings.SplitN(strings.Trim(repoID, "/"), "/", 2)[0]
+}
+
+// NamespaceRole returns the highest role of the principal in the namespace as
+// a member or through its groups.  Users are admins of the namespace with
+// their name.
+func (a *Authorizer) NamespaceRole(p *auth.Principal, ns string) Role {
+	if p == nil || p.Name == "" {
+		return RoleNone
+	}
+	if p.Name == ns {
+		return RoleAdmin
+	}
+	n, err := a.namespaces.Get(ns)
+	if err != nil {
+		return RoleNone
+	}
+	role := n.Members[p.Name]
+	for _, g := range p.Groups {
+		role = maxRole(role, n.Groups[g])
+	}
+	return role
+}
+
+// RepoRole returns the role of the principal in the repo, the highest of its
+// namespace and repo roles and that granted by the visibility limited by the
+// scopes of its credential.  Credentials limited to a repo have the role of
+// their scope in it and are anonymous elsewhere.  p is nil for anonymous
+// users.
+func (a *Authorizer) RepoRole(p *auth.Principal, repoID string) Role {
+	acl := a.acl(repoID)
+	if acl == nil {
+		acl = &ACL{}
+	}
+
+	role := RoleNone
+	if acl.Visibility == Public {
+		role = RoleRead
+	}
+	if p == nil {
+		return role
+	}
+	if p.Repo != "" {
+		if p.Repo != repoID {
+			return role
+		}
+		return maxRole(role, scopeRole(p))
+	}
+	if acl.Visibility == Internal {
+		role = RoleRead
+	}
+	role = maxRole(role, acl.Members[p.Name])
+	role = maxRole(role, a.NamespaceRole(p, NamespaceOf(repoID)))
+	return minRole(role, scopeRole(p))
+}
+
+// Authorize returns nil if the principal has the role in the repo.  Anonymous
+// users are asked to authenticate, users that can't read the repo get
+// ErrNotFound so private repos are not disclosed and others ErrForbidden.
+func (a *Authorizer) Authorize(p *auth.Principal, repoID string, want Role) error {
+	role := a.RepoRole(p, repoID)
+	switch {
+	case role.Includes(want):
+		return nil
+	case p == nil:
+		return auth.ErrUnauthenticated
+	case !role.Includes(RoleRead):
+		return ErrNotFound
+	}
+	return ErrForbidden
+}
+
+// AuthorizeNamespace returns nil if the principal has the role in the
+// namespace.  Credentials limited to a repo have none.
+func (a *Authorizer) AuthorizeNamespace(p *auth.Principal, ns string, want Role) error {
+	if p == nil {
+		return auth.ErrUnauthenticated
+	}
+	role := RoleNone
+	if p.Repo == "" {
+		role = minRole(a.NamespaceRole(p, ns), scopeRole(p))
+	}
+	if !role.Includes(want) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// AuthorizeRepo authorizes reading or writing the repo e.g. over ssh
+func (a *Authorizer) AuthorizeRepo(p *auth.Principal, repoID string, write bool) error {
+	want := RoleRead
+	if write {
+		want = RoleWrite
+	}
+	return a.Authorize(p, repoID, want)
+}
@@ -0,0 +1,79 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/euforia/go-git-server/auth"
+)
+
+func TestAuthorize(t *testing.T) {
+	nss := NewNamespaces()
+	if err := nss.Create(&Namespace{Name: "team", Members: Members{"alice": RoleWrite}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nss.Create(&Namespace{Name: "team"}); err != ErrExists {
+		t.Fatal(err)
+	}
+
+	acls := map[string]*ACL{
+		"team/private":  {Members: Members{"carol": RoleRead}},
+		"team/internal": {Visibility: Internal},
+		"team/public":   {Visibility: Public},
+		"bob/repo":      {},
+	}
+	a := NewAuthorizer(nss, func(id string) *ACL { return acls[id] })
+
+	alice := &auth.Principal{Name: "alice"}
+	bob := &auth.Principal{Name: "bob"}
+	carol := &auth.Principal{Name: "carol"}
+	aliceRead := &auth.Principal{Name: "alice", Scopes: []auth.Scope{auth.ScopeRepoRead}}
+	deploy := &auth.Principal{Name: "deploy:1", Scopes: []auth.Scope{auth.ScopeRepoWrite}, Repo: "team/private"}
+
+	tests := []struct {
+		p    *auth.Principal
+		repo string
+		want Role
+		err  error
+	}{
+		{nil, "team/public", RoleRead, nil},
+		{nil, "team/public", RoleWrite, auth.ErrUnauthenticated},
+		{nil, "team/internal", RoleRead, auth.ErrUnauthenticated},
+		{bob, "team/internal", RoleRead, nil},
+		{bob, "team/internal", RoleWrite, ErrForbidden},
+		{bob, "team/private", RoleRead, ErrNotFound},
+		{carol, "team/private", RoleRead, nil},
+		{carol, "team/private", RoleWrite, ErrForbidden},
+		// Namespace roles apply to all its repos
+		{alice, "team/private", RoleWrite, nil},
+		{alice, "team/private", RoleAdmin, ErrForbidden},
+		// Users administer the namespace with their name
+		{bob, "bob/repo", RoleAdmin, nil},
+		{bob, "team/missing", RoleRead, ErrNotFound},
+		// Scopes limit the role of the user
+		{aliceRead, "team/private", RoleRead, nil},
+		{aliceRead, "team/private", RoleWrite, ErrForbidden},
+		// Deploy credentials only have their scope in their repo
+		{deploy, "team/private", RoleWrite, nil},
+		{deploy, "team/private", RoleAdmin, ErrForbidden},
+		{deploy, "team/internal", RoleRead, ErrNotFound},
+		{deploy, "team/public", RoleRead, nil},
+	}
+	for i, tt := range tests {
+		if err := a.Authorize(tt.p, tt.repo, tt.want); err != tt.err {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+
+	if err := a.AuthorizeNamespace(alice, "team", RoleWrite); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.AuthorizeNamespace(bob, "team", RoleRead); err != ErrForbidden {
+		t.Fatal(err)
+	}
+	if err := a.AuthorizeNamespace(aliceRead, "team", RoleWrite); err != ErrForbidden {
+		t.Fatal(err)
+	}
+	if err := nss.SetMembers("team", Members{"alice": "owner"}); err == nil {
+		t.Fatal("invalid role accepted")
+	}
+}
@@ -0,0 +1,316 @@
+// Package bundle implements reading and writing of git bundles.  A bundle is a
+// header listing the prerequisite commits and the refs it contains followed
+// by a pack of the objects between them.
+// https://git-scm.com/docs/gitformat-bundle
+package bundle
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/packfile"
+)
+
+const (
+	signatureV2 = "# v2 git bundle"
+	signatureV3 = "# v3 git bundle"
+
+	// objectFormat is the only object format supported
+	objectFormat = "sha1"
+)
+
+var (
+	// ErrInvalidBundle is returned when the bundle header is malformed
+	ErrInvalidBundle = errors.New("invalid bundle")
+	// ErrNoRefs is returned when creating a bundle with no refs
+	ErrNoRefs = errors.New("bundle has no refs")
+)
+
+// Prerequisite is a commit the receiving repo must already have
+type Prerequisite struct {
+	Hash plumbing.Hash
+	// Free form, git uses the commit subject
+	Comment string
+}
+
+// Header is the bundle header
+type Header struct {
+	Version int
+	// v3 capabilities i.e. object-format
+	Capabilities  map[string]string
+	Prerequisites []Prerequisite
+	References    []*plumbing.Reference
+}
+
+// ReadHeader reads the bundle header leaving r at the start of the pack
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &Header{Capabilities: map[string]string{}}
+	switch line {
+	case signatureV2:
+		hdr.Version = 2
+	case signatureV3:
+		hdr.Version = 3
+	default:
+		return nil, ErrInvalidBundle
+	}
+
+	for {
+		if line, err = readLine(r); err != nil {
+			return nil, err
+		}
+
+		switch {
+		case line == "":
+			return hdr, nil
+
+		case hdr.Version == 3 && line[0] == '@':
+			kv := strings.SplitN(line[1:], "=", 2)
+			if len(kv) == 1 {
+				kv = append(kv, "")
+			}
+			hdr.Capabilities[kv[0]] = kv[1]
+
+		case line[0] == '-':
+			parts := strings.SplitN(line[1:], " ", 2)
+			if !isHash(parts[0]) {
+				return nil, ErrInvalidBundle
+			}
+			p := Prerequisite{Hash: plumbing.NewHash(parts[0])}
+			if len(parts) == 2 {
+				p.Comment = parts[1]
+			}
+			hdr.Prerequisites = append(hdr.Prerequisites, p)
+
+		default:
+			parts := strings.SplitN(line, " ", 2)
+			if len(parts) != 2 || !isHash(parts[0]) {
+				return nil, ErrInvalidBundle
+			}
+			ref := plumbing.NewHashReference(plumbing.ReferenceName(parts[1]), plumbing.NewHash(parts[0]))
+			hdr.References = append(hdr.References, ref)
+		}
+	}
+}
+
+// Encode writes the header including the blank line ending it
+func (hdr *Header) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	if hdr.Version == 3 {
+		bw.WriteString(signatureV3 + "\n")
+		for k, v := range hdr.Capabilities {
+			if v == "" {
+				fmt.Fprintf(bw, "@%s\n", k)
+			} else {
+				fmt.Fprintf(bw, "@%s=%s\n", k, v)
+			}
+		}
+	} else {
+		bw.WriteString(signatureV2 + "\n")
+	}
+
+	for _, p := range hdr.Prerequisites {
+		fmt.Fprintf(bw, "-%s %s\n", p.Hash, p.Comment)
+	}
+	for _, ref := range hdr.References {
+		fmt.Fprintf(bw, "%s %s\n", ref.Hash(), ref.Name())
+	}
+	bw.WriteString("\n")
+
+	return bw.Flush()
+}
+
+// Create writes a v2 bundle of the refs to w.  Objects reachable from the
+// prerequisites are left out of the pack.
+func Create(ctx context.Context, w io.Writer, store storer.Storer, refs []*plumbing.Reference, prereqs []plumbing.Hash) error {
+	if len(refs) == 0 {
+		return ErrNoRefs
+	}
+
+	hdr := &Header{Version: 2, References: refs}
+	for _, h := range prereqs {
+		p := Prerequisite{Hash: h}
+		if c, err := object.GetCommit(store, h); err == nil {
+			p.Comment = strings.SplitN(c.Message, "\n", 2)[0]
+		}
+		hdr.Prerequisites = append(hdr.Prerequisites, p)
+	}
+
+	if err := hdr.Encode(w); err != nil {
+		return err
+	}
+
+	wants := make([]plumbing.Hash, len(refs))
+	for i, ref := range refs {
+		wants[i] = ref.Hash()
+	}
+
+	_, err := packfile.NewEncoder(w, store).Encode(ctx, wants, prereqs)
+	return err
+}
+
+// Verify reads the bundle header checking the store has all the
+// prerequisites.  r is left at the start of the pack.
+func Verify(r *bufio.Reader, store storer.EncodedObjectStorer) (*Header, error) {
+	hdr, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if f, ok := hdr.Capabilities["object-format"]; ok && f != objectFormat {
+		return nil, fmt.Errorf("unsupported object format: %s", f)
+	}
+
+	for _, p := range hdr.Prerequisites {
+		if err = store.HasEncodedObject(p.Hash); err != nil {
+			return nil, fmt.Errorf("missing prerequisite %s: %v", p.Hash, err)
+		}
+	}
+
+	return hdr, nil
+}
+
+// Resolve returns the refs and prerequisites for the revs.  A rev is a ref
+// name, short or full, or a hash to include, ^rev to exclude or rev1..rev2.
+// With no revs all refs are included.
+func Resolve(store storer.Storer, revs []string) (refs []*plumbing.Reference, prereqs []plumbing.Hash, err error) {
+	if len(revs) == 0 {
+		iter, err := store.IterReferences()
+		if err != nil {
+			return nil, nil, err
+		}
+		err = iter.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Type() == plumbing.HashReference {
+				refs = append(refs, ref)
+			}
+			return nil
+		})
+		return refs, nil, err
+	}
+
+	exclude := func(rev string) error {
+		ref, err := resolveRev(store, rev)
+		if err == nil {
+			prereqs = append(prereqs, ref.Hash())
+		}
+		return err
+	}
+	include := func(rev string) error {
+		ref, err := resolveRev(store, rev)
+		if err == nil {
+			refs = append(refs, ref)
+		}
+		return err
+	}
+
+	for _, rev := range revs {
+		switch {
+		case strings.HasPrefix(rev, "^"):
+			err = exclude(rev[1:])
+
+		case strings.Contains(rev, ".."):
+			parts := strings.SplitN(rev, "..", 2)
+			if err = exclude(parts[0]); err == nil {
+				err = include(parts[1])
+			}
+
+		default:
+			err = include(rev)
+		}
+
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", rev, err)
+		}
+	}
+
+	if len(refs) == 0 {
+		err = ErrNoRefs
+	}
+	return refs, prereqs, err
+}
+
+// resolveRev returns the reference for the rev.  Hashes are returned as a
+// reference named after themselves.
+func resolveRev(store storer.Storer, rev string) (*plumbing.Reference, error) {
+	if isHash(rev) {
+		h := plumbing.NewHash(rev)
+		return plumbing.NewHashReference(plumbing.ReferenceName(rev), h), store.HasEncodedObject(h)
+	}
+
+	for _, name := range []string{rev, "refs/" + rev, "refs/heads/" + rev, "refs/tags/" + rev} {
+		ref, err := storer.ResolveReference(store, plumbing.ReferenceName(name))
+		if err == nil {
+			return plumbing.NewHashReference(plumbing.ReferenceName(name), ref.Hash()), nil
+		}
+	}
+
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+// Import verifies and unpacks the bundle into the store then sets the refs it
+// contains
+func Import(r io.Reader, store storer.Storer) (*Header, error) {
+	br := bufio.NewReader(r)
+
+	hdr, err := Verify(br, store)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = packfile.NewDecoder(br, store).Decode(); err != nil {
+		return nil, err
+	}
+
+	for _, ref := range hdr.References {
+		if err = store.HasEncodedObject(ref.Hash()); err != nil {
+			return nil, fmt.Errorf("%s: %v", ref.Name(), err)
+		}
+	}
+	for _, ref := range hdr.References {
+		// Leave HEAD alone and skip tips named by hash
+		if !strings.HasPrefix(ref.Name().String(), "refs/") {
+			continue
+		}
+		if err = store.SetReference(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	return hdr, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = ErrInvalidBundle
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+func isHash(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
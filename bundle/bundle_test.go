@@ -0,0 +1,93 @@
+package bundle
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testCommit(t *testing.T, st storer.EncodedObjectStorer, msg string, parents ...plumbing.Hash) plumbing.Hash {
+	tree := &object.Tree{}
+	obj := st.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	th, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sig := object.Signature{Name: "a", Email: "a@b", When: time.Unix(1500000000, 0)}
+	c := &object.Commit{Author: sig, Committer: sig, Message: msg + "\n", TreeHash: th, ParentHashes: parents}
+	obj = st.NewEncodedObject()
+	if err = c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestBundle(t *testing.T) {
+	src := memory.NewStorage()
+	c1 := testCommit(t, src, "one")
+	c2 := testCommit(t, src, "two", c1)
+	src.SetReference(plumbing.NewHashReference("refs/heads/master", c2))
+
+	refs, prereqs, err := Resolve(src, []string{c1.String() + "..master"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = Create(context.Background(), buf, src, refs, prereqs); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr, err := ReadHeader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Version != 2 || len(hdr.Prerequisites) != 1 || hdr.Prerequisites[0].Comment != "one" {
+		t.Fatalf("%+v", hdr)
+	}
+
+	// Missing prerequisite
+	dst := memory.NewStorage()
+	if _, err = Import(bytes.NewReader(buf.Bytes()), dst); err == nil {
+		t.Fatal("should fail")
+	}
+
+	testCommit(t, dst, "one")
+	if _, err = Import(bytes.NewReader(buf.Bytes()), dst); err != nil {
+		t.Fatal(err)
+	}
+	ref, err := dst.Reference("refs/heads/master")
+	if err != nil || ref.Hash() != c2 {
+		t.Fatal(ref, err)
+	}
+}
+
+func TestReadHeaderV3(t *testing.T) {
+	in := "# v3 git bundle\n@object-format=sha256\n\n"
+	hdr, err := ReadHeader(bufio.NewReader(bytes.NewBufferString(in)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Capabilities["object-format"] != "sha256" {
+		t.Fatal(hdr.Capabilities)
+	}
+
+	if _, err = Verify(bufio.NewReader(bytes.NewBufferString(in)), memory.NewStorage()); err == nil {
+		t.Fatal("sha256 should not be supported")
+	}
+}
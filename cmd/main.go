@@ -1,19 +1,81 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/euforia/go-git-server/audit"
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/events"
+	"github.com/euforia/go-git-server/packcache"
+	"github.com/euforia/go-git-server/packfile"
+	"github.com/euforia/go-git-server/packproto"
 	"github.com/euforia/go-git-server/repository"
+	"github.com/euforia/go-git-server/reviews"
+	"github.com/euforia/go-git-server/secrets"
+	"github.com/euforia/go-git-server/signature"
 	"github.com/euforia/go-git-server/storage"
 	"github.com/euforia/go-git-server/transport"
+	"github.com/euforia/go-git-server/users"
 )
 
 var (
-	httpAddr = "127.0.0.1:12345"
+	httpAddr  = flag.String("http-addr", transport.DefaultHTTPAddr, "address to serve http on")
+	tlsCert   = flag.String("tls-cert", "", "certificate file. Enables tls with -tls-key")
+	tlsKey    = flag.String("tls-key", "", "private key file of the certificate")
+	clientCA  = flag.String("tls-client-ca", "", "CA certificates client certificates are verified with. Verified certificates authenticate users by their common name")
+	certUsers = flag.String("tls-client-users", "", "file of '<user> <subject>' lines mapping client certificate subjects e.g. CN=alice,O=Acme to users instead")
+	requireCC = flag.Bool("tls-require-client-cert", false, "reject connections without a verified client certificate")
+
+	readTimeout     = flag.Duration("http-read-timeout", 0, "time to read a request including the body e.g. a push. 0 is unlimited")
+	writeTimeout    = flag.Duration("http-write-timeout", 0, "time to write a response e.g. a clone. 0 is unlimited")
+	idleTimeout     = flag.Duration("http-idle-timeout", 2*time.Minute, "time a keep-alive connection may be idle. 0 is unlimited")
+	shutdownTimeout = flag.Duration("shutdown-timeout", time.Minute, "time in-flight requests and pushes are waited for on SIGINT or SIGTERM")
+
 	dataDir  = flag.String("data-dir", "", "dir")
+	maintInt = flag.Duration("maintenance-interval", 0, "interval between repo repacks. 0 disables")
+	cacheDir = flag.String("pack-cache-dir", "", "dir to cache generated packs in. empty disables")
+	cacheMax = flag.Int64("pack-cache-size", 1<<30, "max size of the pack cache in bytes")
+	offload  = flag.String("offload-url", "", "base url maintained packs are served under for packfile-uris and bundle-uri. empty disables")
+
+	// Push limits.  0 is unlimited.  Repos may override them.
+	maxPackSize   = flag.Int64("max-pack-size", 0, "max bytes of a pushed pack")
+	maxObjectSize = flag.Int64("max-object-size", 0, "max bytes of a single pushed object")
+	maxObjects    = flag.Int64("max-objects", 0, "max objects in a pushed pack")
+	maxRefUpdates = flag.Int64("max-ref-updates", 0, "max refs updated by a single push")
+	denyNonFF     = flag.Bool("deny-non-fast-forwards", false, "reject pushes that would lose commits")
+
+	secretScan = flag.String("secret-scanning", "off", "secret scanning of pushes: off, report or block. Repos may override it")
+	webhookURL = flag.String("events-webhook", "", "url events are posted to. empty disables")
+
+	daemonAddr      = flag.String("daemon-addr", "", "address to serve git:// on e.g. "+transport.DefaultDaemonAddr+". empty disables")
+	daemonExportAll = flag.Bool("daemon-export-all", false, "serve all public repos over git:// not only those with the export flag")
+	daemonMaxConns  = flag.Int("daemon-max-conns", 32, "max git:// connections. 0 is unlimited")
+	daemonMaxPerIP  = flag.Int("daemon-max-conns-per-ip", 4, "max git:// connections from a single ip. 0 is unlimited")
+	daemonTimeout   = flag.Duration("daemon-timeout", time.Minute, "time a git:// connection may be idle")
+
+	sshAddr    = flag.String("ssh-addr", "", "address to serve git over ssh on e.g. "+transport.DefaultSSHAddr+". requires authentication. empty disables")
+	sshHostKey = flag.String("ssh-host-key", "", "private host key of the ssh server. generated if missing. defaults to .ssh/host_key in the data dir")
+
+	authRealm    = flag.String("auth-realm", auth.DefaultRealm, "realm of http authentication challenges")
+	authHtpasswd = flag.String("auth-htpasswd", "", "htpasswd file of bcrypt hashed passwords. Enables authentication")
+	authTokens   = flag.String("auth-tokens", "", "file of '<token> <user>' lines accepted as bearer tokens. Enables authentication")
+	authJWT      = flag.String("auth-jwt", "", "JSON file of issuers whose JWTs are accepted as bearer tokens. Enables authentication")
+	authAdmins   = flag.String("auth-admins", "", "comma separated users administering the server e.g. managing other users")
+
+	pushCertSecret = flag.String("push-cert-secret", "", "secret push certificate nonces are keyed with. Servers behind a load balancer must share it. empty generates one")
+	auditDir       = flag.String("audit-dir", "", "dir push certificates are logged to. defaults to .audit in the data dir")
 )
 
 func init() {
@@ -27,6 +89,154 @@ func makeManager() *repository.Manager {
 	return repository.NewManager(repoStore, gitRepoMgr)
 }
 
+// maintain periodically repacks all repos writing pack bitmaps until the
+// context is done closing done then
+func maintain(ctx context.Context, objStore *storage.FilesystemGitRepoStorage, interval time.Duration, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids, err := objStore.Repos()
+		if err != nil {
+			log.Println("ERR", err)
+			continue
+		}
+
+		for _, id := range ids {
+			if ctx.Err() != nil {
+				return
+			}
+			if err = objStore.Maintain(ctx, id); err != nil {
+				log.Printf("ERR [maintenance] repo=%s %v", id, err)
+			}
+		}
+	}
+}
+
+// services are drained on shutdown.  Those disabled are nil.
+type services struct {
+	http   *transport.Server
+	ssh    *transport.SSHServer
+	daemon *transport.GitDaemon
+	git    *transport.GitHTTPService
+	// Stops maintenance once the repo being maintained is done
+	stopMaintenance func(ctx context.Context) error
+	// Cancels pack cache builds left once requests are drained
+	stopPackCache context.CancelFunc
+}
+
+// makeAuthenticator returns the configured authenticators or nil if
+// authentication is disabled
+func makeAuthenticator() auth.Chain {
+	var chain auth.Chain
+	if *authHtpasswd != "" {
+		h, err := auth.NewHtpasswd(*authHtpasswd, *authRealm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain = append(chain, h)
+	}
+	if *authTokens != "" {
+		t, err := auth.LoadStaticTokens(*authTokens, *authRealm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain = append(chain, t)
+	}
+	if *authJWT != "" {
+		j, err := auth.LoadJWT(*authJWT, *authRealm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		chain = append(chain, j)
+	}
+	if *clientCA != "" {
+		cc := auth.NewClientCerts(nil)
+		if *certUsers != "" {
+			var err error
+			if cc, err = auth.LoadClientCerts(*certUsers); err != nil {
+				log.Fatal(err)
+			}
+		}
+		chain = append(chain, cc)
+	}
+	return chain
+}
+
+func serverConfig() *transport.ServerConfig {
+	return &transport.ServerConfig{
+		Addr:              *httpAddr,
+		TLSCert:           *tlsCert,
+		TLSKey:            *tlsKey,
+		ClientCA:          *clientCA,
+		RequireClientCert: *requireCC,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+}
+
+// handleSignals reloads certificates on SIGHUP and on SIGINT or SIGTERM drains
+// the servers, then the work pushes started and maintenance, closing drained
+// once done.  Pack cache builds left after the drain are cancelled.  A second
+// signal exits immediately.
+func handleSignals(svcs *services, drained chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			if err := svcs.http.Reload(); err != nil {
+				log.Printf("ERR [server] reload certificates: %v", err)
+			} else {
+				log.Printf("Reloaded certificates")
+			}
+			continue
+		}
+		break
+	}
+	signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Shutting down. Waiting up to %s for in-flight requests", *shutdownTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	drain := func(name string, shutdown func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := shutdown(ctx); err != nil {
+				log.Printf("ERR [%s] shutdown: %v", name, err)
+			}
+		}()
+	}
+	if svcs.ssh != nil {
+		drain("ssh", svcs.ssh.Shutdown)
+	}
+	if svcs.daemon != nil {
+		drain("daemon", svcs.daemon.Shutdown)
+	}
+	drain("maintenance", svcs.stopMaintenance)
+	if err := svcs.http.Shutdown(ctx); err != nil {
+		log.Printf("ERR [server] shutdown: %v", err)
+	}
+	wg.Wait()
+	svcs.stopPackCache()
+	// Pushes may have started commit-graph updates
+	if err := svcs.git.Wait(ctx); err != nil {
+		log.Printf("ERR [server] waiting for commit-graph updates: %v", err)
+	}
+	close(drained)
+}
+
 func main() {
 	flag.Parse()
 	if *dataDir == "" {
@@ -35,13 +245,160 @@ func main() {
 	}
 
 	objStore := storage.NewFilesystemGitRepoStorage(*dataDir)
+	maintCtx, stopMaint := context.WithCancel(context.Background())
+	maintDone := make(chan struct{})
+	if *maintInt > 0 {
+		go maintain(maintCtx, objStore, *maintInt, maintDone)
+	} else {
+		close(maintDone)
+	}
 	gh := transport.NewGitHTTPService(objStore)
+	cacheCtx, stopCache := context.WithCancel(context.Background())
+	if *cacheDir != "" {
+		cache, err := packcache.New(cacheCtx, *cacheDir, *cacheMax)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gh.SetPackCache(cache)
+	}
+
+	gh.SetPushLimits(packproto.PushLimits{
+		Limits: packfile.Limits{
+			MaxPackSize:   *maxPackSize,
+			MaxObjectSize: *maxObjectSize,
+			MaxObjects:    *maxObjects,
+		},
+		MaxRefUpdates: *maxRefUpdates,
+	})
+	gh.SetDenyNonFastForwards(*denyNonFF)
+
+	var sink events.Sink
+	if *webhookURL != "" {
+		sink = events.NewWebhook(*webhookURL)
+	}
+	mode, err := secrets.ParseMode(*secretScan)
+	if err != nil {
+		log.Fatal(err)
+	}
+	gh.SetSecretScanner(secrets.NewScanner(mode, sink))
+
+	userStore := users.NewMemStore()
+	verifier := signature.NewVerifier(userStore)
+	gh.SetSignatureVerifier(verifier)
+
+	secret := []byte(*pushCertSecret)
+	if len(secret) == 0 {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *auditDir == "" {
+		*auditDir = filepath.Join(*dataDir, ".audit")
+	}
+	certLog := audit.NewPushCertLog(filepath.Join(*auditDir, "push-certs"))
+	gh.SetPushCerts(packproto.NewPushCerts(secret, verifier, certLog), certLog)
+	gh.SetReviews(reviews.NewReviews(filepath.Join(*dataDir, ".reviews")))
 
 	mgr := makeManager()
+	gh.SetRepositoryStore(mgr)
 	rh := transport.NewRepoHTTPService(mgr)
+	rh.SetGitStorage(objStore)
 
 	server := transport.NewHTTPTransport(gh, rh)
-	if err := server.ListenAndServe(httpAddr); err != nil {
-		log.Println(err)
+	uh := transport.NewUsersHTTPService(userStore)
+	server.UsersHandler(uh)
+	// Roles are only enforced when users are authenticated.  Without
+	// authentication repos are open and users can't be changed.
+	var authorizer *authz.Authorizer
+	deployKeys := auth.NewDeployKeys()
+	if authn := makeAuthenticator(); authn != nil {
+		tokens := auth.NewTokens(*authRealm)
+		uh.SetTokens(tokens)
+		uh.SetAdmins(auth.NewAdmins(strings.Split(*authAdmins, ",")...))
+		rh.SetDeployCredentials(deployKeys, tokens)
+		server.SetAuthenticator(append(authn, tokens))
+		server.SetAnonymous(true)
+
+		namespaces := authz.NewNamespaces()
+		uh.SetNamespaces(namespaces)
+		authorizer = authz.NewAuthorizer(namespaces, func(repoID string) *authz.ACL {
+			repo, err := mgr.GetRepo(repoID)
+			if err != nil {
+				return nil
+			}
+			return &repo.ACL
+		})
+		gh.SetAuthorizer(authorizer)
+		rh.SetAuthorizer(authorizer)
+		server.NamespacesHandler(transport.NewNamespacesHTTPService(namespaces, authorizer, userStore))
+	}
+	if *offload != "" {
+		oh := transport.NewOffloadHandler(objStore, *dataDir, *offload)
+		oh.SetAuthorizer(authorizer)
+		gh.SetOffloader(oh)
+		server.OffloadHandler(oh)
+	}
+	var daemon *transport.GitDaemon
+	if *daemonAddr != "" {
+		daemon = transport.NewGitDaemon(gh)
+		daemon.SetExportAll(*daemonExportAll)
+		daemon.SetConnLimits(*daemonMaxConns, *daemonMaxPerIP)
+		daemon.SetTimeout(*daemonTimeout)
+		go func() {
+			if err := daemon.ListenAndServe(*daemonAddr); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	var sshServer *transport.SSHServer
+	if *sshAddr != "" {
+		// Keys would give access to all repos
+		if authorizer == nil {
+			log.Fatal("-ssh-addr requires authentication to be enabled")
+		}
+		if *sshHostKey == "" {
+			*sshHostKey = filepath.Join(*dataDir, ".ssh", "host_key")
+		}
+		hostKey, err := transport.LoadHostKey(*sshHostKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		sshServer = transport.NewSSHServer(gh, transport.NewUserKeyStore(userStore), hostKey)
+		sshServer.SetAuthorizer(authorizer)
+		sshServer.SetDeployKeys(deployKeys)
+		go func() {
+			if err := sshServer.ListenAndServe(*sshAddr); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	httpServer, err := transport.NewServer(serverConfig(), server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	drained := make(chan struct{})
+	go handleSignals(&services{
+		http:          httpServer,
+		ssh:           sshServer,
+		daemon:        daemon,
+		git:           gh,
+		stopPackCache: stopCache,
+		stopMaintenance: func(ctx context.Context) error {
+			stopMaint()
+			select {
+			case <-maintDone:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}, drained)
+
+	if err = httpServer.ListenAndServe(); err != nil {
+		log.Fatal(err)
 	}
+	<-drained
 }
@@ -0,0 +1,269 @@
+package commitgraph
+
+import (
+	"container/heap"
+	"context"
+	"log"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// Storer is an optional interface for object stores that have a commit-graph
+type Storer interface {
+	// CommitGraph returns the commit-graph or nil if there is none
+	CommitGraph() (*Graph, error)
+}
+
+// Updater is an optional interface for object stores that persist a
+// commit-graph which should be updated when refs change
+type Updater interface {
+	UpdateCommitGraph(ctx context.Context) error
+}
+
+// NodeIndex resolves commits from the commit-graph falling back to parsing the
+// commit objects for commits not in the graph
+type NodeIndex struct {
+	store storer.EncodedObjectStorer
+	graph *Graph
+}
+
+// NewNodeIndex returns a node index using the commit-graph of the store if it
+// has one
+func NewNodeIndex(store storer.EncodedObjectStorer) *NodeIndex {
+	ni := &NodeIndex{store: store}
+
+	if s, ok := store.(Storer); ok {
+		g, err := s.CommitGraph()
+		if err != nil {
+			log.Printf("ERR [commit-graph] %v", err)
+		}
+		ni.graph = g
+	}
+
+	return ni
+}
+
+// Get returns the commit node for the hash.  Commits not in the graph have
+// GenerationInfinity.
+func (ni *NodeIndex) Get(h plumbing.Hash) (*Node, error) {
+	if ni.graph != nil {
+		if n, err := ni.graph.Node(h); err == nil {
+			return n, nil
+		}
+	}
+
+	c, err := object.GetCommit(ni.store, h)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Node{
+		Hash:       h,
+		Tree:       c.TreeHash,
+		Parents:    c.ParentHashes,
+		Generation: GenerationInfinity,
+		When:       c.Committer.When,
+	}, nil
+}
+
+// Peel returns the commit the hash points to following tags.  ErrInvalidType
+// is returned if the hash does not point to a commit.
+func (ni *NodeIndex) Peel(h plumbing.Hash) (plumbing.Hash, error) {
+	if ni.graph != nil && ni.graph.Contains(h) {
+		return h, nil
+	}
+
+	for {
+		obj, err := ni.store.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return h, err
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			return h, nil
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(ni.store, obj)
+			if err != nil {
+				return h, err
+			}
+			h = t.Target
+		default:
+			return h, plumbing.ErrInvalidType
+		}
+	}
+}
+
+// IsAncestor returns true if commit a is reachable from commit b.  Commits with
+// a generation lower than that of a are not walked.
+func IsAncestor(ctx context.Context, ni *NodeIndex, a, b plumbing.Hash) (bool, error) {
+	if a == b {
+		return true, nil
+	}
+
+	na, err := ni.Get(a)
+	if err != nil {
+		return false, err
+	}
+
+	var (
+		seen  = map[plumbing.Hash]bool{b: true}
+		stack = []plumbing.Hash{b}
+	)
+	for len(stack) > 0 {
+		if err = ctx.Err(); err != nil {
+			return false, err
+		}
+
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		n, err := ni.Get(h)
+		if err != nil {
+			return false, err
+		}
+		if n.Generation < na.Generation {
+			continue
+		}
+
+		for _, p := range n.Parents {
+			if p == a {
+				return true, nil
+			}
+			if !seen[p] {
+				seen[p] = true
+				stack = append(stack, p)
+			}
+		}
+	}
+
+	return false, nil
+}
+
+const (
+	flagParent1 uint8 = 1 << iota
+	flagParent2
+	flagStale
+	flagResult
+)
+
+// MergeBase returns the best common ancestors of commits a and b
+func MergeBase(ctx context.Context, ni *NodeIndex, a, b plumbing.Hash) ([]plumbing.Hash, error) {
+	if a == b {
+		return []plumbing.Hash{a}, nil
+	}
+
+	var (
+		flags = map[plumbing.Hash]uint8{}
+		queue = &nodeQueue{}
+		bases []plumbing.Hash
+		// times each commit is queued and queue entries not stale so the
+		// queue needn't be scanned each step
+		queued   = map[plumbing.Hash]int{}
+		nonStale int
+	)
+
+	push := func(h plumbing.Hash, f uint8) error {
+		n, err := ni.Get(h)
+		if err != nil {
+			return err
+		}
+		if flags[h]&flagStale == 0 && f&flagStale != 0 {
+			nonStale -= queued[h]
+		}
+		flags[h] |= f
+		if flags[h]&flagStale == 0 {
+			nonStale++
+		}
+		queued[h]++
+		heap.Push(queue, n)
+		return nil
+	}
+	if err := push(a, flagParent1); err != nil {
+		return nil, err
+	}
+	if err := push(b, flagParent2); err != nil {
+		return nil, err
+	}
+
+	// Paint down from both sides until only stale commits are left
+	for nonStale > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n := heap.Pop(queue).(*Node)
+		queued[n.Hash]--
+		if flags[n.Hash]&flagStale == 0 {
+			nonStale--
+		}
+		f := flags[n.Hash] & (flagParent1 | flagParent2 | flagStale)
+		if f == flagParent1|flagParent2 {
+			if flags[n.Hash]&flagResult == 0 {
+				flags[n.Hash] |= flagResult
+				bases = append(bases, n.Hash)
+			}
+			f |= flagStale
+		}
+
+		for _, p := range n.Parents {
+			if flags[p]&f == f {
+				continue
+			}
+			if err := push(p, f); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Drop bases reachable from other bases
+	var out []plumbing.Hash
+	for i, h := range bases {
+		redundant := false
+		for j, other := range bases {
+			if i == j {
+				continue
+			}
+			ok, err := IsAncestor(ctx, ni, h, other)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			out = append(out, h)
+		}
+	}
+
+	return out, nil
+}
+
+// nodeQueue is a priority queue of commits ordered by generation then
+// committer date, highest first
+type nodeQueue []*Node
+
+func (q nodeQueue) Len() int { return len(q) }
+
+func (q nodeQueue) Less(i, j int) bool {
+	if q[i].Generation != q[j].Generation {
+		return q[i].Generation > q[j].Generation
+	}
+	return q[i].When.After(q[j].When)
+}
+
+func (q nodeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *nodeQueue) Push(x interface{}) { *q = append(*q, x.(*Node)) }
+
+func (q *nodeQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	c := old[n-1]
+	*q = old[:n-1]
+	return c
+}
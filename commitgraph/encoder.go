@@ -0,0 +1,193 @@
+package commitgraph
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Build returns every commit reachable from the tips with its generation
+// number.  Commits already in the graph of the node index are not parsed.
+func Build(ctx context.Context, ni *NodeIndex, tips []plumbing.Hash) ([]*Node, error) {
+	var (
+		nodes = map[plumbing.Hash]*Node{}
+		stack []plumbing.Hash
+	)
+
+	for _, h := range tips {
+		c, err := ni.Peel(h)
+		if err == plumbing.ErrInvalidType {
+			// Trees and blobs have no history
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		stack = append(stack, c)
+	}
+
+	// Depth first assigning generations once all parents have one
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		h := stack[len(stack)-1]
+		n, ok := nodes[h]
+		if !ok {
+			var err error
+			if n, err = ni.Get(h); err != nil {
+				return nil, err
+			}
+			n.Generation = 0
+			nodes[h] = n
+		}
+		if n.Generation != 0 {
+			stack = stack[:len(stack)-1]
+			continue
+		}
+
+		var (
+			pending bool
+			gen     uint32
+		)
+		for _, ph := range n.Parents {
+			p, ok := nodes[ph]
+			if !ok || p.Generation == 0 {
+				stack = append(stack, ph)
+				pending = true
+			} else if p.Generation > gen {
+				gen = p.Generation
+			}
+		}
+		if pending {
+			continue
+		}
+
+		stack = stack[:len(stack)-1]
+		if n.Generation = gen + 1; n.Generation > generationMax {
+			n.Generation = generationMax
+		}
+	}
+
+	out := make([]*Node, 0, len(nodes))
+	for _, n := range nodes {
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+// Encode writes the nodes as a commit-graph file.  All parents of the nodes
+// must be included.
+func Encode(w io.Writer, nodes []*Node) error {
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].Hash[:], nodes[j].Hash[:]) < 0
+	})
+
+	pos := make(map[plumbing.Hash]uint32, len(nodes))
+	for i, n := range nodes {
+		pos[n.Hash] = uint32(i)
+	}
+	parentPos := func(h plumbing.Hash) (uint32, error) {
+		p, ok := pos[h]
+		if !ok {
+			return 0, plumbing.ErrObjectNotFound
+		}
+		return p, nil
+	}
+
+	var (
+		fanout [256]uint32
+		data   = new(bytes.Buffer)
+		edges  []uint32
+	)
+	for _, n := range nodes {
+		fanout[n.Hash[0]]++
+
+		p1, p2 := uint32(parentNone), uint32(parentNone)
+		var err error
+		if len(n.Parents) > 0 {
+			if p1, err = parentPos(n.Parents[0]); err != nil {
+				return err
+			}
+		}
+		switch {
+		case len(n.Parents) == 2:
+			if p2, err = parentPos(n.Parents[1]); err != nil {
+				return err
+			}
+		case len(n.Parents) > 2:
+			p2 = parentOctopus | uint32(len(edges))
+			for i, ph := range n.Parents[1:] {
+				e, err := parentPos(ph)
+				if err != nil {
+					return err
+				}
+				if i == len(n.Parents)-2 {
+					e |= parentLastEdge
+				}
+				edges = append(edges, e)
+			}
+		}
+
+		t := n.When.Unix()
+		data.Write(n.Tree[:])
+		binary.Write(data, binary.BigEndian, []uint32{
+			p1,
+			p2,
+			n.Generation<<2 | uint32(t>>32)&0x3,
+			uint32(t),
+		})
+	}
+	for i := 1; i < len(fanout); i++ {
+		fanout[i] += fanout[i-1]
+	}
+
+	type chunk struct {
+		id   []byte
+		size int
+	}
+	chunks := []chunk{
+		{chunkFanout, len(fanout) * 4},
+		{chunkLookup, len(nodes) * hashLen},
+		{chunkData, data.Len()},
+	}
+	if len(edges) > 0 {
+		chunks = append(chunks, chunk{chunkEdges, len(edges) * 4})
+	}
+
+	hw := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, hw))
+
+	bw.Write(graphSignature)
+	bw.Write([]byte{graphVersion, hashVersion, byte(len(chunks)), 0})
+
+	offset := uint64(headerLen + (len(chunks)+1)*chunkEntryLen)
+	for _, c := range chunks {
+		bw.Write(c.id)
+		binary.Write(bw, binary.BigEndian, offset)
+		offset += uint64(c.size)
+	}
+	bw.Write([]byte{0, 0, 0, 0})
+	binary.Write(bw, binary.BigEndian, offset)
+
+	binary.Write(bw, binary.BigEndian, fanout[:])
+	for _, n := range nodes {
+		bw.Write(n.Hash[:])
+	}
+	bw.Write(data.Bytes())
+	if len(edges) > 0 {
+		binary.Write(bw, binary.BigEndian, edges)
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(hw.Sum(nil))
+	return err
+}
@@ -0,0 +1,228 @@
+// Package commitgraph implements reading and writing of git's commit-graph file
+// along with ancestry queries that use it.
+// https://github.com/git/git/blob/master/Documentation/technical/commit-graph-format.txt
+package commitgraph
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+const (
+	graphVersion = 1
+	hashVersion  = 1
+	hashLen      = 20
+
+	headerLen     = 8
+	chunkEntryLen = 12
+	commitDataLen = hashLen + 16
+
+	parentNone     = 0x70000000
+	parentOctopus  = 0x80000000
+	parentLastEdge = 0x80000000
+
+	// GenerationInfinity is the generation of commits not in the graph
+	GenerationInfinity = 0xffffffff
+	// generationMax is the largest generation that can be stored
+	generationMax = 0x3fffffff
+)
+
+var (
+	graphSignature = []byte("CGPH")
+
+	chunkFanout = []byte("OIDF")
+	chunkLookup = []byte("OIDL")
+	chunkData   = []byte("CDAT")
+	chunkEdges  = []byte("EDGE")
+
+	// ErrInvalidGraph is returned when decoding a malformed commit-graph
+	ErrInvalidGraph = errors.New("invalid commit-graph")
+)
+
+// Node is a commit as stored in the commit-graph
+type Node struct {
+	Hash    plumbing.Hash
+	Tree    plumbing.Hash
+	Parents []plumbing.Hash
+	// Topological level, 1 for root commits
+	Generation uint32
+	// Committer time
+	When time.Time
+}
+
+// Graph is a decoded commit-graph file
+type Graph struct {
+	fanout [256]uint32
+	oids   []byte
+	data   []byte
+	edges  []byte
+}
+
+// Decode parses a commit-graph file verifying its checksum
+func Decode(b []byte) (*Graph, error) {
+	if len(b) < headerLen+chunkEntryLen+hashLen || !bytes.Equal(b[:4], graphSignature) {
+		return nil, ErrInvalidGraph
+	}
+	if b[4] != graphVersion || b[5] != hashVersion {
+		return nil, fmt.Errorf("unsupported commit-graph version: %d/%d", b[4], b[5])
+	}
+
+	sum := sha1.Sum(b[:len(b)-hashLen])
+	if !bytes.Equal(sum[:], b[len(b)-hashLen:]) {
+		return nil, ErrInvalidGraph
+	}
+
+	var (
+		g      = &Graph{}
+		chunks = int(b[6])
+		table  = b[headerLen:]
+		fanout []byte
+	)
+	if len(table) < (chunks+1)*chunkEntryLen {
+		return nil, ErrInvalidGraph
+	}
+
+	for i := 0; i < chunks; i++ {
+		id := table[i*chunkEntryLen : i*chunkEntryLen+4]
+		start := binary.BigEndian.Uint64(table[i*chunkEntryLen+4:])
+		end := binary.BigEndian.Uint64(table[(i+1)*chunkEntryLen+4:])
+		if start > end || end > uint64(len(b)-hashLen) {
+			return nil, ErrInvalidGraph
+		}
+
+		chunk := b[start:end]
+		switch {
+		case bytes.Equal(id, chunkFanout):
+			fanout = chunk
+		case bytes.Equal(id, chunkLookup):
+			g.oids = chunk
+		case bytes.Equal(id, chunkData):
+			g.data = chunk
+		case bytes.Equal(id, chunkEdges):
+			g.edges = chunk
+		}
+	}
+
+	if len(fanout) != 256*4 {
+		return nil, ErrInvalidGraph
+	}
+	for i := range g.fanout {
+		g.fanout[i] = binary.BigEndian.Uint32(fanout[i*4:])
+	}
+
+	n := int(g.fanout[255])
+	if len(g.oids) != n*hashLen || len(g.data) != n*commitDataLen {
+		return nil, ErrInvalidGraph
+	}
+
+	return g, nil
+}
+
+// Len returns the number of commits in the graph
+func (g *Graph) Len() int {
+	return int(g.fanout[255])
+}
+
+// Contains returns true if the commit is in the graph
+func (g *Graph) Contains(h plumbing.Hash) bool {
+	_, ok := g.lookup(h)
+	return ok
+}
+
+// Node returns the commit with the given hash or plumbing.ErrObjectNotFound
+func (g *Graph) Node(h plumbing.Hash) (*Node, error) {
+	pos, ok := g.lookup(h)
+	if !ok {
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return g.node(pos)
+}
+
+func (g *Graph) lookup(h plumbing.Hash) (int, bool) {
+	lo := 0
+	if h[0] > 0 {
+		lo = int(g.fanout[h[0]-1])
+	}
+	hi := int(g.fanout[h[0]])
+
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch c := bytes.Compare(g.oids[mid*hashLen:(mid+1)*hashLen], h[:]); {
+		case c == 0:
+			return mid, true
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+func (g *Graph) hashAt(pos uint32) (plumbing.Hash, error) {
+	var h plumbing.Hash
+	if int(pos) >= g.Len() {
+		return h, ErrInvalidGraph
+	}
+	copy(h[:], g.oids[int(pos)*hashLen:])
+	return h, nil
+}
+
+func (g *Graph) node(pos int) (*Node, error) {
+	d := g.data[pos*commitDataLen : (pos+1)*commitDataLen]
+
+	n := &Node{}
+	copy(n.Hash[:], g.oids[pos*hashLen:])
+	copy(n.Tree[:], d)
+
+	p1 := binary.BigEndian.Uint32(d[hashLen:])
+	p2 := binary.BigEndian.Uint32(d[hashLen+4:])
+	genTime := binary.BigEndian.Uint32(d[hashLen+8:])
+	timeLo := binary.BigEndian.Uint32(d[hashLen+12:])
+
+	n.Generation = genTime >> 2
+	n.When = time.Unix(int64(genTime&0x3)<<32|int64(timeLo), 0)
+
+	if p1 != parentNone {
+		h, err := g.hashAt(p1)
+		if err != nil {
+			return nil, err
+		}
+		n.Parents = append(n.Parents, h)
+	}
+
+	switch {
+	case p2 == parentNone:
+
+	case p2&parentOctopus != 0:
+		for i := int(p2 &^ parentOctopus); ; i++ {
+			if (i+1)*4 > len(g.edges) {
+				return nil, ErrInvalidGraph
+			}
+			e := binary.BigEndian.Uint32(g.edges[i*4:])
+			h, err := g.hashAt(e &^ parentLastEdge)
+			if err != nil {
+				return nil, err
+			}
+			n.Parents = append(n.Parents, h)
+			if e&parentLastEdge != 0 {
+				break
+			}
+		}
+
+	default:
+		h, err := g.hashAt(p2)
+		if err != nil {
+			return nil, err
+		}
+		n.Parents = append(n.Parents, h)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,113 @@
+package commitgraph
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testCommit(t *testing.T, st *memory.Storage, when int64, parents ...plumbing.Hash) plumbing.Hash {
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(when, 0)}
+	c := &object.Commit{Author: sig, Committer: sig, Message: "test", ParentHashes: parents}
+
+	obj := st.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+type graphStore struct {
+	*memory.Storage
+	graph *Graph
+}
+
+func (s *graphStore) CommitGraph() (*Graph, error) { return s.graph, nil }
+
+func TestGraph(t *testing.T) {
+	st := memory.NewStorage()
+
+	// root <- a <- b, root <- c, octopus(b, c, a), d with no graph
+	root := testCommit(t, st, 1)
+	a := testCommit(t, st, 2, root)
+	b := testCommit(t, st, 3, a)
+	c := testCommit(t, st, 4, root)
+	oct := testCommit(t, st, 5, b, c, a)
+
+	nodes, err := Build(context.Background(), NewNodeIndex(st), []plumbing.Hash{oct})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = Encode(buf, nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := Decode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Len() != 5 {
+		t.Fatalf("expected 5 commits, got %d", g.Len())
+	}
+
+	n, err := g.Node(oct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Generation != 4 || !reflect.DeepEqual(n.Parents, []plumbing.Hash{b, c, a}) || n.When.Unix() != 5 {
+		t.Errorf("unexpected node: %+v", n)
+	}
+
+	d := testCommit(t, st, 6, c)
+	ni := NewNodeIndex(&graphStore{Storage: st, graph: g})
+
+	var ancestorCases = []struct {
+		a, b plumbing.Hash
+		ok   bool
+	}{
+		{root, oct, true},
+		{a, b, true},
+		{b, c, false},
+		{c, d, true},
+		{d, oct, false},
+		{oct, root, false},
+	}
+	for i, tt := range ancestorCases {
+		ok, err := IsAncestor(context.Background(), ni, tt.a, tt.b)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		} else if ok != tt.ok {
+			t.Errorf("%d: expected %v, got %v", i, tt.ok, ok)
+		}
+	}
+
+	var mergeBaseCases = []struct {
+		a, b plumbing.Hash
+		base []plumbing.Hash
+	}{
+		{b, c, []plumbing.Hash{root}},
+		{b, d, []plumbing.Hash{root}},
+		{oct, d, []plumbing.Hash{c}},
+		{a, b, []plumbing.Hash{a}},
+	}
+	for i, tt := range mergeBaseCases {
+		base, err := MergeBase(context.Background(), ni, tt.a, tt.b)
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(base, tt.base) {
+			t.Errorf("%d: expected %v, got %v", i, tt.base, base)
+		}
+	}
+}
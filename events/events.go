@@ -0,0 +1,55 @@
+// Package events publishes server events to external systems
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event is something that happened to a repo
+type Event struct {
+	Type string      `json:"type"`
+	Repo string      `json:"repo"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+// Sink receives events.  Publish must not block.
+type Sink interface {
+	Publish(*Event)
+}
+
+// Webhook posts events as json to a url
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook instantiates a webhook posting to url
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Publish posts the event in the background.  Failures are logged.
+func (wh *Webhook) Publish(ev *Event) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("ERR [events] %s %v", ev.Type, err)
+		return
+	}
+
+	go func() {
+		resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(b))
+		if err != nil {
+			log.Printf("ERR [events] %s %v", ev.Type, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("ERR [events] %s webhook status=%d", ev.Type, resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,289 @@
+// Package packcache implements a size bounded on-disk cache of generated packs
+// so identical upload-pack requests only build a pack once.
+package packcache
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// Cache is an LRU cache of packs stored on disk.  A pack being built is
+// streamed to all requests for it as it is written.
+type Cache struct {
+	dir     string
+	maxSize int64
+	// builds are cancelled once done
+	ctx context.Context
+
+	mu sync.Mutex
+	// bytes written by completed and in-progress builds
+	size int64
+	// front is the most recently used
+	lru     *list.List
+	entries map[string]*entry
+	// generation per repo, bumped on ref changes
+	gens map[string]uint64
+}
+
+// New returns a cache storing packs in dir up to maxSize bytes in total.  Any
+// packs left in dir from a previous run are removed.  Builds are cancelled
+// when ctx is done e.g. on shutdown.
+func New(ctx context.Context, dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	old, err := filepath.Glob(filepath.Join(dir, "*.pack"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range old {
+		os.Remove(p)
+	}
+
+	return &Cache{
+		dir:     dir,
+		maxSize: maxSize,
+		ctx:     ctx,
+		lru:     list.New(),
+		entries: map[string]*entry{},
+		gens:    map[string]uint64{},
+	}, nil
+}
+
+// Key returns the cache key for an upload-pack request.  The order of wants,
+// haves and capabilities does not matter.
+func Key(repo string, wants, haves []plumbing.Hash, filter string, caps []string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00", repo, filter)
+
+	for _, hashes := range [][]plumbing.Hash{wants, haves} {
+		ids := make([]string, len(hashes))
+		for i, x := range hashes {
+			ids[i] = x.String()
+		}
+		sort.Strings(ids)
+		fmt.Fprintf(h, "%s\x00", strings.Join(ids, " "))
+	}
+
+	c := append([]string{}, caps...)
+	sort.Strings(c)
+	fmt.Fprintf(h, "%s", strings.Join(c, " "))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Serve writes the pack for key to w returning its checksum.  If the pack is
+// not cached build is called once to write it, regardless of how many
+// requests are waiting on it.  The build runs to completion even if the
+// requests waiting on it go away, unless the cache context is done.
+func (c *Cache) Serve(key, repo string, w io.Writer, build func(context.Context, io.Writer) ([]byte, error)) ([]byte, error) {
+	c.mu.Lock()
+	key = fmt.Sprintf("%s-%d", key, c.gens[repo])
+
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e.elem)
+	} else {
+		var err error
+		if e, err = c.add(key, repo); err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		go c.build(e, build)
+	}
+
+	// Open while locked so the entry cannot be evicted before we read
+	f, err := os.Open(e.path)
+	if err != nil {
+		c.mu.Unlock()
+		return nil, err
+	}
+	e.readers++
+	c.mu.Unlock()
+
+	defer func() {
+		f.Close()
+		c.mu.Lock()
+		e.readers--
+		c.evict()
+		c.mu.Unlock()
+	}()
+
+	if ok {
+		log.Printf("DBG [pack-cache] hit repo=%s key=%s", repo, key)
+	}
+	return e.copyTo(w, f)
+}
+
+// Invalidate drops all cached packs for the repo.  It should be called
+// whenever the repo refs change.
+func (c *Cache) Invalidate(repo string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gens[repo]++
+	for _, e := range c.entries {
+		if e.repo == repo {
+			c.remove(e)
+		}
+	}
+}
+
+// add creates a new entry.  Must be called with the lock held.
+func (c *Cache) add(key, repo string) (*entry, error) {
+	f, err := ioutil.TempFile(c.dir, "*.pack")
+	if err != nil {
+		return nil, err
+	}
+
+	e := &entry{cache: c, key: key, repo: repo, path: f.Name(), f: f}
+	e.cond = sync.NewCond(&e.mu)
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	return e, nil
+}
+
+func (c *Cache) build(e *entry, build func(context.Context, io.Writer) ([]byte, error)) {
+	checksum, err := build(c.ctx, e)
+	if er := e.f.Close(); err == nil {
+		err = er
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.finish(checksum, err)
+
+	if err != nil {
+		log.Printf("ERR [pack-cache] repo=%s %v", e.repo, err)
+		c.remove(e)
+		return
+	}
+	c.evict()
+}
+
+// evict removes least recently used completed entries not being read until
+// the cache is within its size limit.  Must be called with the lock held.
+func (c *Cache) evict() {
+	for el := c.lru.Back(); el != nil && c.size > c.maxSize; {
+		e := el.Value.(*entry)
+		el = el.Prev()
+		if e.readers == 0 && e.isDone() {
+			c.remove(e)
+		}
+	}
+}
+
+// remove deletes the entry and its file.  Readers with the file open can
+// still finish.  Must be called with the lock held.
+func (c *Cache) remove(e *entry) {
+	if e.removed {
+		return
+	}
+	e.removed = true
+
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	e.mu.Lock()
+	c.size -= e.written
+	e.mu.Unlock()
+	os.Remove(e.path)
+}
+
+// entry is a cached pack.  It is written by a single builder while any number
+// of readers follow along.
+type entry struct {
+	cache *Cache
+	key   string
+	repo  string
+	path  string
+	f     *os.File
+	elem  *list.Element
+
+	// guarded by the cache lock
+	readers int
+	removed bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	written  int64
+	done     bool
+	err      error
+	checksum []byte
+}
+
+// Write implements io.Writer for the builder.  The bytes written count
+// against the cache size as they are written so concurrent builds can't
+// exceed it.
+func (e *entry) Write(p []byte) (int, error) {
+	n, err := e.f.Write(p)
+
+	c := e.cache
+	c.mu.Lock()
+	e.mu.Lock()
+	e.written += int64(n)
+	e.mu.Unlock()
+	if !e.removed {
+		c.size += int64(n)
+		c.evict()
+	}
+	c.mu.Unlock()
+	e.cond.Broadcast()
+
+	return n, err
+}
+
+func (e *entry) finish(checksum []byte, err error) {
+	e.mu.Lock()
+	e.done, e.err, e.checksum = true, err, checksum
+	e.mu.Unlock()
+	e.cond.Broadcast()
+}
+
+func (e *entry) isDone() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.done
+}
+
+// copyTo copies the pack from f to w as it is written
+func (e *entry) copyTo(w io.Writer, f *os.File) ([]byte, error) {
+	var off int64
+	for {
+		e.mu.Lock()
+		for off == e.written && !e.done {
+			e.cond.Wait()
+		}
+		written, done, err := e.written, e.done, e.err
+		e.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if off < written {
+			n, err := io.Copy(w, io.NewSectionReader(f, off, written-off))
+			off += n
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if done && off == written {
+			return e.checksum, nil
+		}
+	}
+}
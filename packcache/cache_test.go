@@ -0,0 +1,147 @@
+package packcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func testCache(t *testing.T, max int64) *Cache {
+	dir, err := ioutil.TempDir("", "packcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(context.Background(), dir, max)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCacheServe(t *testing.T) {
+	c := testCache(t, 1<<20)
+	defer os.RemoveAll(c.dir)
+
+	var (
+		builds  int32
+		release = make(chan struct{})
+		data    = bytes.Repeat([]byte("pack"), 4096)
+	)
+	build := func(_ context.Context, w io.Writer) ([]byte, error) {
+		atomic.AddInt32(&builds, 1)
+		w.Write(data[:100])
+		<-release
+		w.Write(data[100:])
+		return []byte("sum"), nil
+	}
+
+	key := Key("ns/repo", []plumbing.Hash{plumbing.NewHash("01")}, nil, "", []string{"b", "a"})
+	if key != Key("ns/repo", []plumbing.Hash{plumbing.NewHash("01")}, nil, "", []string{"a", "b"}) {
+		t.Fatal("key should not depend on capability order")
+	}
+
+	var (
+		wg   sync.WaitGroup
+		outs = make([]bytes.Buffer, 8)
+	)
+	for i := range outs {
+		wg.Add(1)
+		go func(buf *bytes.Buffer) {
+			defer wg.Done()
+			sum, err := c.Serve(key, "ns/repo", buf, build)
+			if err != nil || string(sum) != "sum" {
+				t.Error(sum, err)
+			}
+		}(&outs[i])
+	}
+	close(release)
+	wg.Wait()
+
+	if builds != 1 {
+		t.Fatalf("builds: have=%d want=1", builds)
+	}
+	for i := range outs {
+		if !bytes.Equal(outs[i].Bytes(), data) {
+			t.Fatalf("reader %d got %d bytes", i, outs[i].Len())
+		}
+	}
+
+	// Cached
+	if _, err := c.Serve(key, "ns/repo", ioutil.Discard, build); err != nil || builds != 1 {
+		t.Fatal("expected cache hit", builds, err)
+	}
+
+	// Ref change
+	c.Invalidate("ns/repo")
+	if _, err := c.Serve(key, "ns/repo", ioutil.Discard, build); err != nil || builds != 2 {
+		t.Fatal("expected rebuild after invalidate", builds, err)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	c := testCache(t, 100)
+	defer os.RemoveAll(c.dir)
+
+	build := func(_ context.Context, w io.Writer) ([]byte, error) {
+		_, err := w.Write(make([]byte, 60))
+		return nil, err
+	}
+
+	for _, key := range []string{"a", "b", "a"} {
+		if _, err := c.Serve(key, "repo", ioutil.Discard, build); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(c.entries) != 1 || c.size != 60 {
+		t.Fatalf("entries=%d size=%d", len(c.entries), c.size)
+	}
+	files, _ := ioutil.ReadDir(c.dir)
+	if len(files) != 1 {
+		t.Fatalf("files: have=%d want=1", len(files))
+	}
+}
+
+func TestCacheEvictWhileBuilding(t *testing.T) {
+	c := testCache(t, 100)
+	defer os.RemoveAll(c.dir)
+
+	if _, err := c.Serve("a", "repo", ioutil.Discard, func(_ context.Context, w io.Writer) ([]byte, error) {
+		_, err := w.Write(make([]byte, 60))
+		return nil, err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	written, release := make(chan struct{}), make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := c.Serve("b", "repo", ioutil.Discard, func(_ context.Context, w io.Writer) ([]byte, error) {
+			_, err := w.Write(make([]byte, 60))
+			close(written)
+			<-release
+			return nil, err
+		})
+		done <- err
+	}()
+
+	// The pack being built counts so the completed one is evicted
+	<-written
+	c.mu.Lock()
+	n, size := len(c.entries), c.size
+	c.mu.Unlock()
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || size != 60 {
+		t.Fatalf("entries=%d size=%d", n, size)
+	}
+}
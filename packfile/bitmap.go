@@ -0,0 +1,509 @@
+package packfile
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/commitgraph"
+)
+
+const (
+	bitmapVersion = 1
+	// Bitmaps contain the full closure of each selected commit
+	bitmapOptFullDAG = 0x1
+	// Every nth commit in recency order gets a bitmap in addition to the tips
+	bitmapInterval = 100
+)
+
+var (
+	bitmapSignature = []byte("BITM")
+
+	// ErrBitmapMismatch is returned when the bitmap does not belong to the pack
+	ErrBitmapMismatch = errors.New("bitmap does not match pack")
+
+	errNotInPack = errors.New("object not in bitmapped pack")
+)
+
+// BitmapStorer is an optional interface for object stores that can provide a
+// reachability bitmap index for their objects.
+type BitmapStorer interface {
+	// BitmapIndex returns the bitmap index or nil if there is none
+	BitmapIndex() (*BitmapIndex, error)
+}
+
+// BitmapIndex is a git compatible reachability bitmap index for a single pack.
+// Bit positions are the object positions in the pack ordered by offset.
+type BitmapIndex struct {
+	// checksum of the pack the bitmaps belong to
+	checksum plumbing.Hash
+	// object hashes in pack order
+	objects []plumbing.Hash
+	// pack order position of each object
+	positions map[plumbing.Hash]uint32
+	// hashes in idx i.e. sorted order
+	sorted []plumbing.Hash
+	// type bitmaps for commits, trees, blobs and tags
+	types [4]bitset
+	// reachability bitmaps of the selected commits
+	bitmaps map[plumbing.Hash]bitset
+}
+
+// bitmap file type bitmap order
+var bitmapTypes = [4]plumbing.ObjectType{
+	plumbing.CommitObject,
+	plumbing.TreeObject,
+	plumbing.BlobObject,
+	plumbing.TagObject,
+}
+
+// NewBitmapIndex instantiates an empty bitmap index for the pack described by
+// the given idx.
+func NewBitmapIndex(idx *idxfile.MemoryIndex) (*BitmapIndex, error) {
+	count, err := idx.Count()
+	if err != nil {
+		return nil, err
+	}
+
+	bi := &BitmapIndex{
+		checksum:  plumbing.Hash(idx.PackfileChecksum),
+		objects:   make([]plumbing.Hash, 0, count),
+		positions: make(map[plumbing.Hash]uint32, count),
+		sorted:    make([]plumbing.Hash, 0, count),
+		bitmaps:   map[plumbing.Hash]bitset{},
+	}
+
+	iter, err := idx.Entries()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	var entries []*idxfile.Entry
+	for {
+		e, err := iter.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		bi.sorted = append(bi.sorted, e.Hash)
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	for i, e := range entries {
+		bi.objects = append(bi.objects, e.Hash)
+		bi.positions[e.Hash] = uint32(i)
+	}
+
+	for i := range bi.types {
+		bi.types[i] = newBitset(len(bi.objects))
+	}
+
+	return bi, nil
+}
+
+// Checksum returns the checksum of the pack the index belongs to
+func (bi *BitmapIndex) Checksum() plumbing.Hash {
+	return bi.checksum
+}
+
+// Contains returns true if the object is in the pack
+func (bi *BitmapIndex) Contains(h plumbing.Hash) bool {
+	_, ok := bi.positions[h]
+	return ok
+}
+
+// Commits returns the commits with a reachability bitmap.  Together they reach
+// every object of the pack reachable from its tips.
+func (bi *BitmapIndex) Commits() []plumbing.Hash {
+	commits := make([]plumbing.Hash, 0, len(bi.bitmaps))
+	for h := range bi.bitmaps {
+		commits = append(commits, h)
+	}
+	sort.Slice(commits, func(i, j int) bool {
+		return bytes.Compare(commits[i][:], commits[j][:]) < 0
+	})
+	return commits
+}
+
+// Build computes the type bitmaps and the reachability bitmaps for the tips
+// and a selection of their history.  The pack must contain every object
+// reachable from the tips.
+func (bi *BitmapIndex) Build(ctx context.Context, store storer.EncodedObjectStorer, tips []plumbing.Hash) error {
+	var commits []plumbing.Hash
+	err := NewObjectWalker(store).Walk(ctx, tips, func(e WalkEntry) error {
+		pos, ok := bi.positions[e.Hash]
+		if !ok {
+			return errNotInPack
+		}
+		bi.types[typeIndex(e.Type)].set(pos)
+		if e.Type == plumbing.CommitObject {
+			commits = append(commits, e.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Type the unreachable objects the walk did not visit
+	for i, h := range bi.objects {
+		if bi.typeAt(uint32(i)) != plumbing.InvalidObject {
+			continue
+		}
+		obj, err := store.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return err
+		}
+		bi.types[typeIndex(obj.Type())].set(uint32(i))
+	}
+
+	var (
+		nodes    = commitgraph.NewNodeIndex(store)
+		selected = map[plumbing.Hash]bool{}
+	)
+	for _, h := range tips {
+		if c, err := nodes.Peel(h); err == nil {
+			selected[c] = true
+		}
+	}
+	for i := 0; i < len(commits); i += bitmapInterval {
+		selected[commits[i]] = true
+	}
+
+	// Oldest first so newer bitmaps can reuse older ones
+	for i := len(commits) - 1; i >= 0; i-- {
+		if !selected[commits[i]] {
+			continue
+		}
+		bm, err := bi.reachable(ctx, store, []plumbing.Hash{commits[i]})
+		if err != nil {
+			return err
+		}
+		bi.bitmaps[commits[i]] = bm
+	}
+
+	return nil
+}
+
+// Encode writes the bitmap index in the git .bitmap format
+func (bi *BitmapIndex) Encode(w io.Writer) error {
+	hw := sha1.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, hw))
+
+	selected := make([]plumbing.Hash, 0, len(bi.bitmaps))
+	for h := range bi.bitmaps {
+		selected = append(selected, h)
+	}
+	sort.Slice(selected, func(i, j int) bool {
+		return bytes.Compare(selected[i][:], selected[j][:]) < 0
+	})
+
+	bw.Write(bitmapSignature)
+	binary.Write(bw, binary.BigEndian, []uint16{bitmapVersion, bitmapOptFullDAG})
+	binary.Write(bw, binary.BigEndian, uint32(len(selected)))
+	bw.Write(bi.checksum[:])
+
+	for _, t := range bi.types {
+		if err := encodeEWAH(bw, t); err != nil {
+			return err
+		}
+	}
+
+	for _, h := range selected {
+		i := sort.Search(len(bi.sorted), func(i int) bool {
+			return bytes.Compare(bi.sorted[i][:], h[:]) >= 0
+		})
+		// idx position, no xor base, no flags
+		binary.Write(bw, binary.BigEndian, uint32(i))
+		bw.Write([]byte{0, 0})
+		if err := encodeEWAH(bw, bi.bitmaps[h]); err != nil {
+			return err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(hw.Sum(nil))
+	return err
+}
+
+// Decode reads a git .bitmap file into the index
+func (bi *BitmapIndex) Decode(r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	sig := make([]byte, 4)
+	if _, err := io.ReadFull(br, sig); err != nil {
+		return err
+	}
+	if !bytes.Equal(sig, bitmapSignature) {
+		return fmt.Errorf("invalid bitmap signature: %q", sig)
+	}
+
+	var hdr struct {
+		Version  uint16
+		Options  uint16
+		Count    uint32
+		Checksum plumbing.Hash
+	}
+	if err := binary.Read(br, binary.BigEndian, &hdr); err != nil {
+		return err
+	}
+	if hdr.Version != bitmapVersion {
+		return fmt.Errorf("unsupported bitmap version: %d", hdr.Version)
+	}
+	if hdr.Checksum != bi.checksum {
+		return ErrBitmapMismatch
+	}
+
+	n := len(bi.objects)
+	for i := range bi.types {
+		t, err := decodeEWAH(br)
+		if err != nil {
+			return err
+		}
+		bi.types[i] = resize(t, n)
+	}
+
+	entries := make([]bitset, hdr.Count)
+	for i := range entries {
+		var ent struct {
+			Pos   uint32
+			XOR   uint8
+			Flags uint8
+		}
+		if err := binary.Read(br, binary.BigEndian, &ent); err != nil {
+			return err
+		}
+		if int(ent.Pos) >= len(bi.sorted) || int(ent.XOR) > i {
+			return fmt.Errorf("invalid bitmap entry: %d", i)
+		}
+
+		bm, err := decodeEWAH(br)
+		if err != nil {
+			return err
+		}
+		bm = resize(bm, n)
+		if ent.XOR > 0 {
+			bm.xor(entries[i-int(ent.XOR)])
+		}
+		entries[i] = bm
+		bi.bitmaps[bi.sorted[ent.Pos]] = bm
+	}
+
+	return nil
+}
+
+// Objects returns the entries reachable from wants but not from haves, those
+// in the pack in pack order.  Haves not in the store are ignored.  Commits and
+// tags written since the pack e.g. by pushes are walked until commits in the
+// pack whose objects are then counted with the bitmaps.
+func (bi *BitmapIndex) Objects(ctx context.Context, store storer.EncodedObjectStorer, wants, haves []plumbing.Hash) ([]WalkEntry, error) {
+	packed, unpacked, err := bi.boundary(store, wants)
+	if err != nil {
+		return nil, err
+	}
+	result, err := bi.reachable(ctx, store, packed)
+	if err != nil {
+		return nil, err
+	}
+
+	var known []plumbing.Hash
+	for _, h := range haves {
+		if store.HasEncodedObject(h) == nil {
+			known = append(known, h)
+		}
+	}
+	packedHaves, _, err := bi.boundary(store, known)
+	if err != nil {
+		return nil, err
+	}
+	hidden, err := bi.reachable(ctx, store, packedHaves)
+	if err != nil {
+		return nil, err
+	}
+	result.andNot(hidden)
+
+	var out []WalkEntry
+	result.forEach(func(pos uint32) {
+		out = append(out, WalkEntry{Hash: bi.objects[pos], Type: bi.typeAt(pos)})
+	})
+	if !unpacked {
+		return out, nil
+	}
+
+	// Objects of the unpacked commits not reachable from the packed ones
+	ow := NewObjectWalker(store)
+	ow.Hide(append(packed, known...)...)
+	err = ow.Walk(ctx, wants, func(e WalkEntry) error {
+		if pos, ok := bi.positions[e.Hash]; !ok || !result.has(pos) {
+			out = append(out, e)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// boundary returns the hashes in the pack reachable from the hashes through
+// commits and tags that are not.  unpacked is true if there were any.
+func (bi *BitmapIndex) boundary(store storer.EncodedObjectStorer, hashes []plumbing.Hash) (packed []plumbing.Hash, unpacked bool, err error) {
+	var (
+		stack = append([]plumbing.Hash{}, hashes...)
+		seen  = map[plumbing.Hash]bool{}
+	)
+	for len(stack) > 0 {
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+
+		if _, ok := bi.positions[h]; ok {
+			packed = append(packed, h)
+			continue
+		}
+		unpacked = true
+
+		obj, err := store.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, false, err
+		}
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			c, err := object.DecodeCommit(store, obj)
+			if err != nil {
+				return nil, false, err
+			}
+			stack = append(stack, c.ParentHashes...)
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(store, obj)
+			if err != nil {
+				return nil, false, err
+			}
+			stack = append(stack, t.Target)
+		}
+	}
+	return packed, unpacked, nil
+}
+
+// reachable returns the bitmap of all objects reachable from the hashes.  The
+// walk stops at commits that already have a bitmap.
+func (bi *BitmapIndex) reachable(ctx context.Context, store storer.EncodedObjectStorer, hashes []plumbing.Hash) (bitset, error) {
+	var (
+		nodes  = commitgraph.NewNodeIndex(store)
+		result = newBitset(len(bi.objects))
+	)
+	stack := append([]plumbing.Hash{}, hashes...)
+
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		h := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		pos, ok := bi.positions[h]
+		if !ok {
+			return nil, errNotInPack
+		}
+		if result.has(pos) {
+			continue
+		}
+		if bm, ok := bi.bitmaps[h]; ok {
+			result.or(bm)
+			continue
+		}
+		result.set(pos)
+
+		switch bi.typeAt(pos) {
+		case plumbing.BlobObject:
+			continue
+
+		case plumbing.CommitObject:
+			n, err := nodes.Get(h)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, n.Tree)
+			stack = append(stack, n.Parents...)
+			continue
+		}
+
+		obj, err := store.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+
+		switch obj.Type() {
+		case plumbing.TagObject:
+			t, err := object.DecodeTag(store, obj)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, t.Target)
+
+		case plumbing.TreeObject:
+			t := &object.Tree{}
+			if err = t.Decode(obj); err != nil {
+				return nil, err
+			}
+			for _, e := range t.Entries {
+				switch e.Mode {
+				case filemode.Submodule:
+				case filemode.Dir:
+					stack = append(stack, e.Hash)
+				default:
+					bp, ok := bi.positions[e.Hash]
+					if !ok {
+						return nil, errNotInPack
+					}
+					result.set(bp)
+				}
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (bi *BitmapIndex) typeAt(pos uint32) plumbing.ObjectType {
+	for i, t := range bi.types {
+		if t.has(pos) {
+			return bitmapTypes[i]
+		}
+	}
+	return plumbing.InvalidObject
+}
+
+func typeIndex(t plumbing.ObjectType) int {
+	for i, bt := range bitmapTypes {
+		if bt == t {
+			return i
+		}
+	}
+	return 0
+}
+
+// resize pads or truncates the bitset to hold n bits
+func resize(b bitset, n int) bitset {
+	out := newBitset(n)
+	copy(out, b)
+	return out
+}
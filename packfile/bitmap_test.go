@@ -0,0 +1,118 @@
+package packfile
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestEWAH(t *testing.T) {
+	var testCases = []bitset{
+		{},
+		{0},
+		{^uint64(0), ^uint64(0), 0, 0, 5},
+		{1, 2, 3, 0, 0, 0, ^uint64(0), 7},
+	}
+
+	for _, tt := range testCases {
+		buf := new(bytes.Buffer)
+		if err := encodeEWAH(buf, tt); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := decodeEWAH(buf)
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt, err)
+		} else if !reflect.DeepEqual(resize(out, len(tt)*64), resize(tt, len(tt)*64)) {
+			t.Errorf("expected %v, got %v", tt, out)
+		}
+	}
+}
+
+func testPackIndex(t *testing.T, st *memory.Storage, tips []plumbing.Hash) *idxfile.MemoryIndex {
+	buf := new(bytes.Buffer)
+	if _, err := NewEncoder(buf, st).Encode(context.Background(), tips, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	w := new(idxfile.Writer)
+	p, err := packfile.NewParser(packfile.NewScanner(bytes.NewReader(buf.Bytes())), w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := w.Index()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestBitmapIndex(t *testing.T) {
+	st, base, merge := testHistory(t)
+	idx := testPackIndex(t, st, []plumbing.Hash{merge})
+
+	bi, err := NewBitmapIndex(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = bi.Build(context.Background(), st, []plumbing.Hash{merge}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err = bi.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, _ := NewBitmapIndex(idx)
+	if err = decoded.Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(bi.bitmaps, decoded.bitmaps) || !reflect.DeepEqual(bi.types, decoded.types) {
+		t.Fatal("decoded bitmaps do not match")
+	}
+
+	var testCases = []struct {
+		desc  string
+		haves []plumbing.Hash
+		count int
+	}{
+		{desc: "clone", count: 11},
+		{desc: "fetch", haves: []plumbing.Hash{base}, count: 7},
+		{desc: "up to date", haves: []plumbing.Hash{merge}, count: 0},
+	}
+
+	for _, tt := range testCases {
+		out, err := decoded.Objects(context.Background(), st, []plumbing.Hash{merge}, tt.haves)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+		} else if len(out) != tt.count {
+			t.Errorf("%s: expected %d objects, got %d", tt.desc, tt.count, len(out))
+		}
+	}
+
+	// Commits pushed since the pack was written are walked
+	tree := testTree(t, st, object.TreeEntry{Name: "new", Mode: filemode.Regular, Hash: testBlob(t, st, "new")})
+	other := testCommit(t, st, tree, 5, merge)
+	for _, tt := range []struct {
+		haves []plumbing.Hash
+		count int
+	}{{nil, 14}, {[]plumbing.Hash{merge}, 3}, {[]plumbing.Hash{other}, 0}} {
+		out, err := decoded.Objects(context.Background(), st, []plumbing.Hash{other}, tt.haves)
+		if err != nil || len(out) != tt.count {
+			t.Errorf("haves=%v: expected %d objects, got %d %v", tt.haves, tt.count, len(out), err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package packfile
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"strconv"
+
+	"github.com/pjbgf/sha1cd"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+var (
+	// ErrSHA1Collision is returned for objects or packs whose SHA-1 shows the
+	// disturbance patterns of a known collision attack
+	ErrSHA1Collision = errors.New("sha1 collision attack detected")
+	// ErrBadChecksum is returned when the pack trailer does not match its
+	// contents
+	ErrBadChecksum = errors.New("pack checksum mismatch")
+)
+
+// objectHash returns the object id computed with SHA-1 collision detection
+func objectHash(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	var h plumbing.Hash
+
+	r, err := obj.Reader()
+	if err != nil {
+		return h, err
+	}
+	defer r.Close()
+
+	hw := sha1cd.New().(sha1cd.CollisionResistantHash)
+	hw.Write(obj.Type().Bytes())
+	hw.Write([]byte(" " + strconv.FormatInt(obj.Size(), 10) + "\x00"))
+	if _, err = io.Copy(hw, r); err != nil {
+		return h, err
+	}
+
+	sum, collision := hw.CollisionResistantSum(nil)
+	copy(h[:], sum)
+	if collision {
+		return h, ErrSHA1Collision
+	}
+	return h, nil
+}
+
+// packHasher hashes a pack as it is read holding back the last 20 bytes seen
+// which are the trailer once the pack is fully read
+type packHasher struct {
+	r    io.Reader
+	hash hash.Hash
+	tail []byte
+}
+
+func newPackHasher(r io.Reader) *packHasher {
+	return &packHasher{r: r, hash: sha1cd.New()}
+}
+
+func (ph *packHasher) Read(p []byte) (int, error) {
+	n, err := ph.r.Read(p)
+
+	ph.tail = append(ph.tail, p[:n]...)
+	if over := len(ph.tail) - sha1cd.Size; over > 0 {
+		ph.hash.Write(ph.tail[:over])
+		ph.tail = append(ph.tail[:0], ph.tail[over:]...)
+	}
+
+	return n, err
+}
+
+// verify checks the trailer read by the scanner matches the hash of what
+// preceded it.  It must be called once the input has been read to the end.
+func (ph *packHasher) verify(trailer plumbing.Hash) error {
+	sum, collision := ph.hash.(sha1cd.CollisionResistantHash).CollisionResistantSum(nil)
+	if collision {
+		return ErrSHA1Collision
+	}
+	if !bytes.Equal(sum, trailer[:]) || !bytes.Equal(ph.tail, trailer[:]) {
+		return ErrBadChecksum
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package packfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+func testPackHasher(t *testing.T, data []byte, trailer plumbing.Hash) error {
+	ph := newPackHasher(bytes.NewReader(append(append([]byte{}, data...), trailer[:]...)))
+	if _, err := io.Copy(ioutil.Discard, ph); err != nil {
+		t.Fatal(err)
+	}
+	return ph.verify(trailer)
+}
+
+func TestPackHasher(t *testing.T) {
+	data := bytes.Repeat([]byte("PACK"), 5000)
+	if err := testPackHasher(t, data, plumbing.Hash(sha1.Sum(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err := testPackHasher(t, data, plumbing.ZeroHash); err != ErrBadChecksum {
+		t.Fatalf("have=%v want=%v", err, ErrBadChecksum)
+	}
+
+	// Chosen-prefix collision from https://sha-mbles.github.io
+	shambles, err := ioutil.ReadFile("testdata/sha-mbles-1.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testPackHasher(t, shambles, plumbing.Hash(sha1.Sum(shambles))); err != ErrSHA1Collision {
+		t.Fatalf("have=%v want=%v", err, ErrSHA1Collision)
+	}
+}
+
+func TestObjectHash(t *testing.T) {
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.BlobObject)
+	obj.Write([]byte("hello\n"))
+
+	h, err := objectHash(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != obj.Hash() {
+		t.Fatalf("have=%s want=%s", h, obj.Hash())
+	}
+}
@@ -13,21 +13,44 @@ import (
 
 type Decoder struct {
 	scanner *packfile.Scanner
+	hasher  *packHasher
+	limits  Limits
+	size    *limitReader
 	store   storer.EncodedObjectStorer
 	// packfile offset to object map
 	objmap map[int64]plumbing.EncodedObject
 }
 
 func NewDecoder(rd io.Reader, store storer.EncodedObjectStorer) *Decoder {
+	size := &limitReader{r: rd}
+	hasher := newPackHasher(size)
 	return &Decoder{
-		scanner: packfile.NewScanner(rd),
+		scanner: packfile.NewScanner(hasher),
+		hasher:  hasher,
+		size:    size,
 		store:   store,
 		objmap:  map[int64]plumbing.EncodedObject{},
 	}
 }
 
+// SetLimits sets the limits checked as the pack is read so oversize packs
+// fail before they are buffered
+func (dec *Decoder) SetLimits(limits Limits) {
+	dec.limits = limits
+	dec.size.max = limits.MaxPackSize
+}
+
 // Decode from reader and write to object storage
 func (dec *Decoder) Decode() error {
+	err := dec.decode()
+	if dec.size.err != nil {
+		// The scanner may have wrapped it
+		err = dec.size.err
+	}
+	return err
+}
+
+func (dec *Decoder) decode() error {
 
 	defer dec.scanner.Close()
 
@@ -38,6 +61,10 @@ func (dec *Decoder) Decode() error {
 
 	log.Printf("DBG [packfile] version=%d objects=%d", version, objcount)
 
+	if max := dec.limits.MaxObjects; max > 0 && int64(objcount) > max {
+		return &LimitError{Limit: "object count", Max: max}
+	}
+
 	for i := 0; i < int(objcount); i++ {
 
 		header, err := dec.scanner.NextObjectHeader()
@@ -67,6 +94,10 @@ func (dec *Decoder) Decode() error {
 		dec.objmap[header.Offset] = obj
 	}
 
+	if err = dec.verify(); err != nil {
+		return err
+	}
+
 	// Set all objects
 	for _, v := range dec.objmap {
 		if _, err := dec.store.SetEncodedObject(v); err != nil {
@@ -77,14 +108,45 @@ func (dec *Decoder) Decode() error {
 	return nil
 }
 
+// verify checks the pack trailer and the object ids for SHA-1 collision attacks
+// before anything is stored
+func (dec *Decoder) verify() error {
+	trailer, err := dec.scanner.Checksum()
+	if err != nil {
+		return err
+	}
+	if err = dec.scanner.Close(); err != nil {
+		return err
+	}
+	if err = dec.hasher.verify(trailer); err != nil {
+		log.Printf("ERR [packfile] pack=%s %v", trailer, err)
+		return err
+	}
+
+	for _, obj := range dec.objmap {
+		if h, err := objectHash(obj); err != nil {
+			log.Printf("ERR [packfile] object=%s %v", h, err)
+			return fmt.Errorf("%s: %v", h, err)
+		}
+	}
+
+	return nil
+}
+
 func (dec *Decoder) makeObject(header *packfile.ObjectHeader) (plumbing.EncodedObject, error) {
 	obj := &plumbing.MemoryObject{}
 	obj.SetType(header.Type)
 	obj.SetSize(header.Length)
 
+	max := dec.limits.MaxObjectSize
+	if max > 0 && header.Length > max {
+		return nil, &LimitError{Limit: "object size", Max: max}
+	}
+
 	w, err := obj.Writer()
 	if err == nil {
-		if _, _, err = dec.scanner.NextObject(w); err == nil {
+		// The header length may lie
+		if _, _, err = dec.scanner.NextObject(&limitWriter{w: w, max: max}); err == nil {
 			err = obj.Close()
 		}
 	}
@@ -97,11 +159,17 @@ func (dec *Decoder) makeDeltaObject(header *packfile.ObjectHeader, base plumbing
 	obj.SetSize(header.Length)
 	obj.SetType(base.Type())
 
+	// Bound the delta itself too as it is inflated in memory
+	max := dec.limits.MaxObjectSize
 	buf := new(bytes.Buffer)
-	_, _, err := dec.scanner.NextObject(buf)
-	if err == nil {
-		err = packfile.ApplyDelta(obj, base, buf.Bytes())
+	_, _, err := dec.scanner.NextObject(&limitWriter{w: buf, max: max})
+	if err != nil {
+		return obj, err
+	}
+	if max > 0 && deltaTargetSize(buf.Bytes()) > max {
+		return obj, &LimitError{Limit: "object size", Max: max}
 	}
+	err = packfile.ApplyDelta(obj, base, buf.Bytes())
 
 	return obj, err
 }
@@ -3,7 +3,7 @@ package packfile
 import (
 	"bufio"
 	"compress/zlib"
-	"crypto/sha1"
+	"context"
 	"encoding/binary"
 	"hash"
 	"io"
@@ -24,29 +24,25 @@ type Encoder struct {
 
 func NewEncoder(w io.Writer, store storer.EncodedObjectStorer) *Encoder {
 	enc := &Encoder{
-		cw:    newSHA160checksumWriter(w),
+		cw:    newChecksumWriter(w, StoreObjectFormat(store).New()),
 		store: store,
 	}
 	enc.w = bufio.NewWriterSize(enc.cw, writerSize)
 	return enc
 }
 
-// Encode walks all hashes collecting them all, writes the header, followed
-// by the entries and then the footer.
-func (enc *Encoder) Encode(hashes ...plumbing.Hash) ([]byte, error) {
-	wlker := NewObjectWalker(enc.store)
-	// Object map to hold uniques
-	out := map[plumbing.Hash]plumbing.EncodedObject{}
-
-	for _, h := range hashes {
-		//h := plumbing.NewHash(want)
-		err := wlker.Walk(h, func(obj plumbing.EncodedObject) error {
-			out[obj.Hash()] = obj
-			return nil
-		})
-
-		if err != nil {
-			log.Println("ERR", h.String(), err)
+// Encode writes a pack of all objects reachable from wants that are not
+// reachable from haves: the header, followed by the entries and then the
+// footer.  The objects are counted using the store bitmap index if available
+// otherwise by walking the history.  Only the object ids are held while
+// counting.  The entries are written in walk order, loading each object from
+// the store as it is written, so the same wants and haves always produce the
+// same pack.
+func (enc *Encoder) Encode(ctx context.Context, wants, haves []plumbing.Hash) ([]byte, error) {
+	out, err := enc.bitmapObjects(ctx, wants, haves)
+	if err != nil {
+		if out, err = enc.walkObjects(ctx, wants, haves); err != nil {
+			return nil, err
 		}
 	}
 
@@ -55,13 +51,48 @@ func (enc *Encoder) Encode(hashes ...plumbing.Hash) ([]byte, error) {
 		return nil, err
 	}
 
-	if err := enc.writeEntries(out); err != nil {
+	if err := enc.writeEntries(ctx, out); err != nil {
 		return nil, err
 	}
 
 	return enc.writeFooter()
 }
 
+// bitmapObjects computes wants - haves using the store bitmap index
+func (enc *Encoder) bitmapObjects(ctx context.Context, wants, haves []plumbing.Hash) ([]WalkEntry, error) {
+	bs, ok := enc.store.(BitmapStorer)
+	if !ok {
+		return nil, errNotInPack
+	}
+
+	bi, err := bs.BitmapIndex()
+	if err != nil {
+		log.Printf("ERR [upload-pack] Failed to load bitmap: %v", err)
+		return nil, err
+	} else if bi == nil {
+		return nil, errNotInPack
+	}
+
+	out, err := bi.Objects(ctx, enc.store, wants, haves)
+	if err != nil {
+		log.Printf("DBG [upload-pack] Bitmap not usable: %v", err)
+	}
+	return out, err
+}
+
+func (enc *Encoder) walkObjects(ctx context.Context, wants, haves []plumbing.Hash) ([]WalkEntry, error) {
+	wlker := NewObjectWalker(enc.store)
+	wlker.Hide(haves...)
+
+	// The walker yields each object only once
+	var out []WalkEntry
+	err := wlker.Walk(ctx, wants, func(e WalkEntry) error {
+		out = append(out, e)
+		return nil
+	})
+	return out, err
+}
+
 func (enc *Encoder) writeHeader(objCount int) (err error) {
 	if err = binary.Write(enc.w, binary.BigEndian, []byte("PACK")); err == nil {
 		// packfile version
@@ -83,11 +114,18 @@ func (enc *Encoder) writeFooter() ([]byte, error) {
 	return checksum, err
 }
 
-// write given objects
-func (enc *Encoder) writeEntries(objs map[plumbing.Hash]plumbing.EncodedObject) error {
-	// write all objects
-	for _, o := range objs {
-		if err := enc.writeEntry(o); err != nil {
+// write given objects loading each one from the store
+func (enc *Encoder) writeEntries(ctx context.Context, entries []WalkEntry) error {
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		o, err := enc.store.EncodedObject(e.Type, e.Hash)
+		if err != nil {
+			return err
+		}
+		if err = enc.writeEntry(o); err != nil {
 			return err
 		}
 		enc.w.Flush()
@@ -133,54 +171,13 @@ func (enc *Encoder) writeEntry(o plumbing.EncodedObject) error {
 	return err
 }
 
-/*// WritePackFile to write with the given objects
-func WritePackFile(objs map[plumbing.Hash]plumbing.EncodedObject, writer io.Writer) ([]byte, error) {
-
-	cw := newSHA160checksumWriter(writer)
-	w := bufio.NewWriterSize(cw, 65519)
-
-	err := writePackfileHeader(uint32(len(objs)), w)
-	if err != nil {
-		return nil, err
-	}
-	w.Flush()
-
-	// write all objects
-	for _, o := range objs {
-		if err = writePackfileEntry(w, o); err != nil {
-			return nil, err
-		}
-		w.Flush()
-	}
-	//w.Flush()
-
-	checksum := cw.Sum()
-	err = binary.Write(w, binary.BigEndian, checksum)
-
-	w.Flush()
-
-	return checksum, err
-}
-
-func writePackfileHeader(objCount uint32, w io.Writer) (err error) {
-	// signature
-	if err = binary.Write(w, binary.BigEndian, []byte("PACK")); err == nil {
-		// packfile version
-		if err = binary.Write(w, binary.BigEndian, uint32(2)); err == nil {
-			// object count
-			err = binary.Write(w, binary.BigEndian, objCount)
-		}
-	}
-	return err
-}*/
-
 type checksumWriter struct {
 	hash   hash.Hash
 	writer io.Writer
 }
 
-func newSHA160checksumWriter(w io.Writer) *checksumWriter {
-	return &checksumWriter{hash: sha1.New(), writer: w}
+func newChecksumWriter(w io.Writer, h hash.Hash) *checksumWriter {
+	return &checksumWriter{hash: h, writer: w}
 }
 
 func (w *checksumWriter) Write(p []byte) (n int, err error) {
@@ -0,0 +1,145 @@
+package packfile
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	ewahMaxRunning = 1<<32 - 1
+	ewahMaxLiteral = 1<<31 - 1
+)
+
+var errInvalidEWAH = errors.New("invalid ewah bitmap")
+
+// bitset is an uncompressed bitmap.  Bit i is bit i%64 of word i/64
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i uint32) {
+	b[i/64] |= 1 << (i % 64)
+}
+
+func (b bitset) has(i uint32) bool {
+	return b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b bitset) or(o bitset) {
+	for i := 0; i < len(b) && i < len(o); i++ {
+		b[i] |= o[i]
+	}
+}
+
+func (b bitset) xor(o bitset) {
+	for i := 0; i < len(b) && i < len(o); i++ {
+		b[i] ^= o[i]
+	}
+}
+
+func (b bitset) andNot(o bitset) {
+	for i := 0; i < len(b) && i < len(o); i++ {
+		b[i] &^= o[i]
+	}
+}
+
+// forEach calls fn with the position of each set bit in ascending order
+func (b bitset) forEach(fn func(uint32)) {
+	for i, w := range b {
+		for j := uint32(0); w != 0; j++ {
+			if w&1 != 0 {
+				fn(uint32(i)*64 + j)
+			}
+			w >>= 1
+		}
+	}
+}
+
+// encodeEWAH writes the bitset using git's ewah serialization: the size in
+// bits, the number of words, the compressed words and the position of the last
+// running length word.
+func encodeEWAH(w io.Writer, b bitset) error {
+	var (
+		buf []uint64
+		rlw int
+		i   int
+	)
+
+	for {
+		rlw = len(buf)
+		buf = append(buf, 0)
+
+		var fill, run, lit uint64
+		if i < len(b) && b[i] == ^uint64(0) {
+			fill = ^uint64(0)
+		}
+		for i < len(b) && run < ewahMaxRunning && b[i] == fill {
+			run++
+			i++
+		}
+		for i < len(b) && lit < ewahMaxLiteral && b[i] != 0 && b[i] != ^uint64(0) {
+			buf = append(buf, b[i])
+			lit++
+			i++
+		}
+
+		buf[rlw] = (fill & 1) | run<<1 | lit<<33
+		if i >= len(b) {
+			break
+		}
+	}
+
+	if err := binary.Write(w, binary.BigEndian, []uint32{uint32(len(b) * 64), uint32(len(buf))}); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, buf); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.BigEndian, uint32(rlw))
+}
+
+// decodeEWAH reads a git ewah serialized bitmap
+func decodeEWAH(r io.Reader) (bitset, error) {
+	var hdr [2]uint32
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return nil, err
+	}
+
+	words := make([]uint64, hdr[1])
+	if err := binary.Read(r, binary.BigEndian, words); err != nil {
+		return nil, err
+	}
+
+	var rlw uint32
+	if err := binary.Read(r, binary.BigEndian, &rlw); err != nil {
+		return nil, err
+	}
+
+	max := (int(hdr[0]) + 63) / 64
+	var out bitset
+	for i := 0; i < len(words); {
+		var (
+			run  = int((words[i] >> 1) & ewahMaxRunning)
+			lit  = int(words[i] >> 33)
+			fill uint64
+		)
+		if words[i]&1 != 0 {
+			fill = ^uint64(0)
+		}
+		i++
+
+		if len(out)+run+lit > max || i+lit > len(words) {
+			return nil, errInvalidEWAH
+		}
+		for ; run > 0; run-- {
+			out = append(out, fill)
+		}
+		out = append(out, words[i:i+lit]...)
+		i += lit
+	}
+
+	return out, nil
+}
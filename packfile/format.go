@@ -0,0 +1,77 @@
+package packfile
+
+import (
+	"crypto/sha1"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// ObjectFormat is the hash algorithm objects of a repo are named by.  Only
+// sha1 is supported as the underlying object storage only holds 20 byte
+// hashes.
+type ObjectFormat string
+
+// SHA1 is the default and only supported object format
+const SHA1 ObjectFormat = "sha1"
+
+// ErrUnsupportedObjectFormat is returned for object formats other than sha1
+// e.g. sha256
+var ErrUnsupportedObjectFormat = errors.New("unsupported object format")
+
+// ObjectFormatStorer is an optional interface for stores knowing the object
+// format of their repo e.g. from its config
+type ObjectFormatStorer interface {
+	ObjectFormat() ObjectFormat
+}
+
+// StoreObjectFormat returns the object format of the store defaulting to sha1
+func StoreObjectFormat(store interface{}) ObjectFormat {
+	if s, ok := store.(ObjectFormatStorer); ok {
+		return s.ObjectFormat()
+	}
+	return SHA1
+}
+
+// ParseObjectFormat parses the value of extensions.objectformat or the
+// object-format capability.  The empty string is sha1.
+func ParseObjectFormat(s string) (ObjectFormat, error) {
+	switch ObjectFormat(strings.ToLower(s)) {
+	case "", SHA1:
+		return SHA1, nil
+	}
+	return "", ErrUnsupportedObjectFormat
+}
+
+// Size returns the size of a hash in bytes
+func (f ObjectFormat) Size() int {
+	return sha1.Size
+}
+
+// HexSize returns the size of a hex encoded hash
+func (f ObjectFormat) HexSize() int {
+	return f.Size() * 2
+}
+
+// New returns a hash used for object names and pack, idx and bitmap trailers
+func (f ObjectFormat) New() hash.Hash {
+	return sha1.New()
+}
+
+// ZeroHex returns the hex encoded null object id
+func (f ObjectFormat) ZeroHex() string {
+	return strings.Repeat("0", f.HexSize())
+}
+
+// IsHex returns true if s is a hex encoded hash of this format
+func (f ObjectFormat) IsHex(s string) bool {
+	if len(s) != f.HexSize() {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
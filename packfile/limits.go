@@ -0,0 +1,86 @@
+package packfile
+
+import (
+	"fmt"
+	"io"
+)
+
+// Limits bound what a Decoder accepts.  Zero values mean no limit.
+type Limits struct {
+	// Max bytes of the pack including the trailer
+	MaxPackSize int64 `json:"max_pack_size,omitempty"`
+	// Max inflated size of a single object
+	MaxObjectSize int64 `json:"max_object_size,omitempty"`
+	// Max objects in the pack
+	MaxObjects int64 `json:"max_objects,omitempty"`
+}
+
+// LimitError is returned when a pack exceeds one of the limits
+type LimitError struct {
+	Limit string
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s exceeds limit of %d", e.Limit, e.Max)
+}
+
+// limitReader fails once more than max bytes have been read
+type limitReader struct {
+	r   io.Reader
+	n   int64
+	max int64
+	err error
+}
+
+func (lr *limitReader) Read(p []byte) (int, error) {
+	if lr.err != nil {
+		return 0, lr.err
+	}
+
+	n, err := lr.r.Read(p)
+	lr.n += int64(n)
+	if lr.max > 0 && lr.n > lr.max {
+		lr.err = &LimitError{Limit: "pack size", Max: lr.max}
+		return n, lr.err
+	}
+	return n, err
+}
+
+// deltaTargetSize returns the size of the object a delta produces from the
+// delta header i.e. the second varint
+func deltaTargetSize(delta []byte) int64 {
+	var (
+		size  int64
+		shift uint
+		i     int
+	)
+	// skip the source size
+	for i < len(delta) && delta[i]&0x80 != 0 {
+		i++
+	}
+	i++
+	for ; i < len(delta); i++ {
+		size |= int64(delta[i]&0x7f) << shift
+		shift += 7
+		if delta[i]&0x80 == 0 {
+			break
+		}
+	}
+	return size
+}
+
+// limitWriter fails once more than max bytes have been written
+type limitWriter struct {
+	w   io.Writer
+	n   int64
+	max int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	lw.n += int64(len(p))
+	if lw.max > 0 && lw.n > lw.max {
+		return 0, &LimitError{Limit: "object size", Max: lw.max}
+	}
+	return lw.w.Write(p)
+}
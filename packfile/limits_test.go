@@ -0,0 +1,55 @@
+package packfile
+
+import (
+	"bytes"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testLimitsPack(t *testing.T) []byte {
+	src := memory.NewStorage()
+	var hashes []plumbing.Hash
+	for _, size := range []int{10, 100, 1000} {
+		obj := src.NewEncodedObject()
+		obj.SetType(plumbing.BlobObject)
+		w, _ := obj.Writer()
+		w.Write(bytes.Repeat([]byte{byte(size)}, size))
+		w.Close()
+		h, err := src.SetEncodedObject(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, h)
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := packfile.NewEncoder(buf, src, false).Encode(hashes, 0); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecoderLimits(t *testing.T) {
+	pack := testLimitsPack(t)
+
+	for _, limits := range []Limits{
+		{MaxPackSize: int64(len(pack)) - 1},
+		{MaxObjectSize: 999},
+		{MaxObjects: 2},
+	} {
+		dec := NewDecoder(bytes.NewReader(pack), memory.NewStorage())
+		dec.SetLimits(limits)
+		if _, ok := dec.Decode().(*LimitError); !ok {
+			t.Fatalf("%+v should fail", limits)
+		}
+	}
+
+	dec := NewDecoder(bytes.NewReader(pack), memory.NewStorage())
+	dec.SetLimits(Limits{MaxPackSize: int64(len(pack)), MaxObjectSize: 1000, MaxObjects: 3})
+	if err := dec.Decode(); err != nil {
+		t.Fatal(err)
+	}
+}
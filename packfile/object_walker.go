@@ -1,102 +1,431 @@
 package packfile
 
 import (
-	"fmt"
-	"io"
+	"bytes"
+	"container/heap"
+	"context"
+	"sort"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
 	"gopkg.in/src-d/go-git.v4/plumbing/object"
 	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/commitgraph"
+)
+
+const (
+	flagSeen uint8 = 1 << iota
+	flagUninteresting
 )
 
-// ObjectWalker walks a hash and makes a callback with each object it walks.  This
-// will yield duplicates.
+// ObjectWalker performs a revision walk from a set of wanted hashes, excluding
+// the history reachable from hidden commits i.e. the client haves.  Each object
+// is visited at most once.
 type ObjectWalker struct {
 	objs storer.EncodedObjectStorer
+	// commit lookups use the commit-graph when available
+	nodes *commitgraph.NodeIndex
+	// hidden commits.  These along with their history are not walked
+	hidden []plumbing.Hash
+	// commits loaded during the walk
+	commits map[plumbing.Hash]*walkCommit
+	// trees and blobs already visited or known to be uninteresting
+	seen map[plumbing.Hash]struct{}
 }
 
 // NewObjectWalker instantiates a new object walker with the given store
 func NewObjectWalker(objs storer.EncodedObjectStorer) *ObjectWalker {
-	return &ObjectWalker{objs: objs}
+	return &ObjectWalker{
+		objs:    objs,
+		nodes:   commitgraph.NewNodeIndex(objs),
+		commits: map[plumbing.Hash]*walkCommit{},
+		seen:    map[plumbing.Hash]struct{}{},
+	}
+}
+
+// Hide marks the given hashes as uninteresting.  Objects reachable from them
+// are not walked.  Hashes not present in the store are ignored.
+func (ow *ObjectWalker) Hide(hashes ...plumbing.Hash) {
+	ow.hidden = append(ow.hidden, hashes...)
+}
+
+// Walk calls cb once for every object reachable from wants but not from the
+// hidden hashes.  Only the object ids are yielded, in git's pack order: commits
+// in recency order, then trees and blobs grouped by path, then tags.  The walk
+// stops when the context is cancelled or the callback returns an error.
+func (ow *ObjectWalker) Walk(ctx context.Context, wants []plumbing.Hash, cb func(WalkEntry) error) error {
+	var (
+		queue = &commitQueue{}
+		tags  []WalkEntry
+		objs  []WalkEntry
+	)
+
+	for _, h := range ow.hidden {
+		if err := ow.hide(queue, h); err != nil {
+			return err
+		}
+	}
+
+	collectTag := func(e WalkEntry) error {
+		tags = append(tags, e)
+		return nil
+	}
+
+	var trees []plumbing.Hash
+	for _, h := range wants {
+		obj, err := ow.peel(h, collectTag)
+		if err != nil {
+			return err
+		}
+
+		switch obj.Type() {
+		case plumbing.CommitObject:
+			if err = ow.pushCommit(queue, obj.Hash(), 0); err != nil {
+				return err
+			}
+		case plumbing.TreeObject:
+			trees = append(trees, obj.Hash())
+		case plumbing.BlobObject:
+			if _, ok := ow.seen[obj.Hash()]; !ok {
+				ow.seen[obj.Hash()] = struct{}{}
+				objs = append(objs, WalkEntry{Hash: obj.Hash(), Type: plumbing.BlobObject})
+			}
+		}
+	}
+
+	commits, err := ow.limit(ctx, queue)
+	if err != nil {
+		return err
+	}
+
+	// Everything in the trees of uninteresting commits is known to the client
+	for _, c := range ow.commits {
+		if c.flags&flagUninteresting == 0 {
+			continue
+		}
+		if err = ow.markTreeUninteresting(ctx, c.node.Tree); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range commits {
+		if c.flags&flagUninteresting != 0 {
+			continue
+		}
+		if err = cb(WalkEntry{Hash: c.node.Hash, Type: plumbing.CommitObject}); err != nil {
+			return err
+		}
+		trees = append(trees, c.node.Tree)
+	}
+
+	collectObj := func(e WalkEntry) error {
+		objs = append(objs, e)
+		return nil
+	}
+	for _, h := range trees {
+		if err = ow.walkTree(ctx, h, "", collectObj); err != nil {
+			return err
+		}
+	}
+
+	// Group by path keeping recency order within a path
+	sort.SliceStable(objs, func(i, j int) bool { return objs[i].Path < objs[j].Path })
+
+	for _, e := range append(objs, tags...) {
+		if err = cb(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// Walk an object to the beginning of time
-func (ow *ObjectWalker) Walk(hash plumbing.Hash, cb func(plumbing.EncodedObject) error) error {
-	obj, err := ow.objs.EncodedObject(plumbing.AnyObject, hash)
+// WalkCommits calls cb for the commits reachable from wants but not from the
+// hidden hashes, newest first.  Unlike Walk no trees are read, neither those
+// of the hidden commits nor those of the walked ones.
+func (ow *ObjectWalker) WalkCommits(ctx context.Context, wants []plumbing.Hash, cb func(plumbing.Hash) error) error {
+	queue := &commitQueue{}
+
+	push := func(h plumbing.Hash, flags uint8) error {
+		obj, err := ow.peel(h, nil)
+		if err == plumbing.ErrObjectNotFound && flags&flagUninteresting != 0 {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if obj.Type() != plumbing.CommitObject {
+			return nil
+		}
+		return ow.pushCommit(queue, obj.Hash(), flags)
+	}
+
+	for _, h := range ow.hidden {
+		if err := push(h, flagUninteresting); err != nil {
+			return err
+		}
+	}
+	for _, h := range wants {
+		if err := push(h, 0); err != nil {
+			return err
+		}
+	}
+
+	commits, err := ow.limit(ctx, queue)
 	if err != nil {
 		return err
 	}
+	for _, c := range commits {
+		if c.flags&flagUninteresting != 0 {
+			continue
+		}
+		if err = cb(c.node.Hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if err = cb(obj); err != nil {
+// hide adds the commit the hash peels to, to the queue as uninteresting.
+func (ow *ObjectWalker) hide(queue *commitQueue, h plumbing.Hash) error {
+	obj, err := ow.peel(h, nil)
+	if err == plumbing.ErrObjectNotFound {
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	// Further walk the following object types
 	switch obj.Type() {
 	case plumbing.CommitObject:
-		err = ow.walkCommit(obj, cb)
-
+		return ow.pushCommit(queue, obj.Hash(), flagUninteresting)
 	case plumbing.TreeObject:
-		err = ow.walkTree(obj, cb)
+		return ow.markTreeUninteresting(context.Background(), obj.Hash())
+	default:
+		ow.seen[obj.Hash()] = struct{}{}
+	}
+	return nil
+}
+
+// peel follows tags until a non-tag object is found, calling cb on each
+// unseen tag if provided.
+func (ow *ObjectWalker) peel(h plumbing.Hash, cb func(WalkEntry) error) (plumbing.EncodedObject, error) {
+	for {
+		obj, err := ow.objs.EncodedObject(plumbing.AnyObject, h)
+		if err != nil {
+			return nil, err
+		}
+		if obj.Type() != plumbing.TagObject {
+			return obj, nil
+		}
 
+		if _, ok := ow.seen[h]; !ok && cb != nil {
+			ow.seen[h] = struct{}{}
+			if err = cb(WalkEntry{Hash: h, Type: plumbing.TagObject}); err != nil {
+				return nil, err
+			}
+		}
+
+		tag, err := object.DecodeTag(ow.objs, obj)
+		if err != nil {
+			return nil, err
+		}
+		h = tag.Target
 	}
+}
+
+// limit pops commits off the queue in date order propagating the
+// uninteresting flag to parents.  It stops once only uninteresting commits
+// remain in the queue and returns the walked commits in order.
+func (ow *ObjectWalker) limit(ctx context.Context, queue *commitQueue) ([]*walkCommit, error) {
+	var out []*walkCommit
+
+	for queue.Len() > 0 && !queue.everybodyUninteresting() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
 
-	return err
+		c := heap.Pop(queue).(*walkCommit)
+		for _, ph := range c.node.Parents {
+			if p, ok := ow.commits[ph]; ok {
+				if c.flags&flagUninteresting != 0 {
+					ow.markParentsUninteresting(p)
+				}
+				continue
+			}
+
+			err := ow.pushCommit(queue, ph, c.flags&flagUninteresting)
+			if err == plumbing.ErrObjectNotFound && c.flags&flagUninteresting != 0 {
+				// Shallow or partial history on the uninteresting side
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+		}
 
+		if c.flags&flagUninteresting == 0 {
+			out = append(out, c)
+		}
+	}
+
+	return out, nil
 }
 
-func (ow *ObjectWalker) walkCommit(obj plumbing.EncodedObject, cb func(plumbing.EncodedObject) error) error {
-	commit, err := object.GetCommit(ow.objs, obj.Hash())
+// markParentsUninteresting marks the commit and all of its already loaded
+// ancestors as uninteresting.
+func (ow *ObjectWalker) markParentsUninteresting(c *walkCommit) {
+	stack := []*walkCommit{c}
+	for len(stack) > 0 {
+		c = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if c.flags&flagUninteresting != 0 {
+			continue
+		}
+		c.flags |= flagUninteresting
+
+		for _, ph := range c.node.Parents {
+			if p, ok := ow.commits[ph]; ok {
+				stack = append(stack, p)
+			}
+		}
+	}
+}
+
+func (ow *ObjectWalker) pushCommit(queue *commitQueue, h plumbing.Hash, flags uint8) error {
+	if c, ok := ow.commits[h]; ok {
+		if flags&flagUninteresting != 0 {
+			ow.markParentsUninteresting(c)
+		}
+		return nil
+	}
+
+	node, err := ow.nodes.Get(h)
 	if err != nil {
 		return err
 	}
 
-	var tobj *object.Tree
-	if tobj, err = commit.Tree(); err != nil {
+	c := &walkCommit{node: node, flags: flags | flagSeen}
+	ow.commits[h] = c
+	heap.Push(queue, c)
+	return nil
+}
+
+// markTreeUninteresting recursively marks the tree and its entries as seen so
+// they are not walked.
+func (ow *ObjectWalker) markTreeUninteresting(ctx context.Context, h plumbing.Hash) error {
+	return ow.walkTree(ctx, h, "", nil)
+}
+
+// walkTree walks the tree at the given path calling cb on each unseen tree or
+// blob.  A nil cb only marks the objects as seen.
+func (ow *ObjectWalker) walkTree(ctx context.Context, h plumbing.Hash, path string, cb func(WalkEntry) error) error {
+	if _, ok := ow.seen[h]; ok {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	ow.seen[h] = struct{}{}
+
+	obj, err := ow.objs.EncodedObject(plumbing.TreeObject, h)
+	if err != nil {
+		if err == plumbing.ErrObjectNotFound && cb == nil {
+			return nil
+		}
 		return err
 	}
 
-	if err = ow.Walk(tobj.Hash, cb); err != nil {
+	if cb != nil {
+		if err = cb(WalkEntry{Hash: h, Type: plumbing.TreeObject, Path: path}); err != nil {
+			return err
+		}
+	}
+
+	t := &object.Tree{}
+	if err = t.Decode(obj); err != nil {
 		return err
 	}
 
-	iter := commit.Parents()
-	for {
-		cmt, e1 := iter.Next()
-		if e1 != nil {
-			if e1 != io.EOF {
-				err = e1
+	for _, entry := range t.Entries {
+		switch entry.Mode {
+		case filemode.Submodule:
+			// Commit in another repo
+			continue
+
+		case filemode.Dir:
+			err = ow.walkTree(ctx, entry.Hash, joinPath(path, entry.Name), cb)
+
+		default:
+			if _, ok := ow.seen[entry.Hash]; ok {
+				continue
+			}
+			ow.seen[entry.Hash] = struct{}{}
+			if cb != nil {
+				err = cb(WalkEntry{Hash: entry.Hash, Type: plumbing.BlobObject, Path: joinPath(path, entry.Name)})
 			}
-			break
 		}
 
-		if e1 = ow.Walk(cmt.Hash, cb); e1 != nil {
-			err = e1
-			break
+		if err != nil {
+			return err
 		}
 	}
-	return err
+
+	return nil
 }
 
-func (ow *ObjectWalker) walkTree(obj plumbing.EncodedObject, cb func(plumbing.EncodedObject) error) error {
-	t := &object.Tree{}
-	err := t.Decode(obj)
-	if err != nil {
-		return err
+func joinPath(dir, name string) string {
+	if dir == "" {
+		return name
 	}
+	return dir + "/" + name
+}
 
-	for _, entry := range t.Entries {
-		err = mergeErrors(err, ow.Walk(entry.Hash, cb))
+// WalkEntry is an object yielded by the ObjectWalker
+type WalkEntry struct {
+	Hash plumbing.Hash
+	Type plumbing.ObjectType
+	// Path of a tree or blob relative to the root tree it was found in
+	Path string
+}
+
+// walkCommit is a commit loaded during a revision walk
+type walkCommit struct {
+	node  *commitgraph.Node
+	flags uint8
+}
+
+// commitQueue is a priority queue of commits ordered by committer date, newest
+// first
+type commitQueue []*walkCommit
+
+func (q commitQueue) Len() int { return len(q) }
+
+func (q commitQueue) Less(i, j int) bool {
+	ti, tj := q[i].node.When, q[j].node.When
+	if ti.Equal(tj) {
+		// Keep the order deterministic
+		return bytes.Compare(q[i].node.Hash[:], q[j].node.Hash[:]) < 0
 	}
-	return err
+	return ti.After(tj)
 }
 
-func mergeErrors(err1, err2 error) error {
-	if err1 == nil {
-		return err2
-	} else if err2 == nil {
-		return err1
-	} else {
-		return fmt.Errorf("%s\n%s", err1, err2)
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *commitQueue) Push(x interface{}) { *q = append(*q, x.(*walkCommit)) }
+
+func (q *commitQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	c := old[n-1]
+	*q = old[:n-1]
+	return c
+}
+
+func (q commitQueue) everybodyUninteresting() bool {
+	for _, c := range q {
+		if c.flags&flagUninteresting == 0 {
+			return false
+		}
 	}
+	return true
 }
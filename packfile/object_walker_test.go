@@ -0,0 +1,180 @@
+package packfile
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testBlob(t *testing.T, st *memory.Storage, data string) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, _ := obj.Writer()
+	w.Write([]byte(data))
+	w.Close()
+
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testTree(t *testing.T, st *memory.Storage, entries ...object.TreeEntry) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testCommit(t *testing.T, st *memory.Storage, tree plumbing.Hash, when int64, parents ...plumbing.Hash) plumbing.Hash {
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(when, 0)}
+	c := &object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      "test",
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}
+
+	obj := st.NewEncodedObject()
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testHistory creates a diamond shaped history sharing a subtree:
+// base <- left, right <- merge
+func testHistory(t *testing.T) (st *memory.Storage, base, merge plumbing.Hash) {
+	st = memory.NewStorage()
+
+	shared := testTree(t, st, object.TreeEntry{Name: "a", Mode: filemode.Regular, Hash: testBlob(t, st, "a")})
+	t0 := testTree(t, st, object.TreeEntry{Name: "dir", Mode: filemode.Dir, Hash: shared})
+	t1 := testTree(t, st,
+		object.TreeEntry{Name: "dir", Mode: filemode.Dir, Hash: shared},
+		object.TreeEntry{Name: "l", Mode: filemode.Regular, Hash: testBlob(t, st, "l")},
+	)
+	t2 := testTree(t, st,
+		object.TreeEntry{Name: "dir", Mode: filemode.Dir, Hash: shared},
+		object.TreeEntry{Name: "r", Mode: filemode.Regular, Hash: testBlob(t, st, "r")},
+	)
+
+	base = testCommit(t, st, t0, 1)
+	left := testCommit(t, st, t1, 2, base)
+	right := testCommit(t, st, t2, 3, base)
+	merge = testCommit(t, st, t2, 4, left, right)
+	return
+}
+
+func TestObjectWalker(t *testing.T) {
+	st, base, merge := testHistory(t)
+
+	var testCases = []struct {
+		desc  string
+		haves []plumbing.Hash
+		count int
+	}{
+		// 4 commits, 4 trees, 3 blobs
+		{desc: "clone", count: 11},
+		// 3 commits, 2 trees, 2 blobs
+		{desc: "fetch", haves: []plumbing.Hash{base}, count: 7},
+		{desc: "up to date", haves: []plumbing.Hash{merge}, count: 0},
+		{desc: "unknown have", haves: []plumbing.Hash{plumbing.NewHash("1234")}, count: 11},
+	}
+
+	for _, tt := range testCases {
+		ow := NewObjectWalker(st)
+		ow.Hide(tt.haves...)
+
+		seen := map[plumbing.Hash]bool{}
+		err := ow.Walk(context.Background(), []plumbing.Hash{merge}, func(e WalkEntry) error {
+			if seen[e.Hash] {
+				t.Errorf("%s: duplicate object %s", tt.desc, e.Hash)
+			}
+			seen[e.Hash] = true
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+		} else if len(seen) != tt.count {
+			t.Errorf("%s: expected %d objects, got %d", tt.desc, tt.count, len(seen))
+		}
+	}
+}
+
+func TestObjectWalkerCancel(t *testing.T) {
+	st, _, merge := testHistory(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := NewObjectWalker(st).Walk(ctx, []plumbing.Hash{merge}, func(WalkEntry) error { return nil })
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestObjectWalkerOrder(t *testing.T) {
+	st, _, merge := testHistory(t)
+
+	var entries []WalkEntry
+	err := NewObjectWalker(st).Walk(context.Background(), []plumbing.Hash{merge}, func(e WalkEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 4 commits in recency order followed by trees and blobs by path
+	if entries[0].Hash != merge {
+		t.Errorf("expected first commit %s, got %s", merge, entries[0].Hash)
+	}
+	for i, e := range entries {
+		if (i < 4) != (e.Type == plumbing.CommitObject) {
+			t.Errorf("unexpected %s at position %d", e.Type, i)
+		}
+		if i > 4 && e.Path < entries[i-1].Path {
+			t.Errorf("%q before %q", entries[i-1].Path, e.Path)
+		}
+	}
+}
+
+func TestObjectWalkerCommits(t *testing.T) {
+	st, base, merge := testHistory(t)
+
+	ow := NewObjectWalker(st)
+	ow.Hide(base)
+
+	var commits []plumbing.Hash
+	err := ow.WalkCommits(context.Background(), []plumbing.Hash{merge}, func(h plumbing.Hash) error {
+		commits = append(commits, h)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// merge, right and left
+	if len(commits) != 3 || commits[0] != merge {
+		t.Fatal(commits)
+	}
+	// No tree was read
+	if len(ow.seen) != 0 {
+		t.Fatalf("%d trees and blobs seen", len(ow.seen))
+	}
+}
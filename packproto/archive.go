@@ -0,0 +1,115 @@
+package packproto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/archive"
+	"github.com/euforia/go-git-server/pktline"
+)
+
+// Max arguments of an upload-archive request as limited by git
+const maxArchiveArgs = 64
+
+var (
+	errArchiveTooManyArgs = errors.New("too many options")
+	errArchiveNoTreeish   = errors.New("no tree-ish given")
+)
+
+// UploadArchive serves git archive --remote.  The archive options are read
+// and the archive of the ref sent on the data sideband.  Only refs can be
+// archived.
+func (proto *Protocol) UploadArchive(ctx context.Context, store storer.Storer) error {
+	enc := pktline.NewEncoder(proto.w)
+
+	rev, opts, err := parseArchiveArgs(proto.r)
+	if err == nil {
+		opts.Format, err = archive.ParseFormat(string(opts.Format))
+	}
+	if err != nil {
+		return enc.Encode([]byte(fmt.Sprintf("NACK %v\n", err)))
+	}
+	h, err := archive.ResolveRef(store, rev)
+	if err != nil {
+		return enc.Encode([]byte(fmt.Sprintf("NACK %v\n", err)))
+	}
+	log.Printf("DBG [upload-archive] repo=%s rev=%s format=%s", proto.repo, rev, opts.Format)
+
+	enc.Encode([]byte("ACK\n"))
+	enc.Encode(nil)
+
+	if err = archive.Write(&sidebandWriter{enc: enc, band: bandData}, store, h, opts); err != nil {
+		log.Printf("ERR [upload-archive] repo=%s %v", proto.repo, err)
+		(&sidebandWriter{enc: enc, band: bandError}).Write([]byte(err.Error()))
+		return err
+	}
+	return enc.Encode(nil)
+}
+
+// parseArchiveArgs reads the "argument <arg>" lines sent by git archive
+// returning the tree-ish and options
+func parseArchiveArgs(r io.Reader) (rev string, opts archive.Options, err error) {
+	opts.Format = archive.Tar
+
+	dec := pktline.NewDecoder(r)
+	var args []string
+	for {
+		var line []byte
+		if err = dec.Decode(&line); err != nil {
+			return
+		}
+		if len(line) == 0 {
+			break
+		}
+		if len(args) == maxArchiveArgs {
+			err = errArchiveTooManyArgs
+			return
+		}
+		arg := strings.TrimSuffix(string(line), "\n")
+		if !strings.HasPrefix(arg, "argument ") {
+			err = fmt.Errorf("expected argument: %s", arg)
+			return
+		}
+		args = append(args, strings.TrimPrefix(arg, "argument "))
+	}
+
+	var noOpts bool
+	for _, arg := range args {
+		switch {
+		case noOpts || !strings.HasPrefix(arg, "-"):
+			if rev == "" {
+				rev = arg
+			} else {
+				opts.Paths = append(opts.Paths, arg)
+			}
+		case arg == "--":
+			noOpts = true
+		case strings.HasPrefix(arg, "--format="):
+			opts.Format = archive.Format(strings.TrimPrefix(arg, "--format="))
+		case strings.HasPrefix(arg, "--prefix="):
+			opts.Prefix = strings.TrimPrefix(arg, "--prefix=")
+		case arg == "--worktree-attributes":
+			// There is no worktree, the attributes of the tree are used
+		case len(arg) == 2 && arg[1] >= '0' && arg[1] <= '9':
+			opts.Level, _ = strconv.Atoi(arg[1:])
+			if opts.Level == 0 {
+				opts.Level = archive.NoCompression
+			}
+		default:
+			err = fmt.Errorf("unsupported option: %s", arg)
+			return
+		}
+	}
+
+	if rev == "" {
+		err = errArchiveNoTreeish
+	}
+	return
+}
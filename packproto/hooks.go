@@ -0,0 +1,90 @@
+package packproto
+
+import (
+	"context"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/packfile"
+)
+
+// RefUpdate is a ref update requested by a push
+type RefUpdate struct {
+	Ref string
+	Old plumbing.Hash
+	New plumbing.Hash
+}
+
+// PreReceiveHook vets a ref update once the pack is unpacked and before the ref
+// is updated.  Commits are those the update introduces, newest first.  The
+// returned error is reported to the client as the reason the ref was rejected.
+type PreReceiveHook interface {
+	PreReceive(ctx context.Context, store storer.Storer, update RefUpdate, commits []plumbing.Hash) error
+}
+
+// SetPreReceiveHooks sets the hooks run for each ref update of a push
+func (proto *Protocol) SetPreReceiveHooks(hooks ...PreReceiveHook) {
+	proto.hooks = hooks
+}
+
+func (proto *Protocol) preReceive(ctx context.Context, store storer.Storer, tx txRef) error {
+	if len(proto.hooks) == 0 {
+		return nil
+	}
+
+	commits, err := newCommits(ctx, store, tx.newHash)
+	if err != nil {
+		return err
+	}
+
+	update := RefUpdate{Ref: tx.ref, Old: tx.oldHash, New: tx.newHash}
+	for _, hook := range proto.hooks {
+		if err = hook.PreReceive(ctx, store, update, commits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newCommits returns the commits reachable from h but not from any ref
+func newCommits(ctx context.Context, store storer.Storer, h plumbing.Hash) ([]plumbing.Hash, error) {
+	if h.IsZero() {
+		return nil, nil
+	}
+
+	var hide []plumbing.Hash
+	iter, err := store.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			hide = append(hide, ref.Hash())
+		}
+		return nil
+	})
+	return NewCommits(ctx, store, h, hide)
+}
+
+// NewCommits returns the commits reachable from h but not from the hidden
+// hashes, newest first
+func NewCommits(ctx context.Context, store storer.Storer, h plumbing.Hash, hide []plumbing.Hash) ([]plumbing.Hash, error) {
+	if h.IsZero() {
+		return nil, nil
+	}
+
+	ow := packfile.NewObjectWalker(store)
+	for _, hh := range hide {
+		if !hh.IsZero() {
+			ow.Hide(hh)
+		}
+	}
+
+	var commits []plumbing.Hash
+	err := ow.WalkCommits(ctx, []plumbing.Hash{h}, func(c plumbing.Hash) error {
+		commits = append(commits, c)
+		return nil
+	})
+	return commits, err
+}
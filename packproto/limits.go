@@ -0,0 +1,38 @@
+package packproto
+
+import "github.com/euforia/go-git-server/packfile"
+
+// PushLimits bound what receive-pack accepts.  Zero values mean no limit.
+type PushLimits struct {
+	packfile.Limits
+	// Max refs updated by a single push
+	MaxRefUpdates int64 `json:"max_ref_updates,omitempty"`
+}
+
+// Merge returns the lower of each limit of the two.  It is used to apply per
+// repo limits under the server wide ones so repos can only tighten them.
+func (l PushLimits) Merge(override *PushLimits) PushLimits {
+	if override == nil {
+		return l
+	}
+	l.MaxPackSize = minLimit(l.MaxPackSize, override.MaxPackSize)
+	l.MaxObjectSize = minLimit(l.MaxObjectSize, override.MaxObjectSize)
+	l.MaxObjects = minLimit(l.MaxObjects, override.MaxObjects)
+	l.MaxRefUpdates = minLimit(l.MaxRefUpdates, override.MaxRefUpdates)
+	return l
+}
+
+// minLimit returns the lower of the limits where 0 is unlimited
+func minLimit(a, b int64) int64 {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
+
+func (l PushLimits) checkRefUpdates(n int) error {
+	if l.MaxRefUpdates > 0 && int64(n) > l.MaxRefUpdates {
+		return &packfile.LimitError{Limit: "ref updates", Max: l.MaxRefUpdates}
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+package packproto
+
+import (
+	"testing"
+
+	"github.com/euforia/go-git-server/packfile"
+)
+
+func TestPushLimitsMerge(t *testing.T) {
+	server := PushLimits{Limits: packfile.Limits{MaxPackSize: 100, MaxObjects: 10}}
+	repo := &PushLimits{Limits: packfile.Limits{MaxPackSize: 1000, MaxObjectSize: 5, MaxObjects: 2}}
+
+	l := server.Merge(repo)
+	if l.MaxPackSize != 100 || l.MaxObjectSize != 5 || l.MaxObjects != 2 || l.MaxRefUpdates != 0 {
+		t.Fatalf("%+v", l)
+	}
+	if l = server.Merge(nil); l != server {
+		t.Fatalf("%+v", l)
+	}
+}
@@ -0,0 +1,72 @@
+package packproto
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// ProcResult is the outcome of a ref update handled by a proc receiver
+type ProcResult struct {
+	// Ref actually written, reported to report-status-v2 clients
+	Ref string
+	Old plumbing.Hash
+	New plumbing.Hash
+}
+
+// ProcReceiver handles the ref updates under a prefix in place of receive-pack
+// as git's proc-receive hook does.  The pushed ref is not updated, instead the
+// receiver writes and returns another one.
+type ProcReceiver interface {
+	ProcReceive(ctx context.Context, store storer.Storer, update RefUpdate) (*ProcResult, error)
+}
+
+// ProcRefOwner is an optional interface for proc receivers owning the refs
+// they write.  Pushes can't update those directly.
+type ProcRefOwner interface {
+	OwnsRef(ref string) bool
+}
+
+// PostReceiver is an optional interface for proc receivers told of the results
+// of each push once its refs are updated e.g. to track merges
+type PostReceiver interface {
+	PostReceive(ctx context.Context, store storer.Storer, results []*RefResult)
+}
+
+// SetProcReceiver sets the receiver of the updates of refs under prefix e.g.
+// refs/for/
+func (proto *Protocol) SetProcReceiver(prefix string, pr ProcReceiver) {
+	proto.procPrefix = prefix
+	proto.proc = pr
+}
+
+// isProcRef returns true if the ref is handled by the proc receiver
+func (proto *Protocol) isProcRef(ref string) bool {
+	return proto.proc != nil && strings.HasPrefix(ref, proto.procPrefix)
+}
+
+// isProcOwnedRef returns true if the ref is written only by the proc receiver
+func (proto *Protocol) isProcOwnedRef(ref string) bool {
+	o, ok := proto.proc.(ProcRefOwner)
+	return ok && o.OwnsRef(ref)
+}
+
+// procReceive hands the ref update to the proc receiver
+func (proto *Protocol) procReceive(ctx context.Context, store storer.Storer, tx txRef, res *RefResult) *RefResult {
+	if tx.newHash.IsZero() {
+		return res.reject(RefRejected, "cannot delete")
+	}
+
+	pr, err := proto.proc.ProcReceive(ctx, store, RefUpdate{Ref: tx.ref, Old: tx.oldHash, New: tx.newHash})
+	if err != nil {
+		return res.reject(RefRejectedByHook, err)
+	}
+	log.Printf("DBG [receive-pack] repo=%s ref=%s written to %s", proto.repo, tx.ref, pr.Ref)
+
+	res.RefName, res.Old, res.New = pr.Ref, pr.Old, pr.New
+	res.Status = RefOK
+	return res
+}
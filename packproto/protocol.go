@@ -1,14 +1,19 @@
 package packproto
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"strings"
+	"sync"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
 	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 
+	"github.com/euforia/go-git-server/commitgraph"
+	"github.com/euforia/go-git-server/packcache"
 	"github.com/euforia/go-git-server/packfile"
 	"github.com/euforia/go-git-server/pktline"
 )
@@ -18,172 +23,420 @@ const (
 	GitRecvPack = "git-receive-pack"
 	// GitUploadPack is the upload pack service name
 	GitUploadPack = "git-upload-pack"
+	// GitUploadArchive is the upload archive service name
+	GitUploadArchive = "git-upload-archive"
 )
 
 // Protocol implements the git pack protocol
 type Protocol struct {
 	w io.Writer
 	r io.Reader
+
+	// Optional pack cache and the repo id to key it with
+	cache *packcache.Cache
+	repo  string
+	// Optional pre-generated packs and bundles for protocol v2 fetches
+	offload Offloader
+	// Hash algorithm of the repo
+	format packfile.ObjectFormat
+	// What receive-pack accepts
+	limits PushLimits
+	// Run before each ref update
+	hooks []PreReceiveHook
+	// Optional signed push support
+	certs *PushCerts
+	// Optional handler of the updates of refs under procPrefix
+	procPrefix string
+	proc       ProcReceiver
+	// Reject updates that aren't fast-forwards
+	denyNonFF bool
+	// Set for connections lasting the whole session e.g. git:// and ssh
+	stateful bool
+	// Optional.  Tracks work outliving the request e.g. commit-graph updates.
+	bg *sync.WaitGroup
 }
 
 // NewProtocol instantiates a new protocol with the given reader and writer
 func NewProtocol(w io.Writer, r io.Reader) *Protocol {
-	return &Protocol{w: w, r: r}
+	return &Protocol{w: w, r: r, format: packfile.SHA1}
 }
 
-// // ListReferences writes the references in the pack protocol given the repository
-// // and service type
-// func (proto *Protocol) ListReferences(service GitServiceType, refs *repository.RepositoryReferences) {
-
-// 	// Start sending info
-// 	enc := pktline.NewEncoder(proto.w)
-// 	enc.Encode([]byte(fmt.Sprintf("# service=%s\n", service)))
-// 	enc.Encode(nil)
-
-// 	// Repo empty so send zeros
-// 	if len(refs.Heads) == 0 && len(refs.Tags) == 0 {
-// 		b0 := append([]byte("0000000000000000000000000000000000000000"), 32)
-// 		b0 = append(b0, nullCapabilities()...)
+// SetObjectFormat sets the object format of the repo.  It is advertised to
+// clients and determines the length of object ids parsed.
+func (proto *Protocol) SetObjectFormat(f packfile.ObjectFormat) {
+	proto.format = f
+}
 
-// 		enc.Encode(append(b0, 10))
-// 		enc.Encode(nil)
-// 		return
-// 	}
+// SetPushLimits sets the limits enforced by receive-pack
+func (proto *Protocol) SetPushLimits(limits PushLimits) {
+	proto.limits = limits
+}
 
-// 	// Send HEAD info
-// 	head := refs.Head
+// SetBackground sets the wait group work started by the protocol that outlives
+// it e.g. commit-graph updates after pushes is added to so it can be waited for
+func (proto *Protocol) SetBackground(wg *sync.WaitGroup) {
+	proto.bg = wg
+}
 
-// 	lh := append([]byte(fmt.Sprintf("%s HEAD", head.Hash.String())), '\x00')
-// 	lh = append(lh, capabilities()...)
+// background runs f in a goroutine added to the wait group if set
+func (proto *Protocol) background(f func()) {
+	if proto.bg != nil {
+		proto.bg.Add(1)
+	}
+	go func() {
+		if proto.bg != nil {
+			defer proto.bg.Done()
+		}
+		f()
+	}()
+}
 
-// 	if service == GitServiceUploadPack {
-// 		lh = append(lh, []byte(" symref=HEAD:refs/"+head.Ref)...)
-// 	}
+// SetPushCerts enables signed pushes to the repo.  A nonce is advertised with
+// the push-cert capability and certificates sent are verified and stored.
+func (proto *Protocol) SetPushCerts(certs *PushCerts, repo string) {
+	proto.certs = certs
+	proto.repo = repo
+}
 
-// 	enc.Encode(append(lh, 10))
+// SetStateful is set for connections lasting the whole session rather than an
+// http request.  The advertisement has no service header and upload-pack
+// answers haves as they are read as the client waits at each flush.
+func (proto *Protocol) SetStateful(stateful bool) {
+	proto.stateful = stateful
+}
 
-// 	// Send refs - heads
-// 	for href, h := range refs.Heads {
-// 		enc.Encode([]byte(fmt.Sprintf("%s refs/heads/%s\n", h.String(), href)))
-// 	}
+// SetDenyNonFastForwards rejects ref updates that would lose commits
+func (proto *Protocol) SetDenyNonFastForwards(deny bool) {
+	proto.denyNonFF = deny
+}
 
-// 	// Send refs - tags
-// 	for tref, h := range refs.Tags {
-// 		enc.Encode([]byte(fmt.Sprintf("%s refs/tags/%s\n", h.String(), tref)))
-// 	}
+// SetOffloader enables packfile-uris and bundle-uri for protocol v2 fetches of
+// the repo
+func (proto *Protocol) SetOffloader(o Offloader, repo string) {
+	proto.offload = o
+	proto.repo = repo
+}
 
-// 	enc.Encode(nil)
-// }
+// SetPackCache enables caching of upload-pack responses for the repo.  The
+// repo entries are invalidated on receive-pack.
+func (proto *Protocol) SetPackCache(cache *packcache.Cache, repo string) {
+	proto.cache = cache
+	proto.repo = repo
+}
 
 // ListReferences writes the references in the pack protocol given the repository
-// and service type
+// and service type.  Symbolic refs are advertised with the hash of their
+// target if it is in refs, HEAD should come first.
 func (proto *Protocol) ListReferences(service string, refs []*plumbing.Reference) {
 
 	// Start sending info
 	enc := pktline.NewEncoder(proto.w)
-	enc.Encode([]byte(fmt.Sprintf("# service=%s\n", service)))
-	enc.Encode(nil)
+	if !proto.stateful {
+		enc.Encode([]byte(fmt.Sprintf("# service=%s\n", service)))
+		enc.Encode(nil)
+	}
+
+	hashes := map[plumbing.ReferenceName]plumbing.Hash{}
+	for _, ref := range refs {
+		if ref.Type() == plumbing.HashReference {
+			hashes[ref.Name()] = ref.Hash()
+		}
+	}
+
+	var (
+		lines  []string
+		symref string
+	)
+	for _, ref := range refs {
+		h := ref.Hash()
+		if ref.Type() == plumbing.SymbolicReference {
+			h = hashes[ref.Target()]
+			if ref.Name() == plumbing.HEAD && !h.IsZero() {
+				symref = " symref=HEAD:" + ref.Target().String()
+			}
+		}
+		if h.IsZero() {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s", h, ref.Name()))
+	}
 
 	// Repo empty so send zeros
-	if len(refs) == 0 {
-		b0 := append([]byte("0000000000000000000000000000000000000000"), 32)
-		b0 = append(b0, nullCapabilities()...)
+	if len(lines) == 0 {
+		b0 := append([]byte(proto.format.ZeroHex()), 32)
+		b0 = append(b0, nullCapabilities(proto.capabilities(service))...)
 
 		enc.Encode(append(b0, 10))
 		enc.Encode(nil)
 		return
 	}
 
-	// Send HEAD info
-	lh := append([]byte(fmt.Sprintf("%s %s", refs[0].Hash(), refs[0].Name())), '\x00')
-	lh = append(lh, capabilities()...)
-
+	// Capabilities on the first line
+	lh := append([]byte(lines[0]), '\x00')
+	lh = append(lh, proto.capabilities(service)...)
 	if service == GitUploadPack {
-		lh = append(lh, []byte(" symref=HEAD:"+refs[0].Name())...)
+		lh = append(lh, []byte(symref)...)
 	}
 
 	enc.Encode(append(lh, 10))
 
-	for _, ref := range refs[1:] {
-		enc.Encode([]byte(fmt.Sprintf("%s %s\n", ref.Hash(), ref.Name())))
+	for _, line := range lines[1:] {
+		enc.Encode([]byte(line + "\n"))
 	}
 	enc.Encode(nil)
 }
 
-// UploadPack implements the git upload pack protocol
-func (proto *Protocol) UploadPack(store storer.EncodedObjectStorer) ([]byte, error) {
-	wants, haves, err := parseUploadPackWantsAndHaves(proto.r)
+// UploadPack implements the git upload pack protocol.  Only objects not
+// reachable from the client haves are sent.
+func (proto *Protocol) UploadPack(ctx context.Context, store storer.EncodedObjectStorer) ([]byte, error) {
+	enc := pktline.NewEncoder(proto.w)
+
+	var ack *acker
+	if proto.stateful {
+		ack = &acker{enc: enc, store: store}
+	}
+	req, err := parseUploadPackRequest(proto.r, proto.format, ack)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("DBG [upload-pack] wants=%d haves=%d", len(wants), len(haves))
+	log.Printf("DBG [upload-pack] wants=%d haves=%d", len(req.wants), len(req.haves))
 
-	enc := pktline.NewEncoder(proto.w)
-	enc.Encode([]byte("NAK\n"))
+	if ack == nil {
+		if common, ok := firstCommon(store, req.haves); ok {
+			enc.Encode([]byte(fmt.Sprintf("ACK %s\n", common)))
+		} else {
+			enc.Encode([]byte("NAK\n"))
+		}
+	}
 
-	packenc := packfile.NewEncoder(proto.w, store)
-	return packenc.Encode(wants...)
+	return proto.writePack(ctx, proto.w, store, req)
 }
 
-// ReceivePack implements the git receive pack protocol
-func (proto *Protocol) ReceivePack(objstore storer.Storer) error {
+// writePack writes the pack for the request to w using the pack cache if there
+// is one
+func (proto *Protocol) writePack(ctx context.Context, w io.Writer, store storer.EncodedObjectStorer, req uploadPackRequest) ([]byte, error) {
+	if proto.cache == nil {
+		return packfile.NewEncoder(w, store).Encode(ctx, req.wants, req.haves)
+	}
+
+	// The build is shared by all waiters so it runs with the cache context
+	// rather than this request's
+	key := packcache.Key(proto.repo, req.wants, req.haves, req.filter, req.caps)
+	return proto.cache.Serve(key, proto.repo, w, func(bctx context.Context, pw io.Writer) ([]byte, error) {
+		return packfile.NewEncoder(pw, store).Encode(bctx, req.wants, req.haves)
+	})
+}
+
+// ReceivePack implements the git receive pack protocol returning the outcome
+// of each ref update.  An error is returned if the push was not unpacked.
+func (proto *Protocol) ReceivePack(objstore storer.Storer) ([]*RefResult, error) {
 	enc := pktline.NewEncoder(proto.w)
 
-	txs, err := parseReceivePackClientRefLines(proto.r)
+	req, err := parseReceivePackClientRefLines(proto.r, proto.format, proto.certs, proto.repo)
+	if err == nil {
+		err = proto.limits.checkRefUpdates(len(req.txs))
+	}
 	if err != nil {
-		enc.Encode([]byte(fmt.Sprintf("unpack %v", err)))
-		return err
+		return unpackFailed(enc, req, err), err
 	}
-
-	// Decode packfile
-	packdec := packfile.NewDecoder(proto.r, objstore)
-	if err = packdec.Decode(); err != nil {
-		enc.Encode([]byte(fmt.Sprintf("unpack %v", err)))
-		return err
+	// Clients with nothing to update only send a flush and expect no report
+	if len(req.txs) == 0 {
+		return nil, nil
 	}
-	enc.Encode([]byte("unpack ok\n"))
 
+	// Decode packfile aborting as soon as a limit is hit.  Clients only
+	// deleting refs send none.  Objects are quarantined until the updates
+	// referencing them are accepted.
+	q := newQuarantine(objstore)
+	if !req.deletesOnly() {
+		packdec := packfile.NewDecoder(proto.r, q)
+		packdec.SetLimits(proto.limits.Limits)
+		if err = packdec.Decode(); err != nil {
+			log.Printf("ERR [receive-pack] repo=%s unpack: %v", proto.repo, err)
+			return unpackFailed(enc, req, err), err
+		}
+	}
 	// Update repo refs
-	for _, tx := range txs {
-		if er := objstore.CheckAndSetReference(tx.new(), tx.old()); er != nil {
-			enc.Encode([]byte(fmt.Sprintf("ng %s %v\n", tx.ref, er)))
-		} else {
-			enc.Encode([]byte(fmt.Sprintf("ok %s\n", tx.ref)))
+	var (
+		nodes   = commitgraph.NewNodeIndex(q)
+		results = make([]*RefResult, len(req.txs))
+	)
+	for i, tx := range req.txs {
+		results[i] = proto.updateRef(context.Background(), q, nodes, tx)
+	}
+	writeReport(enc, nil, results, req.hasCap("report-status-v2"))
+
+	if req.cert != nil && proto.certs.store != nil {
+		for _, res := range results {
+			req.cert.Results = append(req.cert.Results, CertResult{Ref: res.Ref, Status: res.Status, Reason: res.Reason})
+		}
+		if err = proto.certs.store.StorePushCert(proto.repo, req.cert); err != nil {
+			log.Printf("ERR [receive-pack] repo=%s storing push certificate: %v", proto.repo, err)
 		}
 	}
 
-	enc.Encode(nil)
-	return err
+	if proto.cache != nil {
+		proto.cache.Invalidate(proto.repo)
+	}
+
+	if pr, ok := proto.proc.(PostReceiver); ok {
+		proto.background(func() {
+			pr.PostReceive(context.Background(), objstore, results)
+		})
+	}
+
+	if u, ok := objstore.(commitgraph.Updater); ok {
+		proto.background(func() {
+			if er := u.UpdateCommitGraph(context.Background()); er != nil {
+				log.Printf("ERR [receive-pack] commit-graph update failed: %v", er)
+			}
+		})
+	}
+
+	return results, nil
+}
+
+// unpackFailed reports the unpack error and rejects all ref updates
+func unpackFailed(enc *pktline.Encoder, req receivePackRequest, err error) []*RefResult {
+	results := make([]*RefResult, len(req.txs))
+	for i, tx := range req.txs {
+		results[i] = &RefResult{Ref: tx.ref, Old: tx.oldHash, New: tx.newHash, Status: RefUnpackFailed, Reason: "unpacker error"}
+	}
+	writeReport(enc, err, results, false)
+	return results
+}
+
+// receivePackRequest is what the client sent to receive-pack
+type receivePackRequest struct {
+	txs []txRef
+	// capabilities from the first command or the push certificate
+	caps []string
+	// Verified push certificate if the push is signed
+	cert *PushCert
+}
+
+func (req receivePackRequest) hasCap(c string) bool {
+	for _, cc := range req.caps {
+		if cc == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (req receivePackRequest) deletesOnly() bool {
+	for _, tx := range req.txs {
+		if !tx.newHash.IsZero() {
+			return false
+		}
+	}
+	return true
 }
 
-func parseReceivePackClientRefLines(r io.Reader) ([]txRef, error) {
+// parseReceivePackClientRefLines parses the ref updates sent by the client.  If
+// they are sent in a push certificate it is verified with certs and returned.
+func parseReceivePackClientRefLines(r io.Reader, format packfile.ObjectFormat, certs *PushCerts, repo string) (req receivePackRequest, err error) {
 	var (
 		dec   = pktline.NewDecoder(r)
 		lines [][]byte
 	)
 
 	// Read refs from client
-	if err := dec.DecodeUntilFlush(&lines); err != nil {
+	if err = dec.DecodeUntilFlush(&lines); err != nil {
 		//log.Printf("[receive-pack] ERR %v", e)
-		return nil, err
+		return
+	}
+
+	var certLines [][]byte
+	if len(lines) > 0 && bytes.HasPrefix(lines[0], []byte("push-cert\x00")) {
+		end := 1
+		for end < len(lines) && string(lines[end]) != "push-cert-end\n" {
+			end++
+		}
+		if end == len(lines) {
+			return req, errPushCertMalformed
+		}
+		req.caps = strings.Fields(string(lines[0][len("push-cert\x00"):]))
+		certLines, lines = lines[1:end], lines[end+1:]
+	} else if len(lines) > 0 {
+		if i := bytes.IndexByte(lines[0], 0); i >= 0 {
+			req.caps = strings.Fields(string(lines[0][i+1:]))
+		}
 	}
 
-	txs := make([]txRef, len(lines))
+	req.txs = make([]txRef, len(lines))
 	for i, l := range lines {
 		log.Printf("DBG [receive-pack] %s", l)
 
-		rt, err := newTxRefFromBytes(l)
-		if err != nil {
-			return nil, err
+		if req.txs[i], err = newTxRefFromBytes(l, format); err != nil {
+			return
 		}
-		txs[i] = rt
 	}
 
-	return txs, nil
+	if certLines == nil {
+		return
+	}
+	if certs == nil {
+		return req, errPushCertUnsolicited
+	}
+
+	cert, err := ParsePushCert(bytes.Join(certLines, nil))
+	if err != nil {
+		return
+	}
+	if req.txs, err = certs.verify(repo, cert, req.txs, format); err != nil {
+		return
+	}
+	log.Printf("DBG [receive-pack] repo=%s push certificate pusher=%q signer=%s", repo, cert.Pusher, cert.Signer)
+	req.cert = cert
+
+	return
+}
+
+// uploadPackRequest is what the client sent to upload-pack
+type uploadPackRequest struct {
+	wants []plumbing.Hash
+	haves []plumbing.Hash
+	// capabilities from the first want line
+	caps   []string
+	filter string
+}
+
+// acker answers haves as they are read on stateful connections.  Without
+// multi_ack the first common object is acked and flushes are answered with a
+// NAK until there is one.
+type acker struct {
+	enc   *pktline.Encoder
+	store storer.EncodedObjectStorer
+	// Set once the flush ending the wants is read
+	negotiating bool
+	common      bool
 }
 
-func parseUploadPackWantsAndHaves(r io.Reader) (wants, haves []plumbing.Hash, err error) {
+func (a *acker) have(h plumbing.Hash) {
+	if !a.common && a.store.HasEncodedObject(h) == nil {
+		a.common = true
+		a.enc.Encode([]byte(fmt.Sprintf("ACK %s\n", h)))
+	}
+}
+
+func (a *acker) flush() {
+	if a.negotiating && !a.common {
+		a.enc.Encode([]byte("NAK\n"))
+	}
+	a.negotiating = true
+}
+
+func (a *acker) done() {
+	if !a.common {
+		a.enc.Encode([]byte("NAK\n"))
+	}
+}
+
+// parseUploadPackRequest reads the request up to done.  ack is given on
+// stateful connections.
+func parseUploadPackRequest(r io.Reader, format packfile.ObjectFormat, ack *acker) (req uploadPackRequest, err error) {
 
 	dec := pktline.NewDecoder(r)
 
@@ -192,12 +445,17 @@ func parseUploadPackWantsAndHaves(r io.Reader) (wants, haves []plumbing.Hash, er
 		if err = dec.Decode(&line); err != nil {
 			break
 		} else if len(line) == 0 {
+			if ack != nil {
+				ack.flush()
+			}
 			continue
-		} else {
-			line = line[:len(line)-1]
 		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
 
 		if string(line) == "done" {
+			if ack != nil {
+				ack.done()
+			}
 			break
 		}
 
@@ -206,10 +464,39 @@ func parseUploadPackWantsAndHaves(r io.Reader) (wants, haves []plumbing.Hash, er
 		op := strings.Split(string(line), " ")
 		switch op[0] {
 		case "want":
-			wants = append(wants, plumbing.NewHash(op[1]))
+			var h plumbing.Hash
+			if h, err = parseHash(op, format); err != nil {
+				return
+			}
+			if len(req.wants) == 0 {
+				req.caps = op[2:]
+			}
+			req.wants = append(req.wants, h)
 
 		case "have":
-			haves = append(haves, plumbing.NewHash(op[1]))
+			var h plumbing.Hash
+			if h, err = parseHash(op, format); err != nil {
+				return
+			}
+			req.haves = append(req.haves, h)
+			if ack != nil {
+				ack.have(h)
+			}
+
+		case "filter":
+			req.filter = strings.Join(op[1:], " ")
+
+		case "shallow":
+			// Not advertised but checked so malformed lines are refused
+			if _, err = parseHash(op, format); err != nil {
+				return
+			}
+
+		case "deepen":
+			if len(op) != 2 {
+				err = fmt.Errorf("invalid %s line", op[0])
+				return
+			}
 
 		}
 	}
@@ -217,11 +504,38 @@ func parseUploadPackWantsAndHaves(r io.Reader) (wants, haves []plumbing.Hash, er
 	return
 }
 
-func capabilities() []byte {
+// firstCommon returns the first have that is present in the store
+func firstCommon(store storer.EncodedObjectStorer, haves []plumbing.Hash) (plumbing.Hash, bool) {
+	for _, h := range haves {
+		if store.HasEncodedObject(h) == nil {
+			return h, true
+		}
+	}
+	return plumbing.ZeroHash, false
+}
+
+// parseHash parses the object id following a want or have
+func parseHash(op []string, format packfile.ObjectFormat) (plumbing.Hash, error) {
+	if len(op) < 2 || !format.IsHex(op[1]) {
+		return plumbing.ZeroHash, fmt.Errorf("invalid %s line", op[0])
+	}
+	return plumbing.NewHash(op[1]), nil
+}
+
+// capabilities returns the capabilities advertised for the service
+func (proto *Protocol) capabilities(service string) []byte {
 	//return []byte("report-status delete-refs ofs-delta multi_ack_detailed")
-	return []byte("report-status delete-refs ofs-delta")
+	caps := "report-status delete-refs ofs-delta object-format=" + string(proto.format)
+	if service != GitRecvPack {
+		return []byte(caps)
+	}
+	caps += " report-status-v2"
+	if proto.certs != nil {
+		caps += " push-cert=" + proto.certs.Nonce(proto.repo)
+	}
+	return []byte(caps)
 }
 
-func nullCapabilities() []byte {
-	return append(append([]byte("capabilities^{}"), '\x00'), capabilities()...)
+func nullCapabilities(caps []byte) []byte {
+	return append(append([]byte("capabilities^{}"), '\x00'), caps...)
 }
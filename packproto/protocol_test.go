@@ -0,0 +1,44 @@
+package packproto
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/euforia/go-git-server/packfile"
+	"github.com/euforia/go-git-server/pktline"
+)
+
+func TestParseUploadPackRequest(t *testing.T) {
+	hash := strings.Repeat("ab", 20)
+
+	for _, line := range []string{
+		"want\n",
+		"want \n",
+		"want nothex\n",
+		"have\n",
+		"shallow\n",
+		"shallow xyz\n",
+		"deepen\n",
+	} {
+		var buf bytes.Buffer
+		pktline.NewEncoder(&buf).Encode([]byte(line))
+		if _, err := parseUploadPackRequest(&buf, packfile.SHA1, nil); err == nil {
+			t.Fatalf("%q should fail", line)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := pktline.NewEncoder(&buf)
+	enc.Encode([]byte("want " + hash + " ofs-delta side-band-64k\n"))
+	enc.Encode([]byte("want " + hash + "\n"))
+	enc.Encode([]byte("have " + hash + "\n"))
+	enc.Encode([]byte("done\n"))
+	req, err := parseUploadPackRequest(&buf, packfile.SHA1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(req.wants) != 2 || len(req.haves) != 1 || len(req.caps) != 2 {
+		t.Fatalf("%+v", req)
+	}
+}
@@ -0,0 +1,364 @@
+package packproto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/pktline"
+)
+
+// https://github.com/git/git/blob/master/Documentation/technical/protocol-v2.txt
+
+const (
+	agent = "agent=go-git-server"
+
+	// sideband channels
+	bandData     = 1
+	bandProgress = 2
+	bandError    = 3
+	// max sideband payload i.e. max pkt-line less the band byte
+	bandMaxLen = 65515
+)
+
+// Offloader provides pre-generated packs and bundles clients can download from
+// a static location instead of having upload-pack generate them
+type Offloader interface {
+	// PackURIs returns the packs of the repo served over one of the protocols
+	PackURIs(repo string, store storer.Storer, protocols []string) ([]PackURI, error)
+	// BundleURIs returns the uris of bundles of the repo
+	BundleURIs(repo string, store storer.Storer) ([]string, error)
+}
+
+// PackURI is a pack the client can download itself
+type PackURI struct {
+	// Pack checksum
+	Hash plumbing.Hash
+	URI  string
+	// Commits the pack has the complete history of
+	Tips []plumbing.Hash
+}
+
+// IsV2Request returns true if the Git-Protocol header or GIT_PROTOCOL
+// environment value asks for protocol v2
+func IsV2Request(gitProtocol string) bool {
+	for _, p := range strings.Split(gitProtocol, ":") {
+		if p == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// AdvertiseV2 writes the protocol v2 capability advertisement for upload-pack
+func (proto *Protocol) AdvertiseV2() {
+	caps := []string{"version 2", agent, "ls-refs", "fetch", "object-format=" + string(proto.format)}
+	if proto.offload != nil {
+		caps[3] = "fetch=packfile-uris"
+		caps = append(caps, "bundle-uri")
+	}
+
+	enc := pktline.NewEncoder(proto.w)
+	for _, c := range caps {
+		enc.Encode([]byte(c + "\n"))
+	}
+	enc.Encode(nil)
+}
+
+// v2Request is a single protocol v2 command
+type v2Request struct {
+	command string
+	caps    []string
+	args    []string
+}
+
+func parseV2Request(r io.Reader) (*v2Request, error) {
+	var (
+		dec    = pktline.NewDecoder(r)
+		req    = &v2Request{}
+		inArgs bool
+	)
+
+	for {
+		var line []byte
+		err := dec.Decode(&line)
+		if err == pktline.ErrDelim {
+			inArgs = true
+			continue
+		} else if err != nil {
+			return nil, err
+		} else if line == nil {
+			break
+		}
+
+		l := strings.TrimSuffix(string(line), "\n")
+		switch {
+		case inArgs:
+			req.args = append(req.args, l)
+		case strings.HasPrefix(l, "command="):
+			req.command = strings.TrimPrefix(l, "command=")
+		default:
+			req.caps = append(req.caps, l)
+		}
+	}
+
+	if req.command == "" {
+		// A lone flush ends the session
+		if len(req.caps) == 0 && len(req.args) == 0 {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("no command")
+	}
+	return req, nil
+}
+
+// ServeUploadPackV2 serves protocol v2 upload-pack commands until the client
+// ends the session as on stateful connections
+func (proto *Protocol) ServeUploadPackV2(ctx context.Context, store storer.Storer) error {
+	for {
+		if err := proto.UploadPackV2(ctx, store); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// UploadPackV2 serves a single protocol v2 upload-pack command
+func (proto *Protocol) UploadPackV2(ctx context.Context, store storer.Storer) error {
+	req, err := parseV2Request(proto.r)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("DBG [upload-pack] v2 command=%s args=%d", req.command, len(req.args))
+
+	switch req.command {
+	case "ls-refs":
+		return proto.lsRefs(store, req.args)
+	case "fetch":
+		return proto.fetch(ctx, store, req.args)
+	case "bundle-uri":
+		if proto.offload != nil {
+			return proto.bundleURI(store)
+		}
+	}
+
+	return fmt.Errorf("unsupported command: %s", req.command)
+}
+
+func (proto *Protocol) lsRefs(store storer.Storer, args []string) error {
+	var (
+		symrefs, peel bool
+		prefixes      []string
+	)
+	for _, arg := range args {
+		switch {
+		case arg == "symrefs":
+			symrefs = true
+		case arg == "peel":
+			peel = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, strings.TrimPrefix(arg, "ref-prefix "))
+		}
+	}
+
+	iter, err := store.IterReferences()
+	if err != nil {
+		return err
+	}
+
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	// HEAD first
+	if head, err := store.Reference(plumbing.HEAD); err == nil {
+		refs = append([]*plumbing.Reference{head}, refs...)
+	}
+
+	enc := pktline.NewEncoder(proto.w)
+	for _, ref := range refs {
+		if !hasAnyPrefix(ref.Name().String(), prefixes) {
+			continue
+		}
+
+		resolved, err := storer.ResolveReference(store, ref.Name())
+		if err != nil {
+			// Unborn
+			continue
+		}
+
+		line := fmt.Sprintf("%s %s", resolved.Hash(), ref.Name())
+		if symrefs && ref.Type() == plumbing.SymbolicReference {
+			line += " symref-target:" + ref.Target().String()
+		}
+		if peel {
+			if peeled, ok := peelTag(store, resolved.Hash()); ok {
+				line += " peeled:" + peeled.String()
+			}
+		}
+		enc.Encode([]byte(line + "\n"))
+	}
+
+	return enc.Encode(nil)
+}
+
+func (proto *Protocol) fetch(ctx context.Context, store storer.Storer, args []string) error {
+	var (
+		req       uploadPackRequest
+		done      bool
+		protocols []string
+	)
+	for _, arg := range args {
+		op := strings.SplitN(arg, " ", 2)
+		switch op[0] {
+		case "want", "have":
+			h, err := parseHash(op, proto.format)
+			if err != nil {
+				return err
+			}
+			if op[0] == "want" {
+				req.wants = append(req.wants, h)
+			} else {
+				req.haves = append(req.haves, h)
+			}
+		case "done":
+			done = true
+		case "filter", "packfile-uris":
+			if len(op) != 2 || op[1] == "" {
+				return fmt.Errorf("invalid %s argument", op[0])
+			}
+			if op[0] == "filter" {
+				req.filter = op[1]
+				continue
+			}
+			protocols = strings.Split(op[1], ",")
+			req.caps = append(req.caps, arg)
+		default:
+			req.caps = append(req.caps, arg)
+		}
+	}
+
+	log.Printf("DBG [upload-pack] wants=%d haves=%d done=%v", len(req.wants), len(req.haves), done)
+
+	enc := pktline.NewEncoder(proto.w)
+
+	// Always ready to send a pack so a single round suffices
+	if !done {
+		enc.Encode([]byte("acknowledgments\n"))
+		acked := false
+		for _, h := range req.haves {
+			if store.HasEncodedObject(h) == nil {
+				enc.Encode([]byte(fmt.Sprintf("ACK %s\n", h)))
+				acked = true
+			}
+		}
+		if !acked {
+			enc.Encode([]byte("NAK\n"))
+		}
+		enc.Encode([]byte("ready\n"))
+		enc.Delim()
+	}
+
+	// Only offload full clones
+	if proto.offload != nil && len(protocols) > 0 && len(req.haves) == 0 {
+		uris, err := proto.offload.PackURIs(proto.repo, store, protocols)
+		if err != nil {
+			log.Printf("ERR [upload-pack] packfile-uris: %v", err)
+		} else if len(uris) > 0 {
+			enc.Encode([]byte("packfile-uris\n"))
+			for _, u := range uris {
+				enc.Encode([]byte(fmt.Sprintf("%s %s\n", u.Hash, u.URI)))
+				req.haves = append(req.haves, u.Tips...)
+			}
+			enc.Delim()
+		}
+	}
+
+	enc.Encode([]byte("packfile\n"))
+	if _, err := proto.writePack(ctx, &sidebandWriter{enc: enc, band: bandData}, store, req); err != nil {
+		(&sidebandWriter{enc: enc, band: bandError}).Write([]byte(err.Error()))
+		return err
+	}
+
+	return enc.Encode(nil)
+}
+
+func (proto *Protocol) bundleURI(store storer.Storer) error {
+	uris, err := proto.offload.BundleURIs(proto.repo, store)
+	if err != nil {
+		return err
+	}
+
+	enc := pktline.NewEncoder(proto.w)
+	if len(uris) > 0 {
+		enc.Encode([]byte("bundle.version=1\n"))
+		enc.Encode([]byte("bundle.mode=all\n"))
+		for i, u := range uris {
+			enc.Encode([]byte(fmt.Sprintf("bundle.bundle-%d.uri=%s\n", i, u)))
+		}
+	}
+	return enc.Encode(nil)
+}
+
+// sidebandWriter writes to a sideband channel in pkt-lines
+type sidebandWriter struct {
+	enc  *pktline.Encoder
+	band byte
+}
+
+func (sw *sidebandWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandMaxLen {
+			chunk = chunk[:bandMaxLen]
+		}
+		if err := sw.enc.Encode(append([]byte{sw.band}, chunk...)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// peelTag returns the non-tag object an annotated tag points to
+func peelTag(store storer.EncodedObjectStorer, h plumbing.Hash) (plumbing.Hash, bool) {
+	peeled := false
+	for {
+		t, err := object.GetTag(store, h)
+		if err != nil {
+			return h, peeled
+		}
+		h, peeled = t.Target, true
+	}
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,31 @@
+package packproto
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestFetchMalformedArgs(t *testing.T) {
+	hash := strings.Repeat("ab", 20)
+
+	for _, args := range [][]string{
+		{"filter"},
+		{"filter "},
+		{"packfile-uris"},
+		{"want"},
+		{"want nothex"},
+		{"have"},
+		{"have " + hash + " extra"},
+		{"want " + hash, "filter"},
+	} {
+		var out bytes.Buffer
+		proto := NewProtocol(&out, nil)
+		if err := proto.fetch(context.Background(), memory.NewStorage(), args); err == nil {
+			t.Fatalf("%q should fail", args)
+		}
+	}
+}
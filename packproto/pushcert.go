@@ -0,0 +1,260 @@
+package packproto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/euforia/go-git-server/packfile"
+)
+
+const (
+	pushCertVersion = "0.1"
+	// Nonces are issued by the advertisement and checked by the push that
+	// follows, which is a separate request over http
+	pushCertNonceSlop = 5 * time.Minute
+)
+
+var (
+	errPushCertUnsolicited = errors.New("push certificate not solicited")
+	errPushCertMalformed   = errors.New("malformed push certificate")
+	errPushCertBadNonce    = errors.New("push certificate nonce invalid")
+	errPushCertStaleNonce  = errors.New("push certificate nonce expired")
+	errPushCertMismatch    = errors.New("push certificate commands do not match ref updates")
+	errPushCertReplayed    = errors.New("push certificate nonce already used")
+	errPushCertPushee      = errors.New("push certificate pushee is not the repo")
+)
+
+// PushCert is a parsed push certificate
+type PushCert struct {
+	Version  string   `json:"version"`
+	Pusher   string   `json:"pusher"`
+	Pushee   string   `json:"pushee,omitempty"`
+	Nonce    string   `json:"nonce"`
+	Options  []string `json:"options,omitempty"`
+	Commands []string `json:"commands"`
+	// Name of the user owning the signing key once verified
+	Signer string `json:"signer,omitempty"`
+	// Outcome of the certified ref updates once applied
+	Results []CertResult `json:"results,omitempty"`
+
+	// Certificate up to the signature, which is what is signed
+	Payload   []byte `json:"-"`
+	Signature []byte `json:"-"`
+}
+
+// CertResult is the outcome of a certified ref update
+type CertResult struct {
+	Ref    string    `json:"ref"`
+	Status RefStatus `json:"status"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// ParsePushCert parses a push certificate including its signature
+func ParsePushCert(raw []byte) (*PushCert, error) {
+	var (
+		cert   = &PushCert{}
+		lines  = bytes.SplitAfter(raw, []byte("\n"))
+		inBody bool
+	)
+	for i, l := range lines {
+		if len(l) == 0 {
+			continue
+		}
+		line := strings.TrimSuffix(string(l), "\n")
+
+		if inBody {
+			if strings.HasPrefix(line, "-----BEGIN ") {
+				cert.Signature = bytes.Join(lines[i:], nil)
+				break
+			}
+			cert.Commands = append(cert.Commands, line)
+			cert.Payload = append(cert.Payload, l...)
+			continue
+		}
+		cert.Payload = append(cert.Payload, l...)
+
+		if line == "" {
+			inBody = true
+			continue
+		}
+		kv := strings.SplitN(line, " ", 2)
+		if len(kv) != 2 {
+			return nil, errPushCertMalformed
+		}
+		switch kv[0] {
+		case "certificate":
+			cert.Version = strings.TrimPrefix(kv[1], "version ")
+		case "pusher":
+			cert.Pusher = kv[1]
+		case "pushee":
+			cert.Pushee = kv[1]
+		case "nonce":
+			cert.Nonce = kv[1]
+		case "push-option":
+			cert.Options = append(cert.Options, kv[1])
+		}
+	}
+
+	if cert.Version != pushCertVersion || cert.Pusher == "" || !inBody || len(cert.Signature) == 0 {
+		return nil, errPushCertMalformed
+	}
+	return cert, nil
+}
+
+// PusherEmail returns the email of the pusher or the empty string if it has
+// none e.g. when signed with an ssh key.  git uses the signing key as the
+// pusher which is either an ident, an email or a key.
+func (cert *PushCert) PusherEmail() string {
+	i := strings.IndexByte(cert.Pusher, '<')
+	j := strings.IndexByte(cert.Pusher, '>')
+	if i >= 0 && j > i {
+		return cert.Pusher[i+1 : j]
+	}
+	if f := strings.Fields(cert.Pusher); len(f) > 0 && strings.Contains(f[0], "@") {
+		return f[0]
+	}
+	return ""
+}
+
+// Raw returns the certificate as signed by the client
+func (cert *PushCert) Raw() []byte {
+	return append(append([]byte(nil), cert.Payload...), cert.Signature...)
+}
+
+// CertVerifier verifies the signature of push certificates
+type CertVerifier interface {
+	// VerifyPushCert returns the name of the user owning the signing key
+	VerifyPushCert(cert *PushCert) (string, error)
+}
+
+// CertStore keeps verified push certificates along with the results of their
+// ref updates for auditing
+type CertStore interface {
+	StorePushCert(repo string, cert *PushCert) error
+}
+
+// PushCerts issues push certificate nonces and verifies the certificates of
+// signed pushes.  Nonces are only accepted once per server.
+type PushCerts struct {
+	secret   []byte
+	verifier CertVerifier
+	store    CertStore
+
+	mu sync.Mutex
+	// nonces used and when they expire
+	used map[string]time.Time
+}
+
+// NewPushCerts instantiates push certificate handling with the secret nonces
+// are keyed with.  Verified certificates are kept in store.
+func NewPushCerts(secret []byte, verifier CertVerifier, store CertStore) *PushCerts {
+	return &PushCerts{secret: secret, verifier: verifier, store: store, used: map[string]time.Time{}}
+}
+
+// Nonce returns a nonce for a push to the repo
+func (pc *PushCerts) Nonce(repo string) string {
+	salt := make([]byte, 8)
+	rand.Read(salt)
+	return pc.nonceAt(repo, time.Now().Unix(), hex.EncodeToString(salt))
+}
+
+// nonceAt returns <unix time>-<salt>-<hmac of repo, time and salt>, so nonces
+// can be checked by any server with the secret without keeping state
+func (pc *PushCerts) nonceAt(repo string, ts int64, salt string) string {
+	mac := hmac.New(sha256.New, pc.secret)
+	fmt.Fprintf(mac, "%s:%d:%s", repo, ts, salt)
+	return fmt.Sprintf("%d-%s-%s", ts, salt, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func (pc *PushCerts) checkNonce(repo, nonce string) error {
+	parts := strings.SplitN(nonce, "-", 3)
+	if len(parts) != 3 {
+		return errPushCertBadNonce
+	}
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !hmac.Equal([]byte(pc.nonceAt(repo, ts, parts[1])), []byte(nonce)) {
+		return errPushCertBadNonce
+	}
+
+	age := time.Since(time.Unix(ts, 0))
+	if age > pushCertNonceSlop || age < -pushCertNonceSlop {
+		return errPushCertStaleNonce
+	}
+	return pc.use(nonce, time.Unix(ts, 0).Add(pushCertNonceSlop))
+}
+
+// use records the nonce as used until it expires.  Expired ones are dropped.
+func (pc *PushCerts) use(nonce string, expires time.Time) error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	now := time.Now()
+	for n, exp := range pc.used {
+		if exp.Before(now) {
+			delete(pc.used, n)
+		}
+	}
+	if _, ok := pc.used[nonce]; ok {
+		return errPushCertReplayed
+	}
+	pc.used[nonce] = expires
+	return nil
+}
+
+// checkPushee checks the url pushed to, as given by git, names the repo
+func checkPushee(repo, pushee string) error {
+	p := strings.TrimSuffix(strings.TrimSuffix(pushee, "/"), ".git")
+	if p == repo || strings.HasSuffix(p, "/"+repo) || strings.HasSuffix(p, ":"+repo) {
+		return nil
+	}
+	return errPushCertPushee
+}
+
+// verify checks the certificate was issued for the repo, is signed by a known
+// key and returns the ref updates it certifies.  Commands sent outside the
+// certificate must be the same ones.  The ref updates are returned on failure
+// too so they can be rejected.
+func (pc *PushCerts) verify(repo string, cert *PushCert, unsigned []txRef, format packfile.ObjectFormat) ([]txRef, error) {
+	txs := make([]txRef, len(cert.Commands))
+	for i, c := range cert.Commands {
+		tx, err := newTxRefFromBytes([]byte(c), format)
+		if err != nil {
+			return unsigned, err
+		}
+		txs[i] = tx
+	}
+
+	if len(unsigned) > 0 {
+		if len(unsigned) != len(txs) {
+			return txs, errPushCertMismatch
+		}
+		for i := range txs {
+			if unsigned[i] != txs[i] {
+				return txs, errPushCertMismatch
+			}
+		}
+	}
+
+	if err := checkPushee(repo, cert.Pushee); err != nil {
+		return txs, err
+	}
+	if err := pc.checkNonce(repo, cert.Nonce); err != nil {
+		return txs, err
+	}
+	signer, err := pc.verifier.VerifyPushCert(cert)
+	if err != nil {
+		return txs, err
+	}
+	cert.Signer = signer
+
+	return txs, nil
+}
@@ -0,0 +1,107 @@
+package packproto
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/euforia/go-git-server/packfile"
+	"github.com/euforia/go-git-server/pktline"
+)
+
+type testCertVerifier struct{ err error }
+
+func (v *testCertVerifier) VerifyPushCert(cert *PushCert) (string, error) {
+	if !bytes.HasSuffix(cert.Payload, []byte(cert.Commands[len(cert.Commands)-1]+"\n")) {
+		return "", errors.New("payload")
+	}
+	return "alice", v.err
+}
+
+func testPushCert(nonce, command string) [][]byte {
+	return [][]byte{
+		[]byte("push-cert\x00report-status\n"),
+		[]byte("certificate version 0.1\n"),
+		[]byte("pusher alice <alice@example.com> 1700000000 +0000\n"),
+		[]byte("pushee http://localhost/ns/repo\n"),
+		[]byte("nonce " + nonce + "\n"),
+		[]byte("\n"),
+		[]byte(command + "\n"),
+		[]byte("-----BEGIN PGP SIGNATURE-----\n"),
+		[]byte("sig\n"),
+		[]byte("-----END PGP SIGNATURE-----\n"),
+		[]byte("push-cert-end\n"),
+	}
+}
+
+func encodeLines(lines [][]byte) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	enc := pktline.NewEncoder(buf)
+	for _, l := range lines {
+		enc.Encode(l)
+	}
+	enc.Encode(nil)
+	return buf
+}
+
+func TestPushCert(t *testing.T) {
+	var (
+		certs   = NewPushCerts([]byte("secret"), &testCertVerifier{}, nil)
+		command = packfile.SHA1.ZeroHex() + " " + strings.Repeat("ab", 20) + " refs/heads/master"
+	)
+
+	req, err := parseReceivePackClientRefLines(encodeLines(testPushCert(certs.Nonce("ns/repo"), command)), packfile.SHA1, certs, "ns/repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs, cert := req.txs, req.cert
+	if !req.hasCap("report-status") {
+		t.Fatal(req.caps)
+	}
+	if len(txs) != 1 || txs[0].ref != "refs/heads/master" {
+		t.Fatalf("%+v", txs)
+	}
+	if cert.Signer != "alice" || cert.PusherEmail() != "alice@example.com" || cert.Pushee == "" {
+		t.Fatalf("%+v", cert)
+	}
+	if _, err = ParsePushCert(cert.Raw()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replayed
+	nonce := certs.Nonce("ns/repo")
+	if _, err = parseReceivePackClientRefLines(encodeLines(testPushCert(nonce, command)), packfile.SHA1, certs, "ns/repo"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = parseReceivePackClientRefLines(encodeLines(testPushCert(nonce, command)), packfile.SHA1, certs, "ns/repo")
+	if err != errPushCertReplayed {
+		t.Fatal(err)
+	}
+
+	// Pushed to another repo
+	_, err = parseReceivePackClientRefLines(encodeLines(testPushCert(certs.Nonce("ns/other"), command)), packfile.SHA1, certs, "ns/other")
+	if err != errPushCertPushee {
+		t.Fatal(err)
+	}
+
+	// Nonce of another repo
+	_, err = parseReceivePackClientRefLines(encodeLines(testPushCert(certs.Nonce("ns/other"), command)), packfile.SHA1, certs, "ns/repo")
+	if err != errPushCertBadNonce {
+		t.Fatal(err)
+	}
+
+	// Unsigned commands differing from the certified ones
+	lines := testPushCert(certs.Nonce("ns/repo"), command)
+	lines = append(lines, []byte(strings.Replace(command, "master", "other", 1)+"\n"))
+	_, err = parseReceivePackClientRefLines(encodeLines(lines), packfile.SHA1, certs, "ns/repo")
+	if err != errPushCertMismatch {
+		t.Fatal(err)
+	}
+
+	// Not solicited
+	_, err = parseReceivePackClientRefLines(encodeLines(testPushCert("x", command)), packfile.SHA1, nil, "ns/repo")
+	if err != errPushCertUnsolicited {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+package packproto
+
+import (
+	"context"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/commitgraph"
+	"github.com/euforia/go-git-server/packfile"
+)
+
+// quarantine holds the objects of a push in memory on top of the repo store.
+// Objects are only written to the store once a ref update referencing them is
+// accepted so those of rejected updates are never readable.
+type quarantine struct {
+	storer.Storer
+	objs map[plumbing.Hash]plumbing.EncodedObject
+}
+
+func newQuarantine(st storer.Storer) *quarantine {
+	return &quarantine{Storer: st, objs: map[plumbing.Hash]plumbing.EncodedObject{}}
+}
+
+func (q *quarantine) SetEncodedObject(obj plumbing.EncodedObject) (plumbing.Hash, error) {
+	h := obj.Hash()
+	q.objs[h] = obj
+	return h, nil
+}
+
+func (q *quarantine) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if obj, ok := q.objs[h]; ok {
+		if t != plumbing.AnyObject && obj.Type() != t {
+			return nil, plumbing.ErrObjectNotFound
+		}
+		return obj, nil
+	}
+	return q.Storer.EncodedObject(t, h)
+}
+
+func (q *quarantine) HasEncodedObject(h plumbing.Hash) error {
+	if _, ok := q.objs[h]; ok {
+		return nil
+	}
+	return q.Storer.HasEncodedObject(h)
+}
+
+func (q *quarantine) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	if obj, ok := q.objs[h]; ok {
+		return obj.Size(), nil
+	}
+	return q.Storer.EncodedObjectSize(h)
+}
+
+func (q *quarantine) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
+	iter, err := q.Storer.IterEncodedObjects(t)
+	if err != nil {
+		return nil, err
+	}
+	var objs []plumbing.EncodedObject
+	for _, obj := range q.objs {
+		if t == plumbing.AnyObject || obj.Type() == t {
+			objs = append(objs, obj)
+		}
+	}
+	return storer.NewMultiEncodedObjectIter([]storer.EncodedObjectIter{storer.NewEncodedObjectSliceIter(objs), iter}), nil
+}
+
+// CommitGraph returns the commit-graph of the store so walks over the
+// quarantine use it
+func (q *quarantine) CommitGraph() (*commitgraph.Graph, error) {
+	if s, ok := q.Storer.(commitgraph.Storer); ok {
+		return s.CommitGraph()
+	}
+	return nil, nil
+}
+
+// release writes the quarantined objects reachable from h to the store.
+// Those reachable from refs are already there as are the objects of trees in
+// the store so only quarantined trees are read.
+func (q *quarantine) release(ctx context.Context, h plumbing.Hash) error {
+	if h.IsZero() || len(q.objs) == 0 {
+		return nil
+	}
+
+	ow := packfile.NewObjectWalker(q)
+	iter, err := q.IterReferences()
+	if err != nil {
+		return err
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			ow.Hide(ref.Hash())
+		}
+		return nil
+	})
+
+	if err = ow.WalkCommits(ctx, []plumbing.Hash{h}, q.releaseObject); err != nil {
+		return err
+	}
+	// Tags or a tree or blob pushed for h
+	return q.releaseObject(h)
+}
+
+// releaseObject writes the quarantined object along with the quarantined
+// objects it refers to, except commit parents, to the store.
+func (q *quarantine) releaseObject(h plumbing.Hash) error {
+	obj, ok := q.objs[h]
+	if !ok {
+		return nil
+	}
+	delete(q.objs, h)
+
+	var err error
+	switch obj.Type() {
+	case plumbing.CommitObject:
+		c := &object.Commit{}
+		if err = c.Decode(obj); err == nil {
+			err = q.releaseObject(c.TreeHash)
+		}
+
+	case plumbing.TreeObject:
+		t := &object.Tree{}
+		if err = t.Decode(obj); err != nil {
+			break
+		}
+		for _, entry := range t.Entries {
+			if entry.Mode == filemode.Submodule {
+				continue
+			}
+			if err = q.releaseObject(entry.Hash); err != nil {
+				break
+			}
+		}
+
+	case plumbing.TagObject:
+		tag := &object.Tag{}
+		if err = tag.Decode(obj); err == nil {
+			err = q.releaseObject(tag.Target)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Storer.SetEncodedObject(obj)
+	return err
+}
@@ -0,0 +1,44 @@
+package packproto
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func TestQuarantine(t *testing.T) {
+	var (
+		st      = memory.NewStorage()
+		base    = testCommit(t, st, "base")
+		pushed  = memory.NewStorage()
+		kept    = testCommit(t, pushed, "kept", base)
+		dropped = testCommit(t, pushed, "dropped", base)
+	)
+	st.SetReference(plumbing.NewHashReference("refs/heads/main", base))
+
+	q := newQuarantine(st)
+	iter, _ := pushed.IterEncodedObjects(plumbing.AnyObject)
+	iter.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := q.SetEncodedObject(obj)
+		return err
+	})
+
+	if err := q.HasEncodedObject(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.HasEncodedObject(kept); err != plumbing.ErrObjectNotFound {
+		t.Fatal("quarantined object readable", err)
+	}
+
+	if err := q.release(context.Background(), kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.HasEncodedObject(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.HasEncodedObject(dropped); err != plumbing.ErrObjectNotFound {
+		t.Fatal("unreleased object readable", err)
+	}
+}
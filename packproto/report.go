@@ -0,0 +1,147 @@
+package packproto
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/euforia/go-git-server/commitgraph"
+	"github.com/euforia/go-git-server/pktline"
+)
+
+// RefStatus is the outcome of a ref update
+type RefStatus string
+
+const (
+	// RefOK updates were applied
+	RefOK RefStatus = "ok"
+	// RefUnpackFailed updates were not applied as the push was not unpacked
+	RefUnpackFailed RefStatus = "unpacker-error"
+	// RefRejectedByHook updates were vetoed by a pre-receive hook or failed in
+	// the proc receiver
+	RefRejectedByHook RefStatus = "rejected-by-hook"
+	// RefStale updates have an old value other than the ref's
+	RefStale RefStatus = "stale"
+	// RefNonFastForward updates were rejected as they would lose commits
+	RefNonFastForward RefStatus = "non-fast-forward"
+	// RefRejected updates are not allowed e.g. deleting a proc receiver ref
+	RefRejected RefStatus = "rejected"
+	// RefFailed updates couldn't be written
+	RefFailed RefStatus = "failed"
+)
+
+// RefResult is the outcome of a ref update of a push
+type RefResult struct {
+	Ref string
+	// Ref actually written if not Ref e.g. by a proc receiver
+	RefName string
+	Old     plumbing.Hash
+	New     plumbing.Hash
+	// Set for accepted non fast-forward updates
+	Forced bool
+	Status RefStatus
+	// Why the update was not applied
+	Reason string
+}
+
+// OK returns true if the update was applied
+func (res *RefResult) OK() bool {
+	return res.Status == RefOK
+}
+
+func (res *RefResult) reject(status RefStatus, reason interface{}) *RefResult {
+	res.Status, res.Reason = status, fmt.Sprint(reason)
+	return res
+}
+
+// updateRef runs the hooks for the update and applies it writing the objects
+// it references out of quarantine first
+func (proto *Protocol) updateRef(ctx context.Context, store *quarantine, nodes *commitgraph.NodeIndex, tx txRef) *RefResult {
+	res := &RefResult{Ref: tx.ref, Old: tx.oldHash, New: tx.newHash}
+
+	if proto.isProcOwnedRef(tx.ref) {
+		return res.reject(RefRejected, "written by pushes to "+proto.procPrefix)
+	}
+
+	if err := proto.preReceive(ctx, store, tx); err != nil {
+		log.Printf("DBG [receive-pack] repo=%s ref=%s rejected: %v", proto.repo, tx.ref, err)
+		return res.reject(RefRejectedByHook, err)
+	}
+
+	if proto.isProcRef(tx.ref) {
+		if err := store.release(ctx, tx.newHash); err != nil {
+			return res.reject(RefFailed, err)
+		}
+		return proto.procReceive(ctx, store, tx, res)
+	}
+
+	if !tx.isFastForward(nodes) {
+		if proto.denyNonFF {
+			return res.reject(RefNonFastForward, "non-fast-forward")
+		}
+		log.Printf("DBG [receive-pack] forced update %s", tx.ref)
+		res.Forced = true
+	}
+
+	cur, err := store.Reference(plumbing.ReferenceName(tx.ref))
+	switch {
+	case err == plumbing.ErrReferenceNotFound:
+		if !tx.oldHash.IsZero() {
+			return res.reject(RefStale, "stale info")
+		}
+	case err != nil:
+		return res.reject(RefFailed, err)
+	case cur.Hash() != tx.oldHash:
+		return res.reject(RefStale, "stale info")
+	}
+
+	if tx.newHash.IsZero() {
+		err = store.RemoveReference(plumbing.ReferenceName(tx.ref))
+	} else if err = store.release(ctx, tx.newHash); err == nil {
+		err = store.CheckAndSetReference(tx.new(), tx.old())
+	}
+	if err != nil {
+		return res.reject(RefFailed, err)
+	}
+
+	res.Status = RefOK
+	return res
+}
+
+// writeReport writes the report-status of the push.  report-status-v2
+// clients are also sent the ref written and its values.
+func writeReport(enc *pktline.Encoder, unpackErr error, results []*RefResult, v2 bool) {
+	if unpackErr != nil {
+		enc.Encode([]byte(fmt.Sprintf("unpack %v\n", unpackErr)))
+	} else {
+		enc.Encode([]byte("unpack ok\n"))
+	}
+
+	for _, res := range results {
+		if !res.OK() {
+			enc.Encode([]byte(fmt.Sprintf("ng %s %s\n", res.Ref, res.Reason)))
+			continue
+		}
+		enc.Encode([]byte(fmt.Sprintf("ok %s\n", res.Ref)))
+		if !v2 {
+			continue
+		}
+
+		if res.RefName != "" && res.RefName != res.Ref {
+			enc.Encode([]byte(fmt.Sprintf("option refname %s\n", res.RefName)))
+		}
+		if !res.Old.IsZero() {
+			enc.Encode([]byte(fmt.Sprintf("option old-oid %s\n", res.Old)))
+		}
+		if !res.New.IsZero() {
+			enc.Encode([]byte(fmt.Sprintf("option new-oid %s\n", res.New)))
+		}
+		if res.Forced {
+			enc.Encode([]byte("option forced-update\n"))
+		}
+	}
+
+	enc.Encode(nil)
+}
@@ -0,0 +1,92 @@
+package packproto
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+func testCommit(t *testing.T, st *memory.Storage, msg string, parents ...plumbing.Hash) plumbing.Hash {
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1, 0)}
+
+	tree := st.NewEncodedObject()
+	(&object.Tree{}).Encode(tree)
+	th, _ := st.SetEncodedObject(tree)
+
+	obj := st.NewEncodedObject()
+	c := &object.Commit{Author: sig, Committer: sig, Message: msg, TreeHash: th, ParentHashes: parents}
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := st.SetEncodedObject(obj)
+	return h
+}
+
+// emptyPack is a pack without objects as sent when the remote has them all
+func emptyPack() []byte {
+	b := []byte("PACK\x00\x00\x00\x02\x00\x00\x00\x00")
+	sum := sha1.Sum(b)
+	return append(b, sum[:]...)
+}
+
+func TestReceivePackResults(t *testing.T) {
+	var (
+		st   = memory.NewStorage()
+		base = testCommit(t, st, "base")
+		b    = testCommit(t, st, "b", base)
+		c    = testCommit(t, st, "c", base)
+		zero = plumbing.ZeroHash
+	)
+	st.SetReference(plumbing.NewHashReference("refs/heads/main", b))
+	st.SetReference(plumbing.NewHashReference("refs/heads/old", base))
+
+	cmds := encodeLines([][]byte{
+		[]byte(b.String() + " " + c.String() + " refs/heads/main\x00 report-status-v2"),
+		[]byte(c.String() + " " + b.String() + " refs/heads/stale"),
+		[]byte(base.String() + " " + zero.String() + " refs/heads/old"),
+	})
+	out := new(bytes.Buffer)
+
+	proto := NewProtocol(out, bytes.NewReader(append(cmds.Bytes(), emptyPack()...)))
+	results, err := proto.ReceivePack(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if results[0].Status != RefOK || !results[0].Forced {
+		t.Fatalf("%+v", results[0])
+	}
+	if results[1].Status != RefStale {
+		t.Fatalf("%+v", results[1])
+	}
+	if results[2].Status != RefOK {
+		t.Fatalf("%+v", results[2])
+	}
+	if _, err = st.Reference("refs/heads/old"); err != plumbing.ErrReferenceNotFound {
+		t.Fatal("ref not deleted", err)
+	}
+
+	report := out.String()
+	for _, s := range []string{"unpack ok", "ok refs/heads/main", "option old-oid " + b.String(), "option forced-update", "ng refs/heads/stale stale info"} {
+		if !strings.Contains(report, s) {
+			t.Fatalf("%q not in %q", s, report)
+		}
+	}
+
+	// Rewinding is rejected when denied
+	cmds = encodeLines([][]byte{[]byte(c.String() + " " + b.String() + " refs/heads/main\x00 report-status")})
+	proto = NewProtocol(new(bytes.Buffer), bytes.NewReader(append(cmds.Bytes(), emptyPack()...)))
+	proto.SetDenyNonFastForwards(true)
+	if results, err = proto.ReceivePack(st); err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Status != RefNonFastForward {
+		t.Fatalf("%+v", results[0])
+	}
+}
@@ -1,10 +1,15 @@
 package packproto
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"strings"
 
 	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/euforia/go-git-server/commitgraph"
+	"github.com/euforia/go-git-server/packfile"
 )
 
 // TxRef is a transaction to update a repo reference
@@ -14,18 +19,21 @@ type txRef struct {
 	ref     string
 }
 
-// Parses old hash, new hash, and ref from a line in that order
-func newTxRefFromBytes(line []byte) (rt txRef, err error) {
+// Parses old hash, new hash, and ref from a line in that order.  The hashes
+// must be of the given object format.  Capabilities after a NUL are dropped.
+func newTxRefFromBytes(line []byte, format packfile.ObjectFormat) (rt txRef, err error) {
+	if i := bytes.IndexByte(line, 0); i >= 0 {
+		line = line[:i]
+	}
 	arr := strings.Split(string(line), " ")
-	if len(arr) < 3 {
+	if len(arr) < 3 || !format.IsHex(arr[0]) || !format.IsHex(arr[1]) {
 		err = errors.New("invalid line: " + string(line))
 		return
 	}
-
 	rt = txRef{
 		oldHash: plumbing.NewHash(arr[0]),
 		newHash: plumbing.NewHash(arr[1]),
-		ref:     strings.TrimSuffix(arr[2], string([]byte{0})),
+		ref:     arr[2],
 	}
 
 	return
@@ -40,3 +48,23 @@ func (tx *txRef) old() *plumbing.Reference {
 func (tx *txRef) new() *plumbing.Reference {
 	return plumbing.NewHashReference(plumbing.ReferenceName(tx.ref), tx.newHash)
 }
+
+// isFastForward returns true if the new hash descends from the old one.  Ref
+// creations and deletions are considered fast-forwards.
+func (tx *txRef) isFastForward(nodes *commitgraph.NodeIndex) bool {
+	if tx.oldHash.IsZero() || tx.newHash.IsZero() {
+		return true
+	}
+
+	oldc, err := nodes.Peel(tx.oldHash)
+	if err != nil {
+		return false
+	}
+	newc, err := nodes.Peel(tx.newHash)
+	if err != nil {
+		return false
+	}
+
+	ok, err := commitgraph.IsAncestor(context.Background(), nodes, oldc, newc)
+	return err == nil && ok
+}
@@ -0,0 +1,29 @@
+package packproto
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/euforia/go-git-server/packfile"
+)
+
+func TestNewTxRefFromBytes(t *testing.T) {
+	var (
+		sha1Zero   = packfile.SHA1.ZeroHex()
+		sha1Hash   = strings.Repeat("ab", 20)
+		sha256Hash = strings.Repeat("ab", 32)
+	)
+
+	tx, err := newTxRefFromBytes([]byte(sha1Zero+" "+sha1Hash+" refs/heads/master\x00report-status"), packfile.SHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tx.oldHash.IsZero() || tx.newHash.String() != sha1Hash || tx.ref != "refs/heads/master" {
+		t.Fatalf("%+v", tx)
+	}
+
+	// Wrong length for the format
+	if _, err = newTxRefFromBytes([]byte(sha1Zero+" "+sha256Hash+" refs/heads/master"), packfile.SHA1); err == nil {
+		t.Fatal("should fail")
+	}
+}
@@ -16,6 +16,10 @@ var (
 	ErrInputExcess = errors.New("input is too long")
 	ErrTooLong     = errors.New("too long payload")
 	ErrInvalidLen  = errors.New("invalid length")
+	// ErrDelim is returned by Decode on a protocol v2 delim-pkt
+	ErrDelim = errors.New("delim-pkt")
+	// ErrResponseEnd is returned by Decode on a protocol v2 response-end-pkt
+	ErrResponseEnd = errors.New("response-end-pkt")
 )
 
 const (
@@ -48,9 +52,14 @@ func (d *Decoder) Decode(payload *[]byte) error {
 	if err != nil {
 		return err
 	}
-	if lineLen == 0 { // flush-pkt
+	switch lineLen {
+	case 0: // flush-pkt
 		*payload = nil
 		return nil
+	case 1:
+		return ErrDelim
+	case 2:
+		return ErrResponseEnd
 	}
 	if lineLen < headLen {
 		return ErrInvalidLen
@@ -127,6 +136,12 @@ func (e *Encoder) Encode(payload []byte) error {
 	return nil
 }
 
+// Delim writes a protocol v2 delim-pkt
+func (e *Encoder) Delim() error {
+	_, err := e.w.Write([]byte("0001"))
+	return err
+}
+
 // Encode returns payload encoded in pkt-line format.
 func Encode(payload []byte) ([]byte, error) {
 	if payload == nil {
@@ -81,3 +81,13 @@ func TestMultiple(t *testing.T) {
 		}
 	}
 }
+
+func TestSpecialPackets(t *testing.T) {
+	reader := NewDecoder(strings.NewReader("0001" + "0002" + "0000"))
+	for i, expected := range []error{ErrDelim, ErrResponseEnd, nil} {
+		var actual []byte
+		if err := reader.Decode(&actual); err != expected {
+			t.Errorf("%d: expected %v, got %v", i, expected, err)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+// Package policy implements declarative content policies evaluated over the
+// commits introduced by a push
+package policy
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/packproto"
+)
+
+// maxReported is the max violations reported for a single ref
+const maxReported = 5
+
+// Policy is the content policy of a repo.  Zero values disable a rule.
+type Policy struct {
+	// Globs of paths that may not be added or modified.  Globs without a
+	// slash match a name at any depth.  Globs matching a directory match
+	// everything in it.
+	ForbiddenPaths []string `json:"forbidden_paths,omitempty"`
+	// Max blob sizes for paths matching a glob.  The first match applies.
+	MaxFileSizes []PathSize `json:"max_file_sizes,omitempty"`
+	// Regex commit messages must match e.g. a ticket id
+	MessagePattern string `json:"message_pattern,omitempty"`
+	// Domains author emails must be in
+	AuthorDomains []string `json:"author_domains,omitempty"`
+	// Require a Signed-off-by trailer by the author
+	RequireSignOff bool `json:"require_signoff,omitempty"`
+}
+
+// PathSize is the max size of files matching a glob
+type PathSize struct {
+	Path    string `json:"path"`
+	MaxSize int64  `json:"max_size"`
+}
+
+// Violation is a commit breaking a rule
+type Violation struct {
+	Commit plumbing.Hash
+	// Empty for rules on the commit itself
+	Path   string
+	Reason string
+}
+
+func (v *Violation) Error() string {
+	if v.Path == "" {
+		return fmt.Sprintf("%s: %s", v.Commit.String()[:12], v.Reason)
+	}
+	return fmt.Sprintf("%s: %s: %s", v.Commit.String()[:12], v.Path, v.Reason)
+}
+
+// Violations are all the violations of a ref update
+type Violations []*Violation
+
+func (vs Violations) Error() string {
+	strs := make([]string, 0, maxReported+1)
+	for i, v := range vs {
+		if i == maxReported {
+			strs = append(strs, fmt.Sprintf("and %d more", len(vs)-i))
+			break
+		}
+		strs = append(strs, v.Error())
+	}
+	return strings.Join(strs, "; ")
+}
+
+// Clone returns a deep copy of the policy
+func (p *Policy) Clone() *Policy {
+	c := *p
+	c.ForbiddenPaths = append([]string(nil), p.ForbiddenPaths...)
+	c.MaxFileSizes = append([]PathSize(nil), p.MaxFileSizes...)
+	c.AuthorDomains = append([]string(nil), p.AuthorDomains...)
+	return &c
+}
+
+// Validate checks the globs and the message pattern are well formed
+func (p *Policy) Validate() error {
+	for _, g := range p.ForbiddenPaths {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("forbidden path %s: %v", g, err)
+		}
+	}
+	for _, ps := range p.MaxFileSizes {
+		if _, err := path.Match(ps.Path, ""); err != nil {
+			return fmt.Errorf("max file size path %s: %v", ps.Path, err)
+		}
+	}
+	if _, err := regexp.Compile(p.MessagePattern); err != nil {
+		return fmt.Errorf("message pattern: %v", err)
+	}
+	return nil
+}
+
+// PreReceive checks the commits of a ref update.  It implements
+// packproto.PreReceiveHook.
+func (p *Policy) PreReceive(ctx context.Context, store storer.Storer, update packproto.RefUpdate, commits []plumbing.Hash) error {
+	msgRe, err := regexp.Compile(p.MessagePattern)
+	if err != nil {
+		return err
+	}
+
+	var vs Violations
+	for _, h := range commits {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		c, err := object.GetCommit(store, h)
+		if err != nil {
+			return err
+		}
+
+		for _, reason := range p.checkCommit(c, msgRe) {
+			vs = append(vs, &Violation{Commit: h, Reason: reason})
+		}
+
+		if len(p.ForbiddenPaths) == 0 && len(p.MaxFileSizes) == 0 {
+			continue
+		}
+		changes, err := ChangedFiles(ctx, store, c)
+		if err != nil {
+			return err
+		}
+		for _, f := range changes {
+			if reason := p.checkFile(store, f); reason != "" {
+				vs = append(vs, &Violation{Commit: h, Path: f.Name, Reason: reason})
+			}
+		}
+	}
+
+	if len(vs) > 0 {
+		return vs
+	}
+	return nil
+}
+
+func (p *Policy) checkCommit(c *object.Commit, msgRe *regexp.Regexp) []string {
+	var reasons []string
+
+	if p.MessagePattern != "" && !msgRe.MatchString(c.Message) {
+		reasons = append(reasons, "message does not match "+p.MessagePattern)
+	}
+
+	if len(p.AuthorDomains) > 0 && !domainIn(c.Author.Email, p.AuthorDomains) {
+		reasons = append(reasons, "author email domain not allowed: "+c.Author.Email)
+	}
+
+	if p.RequireSignOff && !hasSignOff(c.Message, c.Author.Email) {
+		reasons = append(reasons, "missing Signed-off-by: "+c.Author.Email)
+	}
+
+	return reasons
+}
+
+func (p *Policy) checkFile(store storer.EncodedObjectStorer, f *object.TreeEntry) string {
+	for _, g := range p.ForbiddenPaths {
+		if MatchPath(g, f.Name) {
+			return "forbidden path " + g
+		}
+	}
+
+	for _, ps := range p.MaxFileSizes {
+		if !MatchPath(ps.Path, f.Name) {
+			continue
+		}
+		obj, err := store.EncodedObject(plumbing.BlobObject, f.Hash)
+		if err == nil && obj.Size() > ps.MaxSize {
+			return fmt.Sprintf("size %d exceeds %d", obj.Size(), ps.MaxSize)
+		}
+		break
+	}
+
+	return ""
+}
+
+// ChangedFiles returns the files a commit adds or modifies compared to its
+// first parent.  Names are full paths.  Submodules are skipped.
+func ChangedFiles(ctx context.Context, store storer.EncodedObjectStorer, c *object.Commit) ([]*object.TreeEntry, error) {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var ptree *object.Tree
+	if len(c.ParentHashes) > 0 {
+		parent, err := object.GetCommit(store, c.ParentHashes[0])
+		if err != nil {
+			return nil, err
+		}
+		if ptree, err = parent.Tree(); err != nil {
+			return nil, err
+		}
+	}
+
+	changes, err := object.DiffTreeContext(ctx, ptree, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]*object.TreeEntry, 0, len(changes))
+	for _, ch := range changes {
+		// Deletions have no destination
+		if ch.To.Name == "" || ch.To.TreeEntry.Mode == filemode.Submodule {
+			continue
+		}
+		files = append(files, &object.TreeEntry{
+			Name: ch.To.Name,
+			Mode: ch.To.TreeEntry.Mode,
+			Hash: ch.To.TreeEntry.Hash,
+		})
+	}
+	return files, nil
+}
+
+// MatchPath matches a glob against the path and its directories, so globs
+// naming a directory match everything in it.  Globs without a slash match a
+// name at any depth.
+func MatchPath(glob, name string) bool {
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		subject := strings.Join(parts[:i+1], "/")
+		if !strings.Contains(glob, "/") {
+			subject = parts[i]
+		}
+		if ok, _ := path.Match(glob, subject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func domainIn(email string, domains []string) bool {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return false
+	}
+	domain := email[i+1:]
+	for _, d := range domains {
+		if strings.EqualFold(domain, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSignOff returns true if the message has a Signed-off-by trailer with the
+// email
+func hasSignOff(msg, email string) bool {
+	for _, line := range strings.Split(msg, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "Signed-off-by:") {
+			continue
+		}
+		if strings.Contains(strings.ToLower(line), "<"+strings.ToLower(email)+">") {
+			return true
+		}
+	}
+	return false
+}
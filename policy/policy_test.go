@@ -0,0 +1,122 @@
+package policy
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+
+	"github.com/euforia/go-git-server/packproto"
+)
+
+func testObject(t *testing.T, st *memory.Storage, enc interface {
+	Encode(plumbing.EncodedObject) error
+}) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	if err := enc.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testBlob(t *testing.T, st *memory.Storage, data string) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, _ := obj.Writer()
+	w.Write([]byte(data))
+	w.Close()
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// testPush returns a store with a base commit and one on top of it adding
+// files
+func testPush(t *testing.T, msg, email string, files map[string]string) (*memory.Storage, plumbing.Hash) {
+	st := memory.NewStorage()
+	sig := object.Signature{Name: "test", Email: email, When: time.Unix(1, 0)}
+
+	readme := object.TreeEntry{Name: "README", Mode: filemode.Regular, Hash: testBlob(t, st, "readme")}
+	base := testObject(t, st, &object.Commit{
+		Author: sig, Committer: sig, Message: "base",
+		TreeHash: testObject(t, st, &object.Tree{Entries: []object.TreeEntry{readme}}),
+	})
+
+	var entries []object.TreeEntry
+	sub := map[string][]object.TreeEntry{}
+	for name, data := range files {
+		e := object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: testBlob(t, st, data)}
+		if i := strings.Index(name, "/"); i > 0 {
+			e.Name = name[i+1:]
+			sub[name[:i]] = append(sub[name[:i]], e)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	for dir, es := range sub {
+		h := testObject(t, st, &object.Tree{Entries: es})
+		entries = append(entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: h})
+	}
+	entries = append(entries, readme)
+
+	head := testObject(t, st, &object.Commit{
+		Author: sig, Committer: sig, Message: msg,
+		TreeHash:     testObject(t, st, &object.Tree{Entries: entries}),
+		ParentHashes: []plumbing.Hash{base},
+	})
+	return st, head
+}
+
+func TestPolicy(t *testing.T) {
+	p := &Policy{
+		ForbiddenPaths: []string{"*.pem", "secrets"},
+		MaxFileSizes:   []PathSize{{Path: "assets/*", MaxSize: 4}},
+		MessagePattern: `^[A-Z]+-[0-9]+ `,
+		AuthorDomains:  []string{"example.com"},
+		RequireSignOff: true,
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		msg, email string
+		files      map[string]string
+		reason     string
+	}{
+		{"ABC-1 ok\n\nSigned-off-by: test <test@example.com>\n", "test@example.com", map[string]string{"a.go": "a", "assets/x": "1234"}, ""},
+		{"no ticket\n\nSigned-off-by: test <test@example.com>\n", "test@example.com", nil, "message does not match"},
+		{"ABC-1 x\n\nSigned-off-by: test <test@other.com>\n", "test@other.com", nil, "author email domain not allowed"},
+		{"ABC-1 x\n", "test@example.com", nil, "missing Signed-off-by"},
+		{"ABC-1 x\n\nSigned-off-by: test <test@example.com>\n", "test@example.com", map[string]string{"key.pem": "k"}, "key.pem: forbidden path"},
+		{"ABC-1 x\n\nSigned-off-by: test <test@example.com>\n", "test@example.com", map[string]string{"secrets/a": "k"}, "secrets/a: forbidden path"},
+		{"ABC-1 x\n\nSigned-off-by: test <test@example.com>\n", "test@example.com", map[string]string{"assets/x": "12345"}, "assets/x: size 5 exceeds 4"},
+	} {
+		st, head := testPush(t, c.msg, c.email, c.files)
+		err := p.PreReceive(context.Background(), st, packproto.RefUpdate{Ref: "refs/heads/master", New: head}, []plumbing.Hash{head})
+		if c.reason == "" {
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.reason) || !strings.HasPrefix(err.Error(), head.String()[:12]) {
+			t.Fatalf("have=%v want=%s", err, c.reason)
+		}
+	}
+
+	if err := (&Policy{MessagePattern: "("}).Validate(); err == nil {
+		t.Fatal("should fail")
+	}
+}
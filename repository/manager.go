@@ -1,10 +1,17 @@
 package repository
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 
 	"gopkg.in/src-d/go-git.v4"
+
+	"github.com/euforia/go-git-server/bundle"
+	"github.com/euforia/go-git-server/packfile"
 )
 
 // Manager wraps an underlying repo store with a git repo manager
@@ -19,7 +26,7 @@ func NewManager(s RepositoryStore, mgr *GitRepoManager) *Manager {
 }
 
 func (s *Manager) CreateRepo(repo *Repository) error {
-	err := s.rmgr.CreateRepo(repo.ID)
+	err := s.rmgr.CreateRepoWithFormat(repo.ID, repo.ObjectFormat)
 	if err == nil {
 		err = s.RepositoryStore.CreateRepo(repo)
 	}
@@ -35,21 +42,42 @@ func NewGitRepoManager(dir string) *GitRepoManager {
 }
 
 func (m *GitRepoManager) CreateRepo(id string) error {
+	return m.CreateRepoWithFormat(id, "")
+}
+
+// CreateRepoWithFormat initializes a bare repo with the given object format.
+// Only sha1, the default if empty, is supported as objects are stored with 20
+// byte hashes.
+func (m *GitRepoManager) CreateRepoWithFormat(id, objectFormat string) error {
+	if _, err := packfile.ParseObjectFormat(objectFormat); err != nil {
+		return fmt.Errorf("%v: %s", err, objectFormat)
+	}
+	err := ValidateID(id)
+	if err != nil {
+		return err
+	}
+
 	path := filepath.Join(m.datadir, id)
-	_, err := os.Stat(path)
-	if err == nil {
+	if _, err = os.Stat(path); err == nil {
 		return ErrExists
 	}
+
 	_, err = git.PlainInit(path, true)
 	return err
 }
 
 func (m *GitRepoManager) GetRepo(id string) (*git.Repository, error) {
+	if err := ValidateID(id); err != nil {
+		return nil, err
+	}
 	path := filepath.Join(m.datadir, id)
 	return git.PlainOpen(path)
 }
 
 func (m *GitRepoManager) RemoveRepo(id string) error {
+	if err := ValidateID(id); err != nil {
+		return err
+	}
 	path := filepath.Join(m.datadir, id)
 	_, err := os.Stat(path)
 	if err != nil {
@@ -58,3 +86,27 @@ func (m *GitRepoManager) RemoveRepo(id string) error {
 
 	return os.RemoveAll(path)
 }
+
+// CreateBundle writes a bundle of the repo for the revs to w.  See
+// bundle.Resolve for the rev syntax.
+func (m *GitRepoManager) CreateBundle(ctx context.Context, id string, w io.Writer, revs []string) error {
+	repo, err := m.GetRepo(id)
+	if err != nil {
+		return err
+	}
+
+	refs, prereqs, err := bundle.Resolve(repo.Storer, revs)
+	if err != nil {
+		return err
+	}
+	return bundle.Create(ctx, w, repo.Storer, refs, prereqs)
+}
+
+// VerifyBundle checks the repo has all the prerequisites of the bundle
+func (m *GitRepoManager) VerifyBundle(id string, r io.Reader) (*bundle.Header, error) {
+	repo, err := m.GetRepo(id)
+	if err != nil {
+		return nil, err
+	}
+	return bundle.Verify(bufio.NewReader(r), repo.Storer)
+}
@@ -1,9 +1,35 @@
 package repository
 
+import (
+	"path"
+	"strings"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/policy"
+	"github.com/euforia/go-git-server/secrets"
+	"github.com/euforia/go-git-server/signature"
+)
+
 // Repository represents a single repo.
 type Repository struct {
 	ID   string                `json:"id"`
 	Refs *RepositoryReferences `json:"refs"`
+	// Hash algorithm of the repo objects.  Only sha1, the default, is
+	// supported.
+	ObjectFormat string `json:"object_format,omitempty"`
+	// Push limits lowering the server wide ones
+	Limits *packproto.PushLimits `json:"limits,omitempty"`
+	// Content policy pushes must comply with
+	Policy *policy.Policy `json:"policy,omitempty"`
+	// Secret scanning overriding the server wide mode
+	Secrets *secrets.Config `json:"secrets,omitempty"`
+	// Refs only taking verified commits and tags
+	RequireSigned *signature.Rule `json:"require_signed,omitempty"`
+	// Served over git:// by the daemon if public
+	Export bool `json:"export,omitempty"`
+	// Visibility and members
+	authz.ACL
 }
 
 // NewRepository instantiates an empty repo.
@@ -14,3 +40,83 @@ func NewRepository(id string) *Repository {
 func (repo *Repository) String() string {
 	return repo.ID
 }
+
+// ValidateID checks the id is a clean namespaced path of names made of
+// letters, digits, '.', '-' and '_' so it stays within the data dir
+func ValidateID(id string) error {
+	if !strings.Contains(id, "/") || path.Clean("/"+id) != "/"+id {
+		return ErrInvalidID
+	}
+	for _, name := range strings.Split(id, "/") {
+		if !validName(name) {
+			return ErrInvalidID
+		}
+	}
+	return nil
+}
+
+// ValidateNamespace checks the name can be the namespace of a repo id
+func ValidateNamespace(name string) error {
+	if !validName(name) {
+		return ErrInvalidNamespace
+	}
+	return nil
+}
+
+// validName checks a path element is made of letters, digits, '.', '-' and
+// '_' and isn't hidden
+func validName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate checks the id and settings are well formed
+func (repo *Repository) Validate() error {
+	if err := ValidateID(repo.ID); err != nil {
+		return err
+	}
+	if err := repo.ACL.Validate(); err != nil {
+		return err
+	}
+	if repo.Policy != nil {
+		if err := repo.Policy.Validate(); err != nil {
+			return err
+		}
+	}
+	if repo.Secrets != nil {
+		if err := repo.Secrets.Validate(); err != nil {
+			return err
+		}
+	}
+	if repo.RequireSigned != nil {
+		return repo.RequireSigned.Validate()
+	}
+	return nil
+}
+
+// Clone returns a copy of the repo with its own settings.  Refs are shared.
+func (repo *Repository) Clone() *Repository {
+	c := *repo
+	c.Members = repo.Members.Clone()
+	if repo.Limits != nil {
+		limits := *repo.Limits
+		c.Limits = &limits
+	}
+	if repo.Policy != nil {
+		c.Policy = repo.Policy.Clone()
+	}
+	if repo.Secrets != nil {
+		c.Secrets = repo.Secrets.Clone()
+	}
+	if repo.RequireSigned != nil {
+		c.RequireSigned = repo.RequireSigned.Clone()
+	}
+	return &c
+}
@@ -8,8 +8,10 @@ import (
 )
 
 var (
-	ErrNotFound = errors.New("not found")
-	ErrExists   = errors.New("exists")
+	ErrNotFound         = errors.New("not found")
+	ErrExists           = errors.New("exists")
+	ErrInvalidID        = errors.New("invalid repo id")
+	ErrInvalidNamespace = errors.New("invalid namespace name")
 )
 
 // RepositoryStore is the repository storage interface that should be implemented.
@@ -107,6 +109,9 @@ func (mrs *FilesystemRepoStore) CreateRepo(repo *Repository) error {
 	if _, ok := mrs.m[repo.ID]; ok {
 		return ErrExists
 	}
+	if err := ValidateID(repo.ID); err != nil {
+		return err
+	}
 	os.MkdirAll(filepath.Join(mrs.datadir, repo.ID), 0755)
 	mrs.m[repo.ID] = repo
 	return nil
@@ -0,0 +1,400 @@
+// Package reviews implements code review pushes.  A push to
+// refs/for/<branch>/<topic> doesn't update a ref but creates a review, or a new
+// patchset of the open review of the topic, written to
+// refs/changes/<id>/<patchset>.
+package reviews
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/commitgraph"
+	"github.com/euforia/go-git-server/packproto"
+)
+
+const (
+	// ForPrefix is the prefix of refs pushed for review
+	ForPrefix = "refs/for/"
+	// ChangesPrefix is the prefix of the refs patchsets are written to
+	ChangesPrefix = "refs/changes/"
+)
+
+var (
+	// ErrNotFound is returned for unknown reviews
+	ErrNotFound = errors.New("not found")
+
+	errNoChanges = errors.New("no new changes")
+)
+
+// Status is the state of a review
+type Status string
+
+const (
+	// StatusOpen reviews take new patchsets
+	StatusOpen Status = "open"
+	// StatusMerged reviews have their latest patchset in the target branch
+	StatusMerged Status = "merged"
+	// StatusAbandoned reviews were closed without merging
+	StatusAbandoned Status = "abandoned"
+)
+
+// Patchset is a version of the change under review
+type Patchset struct {
+	Number  int       `json:"number"`
+	Ref     string    `json:"ref"`
+	Commit  string    `json:"commit"`
+	Created time.Time `json:"created"`
+}
+
+// Review is a change pushed for review
+type Review struct {
+	ID   int    `json:"id"`
+	Repo string `json:"repo"`
+	// Target branch e.g. refs/heads/main
+	Branch string `json:"branch"`
+	Topic  string `json:"topic,omitempty"`
+	// Subject of the latest patchset
+	Subject   string      `json:"subject"`
+	Status    Status      `json:"status"`
+	Patchsets []*Patchset `json:"patchsets"`
+	Created   time.Time   `json:"created"`
+	Updated   time.Time   `json:"updated"`
+}
+
+// Latest returns the latest patchset
+func (r *Review) Latest() *Patchset {
+	return r.Patchsets[len(r.Patchsets)-1]
+}
+
+func (r *Review) clone() *Review {
+	rc := *r
+	rc.Patchsets = append([]*Patchset(nil), r.Patchsets...)
+	return &rc
+}
+
+// Reviews keeps the reviews of each repo in a file per repo under dir
+type Reviews struct {
+	dir string
+
+	mu sync.Mutex
+	// loaded repos and their reviews
+	reviews map[string][]*Review
+}
+
+// NewReviews instantiates the reviews kept under dir.  They are only kept in
+// memory if dir is empty.
+func NewReviews(dir string) *Reviews {
+	return &Reviews{dir: dir, reviews: map[string][]*Review{}}
+}
+
+func (rs *Reviews) path(repo string) string {
+	return filepath.Join(rs.dir, filepath.FromSlash(repo)+".json")
+}
+
+// load returns the reviews of the repo reading them on first use.  It is
+// called with the lock held.
+func (rs *Reviews) load(repo string) []*Review {
+	if list, ok := rs.reviews[repo]; ok || rs.dir == "" {
+		return list
+	}
+
+	var list []*Review
+	b, err := ioutil.ReadFile(rs.path(repo))
+	if err == nil {
+		err = json.Unmarshal(b, &list)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ERR [reviews] repo=%s %v", repo, err)
+	}
+	if list == nil {
+		list = []*Review{}
+	}
+	rs.reviews[repo] = list
+	return list
+}
+
+// save writes the reviews of the repo.  It is called with the lock held.
+func (rs *Reviews) save(repo string) error {
+	if rs.dir == "" {
+		return nil
+	}
+	b, err := json.Marshal(rs.reviews[repo])
+	if err != nil {
+		return err
+	}
+
+	p := rs.path(repo)
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
+
+// List returns the reviews of the repo, oldest first
+func (rs *Reviews) List(repo string) []*Review {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	reviews := rs.load(repo)
+	list := make([]*Review, len(reviews))
+	for i, r := range reviews {
+		list[i] = r.clone()
+	}
+	return list
+}
+
+// Get returns the review of the repo with the id
+func (rs *Reviews) Get(repo string, id int) (*Review, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if r := rs.get(repo, id); r != nil {
+		return r.clone(), nil
+	}
+	return nil, ErrNotFound
+}
+
+func (rs *Reviews) get(repo string, id int) *Review {
+	for _, r := range rs.load(repo) {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// SetStatus abandons or reopens a review.  Reviews are marked merged by Sync.
+func (rs *Reviews) SetStatus(repo string, id int, status Status) (*Review, error) {
+	if status != StatusOpen && status != StatusAbandoned {
+		return nil, fmt.Errorf("invalid status: %s", status)
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r := rs.get(repo, id)
+	if r == nil {
+		return nil, ErrNotFound
+	}
+	if r.Status == StatusMerged {
+		return nil, fmt.Errorf("review %d is merged", id)
+	}
+	prev := r.Status
+	r.Status, r.Updated = status, time.Now()
+	if err := rs.save(repo); err != nil {
+		r.Status = prev
+		return nil, err
+	}
+	return r.clone(), nil
+}
+
+// Sync marks open reviews of the repo merged if their latest patchset is in
+// the target branch.  It is called after pushes to the repo.
+func (rs *Reviews) Sync(ctx context.Context, store storer.Storer, repo string) error {
+	// Ancestry is checked without the lock
+	rs.mu.Lock()
+	var open []*Review
+	for _, r := range rs.load(repo) {
+		if r.Status == StatusOpen {
+			open = append(open, r.clone())
+		}
+	}
+	rs.mu.Unlock()
+
+	var (
+		nodes  = commitgraph.NewNodeIndex(store)
+		merged = map[int]string{}
+	)
+	for _, r := range open {
+		tip, err := store.Reference(plumbing.ReferenceName(r.Branch))
+		if err != nil {
+			continue
+		}
+		ok, err := commitgraph.IsAncestor(ctx, nodes, plumbing.NewHash(r.Latest().Commit), tip.Hash())
+		if err != nil {
+			return err
+		}
+		if ok {
+			merged[r.ID] = r.Latest().Commit
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for id, commit := range merged {
+		// Unless changed meanwhile
+		if r := rs.get(repo, id); r != nil && r.Status == StatusOpen && r.Latest().Commit == commit {
+			r.Status, r.Updated = StatusMerged, time.Now()
+		}
+	}
+	return rs.save(repo)
+}
+
+// Receiver returns the receiver of pushes for review to the repo
+func (rs *Reviews) Receiver(repo string) packproto.ProcReceiver {
+	return &receiver{reviews: rs, repo: repo}
+}
+
+type receiver struct {
+	reviews *Reviews
+	repo    string
+}
+
+// OwnsRef returns true for the refs/changes/ refs patchsets are written to
+func (rcv *receiver) OwnsRef(ref string) bool {
+	return strings.HasPrefix(ref, ChangesPrefix)
+}
+
+// PostReceive marks the reviews merged into the branches the push updated
+func (rcv *receiver) PostReceive(ctx context.Context, store storer.Storer, results []*packproto.RefResult) {
+	for _, res := range results {
+		if res.OK() && strings.HasPrefix(res.Ref, "refs/heads/") {
+			if err := rcv.reviews.Sync(ctx, store, rcv.repo); err != nil {
+				log.Printf("ERR [reviews] repo=%s %v", rcv.repo, err)
+			}
+			return
+		}
+	}
+}
+
+// ProcReceive writes the pushed commit as a new review or a patchset of the
+// open review of the topic
+func (rcv *receiver) ProcReceive(ctx context.Context, store storer.Storer, update packproto.RefUpdate) (*packproto.ProcResult, error) {
+	branch, topic, err := splitTarget(store, strings.TrimPrefix(update.Ref, ForPrefix))
+	if err != nil {
+		return nil, err
+	}
+	c, err := object.GetCommit(store, update.New)
+	if err != nil {
+		return nil, err
+	}
+
+	tip, err := store.Reference(plumbing.ReferenceName(branch))
+	if err != nil {
+		return nil, err
+	}
+	merged, err := commitgraph.IsAncestor(ctx, commitgraph.NewNodeIndex(store), update.New, tip.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if merged {
+		return nil, errNoChanges
+	}
+
+	rs := rcv.reviews
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r := rs.openTopic(rcv.repo, branch, topic)
+	if r == nil {
+		now := time.Now()
+		r = &Review{
+			ID:      rs.nextID(store, rcv.repo),
+			Repo:    rcv.repo,
+			Branch:  branch,
+			Topic:   topic,
+			Status:  StatusOpen,
+			Created: now,
+		}
+		rs.reviews[rcv.repo] = append(rs.load(rcv.repo), r)
+	} else if r.Latest().Commit == update.New.String() {
+		return nil, errNoChanges
+	}
+
+	ps := &Patchset{
+		Number:  len(r.Patchsets) + 1,
+		Ref:     fmt.Sprintf("%s%d/%d", ChangesPrefix, r.ID, len(r.Patchsets)+1),
+		Commit:  update.New.String(),
+		Created: time.Now(),
+	}
+	if err = store.SetReference(plumbing.NewHashReference(plumbing.ReferenceName(ps.Ref), update.New)); err != nil {
+		return nil, err
+	}
+
+	r.Patchsets = append(r.Patchsets, ps)
+	r.Subject = strings.SplitN(c.Message, "\n", 2)[0]
+	r.Updated = ps.Created
+	if err = rs.save(rcv.repo); err != nil {
+		// The patchset is written and kept until the restart
+		log.Printf("ERR [reviews] repo=%s %v", rcv.repo, err)
+	}
+
+	return &packproto.ProcResult{Ref: ps.Ref, New: update.New}, nil
+}
+
+// openTopic returns the open review of the topic for the branch.  Pushes
+// without a topic always create a review.
+func (rs *Reviews) openTopic(repo, branch, topic string) *Review {
+	if topic == "" {
+		return nil
+	}
+	for _, r := range rs.load(repo) {
+		if r.Status == StatusOpen && r.Branch == branch && r.Topic == topic {
+			return r
+		}
+	}
+	return nil
+}
+
+// nextID returns an id above those of the known reviews and of the change
+// refs of the repo, which may predate them
+func (rs *Reviews) nextID(store storer.ReferenceStorer, repo string) int {
+	var max int
+	for _, r := range rs.load(repo) {
+		if r.ID > max {
+			max = r.ID
+		}
+	}
+
+	iter, err := store.IterReferences()
+	if err != nil {
+		return max + 1
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, ChangesPrefix) {
+			return nil
+		}
+		id, err := strconv.Atoi(strings.SplitN(strings.TrimPrefix(name, ChangesPrefix), "/", 2)[0])
+		if err == nil && id > max {
+			max = id
+		}
+		return nil
+	})
+	return max + 1
+}
+
+// splitTarget splits <branch>/<topic> on the longest existing branch as
+// branches may contain slashes
+func splitTarget(store storer.ReferenceStorer, target string) (branch, topic string, err error) {
+	parts := strings.Split(target, "/")
+	for i := len(parts); i > 0; i-- {
+		name := plumbing.ReferenceName("refs/heads/" + strings.Join(parts[:i], "/"))
+		if _, err = store.Reference(name); err == nil {
+			return name.String(), strings.Join(parts[i:], "/"), nil
+		}
+	}
+	return "", "", fmt.Errorf("no branch for %s%s", ForPrefix, target)
+}
@@ -0,0 +1,103 @@
+package reviews
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+
+	"github.com/euforia/go-git-server/packproto"
+)
+
+func testCommit(t *testing.T, st *memory.Storage, msg string, parents ...plumbing.Hash) plumbing.Hash {
+	sig := object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1, 0)}
+
+	tree := st.NewEncodedObject()
+	if err := (&object.Tree{}).Encode(tree); err != nil {
+		t.Fatal(err)
+	}
+	th, _ := st.SetEncodedObject(tree)
+
+	obj := st.NewEncodedObject()
+	c := &object.Commit{Author: sig, Committer: sig, Message: msg, TreeHash: th, ParentHashes: parents}
+	if err := c.Encode(obj); err != nil {
+		t.Fatal(err)
+	}
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestProcReceive(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		st   = memory.NewStorage()
+		base = testCommit(t, st, "base")
+	)
+	dir, _ := ioutil.TempDir("", "reviews")
+	defer os.RemoveAll(dir)
+	rs := NewReviews(dir)
+	rcv := rs.Receiver("ns/repo")
+
+	st.SetReference(plumbing.NewHashReference("refs/heads/release/1.0", base))
+	// Left by reviews from before a restart
+	st.SetReference(plumbing.NewHashReference("refs/changes/7/1", base))
+
+	ps1 := testCommit(t, st, "change\n\nbody", base)
+	res, err := rcv.ProcReceive(ctx, st, packproto.RefUpdate{Ref: "refs/for/release/1.0/topic", New: ps1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Ref != "refs/changes/8/1" {
+		t.Fatal(res.Ref)
+	}
+
+	ps2 := testCommit(t, st, "change v2", base)
+	if res, err = rcv.ProcReceive(ctx, st, packproto.RefUpdate{Ref: "refs/for/release/1.0/topic", New: ps2}); err != nil {
+		t.Fatal(err)
+	}
+	if res.Ref != "refs/changes/8/2" {
+		t.Fatal(res.Ref)
+	}
+	if _, err = rcv.ProcReceive(ctx, st, packproto.RefUpdate{Ref: "refs/for/release/1.0/topic", New: ps2}); err != errNoChanges {
+		t.Fatal(err)
+	}
+	if _, err = rcv.ProcReceive(ctx, st, packproto.RefUpdate{Ref: "refs/for/release/1.0", New: base}); err != errNoChanges {
+		t.Fatal(err)
+	}
+	if _, err = rcv.ProcReceive(ctx, st, packproto.RefUpdate{Ref: "refs/for/main", New: ps2}); err == nil {
+		t.Fatal("should fail")
+	}
+
+	r, err := rs.Get("ns/repo", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Branch != "refs/heads/release/1.0" || r.Topic != "topic" || r.Subject != "change v2" || len(r.Patchsets) != 2 {
+		t.Fatalf("%+v", r)
+	}
+
+	// Patchset refs are only written by pushes for review
+	if !rcv.(packproto.ProcRefOwner).OwnsRef(res.Ref) {
+		t.Fatal(res.Ref)
+	}
+
+	// Merged when pushed to the branch
+	st.SetReference(plumbing.NewHashReference("refs/heads/release/1.0", ps2))
+	rcv.(packproto.PostReceiver).PostReceive(ctx, st, []*packproto.RefResult{{Ref: "refs/heads/release/1.0", Status: packproto.RefOK}})
+	if r, _ = rs.Get("ns/repo", 8); r.Status != StatusMerged {
+		t.Fatal(r.Status)
+	}
+
+	// Kept across restarts
+	if r, err = NewReviews(dir).Get("ns/repo", 8); err != nil || r.Status != StatusMerged || len(r.Patchsets) != 2 {
+		t.Fatal(r, err)
+	}
+}
@@ -0,0 +1,131 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"regexp"
+)
+
+const (
+	// ruleHighEntropy flags random looking values assigned in code or config
+	ruleHighEntropy = "high-entropy"
+	// fraction of the max entropy for its length a value needs to be
+	// considered random.  Hex strings e.g. object ids can't reach it.
+	minEntropyRatio = 0.9
+)
+
+// Rule is a regex matching a secret.  If the regex has a group the first one
+// is the secret otherwise the whole match is.
+type Rule struct {
+	ID      string `json:"id"`
+	Pattern string `json:"pattern"`
+
+	re *regexp.Regexp
+}
+
+func (r *Rule) compile() error {
+	if r.ID == "" {
+		return fmt.Errorf("rule id required")
+	}
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return fmt.Errorf("rule %s: %v", r.ID, err)
+	}
+	r.re = re
+	return nil
+}
+
+// builtinRules are always applied
+var builtinRules = []Rule{
+	{ID: "aws-access-key-id", Pattern: `\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`},
+	{ID: "aws-secret-access-key", Pattern: `(?i)aws_?secret_?access_?key['"]?\s*[:=]\s*['"]?([A-Za-z0-9/+]{40})\b`},
+	{ID: "private-key", Pattern: `-----BEGIN (?:RSA |DSA |EC |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`},
+	{ID: "github-token", Pattern: `\b((?:ghp|gho|ghu|ghs|ghr)_[0-9A-Za-z]{36}|github_pat_[0-9A-Za-z_]{82})\b`},
+	{ID: "slack-token", Pattern: `\b(xox[abposr]-[0-9A-Za-z-]{10,})\b`},
+	{ID: "slack-webhook", Pattern: `(https://hooks\.slack\.com/services/T[0-9A-Z]+/B[0-9A-Z]+/[0-9A-Za-z]+)`},
+}
+
+// assignedValue matches values of 20 or more base64 chars assigned or quoted
+var assignedValue = regexp.MustCompile(`(?:[:=]\s*|['"])([A-Za-z0-9+/_=-]{20,})`)
+
+func init() {
+	for i := range builtinRules {
+		if err := builtinRules[i].compile(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// match is a secret found on a line
+type match struct {
+	rule   string
+	secret string
+}
+
+func matchLine(line []byte, rules []Rule) []match {
+	var matches []match
+	for _, r := range rules {
+		for _, m := range r.re.FindAllSubmatch(line, -1) {
+			s := m[0]
+			if len(m) > 1 && len(m[1]) > 0 {
+				s = m[1]
+			}
+			matches = append(matches, match{rule: r.ID, secret: string(s)})
+		}
+	}
+
+	// Anything already matched is not also reported as high entropy
+	if len(matches) == 0 {
+		for _, m := range assignedValue.FindAllSubmatch(line, -1) {
+			if isRandom(m[1]) {
+				matches = append(matches, match{rule: ruleHighEntropy, secret: string(m[1])})
+			}
+		}
+	}
+	return matches
+}
+
+// isRandom returns true for mixed letters and digits close to the max entropy
+// possible for their length
+func isRandom(b []byte) bool {
+	var letters, digits bool
+	for _, c := range b {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+			letters = true
+		}
+	}
+	if !letters || !digits {
+		return false
+	}
+	return entropy(b) >= minEntropyRatio*math.Log2(math.Min(float64(len(b)), 64))
+}
+
+// entropy returns the shannon entropy of b in bits per byte
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+
+	var e float64
+	n := float64(len(b))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			e -= p * math.Log2(p)
+		}
+	}
+	return e
+}
+
+// fingerprint identifies a secret without revealing it so it can be
+// allowlisted
+func fingerprint(rule, secret string) string {
+	sum := sha256.Sum256([]byte(rule + ":" + secret))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,367 @@
+// Package secrets scans the blobs introduced by a push for credentials
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/events"
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/policy"
+)
+
+const (
+	// AllowlistFile is read from the root of the tree of the updated ref, or
+	// of the default branch for new refs, before the push.  Lines are
+	// path:<glob>, rule:<id> or fingerprint:<fingerprint>.  # starts a comment.
+	AllowlistFile = ".secrets-allowlist"
+
+	// Blobs larger than this are not scanned
+	maxBlobSize = 1 << 20
+	// Findings kept per repo
+	maxFindings = 1000
+	// Findings listed in a push rejection
+	maxReported = 5
+
+	// EventSecretsDetected is published with the findings of a ref update
+	EventSecretsDetected = "secrets.detected"
+)
+
+// Mode is what is done with findings
+type Mode string
+
+const (
+	// ModeOff disables scanning
+	ModeOff Mode = "off"
+	// ModeReport records findings and lets the push through
+	ModeReport Mode = "report"
+	// ModeBlock rejects ref updates with findings
+	ModeBlock Mode = "block"
+)
+
+// ParseMode parses a mode.  The empty string is off.
+func ParseMode(s string) (Mode, error) {
+	switch Mode(s) {
+	case "", ModeOff:
+		return ModeOff, nil
+	case ModeReport, ModeBlock:
+		return Mode(s), nil
+	}
+	return "", fmt.Errorf("invalid secret scanning mode: %s", s)
+}
+
+// Config is the secret scanning config of a repo
+type Config struct {
+	// Overrides the server mode if set
+	Mode Mode `json:"mode,omitempty"`
+	// Applied in addition to the built-in rules
+	Rules []Rule `json:"rules,omitempty"`
+}
+
+// Validate checks the mode and rules
+func (c *Config) Validate() error {
+	if _, err := ParseMode(string(c.Mode)); err != nil {
+		return err
+	}
+	for _, r := range c.Rules {
+		if err := r.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the config
+func (c *Config) Clone() *Config {
+	cc := *c
+	cc.Rules = append([]Rule(nil), c.Rules...)
+	return &cc
+}
+
+// Finding is a secret found in a blob.  The secret itself is not kept.
+type Finding struct {
+	Repo        string    `json:"repo"`
+	Ref         string    `json:"ref"`
+	Commit      string    `json:"commit"`
+	Path        string    `json:"path"`
+	Line        int       `json:"line"`
+	Rule        string    `json:"rule"`
+	Fingerprint string    `json:"fingerprint"`
+	Blocked     bool      `json:"blocked"`
+	Time        time.Time `json:"time"`
+}
+
+func (f *Finding) String() string {
+	return fmt.Sprintf("%s: %s:%d: %s (%s)", f.Commit[:12], f.Path, f.Line, f.Rule, f.Fingerprint)
+}
+
+// Findings of a ref update
+type Findings []*Finding
+
+func (fs Findings) Error() string {
+	strs := make([]string, 0, maxReported+1)
+	for i, f := range fs {
+		if i == maxReported {
+			strs = append(strs, fmt.Sprintf("and %d more", len(fs)-i))
+			break
+		}
+		strs = append(strs, f.String())
+	}
+	return "secrets detected: " + strings.Join(strs, "; ")
+}
+
+// Scanner scans pushes and keeps the findings of each repo
+type Scanner struct {
+	// Server wide mode
+	mode Mode
+	// Optional event sink
+	sink events.Sink
+
+	mu       sync.Mutex
+	findings map[string][]*Finding
+}
+
+// NewScanner instantiates a scanner with the server wide mode.  Findings are
+// published to sink if not nil.
+func NewScanner(mode Mode, sink events.Sink) *Scanner {
+	return &Scanner{
+		mode:     mode,
+		sink:     sink,
+		findings: map[string][]*Finding{},
+	}
+}
+
+// Findings returns the recorded findings of the repo, oldest first
+func (s *Scanner) Findings(repo string) []*Finding {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Finding(nil), s.findings[repo]...)
+}
+
+func (s *Scanner) record(repo string, fs Findings) {
+	s.mu.Lock()
+	all := append(s.findings[repo], fs...)
+	if len(all) > maxFindings {
+		all = all[len(all)-maxFindings:]
+	}
+	s.findings[repo] = all
+	s.mu.Unlock()
+
+	if s.sink != nil {
+		s.sink.Publish(&events.Event{Type: EventSecretsDetected, Repo: repo, Time: time.Now(), Data: fs})
+	}
+}
+
+// Hook returns the pre-receive hook scanning pushes to the repo or nil if
+// scanning is off.  cfg may be nil.
+func (s *Scanner) Hook(repo string, cfg *Config) packproto.PreReceiveHook {
+	h := &hook{scanner: s, repo: repo, mode: s.mode, rules: append([]Rule(nil), builtinRules...)}
+	if cfg != nil {
+		if cfg.Mode != "" {
+			h.mode = cfg.Mode
+		}
+		for _, r := range cfg.Rules {
+			if err := r.compile(); err != nil {
+				log.Printf("ERR [secrets] repo=%s %v", repo, err)
+				continue
+			}
+			h.rules = append(h.rules, r)
+		}
+	}
+
+	if h.mode == ModeOff {
+		return nil
+	}
+	return h
+}
+
+// hook scans the blobs of each ref update
+type hook struct {
+	scanner *Scanner
+	repo    string
+	mode    Mode
+	rules   []Rule
+}
+
+// PreReceive scans the blobs the commits add or modify
+func (h *hook) PreReceive(ctx context.Context, store storer.Storer, update packproto.RefUpdate, commits []plumbing.Hash) error {
+	// The allowlist of the pushed tree could allow its own secrets so the
+	// one of the ref, or of the default branch for new refs, is used
+	base := update.Old
+	if base.IsZero() {
+		if head, err := storer.ResolveReference(store, plumbing.HEAD); err == nil {
+			base = head.Hash()
+		}
+	}
+	allow := readAllowlist(store, base)
+
+	var (
+		fs      Findings
+		scanned = map[plumbing.Hash]struct{}{}
+	)
+	for _, ch := range commits {
+		c, err := object.GetCommit(store, ch)
+		if err != nil {
+			return err
+		}
+		files, err := policy.ChangedFiles(ctx, store, c)
+		if err != nil {
+			return err
+		}
+
+		for _, f := range files {
+			if _, ok := scanned[f.Hash]; ok || allow.path(f.Name) {
+				continue
+			}
+			scanned[f.Hash] = struct{}{}
+
+			found, err := h.scanBlob(store, f.Hash)
+			if err != nil {
+				return err
+			}
+			for _, fnd := range found {
+				if allow.finding(fnd) {
+					continue
+				}
+				fnd.Repo, fnd.Ref, fnd.Commit, fnd.Path = h.repo, update.Ref, ch.String(), f.Name
+				fnd.Blocked = h.mode == ModeBlock
+				fnd.Time = time.Now()
+				fs = append(fs, fnd)
+			}
+		}
+	}
+
+	if len(fs) == 0 {
+		return nil
+	}
+
+	log.Printf("DBG [secrets] repo=%s ref=%s findings=%d mode=%s", h.repo, update.Ref, len(fs), h.mode)
+	h.scanner.record(h.repo, fs)
+
+	if h.mode == ModeBlock {
+		return fs
+	}
+	return nil
+}
+
+// scanBlob returns the secrets in a text blob
+func (h *hook) scanBlob(store storer.EncodedObjectStorer, bh plumbing.Hash) ([]*Finding, error) {
+	obj, err := store.EncodedObject(plumbing.BlobObject, bh)
+	if err != nil {
+		return nil, err
+	}
+	if obj.Size() > maxBlobSize {
+		return nil, nil
+	}
+
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return scan(r, h.rules)
+}
+
+// scan returns the secrets in r, or nothing if it is binary
+func scan(r io.Reader, rules []Rule) ([]*Finding, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return nil, nil
+	}
+
+	var (
+		found []*Finding
+		sc    = bufio.NewScanner(bytes.NewReader(data))
+	)
+	sc.Buffer(make([]byte, 0, 64*1024), maxBlobSize)
+	for n := 1; sc.Scan(); n++ {
+		for _, m := range matchLine(sc.Bytes(), rules) {
+			found = append(found, &Finding{Line: n, Rule: m.rule, Fingerprint: fingerprint(m.rule, m.secret)})
+		}
+	}
+	return found, sc.Err()
+}
+
+// allowlist is the parsed allowlist file
+type allowlist struct {
+	paths        []string
+	rules        map[string]bool
+	fingerprints map[string]bool
+}
+
+func parseAllowlist(r io.Reader) *allowlist {
+	al := &allowlist{rules: map[string]bool{}, fingerprints: map[string]bool{}}
+
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "path":
+			al.paths = append(al.paths, v)
+		case "rule":
+			al.rules[v] = true
+		case "fingerprint":
+			al.fingerprints[v] = true
+		}
+	}
+	return al
+}
+
+// readAllowlist reads the allowlist from the tree of the commit, returning an
+// empty one if there is none or no commit
+func readAllowlist(store storer.EncodedObjectStorer, h plumbing.Hash) *allowlist {
+	empty := parseAllowlist(strings.NewReader(""))
+
+	c, err := object.GetCommit(store, h)
+	if err != nil {
+		return empty
+	}
+	f, err := c.File(AllowlistFile)
+	if err != nil {
+		return empty
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return empty
+	}
+	defer r.Close()
+
+	return parseAllowlist(r)
+}
+
+func (al *allowlist) path(name string) bool {
+	for _, g := range al.paths {
+		if policy.MatchPath(g, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (al *allowlist) finding(f *Finding) bool {
+	return al.rules[f.Rule] || al.fingerprints[f.Fingerprint]
+}
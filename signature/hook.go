@@ -0,0 +1,114 @@
+package signature
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/packproto"
+)
+
+// maxReported is the max unverified objects listed in a push rejection
+const maxReported = 5
+
+// Rule requires commits and annotated tags pushed to protected refs to be
+// verified
+type Rule struct {
+	// Globs of the protected refs e.g. refs/heads/master or refs/tags/*
+	Refs []string `json:"refs"`
+}
+
+// Validate checks the ref globs are well formed
+func (r *Rule) Validate() error {
+	for _, g := range r.Refs {
+		if _, err := path.Match(g, ""); err != nil {
+			return fmt.Errorf("require signed ref %s: %v", g, err)
+		}
+	}
+	return nil
+}
+
+// Clone returns a deep copy of the rule
+func (r *Rule) Clone() *Rule {
+	return &Rule{Refs: append([]string(nil), r.Refs...)}
+}
+
+func (r *Rule) protects(ref string) bool {
+	for _, g := range r.Refs {
+		if ok, _ := path.Match(g, ref); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Hook returns the pre-receive hook enforcing the rule
+func (v *Verifier) Hook(rule *Rule) packproto.PreReceiveHook {
+	return &hook{verifier: v, rule: rule}
+}
+
+type hook struct {
+	verifier *Verifier
+	rule     *Rule
+}
+
+// PreReceive rejects updates of protected refs introducing objects that are
+// not verified.  Commits already on other refs aren't trusted as they may have
+// been pushed to unprotected ones, only those on protected refs are.
+func (h *hook) PreReceive(ctx context.Context, store storer.Storer, update packproto.RefUpdate, _ []plumbing.Hash) error {
+	if update.New.IsZero() || !h.rule.protects(update.Ref) {
+		return nil
+	}
+
+	hide := []plumbing.Hash{update.Old}
+	iter, err := store.IterReferences()
+	if err != nil {
+		return err
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && h.rule.protects(ref.Name().String()) {
+			hide = append(hide, ref.Hash())
+		}
+		return nil
+	})
+	commits, err := packproto.NewCommits(ctx, store, update.New, hide)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	check := func(res *Result, err error, oh plumbing.Hash) error {
+		if err != nil {
+			return err
+		}
+		if res.Status != Verified {
+			failed = append(failed, fmt.Sprintf("%s: %s", oh.String()[:12], res.Status))
+		}
+		return nil
+	}
+
+	if _, err := store.EncodedObject(plumbing.TagObject, update.New); err == nil {
+		res, err := h.verifier.VerifyTag(store, update.New)
+		if err = check(res, err, update.New); err != nil {
+			return err
+		}
+	}
+	for _, c := range commits {
+		res, err := h.verifier.VerifyCommit(store, c)
+		if err = check(res, err, c); err != nil {
+			return err
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(failed) > maxReported {
+		failed = append(failed[:maxReported], fmt.Sprintf("and %d more", len(failed)-maxReported))
+	}
+	return fmt.Errorf("signature required: %s", strings.Join(failed, "; "))
+}
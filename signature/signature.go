@@ -0,0 +1,264 @@
+// Package signature verifies OpenPGP and ssh signatures of commits and tags
+// against the keys users have registered
+package signature
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/users"
+)
+
+// Status is the outcome of verifying an object
+type Status string
+
+const (
+	// Unsigned objects have no signature
+	Unsigned Status = "unsigned"
+	// Verified objects are signed by a registered key of a user with the
+	// committer or tagger email
+	Verified Status = "verified"
+	// UnknownKey signatures are by a key no user has registered
+	UnknownKey Status = "unknown_key"
+	// BadSignature signatures don't match the object or can't be parsed
+	BadSignature Status = "bad_signature"
+	// EmailMismatch signatures are good but by a user without the committer
+	// or tagger email
+	EmailMismatch Status = "email_mismatch"
+)
+
+const (
+	formatOpenPGP = "openpgp"
+	formatSSH     = "ssh"
+)
+
+var (
+	pgpArmorStart = []byte("-----BEGIN PGP SIGNATURE-----")
+	sshArmorStart = []byte("-----BEGIN SSH SIGNATURE-----")
+)
+
+// Result is the verification of an object
+type Result struct {
+	Status Status `json:"status"`
+	Format string `json:"format,omitempty"`
+	KeyID  string `json:"key_id,omitempty"`
+	// Name of the user owning the key
+	Signer string `json:"signer,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Verifier verifies signatures with the keys of a user store
+type Verifier struct {
+	users users.Store
+}
+
+// NewVerifier instantiates a verifier looking keys up in the store
+func NewVerifier(store users.Store) *Verifier {
+	return &Verifier{users: store}
+}
+
+// VerifyCommit verifies the gpgsig header of a commit
+func (v *Verifier) VerifyCommit(store storer.EncodedObjectStorer, h plumbing.Hash) (*Result, error) {
+	raw, err := rawObject(store, plumbing.CommitObject, h)
+	if err != nil {
+		return nil, err
+	}
+	c, err := object.GetCommit(store, h)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, sig := splitCommit(raw)
+	return v.verify(payload, sig, c.Committer.Email), nil
+}
+
+// VerifyTag verifies the signature of an annotated tag
+func (v *Verifier) VerifyTag(store storer.EncodedObjectStorer, h plumbing.Hash) (*Result, error) {
+	raw, err := rawObject(store, plumbing.TagObject, h)
+	if err != nil {
+		return nil, err
+	}
+	t, err := object.GetTag(store, h)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, sig := splitTag(raw)
+	return v.verify(payload, sig, t.Tagger.Email), nil
+}
+
+// VerifyPushCert verifies the signature of a push certificate returning the
+// user owning the key.  Pushers without an email, as with ssh keys, only need
+// a registered key.
+func (v *Verifier) VerifyPushCert(cert *packproto.PushCert) (string, error) {
+	email := cert.PusherEmail()
+	res := v.verify(cert.Payload, cert.Signature, email)
+	if res.Status == Verified || (res.Status == EmailMismatch && email == "") {
+		return res.Signer, nil
+	}
+	if res.Reason != "" {
+		return "", fmt.Errorf("push certificate %s: %s", res.Status, res.Reason)
+	}
+	return "", fmt.Errorf("push certificate %s", res.Status)
+}
+
+func (v *Verifier) verify(payload, sig []byte, email string) *Result {
+	switch {
+	case len(sig) == 0:
+		return &Result{Status: Unsigned}
+	case bytes.HasPrefix(sig, sshArmorStart):
+		return v.verifySSH(payload, sig, email)
+	case bytes.HasPrefix(sig, pgpArmorStart):
+		return v.verifyOpenPGP(payload, sig, email)
+	}
+	return &Result{Status: BadSignature, Reason: "unknown signature format"}
+}
+
+func (v *Verifier) verifySSH(payload, armored []byte, email string) *Result {
+	res := &Result{Format: formatSSH}
+
+	sig, pub, err := parseSSHSig(armored)
+	if err != nil {
+		res.Status, res.Reason = BadSignature, err.Error()
+		return res
+	}
+	res.KeyID = users.SSHKeyID(pub)
+
+	if err = sig.verify(pub, payload); err != nil {
+		res.Status, res.Reason = BadSignature, err.Error()
+		return res
+	}
+
+	u, _, err := v.users.KeyOwner(res.KeyID)
+	if err != nil {
+		res.Status = UnknownKey
+		return res
+	}
+	return signedBy(res, u, email)
+}
+
+func (v *Verifier) verifyOpenPGP(payload, armored []byte, email string) *Result {
+	res := &Result{Format: formatOpenPGP}
+
+	ring := &keyRing{users: v.users}
+	entity, err := openpgp.CheckArmoredDetachedSignature(ring, bytes.NewReader(payload), bytes.NewReader(armored))
+	if ring.issuer != 0 {
+		res.KeyID = users.OpenPGPKeyID(ring.issuer)
+	}
+	if err != nil {
+		res.Status, res.Reason = BadSignature, err.Error()
+		if ring.owner == nil {
+			res.Status, res.Reason = UnknownKey, ""
+		}
+		return res
+	}
+
+	u, _, err := v.users.KeyOwner(users.OpenPGPKeyID(entity.PrimaryKey.KeyId))
+	if err != nil {
+		res.Status = UnknownKey
+		return res
+	}
+	return signedBy(res, u, email)
+}
+
+func signedBy(res *Result, u *users.User, email string) *Result {
+	res.Signer = u.Name
+	if u.HasEmail(email) {
+		res.Status = Verified
+	} else {
+		res.Status, res.Reason = EmailMismatch, email+" is not an email of "+u.Name
+	}
+	return res
+}
+
+// keyRing looks OpenPGP keys up in the user store recording the issuer asked
+// for
+type keyRing struct {
+	users  users.Store
+	issuer uint64
+	owner  *users.User
+}
+
+func (kr *keyRing) KeysById(id uint64) []openpgp.Key {
+	kr.issuer = id
+	u, k, err := kr.users.KeyOwner(users.OpenPGPKeyID(id))
+	if err != nil || k.Entity() == nil {
+		return nil
+	}
+	kr.owner = u
+	return openpgp.EntityList{k.Entity()}.KeysById(id)
+}
+
+func (kr *keyRing) KeysByIdUsage(id uint64, usage byte) []openpgp.Key {
+	kr.issuer = id
+	u, k, err := kr.users.KeyOwner(users.OpenPGPKeyID(id))
+	if err != nil || k.Entity() == nil {
+		return nil
+	}
+	kr.owner = u
+	return openpgp.EntityList{k.Entity()}.KeysByIdUsage(id, usage)
+}
+
+func (kr *keyRing) DecryptionKeys() []openpgp.Key {
+	return nil
+}
+
+func rawObject(store storer.EncodedObjectStorer, t plumbing.ObjectType, h plumbing.Hash) ([]byte, error) {
+	obj, err := store.EncodedObject(t, h)
+	if err != nil {
+		return nil, err
+	}
+	r, err := obj.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// splitCommit returns the commit without its gpgsig header, which is what is
+// signed, and the signature
+func splitCommit(raw []byte) (payload, sig []byte) {
+	var (
+		lines  = bytes.SplitAfter(raw, []byte("\n"))
+		inSig  bool
+		inBody bool
+	)
+	for _, line := range lines {
+		switch {
+		case inBody:
+			payload = append(payload, line...)
+		case inSig && bytes.HasPrefix(line, []byte(" ")):
+			sig = append(sig, line[1:]...)
+		case bytes.HasPrefix(line, []byte("gpgsig ")):
+			inSig = true
+			sig = append(sig, line[len("gpgsig "):]...)
+		default:
+			inSig = false
+			if len(bytes.TrimRight(line, "\n")) == 0 {
+				inBody = true
+			}
+			payload = append(payload, line...)
+		}
+	}
+	return payload, sig
+}
+
+// splitTag returns the tag up to the signature at the end of its message and
+// the signature
+func splitTag(raw []byte) (payload, sig []byte) {
+	for _, start := range [][]byte{pgpArmorStart, sshArmorStart} {
+		i := bytes.LastIndex(raw, start)
+		if i >= 0 && (i == 0 || raw[i-1] == '\n') {
+			return raw[:i], raw[i:]
+		}
+	}
+	return raw, nil
+}
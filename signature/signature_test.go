@@ -0,0 +1,130 @@
+package signature
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/pem"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/users"
+)
+
+const testCommit = "tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n" +
+	"author alice <alice@example.com> 1500000000 +0000\n" +
+	"committer alice <alice@example.com> 1500000000 +0000\n"
+
+// testSSHSign returns the armored ssh signature of msg
+func testSSHSign(t *testing.T, signer ssh.Signer, msg []byte) string {
+	h := sha512.Sum512(msg)
+	signed := append([]byte(sshsigMagic), ssh.Marshal(struct {
+		Namespace, Reserved, HashAlgorithm string
+		Hash                               []byte
+	}{"git", "", "sha512", h[:]})...)
+
+	sig, err := signer.Sign(rand.Reader, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob := append([]byte(sshsigMagic), ssh.Marshal(struct {
+		Version                            uint32
+		PublicKey                          []byte
+		Namespace, Reserved, HashAlgorithm string
+		Signature                          []byte
+	}{1, signer.PublicKey().Marshal(), "git", "", "sha512", ssh.Marshal(sig)})...)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "SSH SIGNATURE", Bytes: blob}))
+}
+
+func testStoreCommit(t *testing.T, st *memory.Storage, raw string) plumbing.Hash {
+	obj := st.NewEncodedObject()
+	obj.SetType(plumbing.CommitObject)
+	w, _ := obj.Writer()
+	w.Write([]byte(raw))
+	w.Close()
+	h, err := st.SetEncodedObject(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestVerifyCommitSSH(t *testing.T) {
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	us := users.NewMemStore()
+	us.CreateUser(&users.User{Name: "alice", Emails: []string{"alice@example.com"}})
+	v := NewVerifier(us)
+
+	st := memory.NewStorage()
+	msg := "\nsigned\n"
+	armored := testSSHSign(t, signer, []byte(testCommit+msg))
+	gpgsig := "gpgsig " + strings.Replace(strings.TrimSuffix(armored, "\n"), "\n", "\n ", -1) + "\n"
+	signed := testStoreCommit(t, st, testCommit+gpgsig+msg)
+	tampered := testStoreCommit(t, st, testCommit+gpgsig+"\ntampered\n")
+	unsigned := testStoreCommit(t, st, testCommit+msg)
+
+	for _, c := range []struct {
+		h    plumbing.Hash
+		want Status
+	}{{signed, UnknownKey}, {tampered, BadSignature}, {unsigned, Unsigned}} {
+		res, err := v.VerifyCommit(st, c.h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != c.want {
+			t.Fatalf("have=%+v want=%s", res, c.want)
+		}
+	}
+
+	key, err := users.ParseKey(users.KeyTypeSSH, string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = us.AddKey("alice", key); err != nil {
+		t.Fatal(err)
+	}
+	res, err := v.VerifyCommit(st, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != Verified || res.Signer != "alice" || res.KeyID != key.ID {
+		t.Fatalf("%+v", res)
+	}
+}
+
+func TestHookUnprotectedRef(t *testing.T) {
+	st := memory.NewStorage()
+	tree := st.NewEncodedObject()
+	tree.SetType(plumbing.TreeObject)
+	st.SetEncodedObject(tree)
+	unsigned := testStoreCommit(t, st, testCommit+"\nunsigned\n")
+
+	hook := NewVerifier(users.NewMemStore()).Hook(&Rule{Refs: []string{"refs/heads/master"}})
+	update := packproto.RefUpdate{Ref: "refs/heads/master", New: unsigned}
+
+	// Commits pushed to unprotected refs first aren't trusted
+	st.SetReference(plumbing.NewHashReference("refs/heads/dev", unsigned))
+	if err := hook.PreReceive(context.Background(), st, update, nil); err == nil || !strings.Contains(err.Error(), "unsigned") {
+		t.Fatal(err)
+	}
+
+	// Those already on protected refs are
+	st.SetReference(plumbing.NewHashReference("refs/heads/master", unsigned))
+	update.Old = unsigned
+	if err := hook.PreReceive(context.Background(), st, update, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,115 @@
+package signature
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+
+const (
+	sshsigMagic = "SSHSIG"
+	// git signs with this namespace
+	sshsigNamespace = "git"
+)
+
+var errBadSSHSig = errors.New("malformed ssh signature")
+
+// sshsig is a parsed armored ssh signature
+type sshsig struct {
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      []byte
+	HashAlgorithm string
+	Signature     []byte
+}
+
+func parseSSHSig(armored []byte) (*sshsig, ssh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" || !bytes.HasPrefix(block.Bytes, []byte(sshsigMagic)) {
+		return nil, nil, errBadSSHSig
+	}
+
+	var sig sshsig
+	if err := ssh.Unmarshal(block.Bytes[len(sshsigMagic):], &sig); err != nil {
+		return nil, nil, errBadSSHSig
+	}
+	if sig.Version != 1 {
+		return nil, nil, errBadSSHSig
+	}
+
+	pub, err := ssh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &sig, pub, nil
+}
+
+// verify checks the signature is by pub over the message in the git namespace
+func (sig *sshsig) verify(pub ssh.PublicKey, message []byte) error {
+	if sig.Namespace != sshsigNamespace {
+		return errors.New("ssh signature namespace is not git")
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return errors.New("unsupported ssh signature hash: " + sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	signed := []byte(sshsigMagic)
+	signed = append(signed, ssh.Marshal(struct {
+		Namespace     string
+		Reserved      []byte
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+
+	var s ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &s); err != nil {
+		return errBadSSHSig
+	}
+
+	return verifySSH(pub, signed, &s)
+}
+
+// verifySSH verifies the signature including the rsa-sha2 formats ssh-keygen
+// signs with
+func verifySSH(pub ssh.PublicKey, data []byte, s *ssh.Signature) error {
+	var ch crypto.Hash
+	switch s.Format {
+	case "rsa-sha2-256":
+		ch = crypto.SHA256
+	case "rsa-sha2-512":
+		ch = crypto.SHA512
+	default:
+		return pub.Verify(data, s)
+	}
+
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return errors.New("signature format " + s.Format + " for key type " + pub.Type())
+	}
+	rpk, ok := cpk.CryptoPublicKey().(*rsa.PublicKey)
+	if !ok {
+		return errors.New("signature format " + s.Format + " for key type " + pub.Type())
+	}
+
+	h := ch.New()
+	h.Write(data)
+	return rsa.VerifyPKCS1v15(rpk, ch, h.Sum(nil), s.Blob)
+}
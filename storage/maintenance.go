@@ -0,0 +1,342 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+
+	"github.com/euforia/go-git-server/packfile"
+)
+
+const (
+	// packExpiry is how long superseded packs and loose objects that were
+	// packed are kept for stores opened before and readers still using them
+	packExpiry = time.Hour
+	// repackLooseObjects is the number of loose objects from which repos
+	// are repacked
+	repackLooseObjects = 100
+	// supersededExt marks packs replaced by a repack.  Its mtime is when.
+	supersededExt = ".superseded"
+)
+
+// Repos returns the ids of all repos under the data dir
+func (mos *FilesystemGitRepoStorage) Repos() ([]string, error) {
+	var ids []string
+	err := filepath.Walk(mos.datadir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return err
+		}
+		// Hidden dirs e.g. .audit hold server data, not repos
+		if path != mos.datadir && strings.HasPrefix(info.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !isBareRepo(path) {
+			return nil
+		}
+
+		id, err := filepath.Rel(mos.datadir, path)
+		if err == nil {
+			ids = append(ids, filepath.ToSlash(id))
+		}
+		return filepath.SkipDir
+	})
+	return ids, err
+}
+
+// Maintain repacks all objects reachable from the repo refs into a single pack
+// along with its reachability bitmap and updates the commit-graph when the repo
+// has many loose objects, more than one pack or no bitmap.  Loose objects in
+// packs written more than packExpiry ago are removed as are packs that were
+// superseded more than packExpiry ago.
+func (mos *FilesystemGitRepoStorage) Maintain(ctx context.Context, id string) error {
+	mos.maint.Lock()
+	defer mos.maint.Unlock()
+
+	st, ok := mos.GetStore(id).(*FilesystemStore)
+	if !ok {
+		return fmt.Errorf("repo not found: %s", id)
+	}
+
+	repack, err := needsRepack(st)
+	if err != nil {
+		return err
+	}
+
+	var pack plumbing.Hash
+	if repack {
+		if pack, err = mos.repack(ctx, id, st); err != nil {
+			return err
+		}
+	}
+
+	if err = pruneLooseObjects(st); err != nil {
+		return err
+	}
+	return removeOldPacks(st, pack)
+}
+
+// repack writes the pack of the objects reachable from the refs and its
+// bitmap, then reopens the store so it is used
+func (mos *FilesystemGitRepoStorage) repack(ctx context.Context, id string, st *FilesystemStore) (plumbing.Hash, error) {
+	var pack plumbing.Hash
+
+	tips, err := refTips(st)
+	if err != nil || len(tips) == 0 {
+		return pack, err
+	}
+
+	if pack, err = writePack(ctx, st, tips); err != nil {
+		return pack, err
+	}
+	base := packBase(st, pack)
+
+	idx, err := readIndex(base + ".idx")
+	if err != nil {
+		return pack, err
+	}
+
+	bi, err := packfile.NewBitmapIndex(idx)
+	if err != nil {
+		return pack, err
+	}
+	if err = bi.Build(ctx, st, tips); err != nil {
+		return pack, err
+	}
+	if err = writeFileAtomic(base+".bitmap", bi.Encode); err != nil {
+		return pack, err
+	}
+
+	if err = st.UpdateCommitGraph(ctx); err != nil {
+		return pack, err
+	}
+
+	// Reopen so the new pack is used.  Readers of the old store still find
+	// the superseded packs and loose objects until they expire.
+	mos.mu.Lock()
+	mos.m[id] = st.reopen()
+	mos.mu.Unlock()
+
+	log.Printf("[maintenance] repo=%s pack=%s tips=%d", id, pack, len(tips))
+	return pack, nil
+}
+
+// needsRepack returns true if the repo has many loose objects, more than one
+// pack not superseded or none with a bitmap
+func needsRepack(st *FilesystemStore) (bool, error) {
+	var loose int
+	err := st.ForEachObjectHash(func(plumbing.Hash) error {
+		loose++
+		return nil
+	})
+	if err != nil || loose >= repackLooseObjects {
+		return err == nil, err
+	}
+
+	packs, err := st.ObjectPacks()
+	if err != nil {
+		return false, err
+	}
+	var live, bitmapped int
+	for _, h := range packs {
+		base := packBase(st, h)
+		if _, err = os.Stat(base + supersededExt); err == nil {
+			continue
+		}
+		live++
+		if _, err = os.Stat(base + ".bitmap"); err == nil {
+			bitmapped++
+		}
+	}
+	return live > 1 || bitmapped == 0 && loose > 0, nil
+}
+
+func writePack(ctx context.Context, st *FilesystemStore, tips []plumbing.Hash) (plumbing.Hash, error) {
+	var pack plumbing.Hash
+
+	w, err := st.PackfileWriter()
+	if err != nil {
+		return pack, err
+	}
+
+	checksum, err := packfile.NewEncoder(w, st).Encode(ctx, tips, nil)
+	if er := w.Close(); err == nil {
+		err = er
+	}
+	copy(pack[:], checksum)
+	return pack, err
+}
+
+// removeOldPacks marks the packs other than keep as superseded and removes
+// those superseded more than packExpiry ago.  Nothing is superseded if keep is
+// zero.
+func removeOldPacks(st *FilesystemStore, keep plumbing.Hash) error {
+	packs, err := st.ObjectPacks()
+	if err != nil {
+		return err
+	}
+
+	expired := time.Now().Add(-packExpiry)
+	for _, h := range packs {
+		if h == keep {
+			continue
+		}
+
+		base := packBase(st, h)
+		fi, err := os.Stat(base + supersededExt)
+		switch {
+		case os.IsNotExist(err):
+			if !keep.IsZero() {
+				err = ioutil.WriteFile(base+supersededExt, nil, 0644)
+			} else {
+				err = nil
+			}
+		case err == nil && fi.ModTime().Before(expired):
+			if err = st.DeleteOldObjectPackAndIndex(h, time.Time{}); err == nil {
+				os.Remove(base + ".bitmap")
+				os.Remove(base + supersededExt)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pruneLooseObjects removes the loose objects in packs written more than
+// packExpiry ago.  Stores opened before then may not know the packs.
+func pruneLooseObjects(st *FilesystemStore) error {
+	packs, err := st.ObjectPacks()
+	if err != nil {
+		return err
+	}
+
+	var (
+		idxs    []*idxfile.MemoryIndex
+		expired = time.Now().Add(-packExpiry)
+	)
+	for _, h := range packs {
+		base := packBase(st, h)
+		fi, err := os.Stat(base + ".pack")
+		if err != nil || fi.ModTime().After(expired) {
+			continue
+		}
+		idx, err := readIndex(base + ".idx")
+		if err != nil {
+			return err
+		}
+		idxs = append(idxs, idx)
+	}
+	if len(idxs) == 0 {
+		return nil
+	}
+
+	return st.ForEachObjectHash(func(h plumbing.Hash) error {
+		for _, idx := range idxs {
+			if ok, _ := idx.Contains(h); ok {
+				return st.DeleteLooseObject(h)
+			}
+		}
+		return nil
+	})
+}
+
+// packBase returns the path of the pack sans extension
+func packBase(st *FilesystemStore, h plumbing.Hash) string {
+	return filepath.Join(st.dir, "objects", "pack", "pack-"+h.String())
+}
+
+// refTips returns the unique hashes the repo refs point to
+func refTips(st *FilesystemStore) ([]plumbing.Hash, error) {
+	iter, err := st.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		tips []plumbing.Hash
+		seen = map[plumbing.Hash]bool{}
+	)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		h := ref.Hash()
+		if ref.Type() == plumbing.HashReference && !h.IsZero() && !seen[h] {
+			seen[h] = true
+			tips = append(tips, h)
+		}
+		return nil
+	})
+	return tips, err
+}
+
+func readIndex(path string) (*idxfile.MemoryIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx := idxfile.NewMemoryIndex()
+	err = idxfile.NewDecoder(f).Decode(idx)
+	return idx, err
+}
+
+// readBitmapIndex reads the bitmap of the pack with the given path sans extension
+func readBitmapIndex(base string) (*packfile.BitmapIndex, error) {
+	idx, err := readIndex(base + ".idx")
+	if err != nil {
+		return nil, err
+	}
+
+	bi, err := packfile.NewBitmapIndex(idx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(base + ".bitmap")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return bi, bi.Decode(f)
+}
+
+// writeFileAtomic writes to a temp file renaming it to path on success
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	if err = write(f); err == nil {
+		err = f.Sync()
+	}
+	if er := f.Close(); err == nil {
+		err = er
+	}
+	if err == nil {
+		return os.Rename(path+".tmp", path)
+	}
+
+	os.Remove(path + ".tmp")
+	return err
+}
+
+func isBareRepo(dir string) bool {
+	for _, name := range []string{"HEAD", "objects", "refs"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -1,9 +1,19 @@
 package storage
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/euforia/go-git-server/commitgraph"
+	"github.com/euforia/go-git-server/packfile"
+	"github.com/euforia/go-git-server/repository"
 
 	"gopkg.in/src-d/go-billy.v4/osfs"
 	"gopkg.in/src-d/go-git.v4/plumbing/cache"
@@ -49,6 +59,8 @@ type FilesystemGitRepoStorage struct {
 	mu      sync.Mutex
 	datadir string
 	m       map[string]storer.Storer
+	// serializes repo maintenance
+	maint sync.Mutex
 }
 
 // NewFilesystemGitRepoStorage returns an new instance of FilesystemGitRepoStorage
@@ -68,13 +80,204 @@ func (mos *FilesystemGitRepoStorage) GetStore(id string) storer.Storer {
 		return v
 	}
 
+	// Ids must not reach outside the data dir nor be a namespace or a hidden
+	// dir e.g. .audit
+	if repository.ValidateID(id) != nil {
+		return nil
+	}
 	dir := filepath.Join(mos.datadir, id)
 	_, err := os.Stat(dir)
 	if err != nil {
 		return nil
 	}
 
-	fs := filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault())
+	fs := NewFilesystemStore(dir)
+	if fs.format != packfile.SHA1 {
+		// Objects are stored with 20 byte hashes
+		log.Printf("ERR [storage] repo=%s object-format=%s: %v", id, fs.format, packfile.ErrUnsupportedObjectFormat)
+		return nil
+	}
 	mos.m[id] = fs
 	return fs
 }
+
+// FilesystemStore is the object store for a single repo on the filesystem.  It
+// provides the reachability bitmap of the repo pack if one exists.
+type FilesystemStore struct {
+	*filesystem.Storage
+	dir    string
+	format packfile.ObjectFormat
+
+	mu sync.Mutex
+	// loaded bitmap and the path it was loaded from
+	bitmap     *packfile.BitmapIndex
+	bitmapPath string
+	// loaded commit-graph and the modification time of the file
+	graph      *commitgraph.Graph
+	graphMtime time.Time
+
+	// Shared with the stores the repo is reopened as so updates of the
+	// commit-graph file are serialized
+	updates *graphUpdates
+}
+
+// graphUpdates tracks the commit-graph update running and whether another was
+// requested meanwhile
+type graphUpdates struct {
+	mu    sync.Mutex
+	busy  bool
+	dirty bool
+}
+
+// NewFilesystemStore opens the bare repo at dir
+func NewFilesystemStore(dir string) *FilesystemStore {
+	fs := &FilesystemStore{
+		Storage: filesystem.NewStorage(osfs.New(dir), cache.NewObjectLRUDefault()),
+		dir:     dir,
+		format:  packfile.SHA1,
+		updates: &graphUpdates{},
+	}
+
+	if cfg, err := fs.Config(); err == nil {
+		f := cfg.Raw.Section("extensions").Option("objectformat")
+		if fs.format, err = packfile.ParseObjectFormat(f); err != nil {
+			fs.format = packfile.ObjectFormat(f)
+		}
+	}
+
+	return fs
+}
+
+// ObjectFile opens the file at name relative to the objects dir e.g. a loose
+// object or pack
+func (fs *FilesystemStore) ObjectFile(name string) (*os.File, error) {
+	return os.Open(filepath.Join(fs.dir, "objects", filepath.FromSlash(name)))
+}
+
+// ObjectFormat returns the object format from the repo config
+func (fs *FilesystemStore) ObjectFormat() packfile.ObjectFormat {
+	return fs.format
+}
+
+// BitmapIndex returns the bitmap index of the newest bitmapped pack or nil if
+// there is none.
+func (fs *FilesystemStore) BitmapIndex() (*packfile.BitmapIndex, error) {
+	bitmaps, err := filepath.Glob(filepath.Join(fs.dir, "objects", "pack", "pack-*.bitmap"))
+	if err != nil || len(bitmaps) == 0 {
+		return nil, err
+	}
+
+	var (
+		path  string
+		mtime time.Time
+	)
+	for _, p := range bitmaps {
+		if fi, err := os.Stat(p); err == nil && fi.ModTime().After(mtime) {
+			path, mtime = p, fi.ModTime()
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if path == fs.bitmapPath {
+		return fs.bitmap, nil
+	}
+
+	bi, err := readBitmapIndex(strings.TrimSuffix(path, ".bitmap"))
+	if err != nil {
+		return nil, err
+	}
+	fs.bitmap, fs.bitmapPath = bi, path
+	return bi, nil
+}
+
+// CommitGraph returns the commit-graph of the repo or nil if there is none
+func (fs *FilesystemStore) CommitGraph() (*commitgraph.Graph, error) {
+	path := fs.commitGraphPath()
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fi.ModTime().Equal(fs.graphMtime) {
+		return fs.graph, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g, err := commitgraph.Decode(b)
+	if err != nil {
+		return nil, err
+	}
+	fs.graph, fs.graphMtime = g, fi.ModTime()
+	return g, nil
+}
+
+// UpdateCommitGraph rewrites the commit-graph with all commits reachable from
+// the refs.  Commits already in the graph are not parsed again.  Calls made
+// while an update is running are coalesced into a single further update.
+func (fs *FilesystemStore) UpdateCommitGraph(ctx context.Context) error {
+	u := fs.updates
+	u.mu.Lock()
+	if u.busy {
+		u.dirty = true
+		u.mu.Unlock()
+		return nil
+	}
+	u.busy = true
+	u.mu.Unlock()
+
+	for {
+		err := fs.writeCommitGraph(ctx)
+
+		u.mu.Lock()
+		if err != nil || !u.dirty {
+			u.busy, u.dirty = false, false
+			u.mu.Unlock()
+			return err
+		}
+		u.dirty = false
+		u.mu.Unlock()
+	}
+}
+
+// reopen returns a new store of the repo e.g. so new packs are used.  Commit-
+// graph updates stay serialized with those of fs.
+func (fs *FilesystemStore) reopen() *FilesystemStore {
+	st := NewFilesystemStore(fs.dir)
+	st.updates = fs.updates
+	return st
+}
+
+func (fs *FilesystemStore) writeCommitGraph(ctx context.Context) error {
+	tips, err := refTips(fs)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := commitgraph.Build(ctx, commitgraph.NewNodeIndex(fs), tips)
+	if err != nil {
+		return err
+	}
+
+	path := fs.commitGraphPath()
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, func(w io.Writer) error {
+		return commitgraph.Encode(w, nodes)
+	})
+}
+
+func (fs *FilesystemStore) commitGraphPath() string {
+	return filepath.Join(fs.dir, "objects", "info", "commit-graph")
+}
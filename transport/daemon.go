@@ -0,0 +1,316 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/pktline"
+)
+
+// DefaultDaemonAddr is the address git:// urls without a port connect to
+const DefaultDaemonAddr = ":9418"
+
+var (
+	errDaemonBusy        = errors.New("too many connections")
+	errDaemonBadRequest  = errors.New("malformed request")
+	errDaemonNotExported = errors.New("access denied or repository not exported")
+)
+
+// GitDaemon serves upload-pack over the git:// protocol.  Only repos with the
+// export flag set are served unless all are exported, and only those anonymous
+// users may read when the git http service has an authorizer.  Repos and
+// protocol settings are those of the git http service.
+type GitDaemon struct {
+	git *GitHTTPService
+
+	exportAll bool
+	// Max connections overall and from a single ip.  0 is unlimited.
+	maxConns      int
+	maxConnsPerIP int
+	// Connections idle for longer are closed
+	timeout time.Duration
+
+	mu    sync.Mutex
+	conns int
+	perIP map[string]int
+	// Listeners closed and connections drained on shutdown
+	listeners []net.Listener
+	closed    bool
+}
+
+// NewGitDaemon instantiates a daemon serving the repos of the git service
+func NewGitDaemon(git *GitHTTPService) *GitDaemon {
+	return &GitDaemon{git: git, timeout: time.Minute, perIP: map[string]int{}}
+}
+
+// SetExportAll serves all repos anonymous users may read regardless of their
+// export flag
+func (d *GitDaemon) SetExportAll(all bool) {
+	d.exportAll = all
+}
+
+// SetConnLimits sets the max connections overall and per client ip.  0 is
+// unlimited.
+func (d *GitDaemon) SetConnLimits(max, perIP int) {
+	d.maxConns = max
+	d.maxConnsPerIP = perIP
+}
+
+// SetTimeout sets how long a connection may be idle
+func (d *GitDaemon) SetTimeout(timeout time.Duration) {
+	d.timeout = timeout
+}
+
+// ListenAndServe listens on addr and serves connections
+func (d *GitDaemon) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Git daemon: git://%s", addr)
+	return d.Serve(l)
+}
+
+// Serve serves the connections of the listener until shut down returning nil
+// then
+func (d *GitDaemon) Serve(l net.Listener) error {
+	defer l.Close()
+
+	d.mu.Lock()
+	d.listeners = append(d.listeners, l)
+	d.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			d.mu.Lock()
+			closed := d.closed
+			d.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go d.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for those open to complete
+// or the context to be done
+func (d *GitDaemon) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	for _, l := range d.listeners {
+		l.Close()
+	}
+	d.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		d.mu.Lock()
+		conns := d.conns
+		d.mu.Unlock()
+		if conns == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// acquire takes a connection slot for the ip unless shutting down
+func (d *GitDaemon) acquire(ip string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed || (d.maxConns > 0 && d.conns >= d.maxConns) || (d.maxConnsPerIP > 0 && d.perIP[ip] >= d.maxConnsPerIP) {
+		return false
+	}
+	d.conns++
+	d.perIP[ip]++
+	return true
+}
+
+func (d *GitDaemon) release(ip string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conns--
+	if d.perIP[ip]--; d.perIP[ip] <= 0 {
+		delete(d.perIP, ip)
+	}
+}
+
+func (d *GitDaemon) serveConn(nc net.Conn) {
+	defer nc.Close()
+
+	ip, _, _ := net.SplitHostPort(nc.RemoteAddr().String())
+	var repoID string
+	// Unlike net/http nothing recovers panics of connections so a client
+	// can't take the server down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERR [daemon] client=%s repo=%s panic: %v\n%s", ip, repoID, r, debug.Stack())
+		}
+	}()
+	conn := &idleConn{Conn: nc, timeout: d.timeout}
+	if !d.acquire(ip) {
+		// Read the request first or the client fails writing it
+		log.Printf("DBG [daemon] client=%s %v", ip, errDaemonBusy)
+		parseDaemonRequest(conn)
+		daemonError(conn, errDaemonBusy)
+		return
+	}
+	defer d.release(ip)
+
+	req, err := parseDaemonRequest(conn)
+	if err != nil {
+		log.Printf("DBG [daemon] client=%s %v", ip, err)
+		daemonError(conn, err)
+		return
+	}
+	log.Printf("DBG [daemon] client=%s service=%s path=%s host=%s", ip, req.service, req.path, req.host)
+
+	if req.service != packproto.GitUploadPack {
+		daemonError(conn, fmt.Errorf("service not enabled: %s", req.service))
+		return
+	}
+
+	var st storer.Storer
+	repoID, st = d.lookup(req.path)
+	if st == nil {
+		daemonError(conn, fmt.Errorf("%v: %s", errDaemonNotExported, req.path))
+		return
+	}
+
+	if err = d.uploadPack(conn, repoID, st, req); err != nil && err != io.EOF {
+		log.Printf("ERR [daemon] repo=%s %v", repoID, err)
+	}
+}
+
+// lookup returns the exported public repo at the path trying it with and
+// without the .git suffix as git daemon does
+func (d *GitDaemon) lookup(path string) (string, storer.Storer) {
+	path = strings.Trim(path, "/")
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." || p == ".." {
+			return "", nil
+		}
+	}
+
+	for _, id := range []string{path, strings.TrimSuffix(path, ".git"), path + ".git"} {
+		if !d.exportAll {
+			repo := d.git.repoSettings(id)
+			if repo == nil || !repo.Export {
+				continue
+			}
+		}
+		// Connections are anonymous
+		if d.git.authz != nil && d.git.authz.Authorize(nil, id, authz.RoleRead) != nil {
+			continue
+		}
+		if st := d.git.stores.GetStore(id); st != nil {
+			return id, st
+		}
+	}
+	return "", nil
+}
+
+func (d *GitDaemon) uploadPack(conn io.ReadWriter, repoID string, st storer.Storer, req *daemonRequest) error {
+	proto := d.git.newProtocol(conn, conn, repoID, st)
+	proto.SetStateful(true)
+
+	ctx := context.Background()
+	if packproto.IsV2Request(strings.Join(req.extra, ":")) {
+		proto.AdvertiseV2()
+		return proto.ServeUploadPackV2(ctx, st)
+	}
+
+	refs, err := advertisedRefs(st)
+	if err != nil {
+		return err
+	}
+	proto.ListReferences(packproto.GitUploadPack, refs)
+	_, err = proto.UploadPack(ctx, st)
+	return err
+}
+
+// daemonRequest is the request line of a git:// connection
+type daemonRequest struct {
+	service string
+	path    string
+	host    string
+	// Extra parameters e.g. version=2
+	extra []string
+}
+
+// parseDaemonRequest parses "<service> <path>\0host=<host>\0\0<extra>\0..."
+func parseDaemonRequest(r io.Reader) (*daemonRequest, error) {
+	var line []byte
+	if err := pktline.NewDecoder(r).Decode(&line); err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\n"), "\x00")
+	cmd := strings.SplitN(fields[0], " ", 2)
+	if len(cmd) != 2 || !strings.HasPrefix(cmd[1], "/") {
+		return nil, errDaemonBadRequest
+	}
+
+	req := &daemonRequest{service: cmd[0], path: cmd[1]}
+	inExtra := false
+	for _, f := range fields[1:] {
+		switch {
+		case inExtra:
+			if f != "" {
+				req.extra = append(req.extra, f)
+			}
+		case f == "":
+			inExtra = true
+		case strings.HasPrefix(f, "host="):
+			req.host = strings.TrimPrefix(f, "host=")
+		}
+	}
+	return req, nil
+}
+
+// daemonError sends the error to the client which prints it
+func daemonError(w io.Writer, err error) {
+	pktline.NewEncoder(w).Encode([]byte("ERR " + err.Error() + "\n"))
+}
+
+// idleConn closes the connection once idle for timeout
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(p)
+}
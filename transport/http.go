@@ -5,6 +5,7 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/euforia/go-git-server/auth"
 	"github.com/euforia/go-git-server/packproto"
 )
 
@@ -15,6 +16,13 @@ const (
 	ctxKeyRepo    ctxKey = "repo"
 )
 
+const (
+	// usersPrefix is the path the users api is served under
+	usersPrefix = "/api/users/"
+	// namespacesPrefix is the path the namespaces api is served under
+	namespacesPrefix = "/api/namespaces/"
+)
+
 // GitHandler interface for git specific operations
 type GitHandler interface {
 	// clone, fetch, pull ???
@@ -32,6 +40,16 @@ type HTTPTransport struct {
 	repo http.Handler
 	// ui
 	ui http.Handler
+	// static pre-generated packs and bundles
+	offload http.Handler
+	// users and their keys
+	users http.Handler
+	// namespaces and their members
+	namespaces http.Handler
+	// Optional.  All requests must be authenticated if set unless anonymous
+	// ones are allowed.
+	auth      auth.Authenticator
+	anonymous bool
 }
 
 // NewHTTPTransport given the git handler
@@ -44,10 +62,76 @@ func (server *HTTPTransport) UIHandler(h http.Handler) {
 	server.ui = h
 }
 
+// OffloadHandler registers the handler serving pre-generated packs and bundles
+func (server *HTTPTransport) OffloadHandler(h http.Handler) {
+	server.offload = h
+}
+
+// UsersHandler registers the handler serving the users api
+func (server *HTTPTransport) UsersHandler(h http.Handler) {
+	server.users = h
+}
+
+// NamespacesHandler registers the handler serving the namespaces api
+func (server *HTTPTransport) NamespacesHandler(h http.Handler) {
+	server.namespaces = h
+}
+
+// SetAuthenticator requires requests to be authenticated by a
+func (server *HTTPTransport) SetAuthenticator(a auth.Authenticator) {
+	server.auth = a
+}
+
+// SetAnonymous lets requests without credentials through to the handlers to
+// authorize.  The users and namespaces apis always require authentication.
+func (server *HTTPTransport) SetAnonymous(allow bool) {
+	server.anonymous = allow
+}
+
+// authenticate adds the principal of the request to its context.  Requests
+// with invalid credentials or without any when they are required are
+// challenged for them.
+func (server *HTTPTransport) authenticate(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, bool) {
+	p, err := server.auth.Authenticate(r)
+	if p != nil {
+		// Credentials limited to a repo can't use the apis and scoped ones
+		// need the admin scope to change anything through them.  Whether
+		// the user may is up to the handlers.
+		if isAPIRequest(r) && (p.Repo != "" || r.Method != "GET" && p.Scopes != nil && !p.HasScope(auth.ScopeAdmin)) {
+			log.Printf("DBG [auth] %s %s %s %v", r.Method, r.URL.Path, p, errForbidden)
+			writeJSONError(w, 403, errForbidden)
+			return w, r, false
+		}
+		return w, r.WithContext(auth.NewContext(r.Context(), p)), true
+	}
+
+	if err == nil {
+		if server.anonymous && !isAPIRequest(r) {
+			// Handlers refusing anonymous requests ask for credentials
+			return &challengeWriter{ResponseWriter: w, challenge: server.auth.Challenge()}, r, true
+		}
+		err = auth.ErrUnauthenticated
+	} else {
+		log.Printf("DBG [auth] %s %s %v", r.Method, r.URL.Path, err)
+	}
+	if ch := server.auth.Challenge(); ch != "" {
+		w.Header().Set("WWW-Authenticate", ch)
+	}
+	writeJSONError(w, 401, err)
+	return w, r, false
+}
+
 // ServeHTTP assign context to requests and ID to all requests.
 func (server *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Printf("[http] %s %s", r.Method, r.URL.RequestURI())
 
+	if server.auth != nil {
+		var ok bool
+		if w, r, ok = server.authenticate(w, r); !ok {
+			return
+		}
+	}
+
 	switch r.Method {
 	case "GET":
 		if repoID, service, ok := isListRefRequest(r); ok {
@@ -56,6 +140,13 @@ func (server *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			server.git.ListReferences(w, r.WithContext(ctx))
 			return
 		}
+		if repoID, file, ok := isDumbRequest(r); ok {
+			if dh, ok := server.git.(DumbHandler); ok {
+				ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
+				dh.Dumb(w, r.WithContext(ctx), file)
+				return
+			}
+		}
 
 	case "POST":
 		if repoID, service, ok := isPackfileRequest(r); ok {
@@ -73,6 +164,61 @@ func (server *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	}
 
+	if _, _, ok := isUsersRequest(r); ok && server.users != nil {
+		server.users.ServeHTTP(w, r)
+		return
+	}
+
+	if _, ok := isNamespacesRequest(r); ok && server.namespaces != nil {
+		server.namespaces.ServeHTTP(w, r)
+		return
+	}
+
+	if _, _, ok := isOffloadRequest(r); ok && server.offload != nil {
+		server.offload.ServeHTTP(w, r)
+		return
+	}
+
+	if repoID, ok := isBundleRequest(r); ok {
+		if bh, ok := server.git.(BundleHandler); ok {
+			ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
+			bh.Bundle(w, r.WithContext(ctx))
+			return
+		}
+	}
+
+	if repoID, ok := isSecretsRequest(r); ok {
+		if sh, ok := server.git.(SecretsHandler); ok {
+			ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
+			sh.Secrets(w, r.WithContext(ctx))
+			return
+		}
+	}
+
+	if repoID, ok := isPushCertsRequest(r); ok {
+		if ph, ok := server.git.(PushCertsHandler); ok {
+			ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
+			ph.PushCerts(w, r.WithContext(ctx))
+			return
+		}
+	}
+
+	if repoID, rev, ok := isCommitsRequest(r); ok {
+		if ch, ok := server.git.(CommitsHandler); ok {
+			ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
+			ch.Commits(w, r.WithContext(ctx), rev)
+			return
+		}
+	}
+
+	if repoID, id, ok := isReviewsRequest(r); ok {
+		if rh, ok := server.git.(ReviewsHandler); ok {
+			ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
+			rh.Reviews(w, r.WithContext(ctx), id)
+			return
+		}
+	}
+
 	repoID := r.URL.Path[1:]
 	ctx := context.WithValue(r.Context(), ctxKeyRepo, repoID)
 
@@ -84,8 +230,11 @@ func (server *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	server.repo.ServeHTTP(w, r.WithContext(ctx))
 }
 
-// ListenAndServe starts and listener on addr and serves the router handlers
-func (server *HTTPTransport) ListenAndServe(addr string) error {
-	log.Printf("HTTP Server: http://%s", addr)
-	return http.ListenAndServe(addr, server)
+// ListenAndServe serves the router handlers per the config
+func (server *HTTPTransport) ListenAndServe(config *ServerConfig) error {
+	srv, err := NewServer(config, server)
+	if err != nil {
+		return err
+	}
+	return srv.ListenAndServe()
 }
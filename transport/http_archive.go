@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+
+	"github.com/euforia/go-git-server/archive"
+	"github.com/euforia/go-git-server/authz"
+)
+
+// Archive serves GET /<repo>/archive/<ref>.{tar,tar.gz,zip} downloading the
+// tree of the ref.  Paths are prefixed with <repo name>-<ref>/ unless a prefix
+// is given with ?prefix=.
+func (svr *RepoHTTPService) Archive(w http.ResponseWriter, r *http.Request, repoID, ref string, format archive.Format) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if svr.stores == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleRead) {
+		return
+	}
+	st := svr.stores.GetStore(repoID)
+	if st == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	h, err := archive.ResolveRef(st, ref)
+	if err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+
+	// e.g. repo-feature-x for refs/heads/feature/x
+	name := path.Base(repoID) + "-" + strings.Replace(plumbing.ReferenceName(ref).Short(), "/", "-", -1)
+	opts := archive.Options{Format: format, Prefix: name + "/"}
+	if prefix, ok := r.URL.Query()["prefix"]; ok {
+		opts.Prefix = prefix[0]
+	}
+
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s%s"`, name, format.Ext()))
+	w.WriteHeader(200)
+
+	if err = archive.Write(w, st, h, opts); err != nil {
+		log.Printf("ERR [archive] repo=%s ref=%s %v", repoID, ref, err)
+	}
+}
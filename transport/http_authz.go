@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+)
+
+// authzStatus returns the http status of an authorization error
+func authzStatus(err error) int {
+	switch err {
+	case auth.ErrUnauthenticated:
+		return 401
+	case authz.ErrNotFound:
+		return 404
+	}
+	return 403
+}
+
+// authorizeRepo checks the principal of the request has the role in the repo
+// writing the error if not.  Everything is allowed without an authorizer.
+func authorizeRepo(w http.ResponseWriter, r *http.Request, a *authz.Authorizer, repoID string, want authz.Role) bool {
+	if a == nil {
+		return true
+	}
+	p, _ := auth.FromContext(r.Context())
+	err := a.Authorize(p, repoID, want)
+	if err == nil {
+		return true
+	}
+	log.Printf("DBG [authz] %s %s repo=%s want=%s %v", r.Method, r.URL.Path, repoID, want, err)
+	writeJSONError(w, authzStatus(err), err)
+	return false
+}
+
+// authorizeNamespace checks the principal of the request has the role in the
+// namespace writing the error if not
+func authorizeNamespace(w http.ResponseWriter, r *http.Request, a *authz.Authorizer, ns string, want authz.Role) bool {
+	if a == nil {
+		return true
+	}
+	p, _ := auth.FromContext(r.Context())
+	err := a.AuthorizeNamespace(p, ns, want)
+	if err == nil {
+		return true
+	}
+	log.Printf("DBG [authz] %s %s ns=%s want=%s %v", r.Method, r.URL.Path, ns, want, err)
+	writeJSONError(w, authzStatus(err), err)
+	return false
+}
+
+// challengeWriter adds the authentication challenge to 401 responses of
+// anonymous requests handlers refused
+type challengeWriter struct {
+	http.ResponseWriter
+	challenge string
+}
+
+func (cw *challengeWriter) WriteHeader(code int) {
+	if code == 401 && cw.challenge != "" {
+		cw.Header().Set("WWW-Authenticate", cw.challenge)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/repository"
+	"github.com/euforia/go-git-server/storage"
+	"github.com/euforia/go-git-server/users"
+)
+
+// testTokens authenticates the token <name> as the user <name>
+func testTokens() auth.Authenticator {
+	tokens := map[string]string{}
+	for _, name := range []string{"alice", "bob", "root", "team"} {
+		tokens[name] = name
+	}
+	return auth.NewStaticTokens(tokens, "")
+}
+
+// testTransport serves the repo, users and namespaces apis as the server does
+// enforcing roles if authn is set.  root is the admin.
+func testTransport(authn auth.Authenticator) *HTTPTransport {
+	repos := repository.NewMemRepoStore()
+	userStore := users.NewMemStore()
+
+	gh := NewGitHTTPService(storage.NewMemGitRepoStorage())
+	rh := NewRepoHTTPService(repos)
+	uh := NewUsersHTTPService(userStore)
+	uh.SetAdmins(auth.NewAdmins("root"))
+
+	server := NewHTTPTransport(gh, rh)
+	server.UsersHandler(uh)
+	if authn == nil {
+		return server
+	}
+
+	server.SetAuthenticator(authn)
+	server.SetAnonymous(true)
+
+	namespaces := authz.NewNamespaces()
+	uh.SetNamespaces(namespaces)
+	a := authz.NewAuthorizer(namespaces, func(repoID string) *authz.ACL {
+		repo, err := repos.GetRepo(repoID)
+		if err != nil {
+			return nil
+		}
+		return &repo.ACL
+	})
+	gh.SetAuthorizer(a)
+	rh.SetAuthorizer(a)
+	server.NamespacesHandler(NewNamespacesHTTPService(namespaces, a, userStore))
+	return server
+}
+
+// doRequest returns the status of the request made with the token if set
+func doRequest(h *HTTPTransport, method, path, token, body string) int {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestRepoAuthz(t *testing.T) {
+	server := testTransport(testTokens())
+
+	tests := []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		// Repos are created in namespaces users may write to
+		{"PUT", "/alice/r", "", `{}`, 401},
+		{"PUT", "/alice/r", "bob", `{}`, 403},
+		{"PUT", "/alice/r", "alice", `{}`, 200},
+		// Private repos are not disclosed
+		{"GET", "/alice/r", "", "", 401},
+		{"GET", "/alice/r", "bob", "", 404},
+		{"POST", "/alice/r", "bob", `{"visibility": "public"}`, 404},
+		{"GET", "/alice/r", "alice", "", 200},
+		// Members have their role
+		{"POST", "/alice/r", "alice", `{"members": {"bob": "read"}}`, 200},
+		{"GET", "/alice/r", "bob", "", 200},
+		{"POST", "/alice/r", "bob", `{"visibility": "public"}`, 403},
+		// Public repos are read by anyone but only changed by admins
+		{"POST", "/alice/r", "alice", `{"visibility": "public"}`, 200},
+		{"GET", "/alice/r", "", "", 200},
+		{"POST", "/alice/r", "", `{}`, 401},
+		{"GET", "/alice/r/info/refs?service=git-receive-pack", "", "", 401},
+	}
+	for i, tt := range tests {
+		if code := doRequest(server, tt.method, tt.path, tt.token, tt.body); code != tt.code {
+			t.Fatal(i, tt.method, tt.path, tt.token, code)
+		}
+	}
+}
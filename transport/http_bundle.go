@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/bundle"
+	"github.com/euforia/go-git-server/pktline"
+)
+
+// BundleHandler is an optional interface for git handlers that serve bundles
+type BundleHandler interface {
+	// GET downloads and POST uploads a bundle
+	Bundle(w http.ResponseWriter, r *http.Request)
+}
+
+// bundleResult is the response to a bundle upload
+type bundleResult struct {
+	Refs          map[string]string `json:"refs"`
+	Prerequisites []string          `json:"prerequisites"`
+	Imported      bool              `json:"imported"`
+	// Refs not updated and why
+	Rejected map[string]string `json:"rejected,omitempty"`
+}
+
+// Bundle serves GET /<repo>/bundle?rev=<rev>... to download a bundle of the
+// repo and POST /<repo>/bundle to import one.  POST with verify=true only checks
+// the prerequisites are present.  Imports are pushes of the bundle refs so the
+// same hooks, limits and fast-forward rules apply.
+func (svr *GitHTTPService) Bundle(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	repoID := r.Context().Value(ctxKeyRepo).(string)
+	want := authz.RoleRead
+	if r.Method == "POST" {
+		want = authz.RoleWrite
+	}
+	if !authorizeRepo(w, r, svr.authz, repoID, want) {
+		return
+	}
+	st := svr.stores.GetStore(repoID)
+	if st == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		refs, prereqs, err := bundle.Resolve(st, r.URL.Query()["rev"])
+		if err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-git-bundle")
+		w.Header().Set("Content-Disposition",
+			fmt.Sprintf(`attachment; filename="%s.bundle"`, path.Base(repoID)))
+		w.WriteHeader(200)
+
+		if err = bundle.Create(r.Context(), w, st, refs, prereqs); err != nil {
+			log.Printf("ERR [bundle] repo=%s %v", repoID, err)
+		}
+
+	case "POST":
+		br := bufio.NewReader(r.Body)
+		hdr, err := bundle.Verify(br, st)
+		if err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+
+		res := bundleResult{Refs: map[string]string{}}
+		for _, ref := range hdr.References {
+			res.Refs[ref.Name().String()] = ref.Hash().String()
+		}
+		for _, p := range hdr.Prerequisites {
+			res.Prerequisites = append(res.Prerequisites, p.Hash.String())
+		}
+
+		if r.URL.Query().Get("verify") != "true" {
+			if res.Rejected, err = svr.importBundle(repoID, st, hdr, br); err != nil {
+				writeJSONError(w, 400, err)
+				return
+			}
+			res.Imported = true
+		}
+
+		b, _ := json.Marshal(res)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(200)
+		w.Write(b)
+
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// importBundle receives the pack of the bundle updating its refs as a push
+// would, returning the rejected refs.  The pack is streamed from r.
+func (svr *GitHTTPService) importBundle(repoID string, st storer.Storer, hdr *bundle.Header, r io.Reader) (map[string]string, error) {
+	cmds := &bytes.Buffer{}
+	enc := pktline.NewEncoder(cmds)
+	for _, ref := range hdr.References {
+		// Leave HEAD alone and skip tips named by hash
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, "refs/") {
+			continue
+		}
+		old := plumbing.ZeroHash
+		if cur, err := st.Reference(ref.Name()); err == nil {
+			old = cur.Hash()
+		}
+		if old != ref.Hash() {
+			enc.Encode([]byte(fmt.Sprintf("%s %s %s", old, ref.Hash(), name)))
+		}
+	}
+	enc.Encode(nil)
+
+	proto := svr.newProtocol(ioutil.Discard, io.MultiReader(cmds, r), repoID, st)
+	results, err := proto.ReceivePack(st)
+	if err != nil {
+		return nil, err
+	}
+
+	rejected := map[string]string{}
+	for _, res := range results {
+		if !res.OK() {
+			rejected[res.Ref] = res.Reason
+		}
+	}
+	log.Printf("DBG [bundle] repo=%s imported=%d rejected=%d", repoID, len(results)-len(rejected), len(rejected))
+	return rejected, nil
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	b, _ := json.Marshal(map[string]string{"error": err.Error()})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
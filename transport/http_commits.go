@@ -0,0 +1,158 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/packfile"
+	"github.com/euforia/go-git-server/signature"
+)
+
+const (
+	defaultCommitsLimit = 30
+	maxCommitsLimit     = 100
+)
+
+var errUnknownRevision = errors.New("unknown revision")
+
+// CommitsHandler is an optional interface for git handlers that serve commits
+type CommitsHandler interface {
+	Commits(w http.ResponseWriter, r *http.Request, rev string)
+}
+
+type commitSignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"when"`
+}
+
+type commitInfo struct {
+	Hash         string            `json:"hash"`
+	Tree         string            `json:"tree"`
+	Parents      []string          `json:"parents"`
+	Author       commitSignature   `json:"author"`
+	Committer    commitSignature   `json:"committer"`
+	Message      string            `json:"message"`
+	Verification *signature.Result `json:"verification,omitempty"`
+}
+
+// Commits serves GET /<repo>/commits/<rev> returning a commit and
+// GET /<repo>/commits?rev=<rev>&limit=<n> listing the history of rev, HEAD by
+// default.  Commits include their signature verification.
+func (svr *GitHTTPService) Commits(w http.ResponseWriter, r *http.Request, rev string) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+
+	repoID := r.Context().Value(ctxKeyRepo).(string)
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleRead) {
+		return
+	}
+	st := svr.stores.GetStore(repoID)
+	if st == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	single := rev != ""
+	if !single {
+		rev = r.URL.Query().Get("rev")
+	}
+	h, err := resolveCommit(st, rev)
+	if err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+	c, err := object.GetCommit(st, h)
+	if err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+
+	var resp interface{}
+	if single {
+		resp = svr.commitInfo(st, c)
+	} else {
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 {
+			limit = defaultCommitsLimit
+		} else if limit > maxCommitsLimit {
+			limit = maxCommitsLimit
+		}
+
+		list := make([]*commitInfo, 0, limit)
+		iter := object.NewCommitIterCTime(c, nil, nil)
+		for len(list) < limit {
+			if c, err = iter.Next(); err != nil {
+				break
+			}
+			list = append(list, svr.commitInfo(st, c))
+		}
+		iter.Close()
+		resp = list
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+func (svr *GitHTTPService) commitInfo(st storer.EncodedObjectStorer, c *object.Commit) *commitInfo {
+	ci := &commitInfo{
+		Hash:      c.Hash.String(),
+		Tree:      c.TreeHash.String(),
+		Parents:   make([]string, len(c.ParentHashes)),
+		Author:    commitSignature{c.Author.Name, c.Author.Email, c.Author.When},
+		Committer: commitSignature{c.Committer.Name, c.Committer.Email, c.Committer.When},
+		Message:   c.Message,
+	}
+	for i, p := range c.ParentHashes {
+		ci.Parents[i] = p.String()
+	}
+
+	if svr.verifier != nil {
+		ci.Verification, _ = svr.verifier.VerifyCommit(st, c.Hash)
+	}
+	return ci
+}
+
+// resolveCommit resolves a hash, full ref name or branch or tag name, peeling
+// tags, to a commit.  The empty rev is HEAD.
+func resolveCommit(st storer.Storer, rev string) (plumbing.Hash, error) {
+	var h plumbing.Hash
+	if rev == "" {
+		rev = string(plumbing.HEAD)
+	}
+
+	if packfile.SHA1.IsHex(rev) {
+		h = plumbing.NewHash(rev)
+	} else {
+		for _, name := range []string{rev, "refs/heads/" + rev, "refs/tags/" + rev} {
+			if ref, err := storer.ResolveReference(st, plumbing.ReferenceName(name)); err == nil {
+				h = ref.Hash()
+				break
+			}
+		}
+		if h.IsZero() {
+			return h, errUnknownRevision
+		}
+	}
+
+	for {
+		t, err := object.GetTag(st, h)
+		if err != nil {
+			return h, nil
+		}
+		h = t.Target
+	}
+}
@@ -0,0 +1,120 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+)
+
+// Kinds of deploy credentials
+const (
+	deployKeys   = "deploy-keys"
+	deployTokens = "deploy-tokens"
+)
+
+// deployKeyRequest is the body of a deploy key upload
+type deployKeyRequest struct {
+	Title string `json:"title"`
+	Key   string `json:"key"`
+	Write bool   `json:"write"`
+}
+
+// deployTokenRequest is the body of a deploy token creation
+type deployTokenRequest struct {
+	Name    string     `json:"name"`
+	Write   bool       `json:"write"`
+	Expires *time.Time `json:"expires"`
+}
+
+// SetDeployCredentials enables managing the deploy keys and tokens of repos
+func (svr *RepoHTTPService) SetDeployCredentials(keys *auth.DeployKeys, tokens *auth.Tokens) {
+	svr.deployKeys = keys
+	svr.deployTokens = tokens
+}
+
+// Deploy serves GET /<repo>/deploy-keys listing the deploy keys of a repo,
+// POST {"title": ..., "key": ..., "write": false} to add one and
+// DELETE /<repo>/deploy-keys/<id> to remove one.  Deploy tokens are managed
+// the same under /<repo>/deploy-tokens with POST
+// {"name": ..., "write": false, "expires": ...}.  Repo admins only.
+func (svr *RepoHTTPService) Deploy(w http.ResponseWriter, r *http.Request, repoID, kind, id string) {
+	defer r.Body.Close()
+
+	if (kind == deployKeys && svr.deployKeys == nil) || (kind == deployTokens && svr.deployTokens == nil) {
+		w.WriteHeader(404)
+		return
+	}
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleAdmin) {
+		return
+	}
+	if _, err := svr.repos.GetRepo(repoID); err != nil {
+		writeJSONError(w, 404, err)
+		return
+	}
+
+	var (
+		resp interface{}
+		err  error
+	)
+	switch {
+	case id == "" && r.Method == "GET":
+		if kind == deployKeys {
+			resp = svr.deployKeys.List(repoID)
+		} else {
+			resp = svr.deployTokens.ListDeploy(repoID)
+		}
+
+	case id == "" && r.Method == "POST" && kind == deployKeys:
+		var req deployKeyRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		if resp, err = svr.deployKeys.Add(repoID, req.Title, req.Key, req.Write); err == auth.ErrKeyInUse {
+			writeJSONError(w, 409, err)
+			return
+		}
+
+	case id == "" && r.Method == "POST":
+		var req deployTokenRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		var tc tokenCreated
+		if tc.Token, tc.Secret, err = svr.deployTokens.CreateDeploy(repoID, req.Name, req.Write, req.Expires); err == nil {
+			resp = tc
+		}
+
+	case id != "" && r.Method == "DELETE":
+		if kind == deployKeys {
+			err = svr.deployKeys.Remove(repoID, id)
+		} else {
+			err = svr.deployTokens.RevokeDeploy(repoID, id)
+		}
+		if err == auth.ErrKeyNotFound || err == auth.ErrTokenNotFound {
+			writeJSONError(w, 404, err)
+			return
+		}
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if resp == nil {
+		w.WriteHeader(204)
+		return
+	}
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
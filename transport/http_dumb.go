@@ -0,0 +1,361 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/idxfile"
+	gitpackfile "gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/packfile"
+)
+
+// DumbHandler is an optional interface for git handlers that serve the read
+// only dumb http protocol
+type DumbHandler interface {
+	// file is the path within the repo e.g. info/refs or objects/info/packs
+	Dumb(w http.ResponseWriter, r *http.Request, file string)
+}
+
+// objectFiler is implemented by stores keeping objects in files as git does
+type objectFiler interface {
+	// ObjectFile opens the file relative to the objects dir
+	ObjectFile(name string) (*os.File, error)
+	ObjectPacks() ([]plumbing.Hash, error)
+}
+
+// dumbPacksMax bounds the size of the generated packs kept.  Those of the least
+// recently fetched repos are dropped first.
+const dumbPacksMax = 256 << 20
+
+// dumbRepo is the generated pack of a repo
+type dumbRepo struct {
+	// serializes generating the pack
+	gen sync.Mutex
+	// guarded by the service dumbMu
+	pack *dumbPack
+	used time.Time
+}
+
+// dumbPack is a pack of all objects reachable from the refs generated for
+// stores without pack files
+type dumbPack struct {
+	// ref tips the pack was generated from
+	tips string
+	name plumbing.Hash
+	pack []byte
+	idx  []byte
+	time time.Time
+}
+
+// Dumb serves the files dumb http clients fetch: info/refs, HEAD,
+// objects/info/packs, loose objects and packs.  Stores without object files
+// serve a pack generated on the fly in their place.
+func (svr *GitHTTPService) Dumb(w http.ResponseWriter, r *http.Request, file string) {
+	repoID := r.Context().Value(ctxKeyRepo).(string)
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleRead) {
+		return
+	}
+	st := svr.stores.GetStore(repoID)
+	if st == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	var (
+		b   []byte
+		err error
+	)
+	switch file {
+	case "info/refs":
+		b, err = dumbInfoRefs(st)
+
+	case "HEAD":
+		var head *plumbing.Reference
+		if head, err = st.Reference(plumbing.HEAD); err == nil {
+			if head.Type() == plumbing.SymbolicReference {
+				b = []byte(fmt.Sprintf("ref: %s\n", head.Target()))
+			} else {
+				b = []byte(head.Hash().String() + "\n")
+			}
+		}
+
+	case "objects/info/packs":
+		var packs []plumbing.Hash
+		if packs, err = svr.dumbPackNames(r.Context(), repoID, st); err == nil {
+			var buf bytes.Buffer
+			for _, h := range packs {
+				fmt.Fprintf(&buf, "P pack-%s.pack\n", h)
+			}
+			buf.WriteString("\n")
+			b = buf.Bytes()
+		}
+
+	default:
+		svr.dumbObjectFile(w, r, repoID, st, strings.TrimPrefix(file, "objects/"))
+		return
+	}
+
+	if err == plumbing.ErrReferenceNotFound {
+		w.WriteHeader(404)
+		return
+	} else if err != nil {
+		log.Printf("ERR [dumb] repo=%s file=%s %v", repoID, file, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(b)
+}
+
+// dumbObjectFile serves a loose object, pack or idx
+func (svr *GitHTTPService) dumbObjectFile(w http.ResponseWriter, r *http.Request, repoID string, st storer.Storer, name string) {
+	contentType := "application/x-git-loose-object"
+	if strings.HasSuffix(name, ".pack") {
+		contentType = "application/x-git-packed-objects"
+	} else if strings.HasSuffix(name, ".idx") {
+		contentType = "application/x-git-packed-objects-toc"
+	}
+	w.Header().Set("Content-Type", contentType)
+	// Object files never change
+	w.Header().Set("Cache-Control", "public, max-age=31536000")
+
+	if of, ok := st.(objectFiler); ok {
+		f, err := of.ObjectFile(name)
+		if err != nil {
+			w.WriteHeader(404)
+			return
+		}
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+		return
+	}
+
+	// Only the generated pack exists.  Loose objects are not found so clients
+	// fetch it.
+	dp, err := svr.dumbPack(r.Context(), repoID, st)
+	if err != nil {
+		log.Printf("ERR [dumb] repo=%s %v", repoID, err)
+		w.WriteHeader(500)
+		return
+	} else if dp == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	base := "pack/pack-" + dp.name.String()
+	switch name {
+	case base + ".pack":
+		http.ServeContent(w, r, "", dp.time, bytes.NewReader(dp.pack))
+	case base + ".idx":
+		http.ServeContent(w, r, "", dp.time, bytes.NewReader(dp.idx))
+	default:
+		w.WriteHeader(404)
+	}
+}
+
+// dumbPackNames returns the packs of the repo generating one if the store
+// has no pack files
+func (svr *GitHTTPService) dumbPackNames(ctx context.Context, repoID string, st storer.Storer) ([]plumbing.Hash, error) {
+	if of, ok := st.(objectFiler); ok {
+		return of.ObjectPacks()
+	}
+
+	dp, err := svr.dumbPack(ctx, repoID, st)
+	if err != nil || dp == nil {
+		return nil, err
+	}
+	return []plumbing.Hash{dp.name}, nil
+}
+
+// dumbPack returns the generated pack of the repo, regenerating it if the
+// refs have changed.  It is nil for repos without refs.
+func (svr *GitHTTPService) dumbPack(ctx context.Context, repoID string, st storer.Storer) (*dumbPack, error) {
+	tips, err := dumbRefTips(st)
+	if err != nil || len(tips) == 0 {
+		return nil, err
+	}
+	key := fmt.Sprint(tips)
+
+	svr.dumbMu.Lock()
+	if svr.dumbRepos == nil {
+		svr.dumbRepos = map[string]*dumbRepo{}
+	}
+	dr, ok := svr.dumbRepos[repoID]
+	if !ok {
+		dr = &dumbRepo{}
+		svr.dumbRepos[repoID] = dr
+	}
+	dr.used = time.Now()
+	svr.dumbMu.Unlock()
+
+	// Only one pack of the repo is generated at a time
+	dr.gen.Lock()
+	defer dr.gen.Unlock()
+
+	svr.dumbMu.Lock()
+	dp := dr.pack
+	svr.dumbMu.Unlock()
+	if dp != nil && dp.tips == key {
+		return dp, nil
+	}
+
+	if dp, err = generateDumbPack(ctx, st, tips); err != nil {
+		return nil, err
+	}
+	dp.tips = key
+	log.Printf("DBG [dumb] repo=%s generated pack=%s tips=%d", repoID, dp.name, len(tips))
+
+	svr.dumbMu.Lock()
+	if dr.pack != nil {
+		svr.dumbSize -= dr.pack.size()
+	}
+	dr.pack = dp
+	svr.dumbSize += dp.size()
+	svr.evictDumbPacks()
+	svr.dumbMu.Unlock()
+
+	return dp, nil
+}
+
+// evictDumbPacks drops the packs of the least recently fetched repos until
+// those kept are within dumbPacksMax.  It is called with dumbMu held.
+func (svr *GitHTTPService) evictDumbPacks() {
+	for svr.dumbSize > dumbPacksMax {
+		var lru *dumbRepo
+		for _, dr := range svr.dumbRepos {
+			if dr.pack != nil && (lru == nil || dr.used.Before(lru.used)) {
+				lru = dr
+			}
+		}
+		if lru == nil {
+			return
+		}
+		svr.dumbSize -= lru.pack.size()
+		lru.pack = nil
+	}
+}
+
+func (dp *dumbPack) size() int64 {
+	return int64(len(dp.pack) + len(dp.idx))
+}
+
+// generateDumbPack packs the objects reachable from tips and indexes the pack
+func generateDumbPack(ctx context.Context, st storer.Storer, tips []plumbing.Hash) (*dumbPack, error) {
+	dp := &dumbPack{time: time.Now()}
+
+	var pack bytes.Buffer
+	checksum, err := packfile.NewEncoder(&pack, st).Encode(ctx, tips, nil)
+	if err != nil {
+		return nil, err
+	}
+	copy(dp.name[:], checksum)
+	dp.pack = pack.Bytes()
+
+	// Index the pack as git would on receiving it
+	iw := new(idxfile.Writer)
+	parser, err := gitpackfile.NewParser(gitpackfile.NewScanner(bytes.NewReader(dp.pack)), iw)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = parser.Parse(); err != nil {
+		return nil, err
+	}
+	idx, err := iw.Index()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if _, err = idxfile.NewEncoder(&buf).Encode(idx); err != nil {
+		return nil, err
+	}
+	dp.idx = buf.Bytes()
+
+	return dp, nil
+}
+
+// dumbRefTips returns the sorted unique hashes the refs point to
+func dumbRefTips(st storer.ReferenceStorer) ([]plumbing.Hash, error) {
+	iter, err := st.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		tips []plumbing.Hash
+		seen = map[plumbing.Hash]bool{}
+	)
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		h := ref.Hash()
+		if ref.Type() == plumbing.HashReference && !h.IsZero() && !seen[h] {
+			seen[h] = true
+			tips = append(tips, h)
+		}
+		return nil
+	})
+	sort.Slice(tips, func(i, j int) bool { return bytes.Compare(tips[i][:], tips[j][:]) < 0 })
+	return tips, err
+}
+
+// dumbInfoRefs returns info/refs as written by git update-server-info.
+// Annotated tags are followed by the object they peel to.
+func dumbInfoRefs(st storer.Storer) ([]byte, error) {
+	iter, err := st.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && !ref.Hash().IsZero() {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+
+	var buf bytes.Buffer
+	for _, ref := range refs {
+		fmt.Fprintf(&buf, "%s\t%s\n", ref.Hash(), ref.Name())
+		if !ref.Name().IsTag() {
+			continue
+		}
+
+		tag, err := object.GetTag(st, ref.Hash())
+		if err != nil {
+			continue
+		}
+		for {
+			next, err := object.GetTag(st, tag.Target)
+			if err != nil {
+				break
+			}
+			tag = next
+		}
+		fmt.Fprintf(&buf, "%s\t%s^{}\n", tag.Target, ref.Name())
+	}
+	return buf.Bytes(), nil
+}
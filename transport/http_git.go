@@ -1,18 +1,61 @@
 package transport
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"sync"
 
+	"github.com/euforia/go-git-server/audit"
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/packcache"
+	"github.com/euforia/go-git-server/packfile"
 	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/repository"
+	"github.com/euforia/go-git-server/reviews"
+	"github.com/euforia/go-git-server/secrets"
+	"github.com/euforia/go-git-server/signature"
 	"github.com/euforia/go-git-server/storage"
 	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
 )
 
 // GitHTTPService is a git http server
 type GitHTTPService struct {
 	// Store containing all repo storage
 	stores storage.GitRepoStorage
+	// Optional cache of upload-pack responses
+	cache *packcache.Cache
+	// Optional packfile-uris and bundle-uri provider
+	offload packproto.Offloader
+	// Server wide push limits
+	limits packproto.PushLimits
+	// Reject non fast-forward ref updates
+	denyNonFF bool
+	// Optional repo settings overriding server wide ones
+	repos repository.RepositoryStore
+	// Optional secret scanning of pushes
+	scanner *secrets.Scanner
+	// Optional signature verification of commits and tags
+	verifier *signature.Verifier
+	// Optional signed push support and the log certificates are kept in
+	certs   *packproto.PushCerts
+	certLog *audit.PushCertLog
+	// Optional code review pushes to refs/for/
+	reviews *reviews.Reviews
+	// Optional.  Everything is allowed without one.
+	authz *authz.Authorizer
+
+	// Packs generated for dumb clients of stores without pack files and
+	// their total size
+	dumbMu    sync.Mutex
+	dumbRepos map[string]*dumbRepo
+	dumbSize  int64
+
+	// Work outliving requests e.g. commit-graph updates after pushes
+	bg sync.WaitGroup
 }
 
 // NewGitHTTPService instantiates the git http service with the provided repo store
@@ -25,6 +68,143 @@ func NewGitHTTPService(objstore storage.GitRepoStorage) *GitHTTPService {
 	return svr
 }
 
+// SetPackCache enables caching of generated packs across clones
+func (svr *GitHTTPService) SetPackCache(cache *packcache.Cache) {
+	svr.cache = cache
+}
+
+// SetOffloader enables packfile-uris and bundle-uri for protocol v2 clients
+func (svr *GitHTTPService) SetOffloader(o packproto.Offloader) {
+	svr.offload = o
+}
+
+// SetPushLimits sets the server wide receive-pack limits
+func (svr *GitHTTPService) SetPushLimits(limits packproto.PushLimits) {
+	svr.limits = limits
+}
+
+// SetDenyNonFastForwards rejects pushes that would lose commits
+func (svr *GitHTTPService) SetDenyNonFastForwards(deny bool) {
+	svr.denyNonFF = deny
+}
+
+// SetRepositoryStore sets the store per repo settings are read from
+func (svr *GitHTTPService) SetRepositoryStore(repos repository.RepositoryStore) {
+	svr.repos = repos
+}
+
+// SetSecretScanner enables secret scanning of pushes
+func (svr *GitHTTPService) SetSecretScanner(s *secrets.Scanner) {
+	svr.scanner = s
+}
+
+// SetSignatureVerifier enables signature verification in the commit api and
+// the require signed rule of repos
+func (svr *GitHTTPService) SetSignatureVerifier(v *signature.Verifier) {
+	svr.verifier = v
+}
+
+// SetPushCerts enables signed pushes.  certLog is where certs stores verified
+// certificates and is listed by the push certificate api.
+func (svr *GitHTTPService) SetPushCerts(certs *packproto.PushCerts, certLog *audit.PushCertLog) {
+	svr.certs = certs
+	svr.certLog = certLog
+}
+
+// SetAuthorizer enforces the roles of users in repos
+func (svr *GitHTTPService) SetAuthorizer(a *authz.Authorizer) {
+	svr.authz = a
+}
+
+// SetReviews enables code review pushes to refs/for/<branch>/<topic>
+func (svr *GitHTTPService) SetReviews(rs *reviews.Reviews) {
+	svr.reviews = rs
+}
+
+// Wait waits for the work started by requests that outlives them e.g.
+// commit-graph updates after pushes or the context to be done.  It is called
+// once the servers are shut down.
+func (svr *GitHTTPService) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		svr.bg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// repoSettings returns the settings of the repo or nil if it has none
+func (svr *GitHTTPService) repoSettings(repoID string) *repository.Repository {
+	if svr.repos == nil {
+		return nil
+	}
+	repo, err := svr.repos.GetRepo(repoID)
+	if err != nil {
+		return nil
+	}
+	return repo
+}
+
+// setPushRules sets the limits and pre-receive hooks of the repo
+func (svr *GitHTTPService) setPushRules(proto *packproto.Protocol, repoID string) {
+	var (
+		repo   = svr.repoSettings(repoID)
+		limits = svr.limits
+		hooks  []packproto.PreReceiveHook
+	)
+	if repo != nil {
+		limits = limits.Merge(repo.Limits)
+		if repo.Policy != nil {
+			hooks = append(hooks, repo.Policy)
+		}
+		if repo.RequireSigned != nil {
+			if svr.verifier != nil {
+				hooks = append(hooks, svr.verifier.Hook(repo.RequireSigned))
+			} else {
+				log.Printf("ERR [receive-pack] repo=%s requires signed commits but verification is disabled", repoID)
+			}
+		}
+	}
+	if svr.scanner != nil {
+		var cfg *secrets.Config
+		if repo != nil {
+			cfg = repo.Secrets
+		}
+		if hook := svr.scanner.Hook(repoID, cfg); hook != nil {
+			hooks = append(hooks, hook)
+		}
+	}
+	proto.SetPushLimits(limits)
+	proto.SetDenyNonFastForwards(svr.denyNonFF)
+	proto.SetPreReceiveHooks(hooks...)
+}
+
+func (svr *GitHTTPService) newProtocol(w io.Writer, r io.Reader, repoID string, st storer.Storer) *packproto.Protocol {
+	proto := packproto.NewProtocol(w, r)
+	proto.SetObjectFormat(packfile.StoreObjectFormat(st))
+	proto.SetBackground(&svr.bg)
+	svr.setPushRules(proto, repoID)
+	if svr.cache != nil {
+		proto.SetPackCache(svr.cache, repoID)
+	}
+	if svr.offload != nil {
+		proto.SetOffloader(svr.offload, repoID)
+	}
+	if svr.certs != nil {
+		proto.SetPushCerts(svr.certs, repoID)
+	}
+	if svr.reviews != nil {
+		proto.SetProcReceiver(reviews.ForPrefix, svr.reviews.Receiver(repoID))
+	}
+	return proto
+}
+
 // ListReferences per the git protocol
 func (svr *GitHTTPService) ListReferences(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -33,36 +213,65 @@ func (svr *GitHTTPService) ListReferences(w http.ResponseWriter, r *http.Request
 	repoID := ctx.Value(ctxKeyRepo).(string)
 	service := ctx.Value(ctxKeyService).(string)
 
+	want := authz.RoleRead
+	if service == packproto.GitRecvPack {
+		want = authz.RoleWrite
+	}
+	if !authorizeRepo(w, r, svr.authz, repoID, want) {
+		return
+	}
+
 	st := svr.stores.GetStore(repoID)
 	if st == nil {
 		w.WriteHeader(404)
 		return
 	}
-	riter, err := st.IterReferences()
+	refs, err := advertisedRefs(st)
 	if err != nil {
 		w.WriteHeader(404)
 		w.Write([]byte(err.Error()))
 		return
 	}
 
-	refs := make([]*plumbing.Reference, 0)
-	riter.ForEach(func(ref *plumbing.Reference) error {
-		refs = append(refs, ref)
-		return nil
-	})
-
 	w.Header().Add("Content-Type", fmt.Sprintf("application/x-%s-advertisement", service))
 	w.WriteHeader(200)
 
-	proto := packproto.NewProtocol(w, nil)
+	proto := svr.newProtocol(w, nil, repoID, st)
+	if service == packproto.GitUploadPack && packproto.IsV2Request(r.Header.Get("Git-Protocol")) {
+		proto.AdvertiseV2()
+		return
+	}
 	proto.ListReferences(service, refs)
 }
 
+// advertisedRefs returns the refs of the repo to advertise, HEAD first
+func advertisedRefs(st storer.ReferenceStorer) ([]*plumbing.Reference, error) {
+	riter, err := st.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]*plumbing.Reference, 0)
+	if head, err := st.Reference(plumbing.HEAD); err == nil {
+		refs = append(refs, head)
+	}
+	err = riter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name() != plumbing.HEAD {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	return refs, err
+}
+
 // ReceivePack implements the receive-pack protocol over http
 func (svr *GitHTTPService) ReceivePack(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	repoID := r.Context().Value(ctxKeyRepo).(string)
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleWrite) {
+		return
+	}
 	st := svr.stores.GetStore(repoID)
 	if st == nil {
 		w.WriteHeader(404)
@@ -72,8 +281,19 @@ func (svr *GitHTTPService) ReceivePack(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/x-git-receive-pack-result")
 	w.WriteHeader(200)
 
-	proto := packproto.NewProtocol(w, r.Body)
-	proto.ReceivePack(st)
+	proto := svr.newProtocol(w, r.Body, repoID, st)
+	results, err := proto.ReceivePack(st)
+	if err != nil {
+		return
+	}
+
+	var updated int
+	for _, res := range results {
+		if res.OK() {
+			updated++
+		}
+	}
+	log.Printf("DBG [receive-pack] repo=%s updated=%d rejected=%d", repoID, updated, len(results)-updated)
 }
 
 // UploadPack implements upload-pack protocol over http
@@ -81,12 +301,22 @@ func (svr *GitHTTPService) UploadPack(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	repoID := r.Context().Value(ctxKeyRepo).(string)
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleRead) {
+		return
+	}
 	st := svr.stores.GetStore(repoID)
 	if st == nil {
 		w.WriteHeader(404)
 		return
 	}
 
-	proto := packproto.NewProtocol(w, r.Body)
-	proto.UploadPack(st)
+	proto := svr.newProtocol(w, r.Body, repoID, st)
+	if packproto.IsV2Request(r.Header.Get("Git-Protocol")) {
+		w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+		if err := proto.UploadPackV2(r.Context(), st); err != nil {
+			log.Printf("ERR [upload-pack] repo=%s %v", repoID, err)
+		}
+		return
+	}
+	proto.UploadPack(r.Context(), st)
 }
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/repository"
+	"github.com/euforia/go-git-server/users"
+)
+
+var errUserNamespace = errors.New("namespace belongs to a user")
+
+// NamespacesHTTPService manages namespaces and their members
+type NamespacesHTTPService struct {
+	namespaces *authz.Namespaces
+	authz      *authz.Authorizer
+	// Optional.  Names of users are reserved for their namespaces.
+	users users.Store
+}
+
+// NewNamespacesHTTPService instantiates the service with the namespace store
+// and the authorizer checking roles in them
+func NewNamespacesHTTPService(namespaces *authz.Namespaces, a *authz.Authorizer, store users.Store) *NamespacesHTTPService {
+	return &NamespacesHTTPService{namespaces: namespaces, authz: a, users: store}
+}
+
+// namespaceRequest is the body of a member update.  Omitted fields are left
+// as is.
+type namespaceRequest struct {
+	Members authz.Members `json:"members"`
+	Groups  authz.Members `json:"groups"`
+}
+
+// ServeHTTP serves /api/namespaces/<name> to GET a namespace as a member,
+// PUT to create one administered by the creator and POST
+// {"members": ..., "groups": ...} to replace the user and group roles or DELETE
+// it as an admin
+func (svr *NamespacesHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	name, ok := isNamespacesRequest(r)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	p, _ := auth.FromContext(r.Context())
+
+	var err error
+	switch r.Method {
+	case "GET":
+		if !authorizeNamespace(w, r, svr.authz, name, authz.RoleRead) {
+			return
+		}
+
+	case "PUT":
+		if p == nil {
+			writeJSONError(w, 401, auth.ErrUnauthenticated)
+			return
+		}
+		if err = repository.ValidateNamespace(name); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		if svr.users != nil {
+			if _, err = svr.users.GetUser(name); err == nil {
+				writeJSONError(w, 409, errUserNamespace)
+				return
+			}
+		}
+		err = svr.namespaces.Create(&authz.Namespace{Name: name, Members: authz.Members{p.Name: authz.RoleAdmin}})
+
+	case "POST":
+		if !authorizeNamespace(w, r, svr.authz, name, authz.RoleAdmin) {
+			return
+		}
+		var req namespaceRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		// Validated first so members aren't replaced with invalid groups
+		if err = req.Groups.Validate(); err == nil && req.Members != nil {
+			err = svr.namespaces.SetMembers(name, req.Members)
+		}
+		if err == nil && req.Groups != nil {
+			err = svr.namespaces.SetGroups(name, req.Groups)
+		}
+
+	case "DELETE":
+		if !authorizeNamespace(w, r, svr.authz, name, authz.RoleAdmin) {
+			return
+		}
+		if err = svr.namespaces.Remove(name); err == nil {
+			w.WriteHeader(204)
+			return
+		}
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if err != nil {
+		code := 400
+		switch err {
+		case authz.ErrNotFound:
+			code = 404
+		case authz.ErrExists:
+			code = 409
+		}
+		writeJSONError(w, code, err)
+		return
+	}
+
+	ns, err := svr.namespaces.Get(name)
+	if err != nil {
+		// Personal namespaces exist without being created
+		ns = &authz.Namespace{Name: name, Members: authz.Members{}}
+	}
+	b, _ := json.Marshal(ns)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
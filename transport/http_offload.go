@@ -0,0 +1,202 @@
+package transport
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/bundle"
+	"github.com/euforia/go-git-server/packfile"
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/storage"
+)
+
+// OffloadHandler serves the bitmapped packs written by repo maintenance, and
+// bundles made from them, as static files.  It implements packproto.Offloader
+// so protocol v2 clones can fetch them via packfile-uris or bundle-uri.
+type OffloadHandler struct {
+	stores  storage.GitRepoStorage
+	datadir string
+	// url the files are served under e.g. a caching proxy in front of us
+	baseURL string
+	// Optional.  Everything is allowed without one.
+	authz *authz.Authorizer
+}
+
+// NewOffloadHandler instantiates a handler for the repos in datadir advertising
+// the files under baseURL
+func NewOffloadHandler(stores storage.GitRepoStorage, datadir, baseURL string) *OffloadHandler {
+	return &OffloadHandler{
+		stores:  stores,
+		datadir: datadir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+	}
+}
+
+// SetAuthorizer requires read access to the repos of the files
+func (h *OffloadHandler) SetAuthorizer(a *authz.Authorizer) {
+	h.authz = a
+}
+
+// PackURIs returns the newest bitmapped pack of the repo if the base url
+// scheme is one of the protocols
+func (h *OffloadHandler) PackURIs(repo string, store storer.Storer, protocols []string) ([]packproto.PackURI, error) {
+	if !h.schemeIn(protocols) {
+		return nil, nil
+	}
+
+	bi, err := bitmapIndex(store)
+	if bi == nil {
+		return nil, err
+	}
+
+	pu := packproto.PackURI{
+		Hash: bi.Checksum(),
+		URI:  h.url(repo, "pack-"+bi.Checksum().String()+".pack"),
+		Tips: bi.Commits(),
+	}
+	return []packproto.PackURI{pu}, nil
+}
+
+// BundleURIs returns the bundle of the newest bitmapped pack of the repo
+func (h *OffloadHandler) BundleURIs(repo string, store storer.Storer) ([]string, error) {
+	bi, err := bitmapIndex(store)
+	if bi == nil {
+		return nil, err
+	}
+	return []string{h.url(repo, "pack-"+bi.Checksum().String()+".bundle")}, nil
+}
+
+// ServeHTTP serves GET /<repo>/offload/pack-<hash>.{pack,bundle}
+func (h *OffloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(405)
+		return
+	}
+
+	repoID, file, ok := isOffloadRequest(r)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	if !authorizeRepo(w, r, h.authz, repoID, authz.RoleRead) {
+		return
+	}
+	ext := path.Ext(file)
+	name := strings.TrimSuffix(file, ext)
+	if !isPackName(name) || (ext != ".pack" && ext != ".bundle") {
+		w.WriteHeader(404)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(h.datadir, filepath.FromSlash(repoID), "objects", "pack", name+".pack"))
+	if err != nil {
+		w.WriteHeader(404)
+		return
+	}
+	defer f.Close()
+
+	if ext == ".pack" {
+		// Named by checksum so never changes
+		w.Header().Set("Content-Type", "application/x-git-packed-objects")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, r, file, timeOf(f), f)
+		return
+	}
+
+	h.serveBundle(w, r, repoID, name, f)
+}
+
+// serveBundle writes a bundle of the pack with the refs currently pointing
+// into it
+func (h *OffloadHandler) serveBundle(w http.ResponseWriter, r *http.Request, repoID, name string, f io.Reader) {
+	st := h.stores.GetStore(repoID)
+	if st == nil {
+		w.WriteHeader(404)
+		return
+	}
+	bi, err := bitmapIndex(st)
+	if bi == nil || "pack-"+bi.Checksum().String() != name {
+		// Only the current pack has its refs known
+		w.WriteHeader(404)
+		return
+	}
+
+	hdr := &bundle.Header{Version: 2}
+	iter, err := st.IterReferences()
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && bi.Contains(ref.Hash()) {
+			hdr.References = append(hdr.References, ref)
+		}
+		return nil
+	})
+
+	w.Header().Set("Content-Type", "application/x-git-bundle")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(200)
+	if r.Method == "HEAD" {
+		return
+	}
+
+	if err = hdr.Encode(w); err == nil {
+		_, err = io.Copy(w, f)
+	}
+	if err != nil {
+		log.Printf("ERR [offload] repo=%s %v", repoID, err)
+	}
+}
+
+func (h *OffloadHandler) schemeIn(protocols []string) bool {
+	scheme := strings.SplitN(h.baseURL, "://", 2)[0]
+	for _, p := range protocols {
+		if p == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *OffloadHandler) url(repo, file string) string {
+	return h.baseURL + "/" + repo + "/offload/" + file
+}
+
+// bitmapIndex returns the bitmap index of the store or nil if it has none
+func bitmapIndex(store storer.Storer) (*packfile.BitmapIndex, error) {
+	bs, ok := store.(packfile.BitmapStorer)
+	if !ok {
+		return nil, nil
+	}
+	return bs.BitmapIndex()
+}
+
+func isPackName(name string) bool {
+	if !strings.HasPrefix(name, "pack-") || len(name) != 45 {
+		return false
+	}
+	for _, c := range name[5:] {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func timeOf(f *os.File) (t time.Time) {
+	if fi, err := f.Stat(); err == nil {
+		t = fi.ModTime()
+	}
+	return
+}
@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/euforia/go-git-server/authz"
+)
+
+// PushCertsHandler is an optional interface for git handlers that keep the
+// certificates of signed pushes
+type PushCertsHandler interface {
+	PushCerts(w http.ResponseWriter, r *http.Request)
+}
+
+// PushCerts serves GET /<repo>/push-certs listing the verified certificates of
+// signed pushes to the repo
+func (svr *GitHTTPService) PushCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if svr.certLog == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	repoID := r.Context().Value(ctxKeyRepo).(string)
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleRead) {
+		return
+	}
+	entries, err := svr.certLog.PushCerts(repoID)
+	if err != nil {
+		log.Printf("ERR [push-certs] repo=%s %v", repoID, err)
+		w.WriteHeader(500)
+		return
+	}
+
+	b, _ := json.Marshal(entries)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
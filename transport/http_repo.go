@@ -2,22 +2,54 @@ package transport
 
 import (
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"strings"
 
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
 	"github.com/euforia/go-git-server/repository"
+	"github.com/euforia/go-git-server/storage"
 )
 
+var errRepoIDMismatch = errors.New("id does not match the url")
+
 type RepoHTTPService struct {
 	repos repository.RepositoryStore
+	// Optional git storage archives are generated from
+	stores storage.GitRepoStorage
+	// Optional.  Everything is allowed without one.
+	authz *authz.Authorizer
+	// Optional credentials limited to a repo
+	deployKeys   *auth.DeployKeys
+	deployTokens *auth.Tokens
 }
 
 func NewRepoHTTPService(store repository.RepositoryStore) *RepoHTTPService {
 	return &RepoHTTPService{repos: store}
 }
 
+// SetGitStorage sets the git storage of the repos enabling archive downloads
+func (svr *RepoHTTPService) SetGitStorage(stores storage.GitRepoStorage) {
+	svr.stores = stores
+}
+
+// SetAuthorizer enforces the roles of users in namespaces and repos
+func (svr *RepoHTTPService) SetAuthorizer(a *authz.Authorizer) {
+	svr.authz = a
+}
+
 func (svr *RepoHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if repoID, ref, format, ok := isArchiveRequest(r); ok && format != "" {
+		svr.Archive(w, r, repoID, ref, format)
+		return
+	}
+	if repoID, kind, id, ok := isDeployRequest(r); ok {
+		svr.Deploy(w, r, repoID, kind, id)
+		return
+	}
+
 	repoID := r.Context().Value(ctxKeyRepo).(string)
 	// Must be namespaced
 	if !strings.Contains(repoID, "/") {
@@ -33,15 +65,36 @@ func (svr *RepoHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case "GET":
+		if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleRead) {
+			return
+		}
 		repo, err = svr.repos.GetRepo(repoID)
 
 	case "PUT":
 		// Create
+		if !authorizeNamespace(w, r, svr.authz, authz.NamespaceOf(repoID), authz.RoleWrite) {
+			return
+		}
 		dec := json.NewDecoder(r.Body)
 		defer r.Body.Close()
 
 		repo = repository.NewRepository(repoID)
-		if err = dec.Decode(&repo); err == nil || err == io.EOF {
+		if err = dec.Decode(repo); err == nil || err == io.EOF {
+			// The id is that of the url authorized above
+			if repo.ID != repoID {
+				err = errRepoIDMismatch
+				break
+			}
+			if err = repo.Validate(); err != nil {
+				break
+			}
+			// The creator administers the repo
+			if p, ok := auth.FromContext(r.Context()); ok {
+				if repo.Members == nil {
+					repo.Members = authz.Members{}
+				}
+				repo.Members[p.Name] = authz.RoleAdmin
+			}
 			if err = svr.repos.CreateRepo(repo); err == repository.ErrExists {
 				code = 409
 			}
@@ -49,13 +102,31 @@ func (svr *RepoHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	case "POST":
 		// Update
+		if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleAdmin) {
+			return
+		}
 		dec := json.NewDecoder(r.Body)
 		defer r.Body.Close()
 
 		// Get existing
 		if repo, err = svr.repos.GetRepo(repoID); err == nil {
-			// Unmarshal on to existing
+			// Unmarshal on to a copy of the existing so invalid settings are
+			// not kept
+			repo = repo.Clone()
+			// Members given replace the existing rather than merging in
+			members := repo.Members
+			repo.Members = nil
 			if err = dec.Decode(repo); err == nil {
+				if repo.ID != repoID {
+					err = errRepoIDMismatch
+					break
+				}
+				if repo.Members == nil {
+					repo.Members = members
+				}
+				if err = repo.Validate(); err != nil {
+					break
+				}
 				if err = svr.repos.UpdateRepo(repo); err == repository.ErrNotFound {
 					code = 404
 				}
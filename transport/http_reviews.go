@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/reviews"
+)
+
+// ReviewsHandler is an optional interface for git handlers that serve code
+// reviews
+type ReviewsHandler interface {
+	Reviews(w http.ResponseWriter, r *http.Request, id string)
+}
+
+// Reviews serves GET /<repo>/reviews listing the reviews of the repo,
+// GET /<repo>/reviews/<id> returning one and POST /<repo>/reviews/<id> with
+// {"status": "abandoned"} or {"status": "open"} to abandon or reopen it
+func (svr *GitHTTPService) Reviews(w http.ResponseWriter, r *http.Request, id string) {
+	if svr.reviews == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	repoID := r.Context().Value(ctxKeyRepo).(string)
+	want := authz.RoleRead
+	if r.Method == "POST" {
+		want = authz.RoleWrite
+	}
+	if !authorizeRepo(w, r, svr.authz, repoID, want) {
+		return
+	}
+	if svr.stores.GetStore(repoID) == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	var resp interface{}
+	switch {
+	case id == "" && r.Method == "GET":
+		resp = svr.reviews.List(repoID)
+
+	case id != "" && (r.Method == "GET" || r.Method == "POST"):
+		rid, err := strconv.Atoi(id)
+		if err != nil {
+			writeJSONError(w, 404, reviews.ErrNotFound)
+			return
+		}
+
+		if r.Method == "GET" {
+			resp, err = svr.reviews.Get(repoID, rid)
+		} else {
+			var req struct {
+				Status reviews.Status `json:"status"`
+			}
+			if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, 400, err)
+				return
+			}
+			resp, err = svr.reviews.SetStatus(repoID, rid, req.Status)
+		}
+
+		if err == reviews.ErrNotFound {
+			writeJSONError(w, 404, err)
+			return
+		} else if err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/secrets"
+)
+
+// SecretsHandler is an optional interface for git handlers that report secret
+// scanning findings
+type SecretsHandler interface {
+	Secrets(w http.ResponseWriter, r *http.Request)
+}
+
+// Secrets serves GET /<repo>/secrets listing the findings of pushes to the repo
+func (svr *GitHTTPService) Secrets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	if svr.scanner == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	repoID := r.Context().Value(ctxKeyRepo).(string)
+	if !authorizeRepo(w, r, svr.authz, repoID, authz.RoleAdmin) {
+		return
+	}
+	findings := svr.scanner.Findings(repoID)
+	if findings == nil {
+		findings = []*secrets.Finding{}
+	}
+
+	b, _ := json.Marshal(findings)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
@@ -0,0 +1,265 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/users"
+)
+
+var (
+	errForbidden     = errors.New("forbidden")
+	errNamespaceUser = errors.New("name belongs to a namespace")
+	errAdminEmails   = errors.New("emails are verified and set by admins")
+)
+
+// UsersHTTPService manages users, their signing keys and access tokens
+type UsersHTTPService struct {
+	users users.Store
+	// Optional personal access tokens
+	tokens *auth.Tokens
+	// Server admins
+	admins auth.Admins
+	// Optional.  Names of namespaces can't be taken by users.
+	namespaces *authz.Namespaces
+}
+
+// NewUsersHTTPService instantiates the service with the user store
+func NewUsersHTTPService(store users.Store) *UsersHTTPService {
+	return &UsersHTTPService{users: store}
+}
+
+// SetTokens enables managing personal access tokens
+func (svr *UsersHTTPService) SetTokens(tokens *auth.Tokens) {
+	svr.tokens = tokens
+}
+
+// SetAdmins sets the server admins allowed to manage other users
+func (svr *UsersHTTPService) SetAdmins(admins auth.Admins) {
+	svr.admins = admins
+}
+
+// SetNamespaces reserves the names of namespaces
+func (svr *UsersHTTPService) SetNamespaces(namespaces *authz.Namespaces) {
+	svr.namespaces = namespaces
+}
+
+// authorizeUser checks the principal of the request is the user or an admin
+// writing the error if not.  Nothing is allowed without authentication as keys
+// and emails are trusted to identify users.
+func (svr *UsersHTTPService) authorizeUser(w http.ResponseWriter, r *http.Request, name string) bool {
+	p, ok := auth.FromContext(r.Context())
+	if !ok {
+		log.Printf("DBG [users] %s %s %v", r.Method, r.URL.Path, auth.ErrUnauthenticated)
+		writeJSONError(w, 401, auth.ErrUnauthenticated)
+		return false
+	}
+	if p.Name == name || svr.admins.IsAdmin(p) {
+		return true
+	}
+	log.Printf("DBG [users] %s %s %s %v", r.Method, r.URL.Path, p, errForbidden)
+	writeJSONError(w, 403, errForbidden)
+	return false
+}
+
+// keyRequest is the body of a key upload
+type keyRequest struct {
+	Type  users.KeyType `json:"type"`
+	Title string        `json:"title"`
+	Key   string        `json:"key"`
+}
+
+// ServeHTTP serves /api/users/<name> to GET, PUT (create), POST (update) and
+// DELETE a user, POST /api/users/<name>/keys to add a key and
+// DELETE /api/users/<name>/keys/<id> to remove one.  Only the user or an admin
+// changes a user, so changes require authentication, and only admins set
+// emails.  Personal access tokens
+// are listed with GET /api/users/<name>/tokens, created with POST
+// {"name": ..., "scopes": [...], "expires": ...} by the user only and revoked
+// with DELETE /api/users/<name>/tokens/<id> by the user or an admin.
+func (svr *UsersHTTPService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	name, keyPath, ok := isUsersRequest(r)
+	if !ok {
+		w.WriteHeader(404)
+		return
+	}
+	if keyPath == "tokens" || strings.HasPrefix(keyPath, "tokens/") {
+		svr.serveTokens(w, r, name, strings.TrimPrefix(strings.TrimPrefix(keyPath, "tokens"), "/"))
+		return
+	}
+
+	if r.Method != "GET" && !svr.authorizeUser(w, r, name) {
+		return
+	}
+
+	var (
+		resp interface{}
+		err  error
+	)
+
+	switch {
+	case keyPath == "" && r.Method == "GET":
+		resp, err = svr.users.GetUser(name)
+
+	case keyPath == "" && (r.Method == "PUT" || r.Method == "POST"):
+		u := &users.User{}
+		if err = json.NewDecoder(r.Body).Decode(u); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		u.Name = name
+		// Signatures are trusted for the emails so users can't claim them
+		if p, _ := auth.FromContext(r.Context()); u.Emails != nil && !svr.admins.IsAdmin(p) {
+			writeJSONError(w, 403, errAdminEmails)
+			return
+		}
+		if r.Method == "PUT" {
+			if svr.namespaces != nil {
+				if _, err = svr.namespaces.Get(name); err == nil {
+					writeJSONError(w, 409, errNamespaceUser)
+					return
+				}
+			}
+			err = svr.users.CreateUser(u)
+		} else {
+			err = svr.users.UpdateUser(u)
+		}
+		if err == nil {
+			resp, err = svr.users.GetUser(name)
+		}
+
+	case keyPath == "" && r.Method == "DELETE":
+		err = svr.users.RemoveUser(name)
+
+	case keyPath == "keys" && r.Method == "POST":
+		var kr keyRequest
+		if err = json.NewDecoder(r.Body).Decode(&kr); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		var key *users.Key
+		if key, err = users.ParseKey(kr.Type, kr.Key); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		if kr.Title != "" {
+			key.Title = kr.Title
+		}
+		if err = svr.users.AddKey(name, key); err == nil {
+			resp = key
+		}
+
+	case strings.HasPrefix(keyPath, "keys/") && r.Method == "DELETE":
+		err = svr.users.RemoveKey(name, strings.TrimPrefix(keyPath, "keys/"))
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	switch err {
+	case nil:
+	case users.ErrNotFound:
+		writeJSONError(w, 404, err)
+		return
+	case users.ErrExists:
+		writeJSONError(w, 409, err)
+		return
+	default:
+		writeJSONError(w, 400, err)
+		return
+	}
+
+	if resp == nil {
+		w.WriteHeader(204)
+		return
+	}
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
+
+// tokenCreated is the response to a token creation.  The secret is only
+// returned then.
+type tokenCreated struct {
+	*auth.Token
+	Secret string `json:"token"`
+}
+
+// tokenRequest is the body of a token creation.  Tokens without an expiry
+// don't expire.
+type tokenRequest struct {
+	Name    string       `json:"name"`
+	Scopes  []auth.Scope `json:"scopes"`
+	Expires *time.Time   `json:"expires"`
+}
+
+func (svr *UsersHTTPService) serveTokens(w http.ResponseWriter, r *http.Request, name, id string) {
+	if svr.tokens == nil {
+		w.WriteHeader(404)
+		return
+	}
+	// Only users create tokens for themselves.  Admins may list and revoke
+	// those of others.
+	p, ok := auth.FromContext(r.Context())
+	if !ok {
+		writeJSONError(w, 401, auth.ErrUnauthenticated)
+		return
+	}
+	if p.Name != name && (r.Method == "POST" || !svr.admins.IsAdmin(p)) {
+		writeJSONError(w, 403, errForbidden)
+		return
+	}
+
+	var (
+		resp interface{}
+		err  error
+	)
+	switch {
+	case id == "" && r.Method == "GET":
+		resp = svr.tokens.List(name)
+
+	case id == "" && r.Method == "POST":
+		var req tokenRequest
+		if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, 400, err)
+			return
+		}
+		var tc tokenCreated
+		if tc.Token, tc.Secret, err = svr.tokens.Create(name, req.Name, req.Scopes, req.Expires); err == nil {
+			resp = tc
+		}
+
+	case id != "" && r.Method == "DELETE":
+		if err = svr.tokens.Revoke(name, id); err == auth.ErrTokenNotFound {
+			writeJSONError(w, 404, err)
+			return
+		}
+
+	default:
+		w.WriteHeader(405)
+		return
+	}
+
+	if err != nil {
+		writeJSONError(w, 400, err)
+		return
+	}
+	if resp == nil {
+		w.WriteHeader(204)
+		return
+	}
+	b, _ := json.Marshal(resp)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(b)
+}
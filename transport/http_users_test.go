@@ -0,0 +1,46 @@
+package transport
+
+import "testing"
+
+func TestUsersWithoutAuthentication(t *testing.T) {
+	server := testTransport(nil)
+
+	// Users can't be created or claimed without authentication
+	if code := doRequest(server, "PUT", "/api/users/alice", "", `{}`); code != 401 {
+		t.Fatal(code)
+	}
+	if code := doRequest(server, "POST", "/api/users/alice/keys", "", `{}`); code != 401 {
+		t.Fatal(code)
+	}
+	if code := doRequest(server, "GET", "/api/users/alice", "", ""); code != 404 {
+		t.Fatal(code)
+	}
+}
+
+func TestUsersAuthz(t *testing.T) {
+	server := testTransport(testTokens())
+
+	tests := []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		{"PUT", "/api/users/carol", "", `{}`, 401},
+		{"PUT", "/api/users/alice", "alice", `{}`, 200},
+		// Others can't change the user
+		{"POST", "/api/users/alice", "bob", `{}`, 403},
+		{"DELETE", "/api/users/alice", "bob", "", 403},
+		// Only admins set emails
+		{"POST", "/api/users/alice", "alice", `{"emails": ["alice@example.com"]}`, 403},
+		{"POST", "/api/users/alice", "root", `{"emails": ["alice@example.com"]}`, 200},
+		// Names of namespaces are taken
+		{"PUT", "/api/namespaces/team", "root", `{}`, 200},
+		{"PUT", "/api/users/team", "team", `{}`, 409},
+		{"GET", "/api/users/alice", "bob", "", 200},
+		{"DELETE", "/api/users/alice", "root", "", 204},
+	}
+	for i, tt := range tests {
+		if code := doRequest(server, tt.method, tt.path, tt.token, tt.body); code != tt.code {
+			t.Fatal(i, tt.method, tt.path, tt.token, code)
+		}
+	}
+}
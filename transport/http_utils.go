@@ -2,8 +2,10 @@ package transport
 
 import (
 	"net/http"
+	"regexp"
 	"strings"
 
+	"github.com/euforia/go-git-server/archive"
 	"github.com/euforia/go-git-server/packproto"
 )
 
@@ -22,6 +24,25 @@ func isListRefRequest(r *http.Request) (repo string, service string, ok bool) {
 	return
 }
 
+// dumbFileRe matches the repo files fetched by dumb http clients
+var dumbFileRe = regexp.MustCompile(`^(.+)/(info/refs|HEAD|objects/info/packs|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\.(?:pack|idx))$`)
+
+// isDumbRequest matches the files of the dumb protocol returning the path
+// within the repo.  info/refs requests with a service are smart.
+func isDumbRequest(r *http.Request) (repo string, file string, ok bool) {
+	if r.URL.Query().Get("service") != "" {
+		return
+	}
+	m := dumbFileRe.FindStringSubmatch(r.URL.Path)
+	if m == nil {
+		return
+	}
+	repo = strings.TrimPrefix(m[1], "/")
+	file = m[2]
+	ok = repo != "" && !strings.Contains(repo, "..")
+	return
+}
+
 func isPackfileRequest(r *http.Request) (repo string, service string, ok bool) {
 	switch {
 	case strings.HasSuffix(r.URL.Path, "/"+packproto.GitRecvPack):
@@ -38,6 +59,90 @@ func isPackfileRequest(r *http.Request) (repo string, service string, ok bool) {
 	return
 }
 
+func isBundleRequest(r *http.Request) (repo string, ok bool) {
+	if strings.HasSuffix(r.URL.Path, "/bundle") {
+		repo = strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/bundle"), "/")
+		ok = true
+	}
+	return
+}
+
+func isSecretsRequest(r *http.Request) (repo string, ok bool) {
+	if strings.HasSuffix(r.URL.Path, "/secrets") {
+		repo = strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/secrets"), "/")
+		ok = true
+	}
+	return
+}
+
+func isPushCertsRequest(r *http.Request) (repo string, ok bool) {
+	if strings.HasSuffix(r.URL.Path, "/push-certs") {
+		repo = strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/push-certs"), "/")
+		ok = true
+	}
+	return
+}
+
+// isCommitsRequest matches /<repo>/commits and /<repo>/commits/<rev>
+func isCommitsRequest(r *http.Request) (repo string, rev string, ok bool) {
+	if strings.HasSuffix(r.URL.Path, "/commits") {
+		repo = strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/commits"), "/")
+		return repo, "", repo != ""
+	}
+
+	i := strings.LastIndex(r.URL.Path, "/commits/")
+	if i < 0 {
+		return
+	}
+	repo = strings.TrimPrefix(r.URL.Path[:i], "/")
+	rev = r.URL.Path[i+len("/commits/"):]
+	ok = repo != "" && rev != ""
+	return
+}
+
+// isUsersRequest matches /api/users/<name>[/<key path>]
+func isUsersRequest(r *http.Request) (name string, keyPath string, ok bool) {
+	if !strings.HasPrefix(r.URL.Path, usersPrefix) {
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, usersPrefix), "/", 2)
+	name = parts[0]
+	if len(parts) == 2 {
+		keyPath = parts[1]
+	}
+	ok = name != ""
+	return
+}
+
+// isNamespacesRequest matches /api/namespaces/<name>.  Hidden names are not
+// namespaces.
+func isNamespacesRequest(r *http.Request) (name string, ok bool) {
+	if !strings.HasPrefix(r.URL.Path, namespacesPrefix) {
+		return
+	}
+	name = strings.Trim(strings.TrimPrefix(r.URL.Path, namespacesPrefix), "/")
+	ok = name != "" && !strings.Contains(name, "/") && !strings.HasPrefix(name, ".")
+	return
+}
+
+// isAPIRequest matches the users and namespaces apis
+func isAPIRequest(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, usersPrefix) || strings.HasPrefix(r.URL.Path, namespacesPrefix)
+}
+
+// isOffloadRequest matches /<repo>/offload/<file>
+func isOffloadRequest(r *http.Request) (repo string, file string, ok bool) {
+	i := strings.LastIndex(r.URL.Path, "/offload/")
+	if i < 0 {
+		return
+	}
+
+	repo = strings.TrimPrefix(r.URL.Path[:i], "/")
+	file = r.URL.Path[i+len("/offload/"):]
+	ok = repo != "" && file != "" && !strings.Contains(repo, "..") && !strings.Contains(file, "/")
+	return
+}
+
 func isUIRequest(r *http.Request) bool {
 	agent := r.Header.Get("User-Agent")
 	switch {
@@ -50,3 +155,58 @@ func isUIRequest(r *http.Request) bool {
 
 	return false
 }
+
+// isReviewsRequest matches /<repo>/reviews and /<repo>/reviews/<id>
+func isReviewsRequest(r *http.Request) (repo string, id string, ok bool) {
+	if strings.HasSuffix(r.URL.Path, "/reviews") {
+		repo = strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/reviews"), "/")
+		return repo, "", repo != ""
+	}
+
+	i := strings.LastIndex(r.URL.Path, "/reviews/")
+	if i < 0 {
+		return
+	}
+	repo = strings.TrimPrefix(r.URL.Path[:i], "/")
+	id = r.URL.Path[i+len("/reviews/"):]
+	ok = repo != "" && id != ""
+	return
+}
+
+// isDeployRequest matches /<repo>/deploy-keys[/<id>] and
+// /<repo>/deploy-tokens[/<id>]
+func isDeployRequest(r *http.Request) (repo string, kind string, id string, ok bool) {
+	for _, k := range []string{deployKeys, deployTokens} {
+		if strings.HasSuffix(r.URL.Path, "/"+k) {
+			repo = strings.TrimPrefix(strings.TrimSuffix(r.URL.Path, "/"+k), "/")
+			return repo, k, "", repo != ""
+		}
+		if i := strings.LastIndex(r.URL.Path, "/"+k+"/"); i >= 0 {
+			repo = strings.TrimPrefix(r.URL.Path[:i], "/")
+			id = r.URL.Path[i+len(k)+2:]
+			return repo, k, id, repo != "" && id != "" && !strings.Contains(id, "/")
+		}
+	}
+	return
+}
+
+// isArchiveRequest matches /<repo>/archive/<ref>.<format> where the format is
+// tar, tar.gz or zip
+func isArchiveRequest(r *http.Request) (repo string, ref string, format archive.Format, ok bool) {
+	i := strings.Index(r.URL.Path, "/archive/")
+	if i < 0 {
+		return
+	}
+	repo = strings.TrimPrefix(r.URL.Path[:i], "/")
+	file := r.URL.Path[i+len("/archive/"):]
+
+	for _, f := range []archive.Format{archive.TarGz, archive.Tar, archive.Zip} {
+		if strings.HasSuffix(file, f.Ext()) {
+			ref = strings.TrimSuffix(file, f.Ext())
+			format = f
+			break
+		}
+	}
+	ok = repo != "" && ref != "" && !strings.Contains(ref, "..")
+	return
+}
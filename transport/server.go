@@ -0,0 +1,178 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultHTTPAddr is the address the http server listens on unless configured
+const DefaultHTTPAddr = "127.0.0.1:12345"
+
+// readHeaderTimeout bounds reading request headers even when reading bodies
+// e.g. of large pushes is unlimited
+const readHeaderTimeout = 30 * time.Second
+
+// ServerConfig configures the http server
+type ServerConfig struct {
+	// Address to listen on
+	Addr string
+	// Certificate and key files.  TLS is served if set.
+	TLSCert string
+	TLSKey  string
+	// Optional file of CA certificates client certificates are verified
+	// with.  Verified certificates authenticate their subjects.
+	ClientCA string
+	// Reject connections without a verified client certificate
+	RequireClientCert bool
+	// 0 is unlimited
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+}
+
+// Validate checks the tls settings are complete
+func (c *ServerConfig) Validate() error {
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("both tls cert and key required")
+	}
+	if c.TLSCert == "" && (c.ClientCA != "" || c.RequireClientCert) {
+		return errors.New("client certificates require tls")
+	}
+	if c.RequireClientCert && c.ClientCA == "" {
+		return errors.New("client ca required to verify client certificates")
+	}
+	return nil
+}
+
+func (c *ServerConfig) tls() bool {
+	return c.TLSCert != ""
+}
+
+// Server serves a handler per its config.  Certificates are reloaded with
+// Reload and requests drained with Shutdown.
+type Server struct {
+	config *ServerConfig
+	srv    *http.Server
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// NewServer instantiates a server of the handler loading the certificates of
+// the config
+func NewServer(config *ServerConfig, h http.Handler) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Addr == "" {
+		config.Addr = DefaultHTTPAddr
+	}
+
+	s := &Server{
+		config: config,
+		srv: &http.Server{
+			Addr:              config.Addr,
+			Handler:           h,
+			ReadTimeout:       config.ReadTimeout,
+			ReadHeaderTimeout: readHeaderTimeout,
+			WriteTimeout:      config.WriteTimeout,
+			IdleTimeout:       config.IdleTimeout,
+		},
+	}
+	if !config.tls() {
+		return s, nil
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	clientAuth := tls.NoClientCert
+	if config.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	} else if config.ClientCA != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2", "http/1.1"},
+		ClientAuth: clientAuth,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.cert, nil
+		},
+	}
+	s.srv.TLSConfig = base
+	if config.ClientCA != "" {
+		// Per connection so reloaded cas are used
+		base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c := base.Clone()
+			s.mu.RLock()
+			c.ClientCAs = s.clientCAs
+			s.mu.RUnlock()
+			return c, nil
+		}
+	}
+	return s, nil
+}
+
+// Reload loads the certificate, key and client cas again.  The loaded ones
+// are kept if any fail to load.
+func (s *Server) Reload() error {
+	if !s.config.tls() {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.config.TLSCert, s.config.TLSKey)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+	if s.config.ClientCA != "" {
+		b, err := ioutil.ReadFile(s.config.ClientCA)
+		if err != nil {
+			return err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return fmt.Errorf("no certificates in %s", s.config.ClientCA)
+		}
+	}
+
+	s.mu.Lock()
+	s.cert, s.clientCAs = &cert, pool
+	s.mu.Unlock()
+	return nil
+}
+
+// ListenAndServe listens on the configured address and serves until shut
+// down returning nil then
+func (s *Server) ListenAndServe() error {
+	var err error
+	if s.config.tls() {
+		log.Printf("HTTP Server: https://%s", s.config.Addr)
+		err = s.srv.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("HTTP Server: http://%s", s.config.Addr)
+		err = s.srv.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests e.g.
+// pushes to complete or the context to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
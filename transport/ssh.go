@@ -0,0 +1,473 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+
+	"github.com/euforia/go-git-server/auth"
+	"github.com/euforia/go-git-server/authz"
+	"github.com/euforia/go-git-server/packproto"
+	"github.com/euforia/go-git-server/users"
+)
+
+// DefaultSSHAddr is the address ssh urls without a port connect to
+const DefaultSSHAddr = ":22"
+
+// Extensions of the ssh permissions holding the authenticated principal
+const (
+	sshUserExt   = "user"
+	sshMethodExt = "method"
+	sshRepoExt   = "repo"
+	sshScopeExt  = "scope"
+)
+
+var (
+	errSSHUnknownKey   = errors.New("unknown public key")
+	errSSHBadCommand   = errors.New("invalid command")
+	errSSHRepoNotFound = errors.New("repository not found")
+	errSSHReadOnly     = errors.New("read-only key")
+	errSSHShutdown     = errors.New("server shutting down")
+	errSSHInternal     = errors.New("internal server error")
+)
+
+// SSHKeyStore maps ssh public keys to the users they belong to
+type SSHKeyStore interface {
+	SSHKeyOwner(pub ssh.PublicKey) (*users.User, error)
+}
+
+// userKeys looks ssh keys up in the user store
+type userKeys struct {
+	store users.Store
+}
+
+// NewUserKeyStore returns a key store of the ssh keys of users in the store
+func NewUserKeyStore(store users.Store) SSHKeyStore {
+	return &userKeys{store: store}
+}
+
+func (uk *userKeys) SSHKeyOwner(pub ssh.PublicKey) (*users.User, error) {
+	u, k, err := uk.store.KeyOwner(users.SSHKeyID(pub))
+	if err != nil {
+		return nil, err
+	}
+	// Ids are only a prefix of the key hash
+	if k.Type != users.KeyTypeSSH || !bytes.Equal(k.PublicKey().Marshal(), pub.Marshal()) {
+		return nil, users.ErrNotFound
+	}
+	return u, nil
+}
+
+// RepoAuthorizer decides whether a principal may read or write a repo
+type RepoAuthorizer interface {
+	AuthorizeRepo(p *auth.Principal, repoID string, write bool) error
+}
+
+// SSHServer serves upload-pack, receive-pack and upload-archive over ssh to users
+// authenticated by their public keys.  Repos and protocol settings are those
+// of the git http service.
+type SSHServer struct {
+	git  *GitHTTPService
+	keys SSHKeyStore
+	// Optional.  Any user with a key may access all repos if not set.
+	authz RepoAuthorizer
+	// Optional keys limited to a repo
+	deployKeys *auth.DeployKeys
+
+	config *ssh.ServerConfig
+
+	// Listeners and running commands drained on shutdown
+	mu        sync.Mutex
+	listeners []net.Listener
+	active    int
+	closed    bool
+}
+
+// NewSSHServer instantiates an ssh server identifying itself with the host key
+func NewSSHServer(git *GitHTTPService, keys SSHKeyStore, hostKey ssh.Signer) *SSHServer {
+	s := &SSHServer{git: git, keys: keys}
+	s.config = &ssh.ServerConfig{PublicKeyCallback: s.authenticate}
+	s.config.AddHostKey(hostKey)
+	return s
+}
+
+// SetAuthorizer sets what decides repo access of authenticated users
+func (s *SSHServer) SetAuthorizer(authz RepoAuthorizer) {
+	s.authz = authz
+}
+
+// SetDeployKeys accepts the deploy keys for their repos
+func (s *SSHServer) SetDeployKeys(keys *auth.DeployKeys) {
+	s.deployKeys = keys
+}
+
+// LoadHostKey reads the private host key at path generating one if it does
+// not exist
+func LoadHostKey(path string) (ssh.Signer, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(b)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	b = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(path, b, 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated ssh host key: %s", path)
+	return ssh.NewSignerFromKey(key)
+}
+
+// ListenAndServe listens on addr and serves connections
+func (s *SSHServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("SSH server: ssh://%s", addr)
+	return s.Serve(l)
+}
+
+// Serve serves the connections of the listener until shut down returning nil
+// then
+func (s *SSHServer) Serve(l net.Listener) error {
+	defer l.Close()
+
+	s.mu.Lock()
+	s.listeners = append(s.listeners, l)
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// Shutdown stops accepting connections and commands and waits for running
+// ones e.g. pushes to complete or the context to be done
+func (s *SSHServer) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for _, l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		active := s.active
+		s.mu.Unlock()
+		if active == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// begin counts a running command unless shutting down
+func (s *SSHServer) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.active++
+	return true
+}
+
+func (s *SSHServer) end() {
+	s.mu.Lock()
+	s.active--
+	s.mu.Unlock()
+}
+
+// authenticate accepts the keys of users and deploy keys
+func (s *SSHServer) authenticate(meta ssh.ConnMetadata, pub ssh.PublicKey) (*ssh.Permissions, error) {
+	if u, err := s.keys.SSHKeyOwner(pub); err == nil {
+		return &ssh.Permissions{Extensions: map[string]string{sshUserExt: u.Name, sshMethodExt: auth.MethodSSHKey}}, nil
+	}
+	if s.deployKeys != nil {
+		if p, ok := s.deployKeys.Principal(pub); ok {
+			return &ssh.Permissions{Extensions: map[string]string{
+				sshUserExt:   p.Name,
+				sshMethodExt: p.Method,
+				sshRepoExt:   p.Repo,
+				sshScopeExt:  string(p.Scopes[0]),
+			}}, nil
+		}
+	}
+	log.Printf("DBG [ssh] client=%s key=%s %v", meta.RemoteAddr(), ssh.FingerprintSHA256(pub), errSSHUnknownKey)
+	return nil, errSSHUnknownKey
+}
+
+// sshPrincipal returns the principal authenticated with the permissions
+func sshPrincipal(perms *ssh.Permissions) *auth.Principal {
+	ext := perms.Extensions
+	p := &auth.Principal{Name: ext[sshUserExt], Method: ext[sshMethodExt], Repo: ext[sshRepoExt]}
+	if scope := ext[sshScopeExt]; scope != "" {
+		p.Scopes = []auth.Scope{auth.Scope(scope)}
+	}
+	return p
+}
+
+func (s *SSHServer) serveConn(nc net.Conn) {
+	defer nc.Close()
+	// Unlike net/http nothing recovers panics of connections so a client
+	// can't take the server down
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERR [ssh] client=%s panic: %v\n%s", nc.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+
+	conn, chans, reqs, err := ssh.NewServerConn(nc, s.config)
+	if err != nil {
+		log.Printf("DBG [ssh] client=%s %v", nc.RemoteAddr(), err)
+		return
+	}
+	defer conn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	p := sshPrincipal(conn.Permissions)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, creqs, err := nch.Accept()
+		if err != nil {
+			log.Printf("ERR [ssh] user=%s %v", p.Name, err)
+			continue
+		}
+		go s.serveSession(nc.RemoteAddr().String(), p, ch, creqs)
+	}
+}
+
+// serveSession runs the first exec request of the session.  GIT_PROTOCOL is
+// the only environment variable taken.
+func (s *SSHServer) serveSession(client string, p *auth.Principal, ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+
+	var gitProtocol string
+	for req := range reqs {
+		switch req.Type {
+		case "env":
+			var env struct{ Name, Value string }
+			if err := ssh.Unmarshal(req.Payload, &env); err == nil && env.Name == "GIT_PROTOCOL" {
+				gitProtocol = env.Value
+				req.Reply(true, nil)
+				continue
+			}
+			req.Reply(false, nil)
+
+		case "exec":
+			var cmd struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &cmd); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go ssh.DiscardRequests(reqs)
+
+			status := 0
+			if err := s.exec(ch, client, p, cmd.Command, gitProtocol); err != nil {
+				fmt.Fprintf(ch.Stderr(), "fatal: %v\n", err)
+				status = 128
+			}
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			return
+
+		case "shell":
+			req.Reply(true, nil)
+			fmt.Fprintf(ch.Stderr(), "Hi %s! You've successfully authenticated, but shell access is not provided.\n", p.Name)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{1}))
+			return
+
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exec runs the git command on the channel.  Panics are recovered and
+// reported as an internal error.
+func (s *SSHServer) exec(ch ssh.Channel, client string, p *auth.Principal, command, gitProtocol string) (err error) {
+	if !s.begin() {
+		return errSSHShutdown
+	}
+	defer s.end()
+
+	var repoID string
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERR [ssh] client=%s user=%s repo=%s panic: %v\n%s", client, p.Name, repoID, r, debug.Stack())
+			err = errSSHInternal
+		}
+	}()
+
+	service, path, err := parseSSHCommand(command)
+	if err != nil {
+		return err
+	}
+	var st storer.Storer
+	repoID, st = s.lookup(path)
+	if st == nil {
+		return fmt.Errorf("%v: %s", errSSHRepoNotFound, path)
+	}
+
+	write := service == packproto.GitRecvPack
+	if s.authz != nil {
+		err = s.authz.AuthorizeRepo(p, repoID, write)
+	} else if p.Repo != "" {
+		// Deploy keys are limited to their repo regardless
+		if p.Repo != repoID {
+			err = fmt.Errorf("%v: %s", errSSHRepoNotFound, path)
+		} else if write && !p.HasScope(auth.ScopeRepoWrite) {
+			err = errSSHReadOnly
+		}
+	}
+	if err != nil {
+		log.Printf("DBG [ssh] user=%s repo=%s service=%s %v", p.Name, repoID, service, err)
+		if err == authz.ErrNotFound {
+			// As for missing repos so private ones are not disclosed
+			err = fmt.Errorf("%v: %s", errSSHRepoNotFound, path)
+		}
+		return err
+	}
+	log.Printf("DBG [ssh] user=%s repo=%s service=%s", p.Name, repoID, service)
+
+	proto := s.git.newProtocol(ch, ch, repoID, st)
+	proto.SetStateful(true)
+
+	ctx := context.Background()
+	switch service {
+	case packproto.GitUploadPack:
+		if packproto.IsV2Request(gitProtocol) {
+			proto.AdvertiseV2()
+			err = proto.ServeUploadPackV2(ctx, st)
+			break
+		}
+		refs, er := advertisedRefs(st)
+		if er != nil {
+			return er
+		}
+		proto.ListReferences(service, refs)
+		_, err = proto.UploadPack(ctx, st)
+
+	case packproto.GitRecvPack:
+		refs, er := advertisedRefs(st)
+		if er != nil {
+			return er
+		}
+		proto.ListReferences(service, refs)
+		var results []*packproto.RefResult
+		if results, err = proto.ReceivePack(st); err == nil {
+			var updated int
+			for _, res := range results {
+				if res.OK() {
+					updated++
+				}
+			}
+			log.Printf("DBG [ssh] user=%s repo=%s updated=%d rejected=%d", p.Name, repoID, updated, len(results)-updated)
+		}
+
+	case packproto.GitUploadArchive:
+		err = proto.UploadArchive(ctx, st)
+
+	default:
+		return fmt.Errorf("service not enabled: %s", service)
+	}
+
+	if err != nil && err != io.EOF {
+		log.Printf("ERR [ssh] user=%s repo=%s service=%s %v", p.Name, repoID, service, err)
+	}
+	return nil
+}
+
+// lookup returns the repo at the path with or without the .git suffix
+func (s *SSHServer) lookup(path string) (string, storer.Storer) {
+	path = strings.Trim(path, "/")
+	for _, p := range strings.Split(path, "/") {
+		if p == "" || p == "." || p == ".." {
+			return "", nil
+		}
+	}
+	for _, id := range []string{path, strings.TrimSuffix(path, ".git")} {
+		if st := s.git.stores.GetStore(id); st != nil {
+			return id, st
+		}
+	}
+	return "", nil
+}
+
+// parseSSHCommand parses "git-upload-pack '/ns/repo.git'" as sent by git.  The
+// "git upload-pack" form is also accepted.
+func parseSSHCommand(command string) (service, path string, err error) {
+	command = strings.TrimSpace(command)
+	if strings.HasPrefix(command, "git ") {
+		command = "git-" + strings.TrimSpace(command[4:])
+	}
+
+	i := strings.IndexByte(command, ' ')
+	if i < 0 {
+		return "", "", errSSHBadCommand
+	}
+	service, path = command[:i], strings.TrimSpace(command[i+1:])
+
+	// The path is shell quoted with embedded quotes escaped as '\''
+	if len(path) >= 2 && path[0] == '\'' && path[len(path)-1] == '\'' {
+		path = strings.Replace(path[1:len(path)-1], `'\''`, `'`, -1)
+	}
+	if path == "" || strings.ContainsAny(path, "'\x00") {
+		return "", "", errSSHBadCommand
+	}
+	return service, path, nil
+}
@@ -0,0 +1,284 @@
+// Package users holds the users of the server and the keys they sign with
+package users
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNotFound is returned for unknown users and keys
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when creating a user that exists
+	ErrExists = errors.New("exists")
+	// ErrInvalidKey is returned for keys that can't be parsed
+	ErrInvalidKey = errors.New("invalid key")
+)
+
+// KeyType is the format of a signing key
+type KeyType string
+
+const (
+	// KeyTypeOpenPGP is an armored OpenPGP public key
+	KeyTypeOpenPGP KeyType = "openpgp"
+	// KeyTypeSSH is an ssh public key in authorized_keys format
+	KeyTypeSSH KeyType = "ssh"
+)
+
+// User is a user of the server
+type User struct {
+	Name string `json:"name"`
+	// Verified emails.  Signatures are only trusted for these.
+	Emails []string `json:"emails"`
+	Keys   []*Key   `json:"keys"`
+}
+
+// HasEmail returns true if the email is one of the user's
+func (u *User) HasEmail(email string) bool {
+	for _, e := range u.Emails {
+		if strings.EqualFold(e, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// clone returns a copy of the user sharing the immutable keys
+func (u *User) clone() *User {
+	return &User{
+		Name:   u.Name,
+		Emails: append([]string(nil), u.Emails...),
+		Keys:   append([]*Key(nil), u.Keys...),
+	}
+}
+
+// Key is a public key of a user
+type Key struct {
+	// Short id used to look the key up.  For OpenPGP the key id, for ssh the
+	// start of the sha256 of the key.
+	ID          string    `json:"id"`
+	Type        KeyType   `json:"type"`
+	Title       string    `json:"title,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	Key         string    `json:"key"`
+	Created     time.Time `json:"created"`
+	// OpenPGP subkey ids
+	SubkeyIDs []string `json:"subkey_ids,omitempty"`
+
+	entity *openpgp.Entity
+	pub    ssh.PublicKey
+}
+
+// Entity returns the parsed OpenPGP key
+func (k *Key) Entity() *openpgp.Entity {
+	return k.entity
+}
+
+// PublicKey returns the parsed ssh key
+func (k *Key) PublicKey() ssh.PublicKey {
+	return k.pub
+}
+
+// ParseKey parses a public key of the given type
+func ParseKey(typ KeyType, text string) (*Key, error) {
+	k := &Key{Type: typ, Key: strings.TrimSpace(text), Created: time.Now()}
+
+	switch typ {
+	case KeyTypeOpenPGP:
+		el, err := openpgp.ReadArmoredKeyRing(strings.NewReader(k.Key))
+		if err != nil || len(el) != 1 {
+			return nil, ErrInvalidKey
+		}
+		k.entity = el[0]
+		k.ID = OpenPGPKeyID(k.entity.PrimaryKey.KeyId)
+		k.Fingerprint = strings.ToUpper(hex.EncodeToString(k.entity.PrimaryKey.Fingerprint[:]))
+		for _, sk := range k.entity.Subkeys {
+			k.SubkeyIDs = append(k.SubkeyIDs, OpenPGPKeyID(sk.PublicKey.KeyId))
+		}
+
+	case KeyTypeSSH:
+		pub, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		k.pub = pub
+		k.ID = SSHKeyID(pub)
+		k.Fingerprint = ssh.FingerprintSHA256(pub)
+		if k.Title == "" {
+			k.Title = comment
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", typ)
+	}
+
+	return k, nil
+}
+
+// OpenPGPKeyID returns the hex form of an OpenPGP key id
+func OpenPGPKeyID(id uint64) string {
+	return fmt.Sprintf("%016X", id)
+}
+
+// SSHKeyID returns the id of an ssh key
+func SSHKeyID(pub ssh.PublicKey) string {
+	sum := sha256.Sum256(pub.Marshal())
+	return hex.EncodeToString(sum[:8])
+}
+
+// Store stores users and looks up keys
+type Store interface {
+	GetUser(name string) (*User, error)
+	CreateUser(*User) error
+	UpdateUser(*User) error
+	RemoveUser(name string) error
+	// AddKey adds a parsed key to the user
+	AddKey(name string, key *Key) error
+	RemoveKey(name, id string) error
+	// KeyOwner returns the user with the key or subkey id and the key
+	KeyOwner(id string) (*User, *Key, error)
+}
+
+// MemStore is a memory based user store
+type MemStore struct {
+	mu    sync.RWMutex
+	users map[string]*User
+	// key and subkey ids to owner
+	keys map[string]*User
+}
+
+// NewMemStore instantiates an empty user store
+func NewMemStore() *MemStore {
+	return &MemStore{users: map[string]*User{}, keys: map[string]*User{}}
+}
+
+// GetUser returns a copy of the user with the given name
+func (s *MemStore) GetUser(name string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if u, ok := s.users[name]; ok {
+		return u.clone(), nil
+	}
+	return nil, ErrNotFound
+}
+
+// CreateUser with the given data.  Keys must be added with AddKey.
+func (s *MemStore) CreateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[u.Name]; ok {
+		return ErrExists
+	}
+	u = u.clone()
+	u.Keys = nil
+	s.users[u.Name] = u
+	return nil
+}
+
+// UpdateUser replaces the user emails
+func (s *MemStore) UpdateUser(u *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cur, ok := s.users[u.Name]
+	if !ok {
+		return ErrNotFound
+	}
+	cur.Emails = append([]string(nil), u.Emails...)
+	return nil
+}
+
+// RemoveUser and all their keys
+func (s *MemStore) RemoveUser(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	for id, owner := range s.keys {
+		if owner == u {
+			delete(s.keys, id)
+		}
+	}
+	delete(s.users, name)
+	return nil
+}
+
+// AddKey adds the key to the user.  A key can only belong to one user.
+func (s *MemStore) AddKey(name string, key *Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	ids := append([]string{key.ID}, key.SubkeyIDs...)
+	for _, id := range ids {
+		if _, ok := s.keys[id]; ok {
+			return ErrExists
+		}
+	}
+
+	u.Keys = append(u.Keys, key)
+	for _, id := range ids {
+		s.keys[id] = u
+	}
+	return nil
+}
+
+// RemoveKey removes the key with the id from the user
+func (s *MemStore) RemoveKey(name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return ErrNotFound
+	}
+	for i, k := range u.Keys {
+		if k.ID != id {
+			continue
+		}
+		u.Keys = append(u.Keys[:i], u.Keys[i+1:]...)
+		for _, kid := range append([]string{k.ID}, k.SubkeyIDs...) {
+			delete(s.keys, kid)
+		}
+		return nil
+	}
+	return ErrNotFound
+}
+
+// KeyOwner returns a copy of the user with the key or subkey id and the key
+func (s *MemStore) KeyOwner(id string) (*User, *Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.keys[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	for _, k := range u.Keys {
+		if k.ID == id {
+			return u.clone(), k, nil
+		}
+		for _, sid := range k.SubkeyIDs {
+			if sid == id {
+				return u.clone(), k, nil
+			}
+		}
+	}
+	return nil, nil, ErrNotFound
+}